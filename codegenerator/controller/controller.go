@@ -0,0 +1,147 @@
+// Package controller reconciles the status of TestTypes: it watches them
+// with a shared informer, queues the keys of the ones that changed and sets
+// their Status.Blah to what their annotation asks for.
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	examplev1 "github.com/fatsheep9146/go-best-practise/codegenerator/example.com/v1"
+	"github.com/fatsheep9146/go-best-practise/codegenerator/generated/clientset/versioned"
+	informers "github.com/fatsheep9146/go-best-practise/codegenerator/generated/informers/externalversions/example.com/v1"
+	listers "github.com/fatsheep9146/go-best-practise/codegenerator/generated/listers/example.com/v1"
+)
+
+// BlahAnnotation is the annotation a TestType sets its Status.Blah with.
+const BlahAnnotation = "example.com/blah"
+
+// maxRetries is how many times a key is retried before it's dropped.
+const maxRetries = 5
+
+// DesiredBlah returns the Status.Blah obj should have: its BlahAnnotation,
+// or a greeting of its name without one.
+func DesiredBlah(obj *examplev1.TestType) string {
+	if blah, ok := obj.Annotations[BlahAnnotation]; ok {
+		return blah
+	}
+	return "hello " + obj.Name
+}
+
+// Controller keeps the Status.Blah of TestTypes up to date.
+type Controller struct {
+	client versioned.Interface
+	lister listers.TestTypeLister
+	synced cache.InformerSynced
+	queue  workqueue.RateLimitingInterface
+}
+
+// New returns a controller reconciling the TestTypes informer watches with
+// client.
+func New(client versioned.Interface, informer informers.TestTypeInformer) *Controller {
+	c := &Controller{
+		client: client,
+		lister: informer.Lister(),
+		synced: informer.Informer().HasSynced,
+		queue:  workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "testtypes"),
+	}
+
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueue,
+		// status updates of our own are queued too, and found up to date
+		UpdateFunc: func(old, new interface{}) {
+			c.enqueue(new)
+		},
+	})
+	return c
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// Run waits for the informer to sync, then reconciles with workers workers
+// until stopCh is closed.
+func (c *Controller) Run(workers int, stopCh <-chan struct{}) error {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	if !cache.WaitForCacheSync(stopCh, c.synced) {
+		return fmt.Errorf("wait for testtypes cache to sync failed")
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.Until(c.runWorker, time.Second, stopCh)
+	}
+	<-stopCh
+	return nil
+}
+
+func (c *Controller) runWorker() {
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *Controller) processNextWorkItem() bool {
+	obj, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(obj)
+
+	key := obj.(string)
+	err := c.sync(context.Background(), key)
+	switch {
+	case err == nil:
+		c.queue.Forget(key)
+	case c.queue.NumRequeues(key) < maxRetries:
+		utilruntime.HandleError(fmt.Errorf("sync %q failed, requeuing, err: %v", key, err))
+		c.queue.AddRateLimited(key)
+	default:
+		utilruntime.HandleError(fmt.Errorf("sync %q failed, dropping, err: %v", key, err))
+		c.queue.Forget(key)
+	}
+	return true
+}
+
+// sync sets the Status.Blah of the TestType of key if it's out of date.
+func (c *Controller) sync(ctx context.Context, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		// a broken key won't get better by retrying
+		utilruntime.HandleError(err)
+		return nil
+	}
+
+	obj, err := c.lister.TestTypes(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	blah := DesiredBlah(obj)
+	if obj.Status.Blah == blah {
+		return nil
+	}
+
+	// objects of the cache are shared, so update a copy
+	obj = obj.DeepCopy()
+	obj.Status.Blah = blah
+	_, err = c.client.ExampleV1().TestTypes(namespace).UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,130 @@
+package controller_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/fatsheep9146/go-best-practise/codegenerator/controller"
+	examplev1 "github.com/fatsheep9146/go-best-practise/codegenerator/example.com/v1"
+	"github.com/fatsheep9146/go-best-practise/codegenerator/generated/clientset/versioned/fake"
+	"github.com/fatsheep9146/go-best-practise/codegenerator/generated/informers/externalversions"
+)
+
+func newTestType(name, blah string) *examplev1.TestType {
+	obj := &examplev1.TestType{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+	}
+	if blah != "" {
+		obj.Annotations = map[string]string{controller.BlahAnnotation: blah}
+	}
+	return obj
+}
+
+// waitForBlah polls the status of the TestType name until it's want.
+func waitForBlah(t *testing.T, client *fake.Clientset, name, want string) {
+	t.Helper()
+
+	var got string
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		obj, err := client.ExampleV1().TestTypes("default").Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		got = obj.Status.Blah
+		return got == want, nil
+	})
+	if err != nil {
+		t.Fatalf("status.blah of %s = %q, want %q: %v", name, got, want, err)
+	}
+}
+
+// startController runs a controller reconciling the TestTypes of client
+// until the test ends.
+func startController(t *testing.T, client *fake.Clientset) {
+	factory := externalversions.NewSharedInformerFactory(client, 0)
+	c := controller.New(client, factory.Example().V1().TestTypes())
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+	factory.Start(stop)
+	go func() {
+		defer close(done)
+		if err := c.Run(2, stop); err != nil {
+			t.Errorf("Run failed: %v", err)
+		}
+	}()
+}
+
+func TestDesiredBlah(t *testing.T) {
+	if got := controller.DesiredBlah(newTestType("a", "")); got != "hello a" {
+		t.Errorf("DesiredBlah without annotation = %q, want %q", got, "hello a")
+	}
+	if got := controller.DesiredBlah(newTestType("a", "world")); got != "world" {
+		t.Errorf("DesiredBlah = %q, want the annotation %q", got, "world")
+	}
+}
+
+func TestControllerSetsStatus(t *testing.T) {
+	// a exists before the controller starts
+	client := fake.NewSimpleClientset(newTestType("a", ""))
+	startController(t, client)
+	waitForBlah(t, client, "a", "hello a")
+
+	// b is created afterwards
+	ctx := context.Background()
+	if _, err := client.ExampleV1().TestTypes("default").Create(ctx, newTestType("b", "world"), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("create b failed: %v", err)
+	}
+	waitForBlah(t, client, "b", "world")
+
+	// the annotation of a changes
+	a, err := client.ExampleV1().TestTypes("default").Get(ctx, "a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get a failed: %v", err)
+	}
+	a.Annotations = map[string]string{controller.BlahAnnotation: "changed"}
+	if _, err := client.ExampleV1().TestTypes("default").Update(ctx, a, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update a failed: %v", err)
+	}
+	waitForBlah(t, client, "a", "changed")
+}
+
+func TestControllerRetriesFailedUpdates(t *testing.T) {
+	client := fake.NewSimpleClientset(newTestType("a", "world"))
+
+	var failed int32
+	client.PrependReactor("update", "testtypes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "status" || !atomic.CompareAndSwapInt32(&failed, 0, 1) {
+			return false, nil, nil
+		}
+		return true, nil, errors.New("injected failure")
+	})
+
+	startController(t, client)
+	waitForBlah(t, client, "a", "world")
+
+	if atomic.LoadInt32(&failed) != 1 {
+		t.Fatal("the status update didn't fail first")
+	}
+	var updates int
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "update" && action.GetSubresource() == "status" {
+			updates++
+		}
+	}
+	if updates < 2 {
+		t.Fatalf("status updates = %d, want the failed one retried", updates)
+	}
+}
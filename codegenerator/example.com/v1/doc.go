@@ -0,0 +1,5 @@
+// +k8s:deepcopy-gen=package
+// +groupName=example.com
+
+// Package v1 is the v1 version of the example.com API group.
+package v1
@@ -2,4 +2,7 @@ module github.com/fatsheep9146/go-best-practise/codegenerator
 
 go 1.14
 
-require k8s.io/apimachinery v0.21.0
+require (
+	k8s.io/apimachinery v0.21.0
+	k8s.io/client-go v0.21.0
+)
@@ -0,0 +1,36 @@
+#!/usr/bin/env bash
+
+# Regenerates the deepcopy functions, clientset, listers and informers of
+# example.com/v1. The generators of k8s.io/code-generator, of the version of
+# k8s.io/apimachinery in go.mod, must be on PATH.
+
+set -o errexit
+set -o nounset
+set -o pipefail
+
+ROOT=$(cd "$(dirname "${BASH_SOURCE[0]}")/.." && pwd)
+MODULE=github.com/fatsheep9146/go-best-practise/codegenerator
+APIS=${MODULE}/example.com/v1
+OUTPUT=${MODULE}/generated
+OUTPUT_BASE=$(mktemp -d)
+trap 'rm -rf "${OUTPUT_BASE}"' EXIT
+
+cd "${ROOT}"
+HEADER=hack/boilerplate.go.txt
+
+deepcopy-gen --input-dirs "${APIS}" -O zz_generated.deepcopy \
+  --output-base "${OUTPUT_BASE}" --go-header-file "${HEADER}"
+client-gen --clientset-name versioned --input-base "" --input "${APIS}" \
+  --output-package "${OUTPUT}/clientset" \
+  --output-base "${OUTPUT_BASE}" --go-header-file "${HEADER}"
+lister-gen --input-dirs "${APIS}" --output-package "${OUTPUT}/listers" \
+  --output-base "${OUTPUT_BASE}" --go-header-file "${HEADER}"
+informer-gen --input-dirs "${APIS}" \
+  --versioned-clientset-package "${OUTPUT}/clientset/versioned" \
+  --listers-package "${OUTPUT}/listers" \
+  --output-package "${OUTPUT}/informers" \
+  --output-base "${OUTPUT_BASE}" --go-header-file "${HEADER}"
+
+cp "${OUTPUT_BASE}/${APIS}/zz_generated.deepcopy.go" example.com/v1/
+rm -rf generated
+cp -r "${OUTPUT_BASE}/${OUTPUT}" generated
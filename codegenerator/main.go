@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fatsheep9146/go-best-practise/codegenerator/controller"
+	examplev1 "github.com/fatsheep9146/go-best-practise/codegenerator/example.com/v1"
+	"github.com/fatsheep9146/go-best-practise/codegenerator/generated/clientset/versioned/fake"
+	"github.com/fatsheep9146/go-best-practise/codegenerator/generated/informers/externalversions"
+)
+
+// main runs the controller against the fake clientset for a moment and
+// prints the status it set.
+func main() {
+	client := fake.NewSimpleClientset(&examplev1.TestType{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "a",
+			Annotations: map[string]string{controller.BlahAnnotation: "world"},
+		},
+	})
+	factory := externalversions.NewSharedInformerFactory(client, 0)
+	c := controller.New(client, factory.Example().V1().TestTypes())
+
+	stop := make(chan struct{})
+	factory.Start(stop)
+	go c.Run(1, stop)
+	time.Sleep(500 * time.Millisecond)
+	close(stop)
+
+	a, err := client.ExampleV1().TestTypes("default").Get(context.Background(), "a", metav1.GetOptions{})
+	if err != nil {
+		fmt.Println("err", err)
+		return
+	}
+	fmt.Printf("status.blah of a: %q\n", a.Status.Blah)
+}
@@ -0,0 +1,453 @@
+package evaluator
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Knetic/govaluate"
+)
+
+// NodeKind is the kind of a Node.
+type NodeKind int
+
+const (
+	// LiteralNode is a number, string, pattern, time or bool literal.
+	LiteralNode NodeKind = iota
+	// VariableNode reads a parameter.
+	VariableNode
+	// AccessorNode reads fields or calls methods of a parameter, like foo.Func().
+	AccessorNode
+	// CallNode calls a function.
+	CallNode
+	// UnaryNode applies a prefix operator.
+	UnaryNode
+	// BinaryNode applies an infix operator.
+	BinaryNode
+	// TernaryNode is a `cond ? then : else` expression. A `cond ? then`
+	// without else is a BinaryNode, which is nil if cond is false.
+	TernaryNode
+	// ListNode is a comma separated list, like the right side of `in`.
+	ListNode
+)
+
+func (k NodeKind) String() string {
+	switch k {
+	case LiteralNode:
+		return "literal"
+	case VariableNode:
+		return "variable"
+	case AccessorNode:
+		return "accessor"
+	case CallNode:
+		return "call"
+	case UnaryNode:
+		return "unary"
+	case BinaryNode:
+		return "binary"
+	case TernaryNode:
+		return "ternary"
+	case ListNode:
+		return "list"
+	}
+	return "unknown"
+}
+
+// Node is a node of the syntax tree of an expression. govaluate doesn't export
+// the tree it evaluates, so it is rebuilt from its tokens, with the same
+// precedence rules.
+type Node struct {
+	Kind NodeKind
+	// Pos and End are the byte offsets of the node in the expression.
+	Pos int
+	End int
+	// Text is the source of the node.
+	Text string
+
+	// Op is the operator of unary and binary nodes.
+	Op string
+	// Name is the name of a variable, accessed parameter or called function.
+	Name string
+	// Path are the fields and methods read by an accessor.
+	Path []string
+	// Method tells whether an accessor calls the last element of Path.
+	Method bool
+	// Value is the value of a literal.
+	Value interface{}
+	// Args are the operands of operators, the arguments of calls and the
+	// elements of lists.
+	Args []*Node
+}
+
+// Parse parses expression with the functions of set.
+func Parse(expression string, set FunctionSet) (*Node, error) {
+	expr, err := govaluate.NewEvaluableExpressionWithFunctions(expression, set.Functions)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := expr.Tokens()
+	spans, err := tokenSpans(expression, tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{expression: expression, tokens: tokens, spans: spans}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+
+	node, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(tokens) {
+		return nil, p.errorf("unexpected %s", p.text(p.pos))
+	}
+
+	return node, nil
+}
+
+// ParseError is a syntax error at a position of an expression.
+type ParseError struct {
+	Pos int
+	Msg string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Pos+1, e.Msg)
+}
+
+type span struct {
+	pos, end int
+}
+
+// tokenSpans finds the position of every token in expression.
+func tokenSpans(expression string, tokens []govaluate.ExpressionToken) ([]span, error) {
+	spans := make([]span, len(tokens))
+
+	pos := 0
+	for i, token := range tokens {
+		for pos < len(expression) {
+			r, size := utf8.DecodeRuneInString(expression[pos:])
+			if !unicode.IsSpace(r) {
+				break
+			}
+			pos += size
+		}
+		if pos >= len(expression) {
+			return nil, &ParseError{Pos: pos, Msg: fmt.Sprintf("token %v not found", token.Value)}
+		}
+
+		end := pos
+		switch token.Kind {
+		case govaluate.CLAUSE, govaluate.CLAUSE_CLOSE, govaluate.SEPARATOR:
+			end++
+		case govaluate.STRING, govaluate.PATTERN, govaluate.TIME:
+			end++
+			for end < len(expression) && expression[end] != '\'' && expression[end] != '"' {
+				if expression[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end++
+		case govaluate.NUMERIC:
+			digits := "0123456789."
+			if strings.HasPrefix(expression[pos:], "0x") {
+				digits = "0123456789abcdefABCDEF"
+				end += 2
+			}
+			for end < len(expression) && strings.IndexByte(digits, expression[end]) >= 0 {
+				end++
+			}
+		case govaluate.VARIABLE, govaluate.BOOLEAN, govaluate.FUNCTION, govaluate.ACCESSOR:
+			end = identEnd(expression, pos)
+		default:
+			op, ok := token.Value.(string)
+			if !ok {
+				return nil, &ParseError{Pos: pos, Msg: fmt.Sprintf("unexpected token %v", token.Value)}
+			}
+			if op == "in" {
+				end = identEnd(expression, pos)
+				break
+			}
+			if !strings.HasPrefix(expression[pos:], op) {
+				return nil, &ParseError{Pos: pos, Msg: fmt.Sprintf("expected %q", op)}
+			}
+			end += len(op)
+		}
+
+		if end > len(expression) {
+			end = len(expression)
+		}
+		spans[i] = span{pos: pos, end: end}
+		pos = end
+	}
+
+	return spans, nil
+}
+
+// identEnd returns the end of the variable name, escaped [variable] or
+// accessor starting at pos.
+func identEnd(expression string, pos int) int {
+	if expression[pos] == '[' {
+		if end := strings.IndexByte(expression[pos:], ']'); end >= 0 {
+			return pos + end + 1
+		}
+		return len(expression)
+	}
+
+	end := pos
+	for end < len(expression) {
+		r, size := utf8.DecodeRuneInString(expression[end:])
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '.' {
+			break
+		}
+		end += size
+	}
+	return end
+}
+
+type parser struct {
+	expression string
+	tokens     []govaluate.ExpressionToken
+	spans      []span
+	pos        int
+}
+
+// levels are the binary operators by increasing precedence, as govaluate plans them.
+var levels = [][]string{
+	{"?", ":", "??"},
+	{"||"},
+	{"&&"},
+	{"==", "!=", ">", ">=", "<", "<=", "=~", "!~", "in"},
+	{"&", "|", "^"},
+	{">>", "<<"},
+	{"+", "-"},
+	{"*", "/", "%"},
+	{"**"},
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	pos := len(p.expression)
+	if p.pos < len(p.spans) {
+		pos = p.spans[p.pos].pos
+	}
+	return &ParseError{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) text(i int) string {
+	return p.expression[p.spans[i].pos:p.spans[i].end]
+}
+
+func (p *parser) peek() (govaluate.ExpressionToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return govaluate.ExpressionToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *parser) node(kind NodeKind, pos, end int) *Node {
+	return &Node{Kind: kind, Pos: pos, End: end, Text: p.expression[pos:end]}
+}
+
+// parseList parses comma separated expressions, the lowest precedence level.
+func (p *parser) parseList() (*Node, error) {
+	first, err := p.parseLevel(0)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []*Node{first}
+	for {
+		token, ok := p.peek()
+		if !ok || token.Kind != govaluate.SEPARATOR {
+			break
+		}
+		p.pos++
+
+		item, err := p.parseLevel(0)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	if len(items) == 1 {
+		return first, nil
+	}
+
+	list := p.node(ListNode, first.Pos, items[len(items)-1].End)
+	list.Args = items
+	return list, nil
+}
+
+// parseLevel parses left associative binary operators of levels[level] and higher.
+func (p *parser) parseLevel(level int) (*Node, error) {
+	if level == len(levels) {
+		return p.parseUnary()
+	}
+
+	left, err := p.parseLevel(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		token, ok := p.peek()
+		if !ok || !isOperator(token, levels[level]) {
+			return left, nil
+		}
+		op := token.Value.(string)
+		p.pos++
+
+		right, err := p.parseLevel(level + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		// `cond ? then : else` is planned as (cond ? then) : else
+		if op == ":" && left.Kind == BinaryNode && left.Op == "?" {
+			ternary := p.node(TernaryNode, left.Pos, right.End)
+			ternary.Args = []*Node{left.Args[0], left.Args[1], right}
+			left = ternary
+			continue
+		}
+		binary := p.node(BinaryNode, left.Pos, right.End)
+		binary.Op = op
+		binary.Args = []*Node{left, right}
+		left = binary
+	}
+}
+
+func isOperator(token govaluate.ExpressionToken, ops []string) bool {
+	switch token.Kind {
+	case govaluate.COMPARATOR, govaluate.LOGICALOP, govaluate.MODIFIER, govaluate.TERNARY:
+	default:
+		return false
+	}
+
+	for _, op := range ops {
+		if token.Value == op {
+			return true
+		}
+	}
+	return false
+}
+
+// parseUnary parses prefix operators, which apply to a single value or call.
+func (p *parser) parseUnary() (*Node, error) {
+	token, ok := p.peek()
+	if !ok {
+		return nil, p.errorf("unexpected end of expression")
+	}
+	if token.Kind != govaluate.PREFIX {
+		return p.parsePrimary()
+	}
+
+	pos := p.spans[p.pos].pos
+	p.pos++
+
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	unary := p.node(UnaryNode, pos, operand.End)
+	unary.Op = token.Value.(string)
+	unary.Args = []*Node{operand}
+	return unary, nil
+}
+
+func (p *parser) parsePrimary() (*Node, error) {
+	token, ok := p.peek()
+	if !ok {
+		return nil, p.errorf("unexpected end of expression")
+	}
+	s := p.spans[p.pos]
+	p.pos++
+
+	switch token.Kind {
+	case govaluate.CLAUSE:
+		inner, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		if token, ok := p.peek(); !ok || token.Kind != govaluate.CLAUSE_CLOSE {
+			return nil, p.errorf("expected )")
+		}
+		inner.Pos, inner.End = s.pos, p.spans[p.pos].end
+		inner.Text = p.expression[inner.Pos:inner.End]
+		p.pos++
+		return inner, nil
+
+	case govaluate.NUMERIC, govaluate.STRING, govaluate.PATTERN, govaluate.BOOLEAN, govaluate.TIME:
+		literal := p.node(LiteralNode, s.pos, s.end)
+		literal.Value = token.Value
+		return literal, nil
+
+	case govaluate.VARIABLE:
+		variable := p.node(VariableNode, s.pos, s.end)
+		variable.Name = token.Value.(string)
+		return variable, nil
+
+	case govaluate.FUNCTION:
+		call := p.node(CallNode, s.pos, s.end)
+		call.Name = p.expression[s.pos:s.end]
+		if err := p.parseArgs(call); err != nil {
+			return nil, err
+		}
+		return call, nil
+
+	case govaluate.ACCESSOR:
+		path := token.Value.([]string)
+		accessor := p.node(AccessorNode, s.pos, s.end)
+		accessor.Name = path[0]
+		accessor.Path = path[1:]
+		if token, ok := p.peek(); ok && token.Kind == govaluate.CLAUSE {
+			accessor.Method = true
+			if err := p.parseArgs(accessor); err != nil {
+				return nil, err
+			}
+		}
+		return accessor, nil
+	}
+
+	p.pos--
+	return nil, p.errorf("unexpected %s", p.text(p.pos))
+}
+
+// parseArgs parses the parenthesized arguments of a call into node.Args.
+func (p *parser) parseArgs(node *Node) error {
+	if token, ok := p.peek(); !ok || token.Kind != govaluate.CLAUSE {
+		return p.errorf("expected ( after %s", node.Text)
+	}
+	p.pos++
+
+	if token, ok := p.peek(); ok && token.Kind == govaluate.CLAUSE_CLOSE {
+		node.End = p.spans[p.pos].end
+		node.Text = p.expression[node.Pos:node.End]
+		p.pos++
+		return nil
+	}
+
+	args, err := p.parseList()
+	if err != nil {
+		return err
+	}
+	if token, ok := p.peek(); !ok || token.Kind != govaluate.CLAUSE_CLOSE {
+		return p.errorf("expected )")
+	}
+	node.End = p.spans[p.pos].end
+	node.Text = p.expression[node.Pos:node.End]
+	p.pos++
+
+	if args.Kind == ListNode {
+		node.Args = args.Args
+	} else {
+		node.Args = []*Node{args}
+	}
+	return nil
+}
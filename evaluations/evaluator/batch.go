@@ -0,0 +1,254 @@
+package evaluator
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sync"
+
+	"github.com/Knetic/govaluate"
+)
+
+// ItemError is the error of evaluating an expression for one item of a batch.
+type ItemError struct {
+	Index int
+	Err   error
+}
+
+func (e *ItemError) Error() string {
+	return fmt.Sprintf("item %d: %v", e.Index, e.Err)
+}
+
+func (e *ItemError) Unwrap() error {
+	return e.Err
+}
+
+// Batch is a set of labeled items, such as metric samples, that expressions
+// are evaluated over.
+type Batch struct {
+	// Parameter is the name items are bound to in expressions, "result" if empty.
+	Parameter string
+	// Workers is the number of goroutines evaluating items, runtime.NumCPU() if not positive.
+	Workers int
+
+	items []Labeled
+
+	mu sync.Mutex
+	// index maps label names to label values to the sorted indexes of the
+	// items carrying them. Labels are indexed the first time they are looked up.
+	index map[string]map[string][]int
+}
+
+// NewBatch returns a batch of items.
+func NewBatch(items []Labeled) *Batch {
+	return &Batch{
+		items: items,
+		index: make(map[string]map[string][]int),
+	}
+}
+
+// Filter returns the items for which expr is true, in their original order,
+// together with the errors of the items it couldn't be evaluated for.
+//
+// Expressions that only compare labels for equality, such as
+// getByLabel(result, 'name') == 'test' && getByLabel(result, 'env') == 'prod',
+// are answered from a label index without being evaluated.
+func (b *Batch) Filter(expr *govaluate.EvaluableExpression) (matched []Labeled, errs []*ItemError) {
+	if equalities, ok := labelEqualities(expr, b.parameter()); ok {
+		for _, i := range b.lookup(equalities) {
+			matched = append(matched, b.items[i])
+		}
+		return matched, nil
+	}
+
+	results := make([]bool, len(b.items))
+	failures := make([]error, len(b.items))
+
+	indexes := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < b.workers(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range indexes {
+				results[i], failures[i] = b.evaluate(expr, i)
+			}
+		}()
+	}
+
+	for i := range b.items {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	for i := range b.items {
+		if failures[i] != nil {
+			errs = append(errs, &ItemError{Index: i, Err: failures[i]})
+			continue
+		}
+		if results[i] {
+			matched = append(matched, b.items[i])
+		}
+	}
+
+	return matched, errs
+}
+
+func (b *Batch) evaluate(expr *govaluate.EvaluableExpression, i int) (bool, error) {
+	value, err := expr.Evaluate(map[string]interface{}{
+		b.parameter(): b.items[i],
+	})
+	if err != nil {
+		return false, err
+	}
+
+	matched, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression returned %T (%v), not bool", value, value)
+	}
+
+	return matched, nil
+}
+
+func (b *Batch) parameter() string {
+	if b.Parameter == "" {
+		return "result"
+	}
+	return b.Parameter
+}
+
+func (b *Batch) workers() int {
+	if b.Workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return b.Workers
+}
+
+// lookup returns the sorted indexes of the items carrying all labels of equalities.
+func (b *Batch) lookup(equalities map[string]string) (indexes []int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	first := true
+	for name, value := range equalities {
+		values, exist := b.index[name]
+		if !exist {
+			values = make(map[string][]int)
+			for i, item := range b.items {
+				if v, ok := item.GetLabel(name); ok {
+					values[v] = append(values[v], i)
+				}
+			}
+			b.index[name] = values
+		}
+
+		if first {
+			indexes, first = values[value], false
+			continue
+		}
+		indexes = intersect(indexes, values[value])
+	}
+
+	return indexes
+}
+
+func intersect(a, b []int) []int {
+	result := make([]int, 0)
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+// labelEqualities returns the label values required by expr, if expr is a
+// conjunction of getByLabel(parameter, 'name') == 'value' comparisons.
+func labelEqualities(expr *govaluate.EvaluableExpression, parameter string) (map[string]string, bool) {
+	tokens := expr.Tokens()
+	equalities := make(map[string]string)
+
+	for len(tokens) > 0 {
+		name, value, n, ok := labelEquality(tokens, parameter)
+		if !ok {
+			return nil, false
+		}
+
+		// getByLabel returns '' for missing labels, which the index doesn't know
+		if value == "" {
+			return nil, false
+		}
+		if previous, exist := equalities[name]; exist && previous != value {
+			return nil, false
+		}
+		equalities[name] = value
+
+		tokens = tokens[n:]
+		if len(tokens) == 0 {
+			break
+		}
+		if tokens[0].Kind != govaluate.LOGICALOP || tokens[0].Value != "&&" {
+			return nil, false
+		}
+		tokens = tokens[1:]
+		if len(tokens) == 0 {
+			return nil, false
+		}
+	}
+
+	return equalities, len(equalities) > 0
+}
+
+// labelEquality matches a single getByLabel comparison, in either order, at
+// the start of tokens and returns the number of tokens it spans.
+func labelEquality(tokens []govaluate.ExpressionToken, parameter string) (name, value string, n int, ok bool) {
+	if name, ok = labelCall(tokens, parameter); ok {
+		if len(tokens) < 8 || !isEquals(tokens[6]) || tokens[7].Kind != govaluate.STRING {
+			return "", "", 0, false
+		}
+		return name, tokens[7].Value.(string), 8, true
+	}
+
+	if len(tokens) < 8 || tokens[0].Kind != govaluate.STRING || !isEquals(tokens[1]) {
+		return "", "", 0, false
+	}
+	if name, ok = labelCall(tokens[2:], parameter); !ok {
+		return "", "", 0, false
+	}
+	return name, tokens[0].Value.(string), 8, true
+}
+
+// labelCall matches getByLabel(parameter, 'name') at the start of tokens.
+func labelCall(tokens []govaluate.ExpressionToken, parameter string) (string, bool) {
+	if len(tokens) < 6 ||
+		tokens[0].Kind != govaluate.FUNCTION || !isGetByLabel(tokens[0].Value) ||
+		tokens[1].Kind != govaluate.CLAUSE ||
+		tokens[2].Kind != govaluate.VARIABLE || tokens[2].Value != parameter ||
+		tokens[3].Kind != govaluate.SEPARATOR ||
+		tokens[4].Kind != govaluate.STRING ||
+		tokens[5].Kind != govaluate.CLAUSE_CLOSE {
+		return "", false
+	}
+
+	return tokens[4].Value.(string), true
+}
+
+func isEquals(token govaluate.ExpressionToken) bool {
+	return token.Kind == govaluate.COMPARATOR && token.Value == "=="
+}
+
+// isGetByLabel tells whether a function token is the standard getByLabel,
+// whose semantics the index relies on.
+func isGetByLabel(value interface{}) bool {
+	fn, ok := value.(govaluate.ExpressionFunction)
+	return ok && reflect.ValueOf(fn).Pointer() == reflect.ValueOf(getByLabel).Pointer()
+}
@@ -0,0 +1,224 @@
+package evaluator
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Knetic/govaluate"
+)
+
+type testItem map[string]string
+
+func (i testItem) GetLabel(name string) (string, bool) {
+	value, exist := i[name]
+	return value, exist
+}
+
+var batchItems = []Labeled{
+	testItem{"name": "test", "env": "prod", "cluster": "a"},
+	testItem{"name": "test", "env": "dev"},
+	testItem{"name": "prod", "env": "prod", "cluster": "b"},
+	testItem{"name": "test", "env": "", "cluster": "a"},
+	testItem{"env": "prod"},
+	testItem{"name": "test", "env": "prod", "cluster": "b"},
+}
+
+// evaluateAll filters items by evaluating expr for each of them.
+func evaluateAll(t *testing.T, b *Batch, expr *govaluate.EvaluableExpression) []Labeled {
+	t.Helper()
+
+	var matched []Labeled
+	for i, item := range b.items {
+		ok, err := b.evaluate(expr, i)
+		if err != nil {
+			t.Fatalf("evaluate of item %d failed: %v", i, err)
+		}
+		if ok {
+			matched = append(matched, item)
+		}
+	}
+	return matched
+}
+
+func TestFilterIndexMatchesEvaluation(t *testing.T) {
+	cases := []struct {
+		name       string
+		expression string
+		indexed    bool
+		want       int
+	}{
+		{"equality", "getByLabel(result, 'name') == 'test'", true, 4},
+		{"reversed", "'test' == getByLabel(result, 'name')", true, 4},
+		{"conjunction", "getByLabel(result, 'name') == 'test' && getByLabel(result, 'env') == 'prod'", true, 2},
+		{"reversed conjunction", "'prod' == getByLabel(result, 'env') && getByLabel(result, 'name') == 'test' && 'b' == getByLabel(result, 'cluster')", true, 1},
+		{"same label twice", "getByLabel(result, 'name') == 'test' && 'test' == getByLabel(result, 'name')", true, 4},
+		{"no item", "getByLabel(result, 'name') == 'nope'", true, 0},
+		{"missing label", "getByLabel(result, 'nope') == 'test'", true, 0},
+		// getByLabel returns '' for missing labels as well as empty ones
+		{"empty value", "getByLabel(result, 'cluster') == ''", false, 2},
+		{"empty value reversed", "'' == getByLabel(result, 'env')", false, 1},
+		{"conflicting values", "getByLabel(result, 'name') == 'test' && getByLabel(result, 'name') == 'prod'", false, 0},
+		{"disjunction", "getByLabel(result, 'name') == 'prod' || getByLabel(result, 'env') == 'dev'", false, 2},
+		{"conjunction then disjunction", "getByLabel(result, 'name') == 'test' && getByLabel(result, 'env') == 'dev' || getByLabel(result, 'cluster') == 'b'", false, 3},
+		{"not equal", "getByLabel(result, 'name') != 'test'", false, 2},
+		{"other function", "getByLabel(result, 'name') == 'test' && hasLabel(result, 'cluster')", false, 3},
+		{"parentheses", "(getByLabel(result, 'name') == 'test')", false, 4},
+		{"compared again", "getByLabel(result, 'name') == 'test' == true", false, 4},
+		{"concatenation", "getByLabel(result, 'name') == 'te' + 'st'", false, 4},
+		{"reversed concatenation", "'te' + 'st' == getByLabel(result, 'name')", false, 4},
+		{"trailing and", "getByLabel(result, 'name') == 'test' && true", false, 4},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			expr, err := New(c.expression)
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			b := NewBatch(batchItems)
+
+			if _, indexed := labelEqualities(expr, b.parameter()); indexed != c.indexed {
+				t.Errorf("indexed = %v, want %v", indexed, c.indexed)
+			}
+
+			matched, errs := b.Filter(expr)
+			if len(errs) != 0 {
+				t.Fatalf("Filter failed: %v", errs)
+			}
+			if len(matched) != c.want {
+				t.Errorf("Filter matched %d items, want %d", len(matched), c.want)
+			}
+			if want := evaluateAll(t, b, expr); !reflect.DeepEqual(matched, want) {
+				t.Errorf("Filter = %v, evaluation = %v", matched, want)
+			}
+
+			// the index is kept for the next lookups
+			again, _ := b.Filter(expr)
+			if !reflect.DeepEqual(again, matched) {
+				t.Errorf("second Filter = %v, want %v", again, matched)
+			}
+		})
+	}
+}
+
+func TestFilterIndexNeedsStandardGetByLabel(t *testing.T) {
+	// a getByLabel that isn't the standard one may mean anything
+	functions := Functions()
+	functions["getByLabel"] = func(args ...interface{}) (interface{}, error) {
+		return strings.ToUpper(args[1].(string)), nil
+	}
+	expr, err := govaluate.NewEvaluableExpressionWithFunctions("getByLabel(result, 'name') == 'NAME'", functions)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	b := NewBatch(batchItems)
+	if _, indexed := labelEqualities(expr, b.parameter()); indexed {
+		t.Fatal("expression with another getByLabel is indexed")
+	}
+	if matched, _ := b.Filter(expr); len(matched) != len(batchItems) {
+		t.Errorf("Filter matched %d items, want all %d", len(matched), len(batchItems))
+	}
+}
+
+func TestFilterParameter(t *testing.T) {
+	b := NewBatch(batchItems)
+	b.Parameter = "sample"
+
+	expr, err := New("getByLabel(sample, 'env') == 'prod' && getByLabel(sample, 'cluster') == 'a'")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if matched, errs := b.Filter(expr); len(matched) != 1 || len(errs) != 0 {
+		t.Errorf("Filter = %v, %v, want 1 item", matched, errs)
+	}
+
+	// the index only answers comparisons of the parameter
+	expr, err = New("getByLabel(result, 'env') == 'prod'")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if _, indexed := labelEqualities(expr, b.parameter()); indexed {
+		t.Error("comparison of another variable is indexed")
+	}
+	if matched, errs := b.Filter(expr); len(matched) != 0 || len(errs) != len(batchItems) {
+		t.Errorf("Filter = %v, %v, want an error per item", matched, errs)
+	}
+}
+
+func TestFilterItemErrors(t *testing.T) {
+	items := []Labeled{
+		testItem{"timeout": "5m"},
+		testItem{"timeout": "soon"},
+		testItem{"timeout": "10s"},
+		testItem{},
+		testItem{"timeout": "1h"},
+	}
+
+	cases := []struct {
+		name       string
+		expression string
+		matched    []Labeled
+		failed     []int
+		// err is what the errors of the failed items wrap
+		err interface{}
+	}{
+		{
+			name:       "argument value",
+			expression: "duration(getByLabel(result, 'timeout')) > 60",
+			matched:    []Labeled{items[0], items[4]},
+			failed:     []int{1, 3},
+			err:        &ArgValueError{},
+		},
+		{
+			name:       "argument type",
+			expression: "hasLabel(result, 'timeout') ? abs(getByLabel(result, 'timeout')) > 0 : false",
+			failed:     []int{0, 1, 2, 4},
+			err:        &ArgTypeError{},
+		},
+		{
+			name:       "not bool",
+			expression: "getByLabel(result, 'timeout')",
+			failed:     []int{0, 1, 2, 3, 4},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			expr, err := New(c.expression)
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			b := NewBatch(items)
+			b.Workers = 2
+
+			matched, errs := b.Filter(expr)
+			if !reflect.DeepEqual(matched, c.matched) {
+				t.Errorf("Filter = %v, want %v", matched, c.matched)
+			}
+
+			failed := make([]int, 0, len(errs))
+			for _, e := range errs {
+				failed = append(failed, e.Index)
+				if !strings.HasPrefix(e.Error(), "item ") {
+					t.Errorf("error %q doesn't name the item", e)
+				}
+				switch want := c.err.(type) {
+				case *ArgValueError:
+					if !errors.As(e, &want) {
+						t.Errorf("error of item %d = %v, want an ArgValueError", e.Index, e.Err)
+					}
+				case *ArgTypeError:
+					if !errors.As(e, &want) {
+						t.Errorf("error of item %d = %v, want an ArgTypeError", e.Index, e.Err)
+					}
+				}
+			}
+			if !reflect.DeepEqual(failed, c.failed) {
+				t.Errorf("failed items = %v, want %v", failed, c.failed)
+			}
+		})
+	}
+}
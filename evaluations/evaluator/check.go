@@ -0,0 +1,410 @@
+package evaluator
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Knetic/govaluate"
+)
+
+// TypeKind is the kind of value an expression evaluates to. govaluate turns
+// all numbers into float64, so there's a single numeric kind.
+type TypeKind int
+
+const (
+	// AnyType is a value whose type is unknown until evaluation.
+	AnyType TypeKind = iota
+	NumberType
+	StringType
+	BoolType
+	// ArrayType is a comma separated list, like (1, 2, 3).
+	ArrayType
+	// LabeledType is a Labeled value or a map[string]string.
+	LabeledType
+	// ObjectType is any other Go value, such as a struct parameter.
+	ObjectType
+)
+
+// Type is the static type of an expression.
+type Type struct {
+	Kind TypeKind
+	// Go is the type of ObjectType and LabeledType values, if known.
+	Go reflect.Type
+}
+
+func (t Type) String() string {
+	switch t.Kind {
+	case NumberType:
+		return "number"
+	case StringType:
+		return "string"
+	case BoolType:
+		return "bool"
+	case ArrayType:
+		return "array"
+	case LabeledType:
+		if t.Go != nil {
+			return t.Go.String()
+		}
+		return "labeled value"
+	case ObjectType:
+		if t.Go != nil {
+			return t.Go.String()
+		}
+		return "object"
+	}
+	return "any"
+}
+
+var (
+	anyType    = Type{Kind: AnyType}
+	numberType = Type{Kind: NumberType}
+	stringType = Type{Kind: StringType}
+	boolType   = Type{Kind: BoolType}
+	arrayType  = Type{Kind: ArrayType}
+
+	labeledInterface = reflect.TypeOf((*Labeled)(nil)).Elem()
+	errorInterface   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// TypeOf returns the static type of values of the Go type t.
+func TypeOf(t reflect.Type) Type {
+	if t == nil {
+		return anyType
+	}
+	if t.Implements(labeledInterface) || t == reflect.TypeOf(map[string]string{}) {
+		return Type{Kind: LabeledType, Go: t}
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return numberType
+	case reflect.String:
+		return stringType
+	case reflect.Bool:
+		return boolType
+	case reflect.Interface:
+		return anyType
+	}
+	if t == reflect.TypeOf([]interface{}{}) {
+		return arrayType
+	}
+
+	return Type{Kind: ObjectType, Go: t}
+}
+
+// Schema declares the Go types of the parameters of expressions, such as
+// Schema{"result": reflect.TypeOf(Result{})}.
+type Schema map[string]reflect.Type
+
+// Signature declares the argument and result types of a function. If
+// Variadic is set, the last argument may be repeated or left out.
+type Signature struct {
+	Args     []Type
+	Variadic bool
+	Result   Type
+}
+
+// CheckError is a type error at a position of an expression.
+type CheckError struct {
+	Pos  int
+	End  int
+	Text string
+	Msg  string
+}
+
+func (e *CheckError) Error() string {
+	return fmt.Sprintf("column %d: %s: %s", e.Pos+1, e.Text, e.Msg)
+}
+
+// CheckErrors are all type errors of an expression.
+type CheckErrors []*CheckError
+
+func (e CheckErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Compile parses expression with set and checks it against schema before
+// returning it, so that errors which govaluate would only report when
+// evaluating are found up front.
+func Compile(expression string, set FunctionSet, schema Schema) (*govaluate.EvaluableExpression, error) {
+	node, err := Parse(expression, set)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := Check(node, set, schema); err != nil {
+		return nil, err
+	}
+
+	return govaluate.NewEvaluableExpressionWithFunctions(expression, set.Functions)
+}
+
+// Check checks that the variables of node are declared in schema, that the
+// accessed fields and methods exist, that functions are called with the
+// arguments of their signature and that operators get operands they accept.
+// It returns the type of node, or CheckErrors.
+func Check(node *Node, set FunctionSet, schema Schema) (Type, error) {
+	c := &checker{set: set, schema: schema}
+	t := c.check(node)
+	if len(c.errs) > 0 {
+		return t, c.errs
+	}
+	return t, nil
+}
+
+type checker struct {
+	set    FunctionSet
+	schema Schema
+	errs   CheckErrors
+}
+
+func (c *checker) errorf(node *Node, format string, args ...interface{}) {
+	c.errs = append(c.errs, &CheckError{
+		Pos:  node.Pos,
+		End:  node.End,
+		Text: node.Text,
+		Msg:  fmt.Sprintf(format, args...),
+	})
+}
+
+// expect reports node unless its type t is one of kinds. Values of unknown
+// type are accepted.
+func (c *checker) expect(node *Node, t Type, kinds ...TypeKind) {
+	if t.Kind == AnyType {
+		return
+	}
+
+	names := make([]string, 0, len(kinds))
+	for _, k := range kinds {
+		if t.Kind == k {
+			return
+		}
+		names = append(names, Type{Kind: k}.String())
+	}
+
+	c.errorf(node, "expected %s, got %s", strings.Join(names, " or "), t)
+}
+
+func (c *checker) check(node *Node) Type {
+	switch node.Kind {
+	case LiteralNode:
+		switch node.Value.(type) {
+		case float64, time.Time:
+			return numberType
+		case string, *regexp.Regexp:
+			return stringType
+		case bool:
+			return boolType
+		}
+		return anyType
+
+	case VariableNode:
+		t, declared := c.schema[node.Name]
+		if !declared {
+			c.errorf(node, "undeclared variable %s", node.Name)
+			return anyType
+		}
+		return TypeOf(t)
+
+	case AccessorNode:
+		return c.checkAccessor(node)
+
+	case CallNode:
+		return c.checkCall(node)
+
+	case ListNode:
+		for _, item := range node.Args {
+			c.check(item)
+		}
+		return arrayType
+
+	case UnaryNode:
+		t := c.check(node.Args[0])
+		if node.Op == "!" {
+			c.expect(node.Args[0], t, BoolType)
+			return boolType
+		}
+		c.expect(node.Args[0], t, NumberType)
+		return numberType
+
+	case TernaryNode:
+		c.expect(node.Args[0], c.check(node.Args[0]), BoolType)
+		then, otherwise := c.check(node.Args[1]), c.check(node.Args[2])
+		if then.Kind == otherwise.Kind {
+			return then
+		}
+		return anyType
+
+	case BinaryNode:
+		return c.checkBinary(node)
+	}
+
+	return anyType
+}
+
+func (c *checker) checkBinary(node *Node) Type {
+	left, right := node.Args[0], node.Args[1]
+	lt, rt := c.check(left), c.check(right)
+
+	switch node.Op {
+	case "&&", "||":
+		c.expect(left, lt, BoolType)
+		c.expect(right, rt, BoolType)
+		return boolType
+
+	case "==", "!=":
+		return boolType
+
+	case ">", ">=", "<", "<=":
+		c.expect(left, lt, NumberType, StringType)
+		c.expect(right, rt, NumberType, StringType)
+		// operands of other types are already reported
+		ordered := func(t Type) bool { return t.Kind == NumberType || t.Kind == StringType }
+		if ordered(lt) && ordered(rt) && lt.Kind != rt.Kind {
+			c.errorf(node, "can't compare %s with %s", lt, rt)
+		}
+		return boolType
+
+	case "=~", "!~":
+		c.expect(left, lt, StringType)
+		c.expect(right, rt, StringType)
+		return boolType
+
+	case "in":
+		c.expect(right, rt, ArrayType)
+		return boolType
+
+	case "+":
+		if lt.Kind == StringType || rt.Kind == StringType {
+			return stringType
+		}
+		c.expect(left, lt, NumberType, StringType)
+		c.expect(right, rt, NumberType, StringType)
+		if lt.Kind == NumberType && rt.Kind == NumberType {
+			return numberType
+		}
+		return anyType
+
+	case "?":
+		c.expect(left, lt, BoolType)
+		return rt
+
+	case ":", "??":
+		if lt.Kind == rt.Kind {
+			return lt
+		}
+		return anyType
+	}
+
+	// arithmetic and bitwise operators
+	c.expect(left, lt, NumberType)
+	c.expect(right, rt, NumberType)
+	return numberType
+}
+
+func (c *checker) checkCall(node *Node) Type {
+	args := make([]Type, len(node.Args))
+	for i, arg := range node.Args {
+		args[i] = c.check(arg)
+	}
+
+	sig, declared := c.set.Signatures[node.Name]
+	if !declared {
+		return anyType
+	}
+
+	min := len(sig.Args)
+	if sig.Variadic {
+		min--
+	}
+	switch {
+	case sig.Variadic && len(args) < min:
+		c.errorf(node, "%s expects at least %d arguments, got %d", node.Name, min, len(args))
+		return sig.Result
+	case !sig.Variadic && len(args) != min:
+		c.errorf(node, "%s expects %d arguments, got %d", node.Name, min, len(args))
+		return sig.Result
+	}
+
+	for i, t := range args {
+		want := sig.Args[len(sig.Args)-1]
+		if i < len(sig.Args) {
+			want = sig.Args[i]
+		}
+		if want.Kind != AnyType {
+			c.expect(node.Args[i], t, want.Kind)
+		}
+	}
+
+	return sig.Result
+}
+
+func (c *checker) checkAccessor(node *Node) Type {
+	for _, arg := range node.Args {
+		c.check(arg)
+	}
+
+	declared, exist := c.schema[node.Name]
+	if !exist {
+		c.errorf(node, "undeclared variable %s", node.Name)
+		return anyType
+	}
+
+	t := declared
+	parent := node.Name
+	for _, name := range node.Path {
+		if t == nil || t.Kind() == reflect.Interface {
+			// only known when evaluating
+			return anyType
+		}
+
+		receiver := t
+		if receiver.Kind() == reflect.Ptr {
+			receiver = receiver.Elem()
+		}
+		if receiver.Kind() != reflect.Struct {
+			c.errorf(node, "%s is %s, not a struct", parent, t)
+			return anyType
+		}
+
+		if field, ok := receiver.FieldByName(name); ok {
+			t, parent = field.Type, name
+			continue
+		}
+
+		// govaluate calls methods of the value, or of the pointer if the
+		// parameter is one
+		method, ok := receiver.MethodByName(name)
+		if !ok && t.Kind() == reflect.Ptr {
+			method, ok = t.MethodByName(name)
+		}
+		if !ok {
+			c.errorf(node, "%s has no field or method %s", t, name)
+			return anyType
+		}
+
+		// govaluate passes the arguments to every method of the path
+		if in := method.Type.NumIn() - 1; in != len(node.Args) {
+			c.errorf(node, "method %s of %s expects %d arguments, got %d", name, t, in, len(node.Args))
+		}
+
+		out := method.Type.NumOut()
+		if out == 0 || out > 2 || (out == 2 && method.Type.Out(1) != errorInterface) {
+			c.errorf(node, "method %s of %s must return a value, or a value and an error", name, t)
+			return anyType
+		}
+		t, parent = method.Type.Out(0), name
+	}
+
+	return TypeOf(t)
+}
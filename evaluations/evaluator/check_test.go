@@ -0,0 +1,222 @@
+package evaluator
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type checkHost struct {
+	Name string
+}
+
+type checkSample struct {
+	Value  float64
+	Host   checkHost
+	Labels map[string]string
+	Any    interface{}
+}
+
+func (s checkSample) Age() float64               { return 1 }
+func (s checkSample) Scaled(f float64) float64   { return s.Value * f }
+func (s checkSample) Parsed() (float64, error)   { return s.Value, nil }
+func (s checkSample) Pair() (float64, float64)   { return s.Value, s.Value }
+func (s *checkSample) Reset()                    {}
+func (s *checkSample) Pointer() string           { return "" }
+func (s checkSample) Labeled() map[string]string { return s.Labels }
+
+var checkSchema = Schema{
+	"x":      reflect.TypeOf(0),
+	"s":      reflect.TypeOf(""),
+	"b":      reflect.TypeOf(true),
+	"list":   reflect.TypeOf([]interface{}{}),
+	"labels": reflect.TypeOf(map[string]string{}),
+	"item":   reflect.TypeOf((*Labeled)(nil)).Elem(),
+	"sample": reflect.TypeOf(checkSample{}),
+	"ptr":    reflect.TypeOf(&checkSample{}),
+	"v":      reflect.TypeOf((*interface{})(nil)).Elem(),
+}
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		expression string
+		want       Type
+	}{
+		{"1 + 2 * 3", numberType},
+		{"'a' + 1", stringType},
+		{"x + s", stringType},
+		{"x + v", anyType},
+		{"x > 1 && s == 'a' || !b", boolType},
+		{"s < 'b'", boolType},
+		{"s =~ '^a'", boolType},
+		{"x in (1, 2)", boolType},
+		{"x in list", boolType},
+		{"-x ** 2 % 3", numberType},
+		{"x & 1 | 2 << 3", numberType},
+		{"b ? 1 : 2", numberType},
+		{"b ? 1 : 'a'", anyType},
+		{"v ?? 'a'", anyType},
+		{"s ?? 'a'", stringType},
+		{"labels", Type{Kind: LabeledType, Go: reflect.TypeOf(map[string]string{})}},
+		{"getByLabel(labels, 'a')", stringType},
+		{"hasLabel(item, 'a')", boolType},
+		{"getByLabel(v, 'a')", stringType},
+		{"min(1, x, 3)", numberType},
+		{"max(x)", numberType},
+		{"now() - since(1)", numberType},
+		{"stringInSlice(s, list)", boolType},
+		{"sample.Value * 2", numberType},
+		{"sample.Host.Name =~ '^web'", boolType},
+		{"sample.Age() > 1", boolType},
+		{"sample.Scaled(2)", numberType},
+		{"sample.Parsed()", numberType},
+		{"getByLabel(sample.Labeled(), 'a')", stringType},
+		{"sample.Any.Whatever", anyType},
+		{"ptr.Value + ptr.Pointer()", stringType},
+		{"v.Field", anyType},
+	}
+
+	for _, c := range cases {
+		t.Run(c.expression, func(t *testing.T) {
+			node, err := Parse(c.expression, Standard)
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			got, err := Check(node, Standard, checkSchema)
+			if err != nil {
+				t.Fatalf("Check failed: %v", err)
+			}
+			if got != c.want {
+				t.Errorf("Check = %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestCheckErrors(t *testing.T) {
+	type checkError struct {
+		// col is the 1-based column of the error
+		col  int
+		text string
+		msg  string
+	}
+
+	cases := []struct {
+		expression string
+		want       []checkError
+	}{
+		// variables
+		{"y + 1", []checkError{{1, "y", "undeclared variable y"}}},
+		{"x + other.Field", []checkError{{5, "other.Field", "undeclared variable other"}}},
+
+		// fields and methods
+		{"sample.Nope", []checkError{{1, "sample.Nope", "evaluator.checkSample has no field or method Nope"}}},
+		{"sample.Host.Nope == ''", []checkError{{1, "sample.Host.Nope", "evaluator.checkHost has no field or method Nope"}}},
+		{"sample.Value.Nope", []checkError{{1, "sample.Value.Nope", "Value is float64, not a struct"}}},
+		{"x.Nope", []checkError{{1, "x.Nope", "x is int, not a struct"}}},
+		{"sample.Scaled()", []checkError{{1, "sample.Scaled()", "method Scaled of evaluator.checkSample expects 1 arguments, got 0"}}},
+		{"sample.Age(1)", []checkError{{1, "sample.Age(1)", "method Age of evaluator.checkSample expects 0 arguments, got 1"}}},
+		{"sample.Pair()", []checkError{{1, "sample.Pair()", "method Pair of evaluator.checkSample must return a value, or a value and an error"}}},
+		{"ptr.Reset()", []checkError{{1, "ptr.Reset()", "method Reset of *evaluator.checkSample must return a value, or a value and an error"}}},
+		// methods of the pointer aren't called on values
+		{"sample.Pointer()", []checkError{{1, "sample.Pointer()", "evaluator.checkSample has no field or method Pointer"}}},
+
+		// arity
+		{"getByLabel(labels)", []checkError{{1, "getByLabel(labels)", "getByLabel expects 2 arguments, got 1"}}},
+		{"abs(1, 2)", []checkError{{1, "abs(1, 2)", "abs expects 1 arguments, got 2"}}},
+		{"now(1)", []checkError{{1, "now(1)", "now expects 0 arguments, got 1"}}},
+		{"1 + min()", []checkError{{5, "min()", "min expects at least 1 arguments, got 0"}}},
+
+		// argument types
+		{"abs('a')", []checkError{{5, "'a'", "expected number, got string"}}},
+		{"getByLabel(x, 'a')", []checkError{{12, "x", "expected labeled value, got number"}}},
+		{"hasLabel(labels, 1)", []checkError{{18, "1", "expected string, got number"}}},
+		{"max(1, 2, s)", []checkError{{11, "s", "expected number, got string"}}},
+		{"match(sample.Host, s)", []checkError{{7, "sample.Host", "expected string, got evaluator.checkHost"}}},
+
+		// operand types
+		{"!x", []checkError{{2, "x", "expected bool, got number"}}},
+		{"-s", []checkError{{2, "s", "expected number, got string"}}},
+		{"x && true", []checkError{{1, "x", "expected bool, got number"}}},
+		{"b || 'a'", []checkError{{6, "'a'", "expected bool, got string"}}},
+		{"x > 'a'", []checkError{{1, "x > 'a'", "can't compare number with string"}}},
+		{"b < 1", []checkError{{1, "b", "expected number or string, got bool"}}},
+		{"s =~ x", []checkError{{6, "x", "expected string, got number"}}},
+		{"x in s", []checkError{{6, "s", "expected array, got string"}}},
+		{"x ? 1 : 2", []checkError{{1, "x", "expected bool, got number"}}},
+		{"s * 2", []checkError{{1, "s", "expected number, got string"}}},
+		{"1 | b", []checkError{{5, "b", "expected number, got bool"}}},
+		{"b + 1", []checkError{{1, "b", "expected number or string, got bool"}}},
+
+		// every error is reported, in order
+		{"abs(s) + y > sample.Nope", []checkError{
+			{5, "s", "expected number, got string"},
+			{10, "y", "undeclared variable y"},
+			{14, "sample.Nope", "evaluator.checkSample has no field or method Nope"},
+		}},
+		{"(x && b) || abs(b, 1)", []checkError{
+			{2, "x", "expected bool, got number"},
+			{13, "abs(b, 1)", "abs expects 1 arguments, got 2"},
+			{13, "abs(b, 1)", "expected bool, got number"},
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.expression, func(t *testing.T) {
+			node, err := Parse(c.expression, Standard)
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			_, err = Check(node, Standard, checkSchema)
+
+			var errs CheckErrors
+			if !errors.As(err, &errs) {
+				t.Fatalf("Check err = %v, want CheckErrors", err)
+			}
+			got := make([]checkError, 0, len(errs))
+			for _, e := range errs {
+				got = append(got, checkError{e.Pos + 1, e.Text, e.Msg})
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Check errors = %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestCheckUnknownFunctions(t *testing.T) {
+	// functions without a signature are accepted with any arguments
+	set := FunctionSet{Name: "custom", Functions: Functions()}
+	node, err := Parse("getByLabel(1) + abs('a', 'b')", set)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	got, err := Check(node, set, nil)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if got != anyType {
+		t.Errorf("Check = %s, want any", got)
+	}
+}
+
+func TestCompile(t *testing.T) {
+	schema := Schema{"result": reflect.TypeOf(map[string]string{})}
+
+	expr, err := Compile("getByLabel(result, 'name') == 'test'", Standard, schema)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	got, err := expr.Evaluate(map[string]interface{}{"result": map[string]string{"name": "test"}})
+	if err != nil || got != true {
+		t.Errorf("Evaluate = %v, %v, want true", got, err)
+	}
+
+	_, err = Compile("getByLabel(result) == 1", Standard, schema)
+	if err == nil || err.Error() != "column 1: getByLabel(result): getByLabel expects 2 arguments, got 1" {
+		t.Errorf("Compile err = %v", err)
+	}
+	if _, err := Compile("1 +", Standard, schema); err == nil {
+		t.Error("Compile of an invalid expression succeeded")
+	}
+}
@@ -0,0 +1,68 @@
+package evaluator
+
+import (
+	"fmt"
+)
+
+// ArgCountError is returned by a function called with the wrong number of arguments.
+type ArgCountError struct {
+	Func string
+	Min  int
+	Max  int
+	Got  int
+}
+
+func (e *ArgCountError) Error() string {
+	switch {
+	case e.Min == e.Max:
+		return fmt.Sprintf("%s: expected %d arguments, got %d", e.Func, e.Min, e.Got)
+	case e.Max < 0:
+		return fmt.Sprintf("%s: expected at least %d arguments, got %d", e.Func, e.Min, e.Got)
+	}
+	return fmt.Sprintf("%s: expected %d to %d arguments, got %d", e.Func, e.Min, e.Max, e.Got)
+}
+
+// ArgTypeError is returned by a function called with an argument of the wrong type.
+type ArgTypeError struct {
+	Func  string
+	Index int
+	Want  string
+	Got   interface{}
+}
+
+func (e *ArgTypeError) Error() string {
+	return fmt.Sprintf("%s: argument %d must be %s, got %T (%v)", e.Func, e.Index+1, e.Want, e.Got, e.Got)
+}
+
+// ArgValueError is returned by a function called with an argument of the right
+// type whose value can't be used, such as an invalid regular expression.
+type ArgValueError struct {
+	Func  string
+	Index int
+	Err   error
+}
+
+func (e *ArgValueError) Error() string {
+	return fmt.Sprintf("%s: invalid argument %d: %v", e.Func, e.Index+1, e.Err)
+}
+
+func (e *ArgValueError) Unwrap() error {
+	return e.Err
+}
+
+// MismatchError is returned by Explain when its result differs from the one
+// govaluate evaluates, which means the trace doesn't explain the result.
+type MismatchError struct {
+	Expression string
+	// Explained and ExplainedErr are the result of Explain.
+	Explained    interface{}
+	ExplainedErr error
+	// Evaluated and EvaluatedErr are the result of govaluate.
+	Evaluated    interface{}
+	EvaluatedErr error
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("explain of %q disagrees with govaluate: explained %#v (err: %v), evaluated %#v (err: %v)",
+		e.Expression, e.Explained, e.ExplainedErr, e.Evaluated, e.EvaluatedErr)
+}
@@ -0,0 +1,443 @@
+package evaluator
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"time"
+
+	"github.com/Knetic/govaluate"
+)
+
+// interpreter evaluates syntax trees the way govaluate evaluates its own
+// stages, and optionally records a Trace of every node.
+type interpreter struct {
+	functions  FunctionSet
+	parameters map[string]interface{}
+	trace      bool
+
+	// limits are enforced if set
+	limits *limits
+}
+
+// eval evaluates node. The returned trace is nil unless tracing.
+func (in *interpreter) eval(node *Node) (interface{}, *Trace, error) {
+	var t *Trace
+	if in.trace {
+		t = newTrace(node)
+	}
+
+	var (
+		value interface{}
+		err   error
+	)
+	if in.limits != nil {
+		err = in.limits.step()
+	}
+	if err == nil {
+		value, err = in.evalNode(node, t)
+	}
+	if t != nil {
+		t.setResult(value, err)
+	}
+	return value, t, err
+}
+
+// child evaluates an operand of the node traced by t.
+func (in *interpreter) child(t *Trace, node *Node) (interface{}, error) {
+	value, ct, err := in.eval(node)
+	if t != nil {
+		t.Children = append(t.Children, ct)
+	}
+	return value, err
+}
+
+// skip records that node isn't evaluated because of short circuiting.
+func (in *interpreter) skip(t *Trace, node *Node) {
+	if t == nil || node == nil {
+		return
+	}
+	t.ShortCircuit = true
+	skipped := newTrace(node)
+	skipped.Skipped = true
+	t.Children = append(t.Children, skipped)
+}
+
+func (in *interpreter) evalNode(node *Node, t *Trace) (interface{}, error) {
+	switch node.Kind {
+	case LiteralNode:
+		if tm, ok := node.Value.(time.Time); ok {
+			return float64(tm.Unix()), nil
+		}
+		return node.Value, nil
+
+	case VariableNode:
+		value, exist := in.parameters[node.Name]
+		if !exist {
+			return nil, fmt.Errorf("No parameter '%s' found.", node.Name)
+		}
+		return toFloat(value), nil
+
+	case AccessorNode:
+		args, err := in.args(t, node.Args)
+		if err != nil {
+			return nil, err
+		}
+		return in.access(node, args)
+
+	case CallNode:
+		args, err := in.args(t, node.Args)
+		if err != nil {
+			return nil, err
+		}
+		// like govaluate, a single list argument is spread
+		if len(args) == 1 {
+			if list, ok := args[0].([]interface{}); ok {
+				args = list
+			}
+		}
+		return callFunction(node, in.functions.Functions[node.Name], args)
+
+	case ListNode:
+		return in.args(t, node.Args)
+
+	case UnaryNode:
+		operand, err := in.child(t, node.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		return unaryOp(node.Op, operand)
+
+	case TernaryNode:
+		cond, err := in.child(t, node.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := cond.(bool); !ok {
+			return nil, fmt.Errorf("Value '%v' cannot be used with the ternary operator '?', it is not a bool", cond)
+		}
+
+		if cond == true {
+			then, err := in.child(t, node.Args[1])
+			if err != nil || then != nil {
+				in.skip(t, node.Args[2])
+				return then, err
+			}
+		} else {
+			in.skip(t, node.Args[1])
+		}
+		return in.child(t, node.Args[2])
+
+	case BinaryNode:
+		left, err := in.child(t, node.Args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case node.Op == "&&" && left == false:
+			in.skip(t, node.Args[1])
+			return false, nil
+		case node.Op == "||" && left == true:
+			in.skip(t, node.Args[1])
+			return true, nil
+		case (node.Op == "??" || node.Op == ":") && left != nil:
+			in.skip(t, node.Args[1])
+			return left, nil
+		case node.Op == "?" && left == false:
+			in.skip(t, node.Args[1])
+			return nil, nil
+		}
+
+		right, err := in.child(t, node.Args[1])
+		if err != nil {
+			return nil, err
+		}
+		return binaryOp(node.Op, left, right)
+	}
+
+	return nil, fmt.Errorf("unknown node %s", node.Kind)
+}
+
+func (in *interpreter) args(t *Trace, nodes []*Node) ([]interface{}, error) {
+	args := make([]interface{}, 0, len(nodes))
+	for _, n := range nodes {
+		value, err := in.child(t, n)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, value)
+	}
+	return args, nil
+}
+
+// access reads the fields and calls the methods of an accessor like govaluate.
+func (in *interpreter) access(node *Node, args []interface{}) (value interface{}, err error) {
+	value, exist := in.parameters[node.Name]
+	if !exist {
+		return nil, fmt.Errorf("No parameter '%s' found.", node.Name)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			value, err = nil, fmt.Errorf("Failed to access '%s': %v", node.Text, r)
+		}
+	}()
+
+	parent := node.Name
+	for _, name := range node.Path {
+		v := reflect.ValueOf(value)
+
+		var ptr reflect.Value
+		if v.Kind() == reflect.Ptr {
+			ptr, v = v, v.Elem()
+		}
+		if v.Kind() != reflect.Struct {
+			return nil, fmt.Errorf("Unable to access '%s', '%s' is not a struct", name, parent)
+		}
+
+		if field := v.FieldByName(name); field.IsValid() {
+			if in.limits != nil && !allowed(in.limits.policy.Fields, v.Type(), name) {
+				return nil, &PolicyError{Text: node.Text, Msg: fmt.Sprintf("field %s of %s is not allowed", name, v.Type())}
+			}
+			value, parent = field.Interface(), name
+			continue
+		}
+
+		method := v.MethodByName(name)
+		if !method.IsValid() && ptr.IsValid() {
+			method = ptr.MethodByName(name)
+		}
+		if !method.IsValid() {
+			return nil, fmt.Errorf("No method or field '%s' present on parameter '%s'", name, parent)
+		}
+		if in.limits != nil && !allowed(in.limits.policy.Methods, v.Type(), name) {
+			return nil, &PolicyError{Text: node.Text, Msg: fmt.Sprintf("method %s of %s is not allowed", name, v.Type())}
+		}
+
+		value, err = call(method, args)
+		if err != nil {
+			return value, err
+		}
+		parent = name
+	}
+
+	return toFloat(value), nil
+}
+
+// callFunction calls the function of node, turning a panic into an error like
+// access does for methods.
+func callFunction(node *Node, function govaluate.ExpressionFunction, args []interface{}) (value interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			value, err = nil, fmt.Errorf("Failed to call '%s': %v", node.Text, r)
+		}
+	}()
+
+	return function(args...)
+}
+
+func call(method reflect.Value, args []interface{}) (interface{}, error) {
+	mt := method.Type()
+	if mt.NumIn() != len(args) {
+		return nil, fmt.Errorf("Method call failed: got %d arguments, expected %d", len(args), mt.NumIn())
+	}
+
+	params := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		p := reflect.ValueOf(arg)
+		if !p.IsValid() || !p.Type().ConvertibleTo(mt.In(i)) {
+			return nil, fmt.Errorf("Argument type conversion failed: failed to convert '%T' to '%s'", arg, mt.In(i))
+		}
+		params[i] = p.Convert(mt.In(i))
+	}
+
+	returned := method.Call(params)
+	switch len(returned) {
+	case 1:
+		return returned[0].Interface(), nil
+	case 2:
+		if err, ok := returned[1].Interface().(error); ok && err != nil {
+			return returned[0].Interface(), err
+		}
+		return returned[0].Interface(), nil
+	}
+
+	return nil, errors.New("Method call did not return either one value, or a value and an error")
+}
+
+func unaryOp(op string, operand interface{}) (interface{}, error) {
+	switch op {
+	case "!":
+		b, ok := operand.(bool)
+		if !ok {
+			return nil, fmt.Errorf("Value '%v' cannot be used with the prefix '!'", operand)
+		}
+		return !b, nil
+	case "-":
+		f, ok := operand.(float64)
+		if !ok {
+			return nil, fmt.Errorf("Value '%v' cannot be used with the prefix '-'", operand)
+		}
+		return -f, nil
+	case "~":
+		f, ok := operand.(float64)
+		if !ok {
+			return nil, fmt.Errorf("Value '%v' cannot be used with the prefix '~'", operand)
+		}
+		return float64(^int64(f)), nil
+	}
+
+	return nil, fmt.Errorf("unknown prefix %s", op)
+}
+
+func binaryOp(op string, left, right interface{}) (interface{}, error) {
+	lf, lnum := left.(float64)
+	rf, rnum := right.(float64)
+	ls, lstr := left.(string)
+	rs, rstr := right.(string)
+
+	switch op {
+	case "==":
+		return reflect.DeepEqual(left, right), nil
+	case "!=":
+		return !reflect.DeepEqual(left, right), nil
+
+	case "&&", "||":
+		lb, lok := left.(bool)
+		rb, rok := right.(bool)
+		if !lok || !rok {
+			return nil, fmt.Errorf("Value '%v' cannot be used with the logical operator '%s', it is not a bool", left, op)
+		}
+		if op == "&&" {
+			return lb && rb, nil
+		}
+		return lb || rb, nil
+
+	case ">", ">=", "<", "<=":
+		switch {
+		case lnum && rnum:
+			return compare(op, lf < rf, lf == rf), nil
+		case lstr && rstr:
+			return compare(op, ls < rs, ls == rs), nil
+		}
+		return nil, fmt.Errorf("Value '%v' cannot be used with the comparator '%s', it is not a number", left, op)
+
+	case "=~", "!~":
+		if !lstr {
+			return nil, fmt.Errorf("Value '%v' cannot be used with the comparator '%s', it is not a number", left, op)
+		}
+		var re *regexp.Regexp
+		switch r := right.(type) {
+		case *regexp.Regexp:
+			re = r
+		case string:
+			var err error
+			if re, err = regexp.Compile(r); err != nil {
+				return nil, fmt.Errorf("Unable to compile regexp pattern '%v': %v", r, err)
+			}
+		default:
+			return nil, fmt.Errorf("Value '%v' cannot be used with the comparator '%s', it is not a number", right, op)
+		}
+		return re.MatchString(ls) == (op == "=~"), nil
+
+	case "in":
+		list, ok := right.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Value '%v' cannot be used with the comparator 'in', it is not a number", right)
+		}
+		for _, v := range list {
+			if left == v {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "?":
+		if _, ok := left.(bool); !ok {
+			return nil, fmt.Errorf("Value '%v' cannot be used with the ternary operator '?', it is not a bool", left)
+		}
+		return right, nil
+	case ":", "??":
+		return right, nil
+
+	case "+":
+		if lnum && rnum {
+			return lf + rf, nil
+		}
+		if !lstr && !rstr {
+			return nil, fmt.Errorf("Value '%v' cannot be used with the modifier '+', it is not a number", left)
+		}
+		return fmt.Sprintf("%v%v", left, right), nil
+	}
+
+	if !lnum || !rnum {
+		return nil, fmt.Errorf("Value '%v' cannot be used with the modifier '%s', it is not a number", left, op)
+	}
+
+	switch op {
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	case "/":
+		return lf / rf, nil
+	case "%":
+		return math.Mod(lf, rf), nil
+	case "**":
+		return math.Pow(lf, rf), nil
+	case "&":
+		return float64(int64(lf) & int64(rf)), nil
+	case "|":
+		return float64(int64(lf) | int64(rf)), nil
+	case "^":
+		return float64(int64(lf) ^ int64(rf)), nil
+	case "<<":
+		return float64(uint64(lf) << uint64(rf)), nil
+	case ">>":
+		return float64(uint64(lf) >> uint64(rf)), nil
+	}
+
+	return nil, fmt.Errorf("unknown operator %s", op)
+}
+
+func compare(op string, less, equal bool) bool {
+	switch op {
+	case ">":
+		return !less && !equal
+	case ">=":
+		return !less
+	case "<":
+		return less
+	}
+	return less || equal
+}
+
+// toFloat converts numbers to float64 like govaluate does for parameters.
+func toFloat(value interface{}) interface{} {
+	switch v := value.(type) {
+	case uint8:
+		return float64(v)
+	case uint16:
+		return float64(v)
+	case uint32:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case int8:
+		return float64(v)
+	case int16:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case int:
+		return float64(v)
+	case float32:
+		return float64(v)
+	}
+	return value
+}
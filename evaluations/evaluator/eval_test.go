@@ -0,0 +1,115 @@
+package evaluator
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Knetic/govaluate"
+)
+
+func TestExplainMatchesGovaluate(t *testing.T) {
+	parameters := map[string]interface{}{
+		"x": 3,
+		"y": int64(2),
+		"f": float32(1.5),
+		"s": "abc",
+	}
+
+	cases := []struct {
+		name       string
+		expression string
+		want       interface{}
+	}{
+		// precedence and associativity
+		{"multiplication first", "1 + 2 * 3", 7.0},
+		{"parentheses", "(1 + 2) * 3", 9.0},
+		{"subtraction left to right", "10 - 2 - 3", 5.0},
+		{"division left to right", "12 / 2 / 3", 2.0},
+		{"exponent left to right", "2 ** 3 ** 2", 64.0},
+		{"negation before exponent", "-2 ** 2", 4.0},
+		{"modulus", "7 % 3", 1.0},
+		{"shift after addition", "1 << 2 + 1", 8.0},
+		{"bitwise", "1 | 2 ^ 3 & 1", 0.0},
+		{"and before or", "true || false && false", true},
+		{"comparison before and", "1 < 2 && 3 > 4 || true", true},
+		{"not binds tightest", "!true || true", true},
+		{"chained equality", "1 == 1 == true", true},
+		{"comparison before equality", "2 > 1 == true", true},
+		{"ternary after addition", "1 > 2 ? 1 : 2 + 3", 5.0},
+		{"bitwise not", "~1", -2.0},
+		{"negated parameter", "-x + 1", -2.0},
+
+		// type coercion
+		{"int parameter", "x * 2", 6.0},
+		{"int64 parameter", "y + x", 5.0},
+		{"float32 parameter", "f * 2", 3.0},
+		{"int parameter equality", "x == 3", true},
+		{"string concatenation", "'a' + 'b'", "ab"},
+		{"string plus number", "'a' + 1", "a1"},
+		{"number plus string", "1 + '1'", "11"},
+		{"string never equals number", "'2' == 2", false},
+		{"membership", "x in (1, 2, 3)", true},
+		{"string membership among numbers", "'3' in (1, 2, 3)", false},
+		{"regex match", "s =~ 'b'", true},
+		{"regex not match", "s !~ '^b'", true},
+		{"ternary string", "x > 1 ? 'big' : 'small'", "big"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, trace, err := Explain(c.expression, Standard, parameters)
+			if err != nil {
+				t.Fatalf("Explain(%q) failed: %v", c.expression, err)
+			}
+			if got != c.want {
+				t.Errorf("Explain(%q) = %#v, want %#v", c.expression, got, c.want)
+			}
+			if trace == nil || trace.Value != got {
+				t.Errorf("Explain(%q) trace value = %#v, want %#v", c.expression, trace, got)
+			}
+		})
+	}
+}
+
+func TestExplainErrorsMatchGovaluate(t *testing.T) {
+	for _, expression := range []string{
+		"missing + 1",
+		"getByLabel(1, 'name')",
+	} {
+		_, _, err := Explain(expression, Standard, map[string]interface{}{})
+		if err == nil {
+			t.Errorf("Explain(%q) succeeded, want an error", expression)
+		}
+		var mismatch *MismatchError
+		if errors.As(err, &mismatch) {
+			t.Errorf("Explain(%q) disagrees with govaluate: %v", expression, err)
+		}
+	}
+}
+
+func TestExplainReportsMismatch(t *testing.T) {
+	// a function that returns something else on every call makes the two
+	// evaluations differ
+	calls := 0
+	set := FunctionSet{
+		Name: "counter",
+		Functions: map[string]govaluate.ExpressionFunction{
+			"next": func(args ...interface{}) (interface{}, error) {
+				calls++
+				return float64(calls), nil
+			},
+		},
+	}
+
+	_, trace, err := Explain("next() + 1", set, nil)
+	var mismatch *MismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Explain err = %v, want a *MismatchError", err)
+	}
+	if mismatch.Explained != 2.0 || mismatch.Evaluated != 3.0 {
+		t.Errorf("mismatch = %+v, want explained 2 and evaluated 3", mismatch)
+	}
+	if trace == nil {
+		t.Error("trace is nil on mismatch")
+	}
+}
@@ -0,0 +1,12 @@
+// Package evaluator evaluates govaluate expressions with a standard library of
+// label, string, numeric and time functions.
+package evaluator
+
+import (
+	"github.com/Knetic/govaluate"
+)
+
+// New parses expression with the standard functions.
+func New(expression string) (*govaluate.EvaluableExpression, error) {
+	return govaluate.NewEvaluableExpressionWithFunctions(expression, Functions())
+}
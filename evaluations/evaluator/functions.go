@@ -0,0 +1,355 @@
+package evaluator
+
+import (
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Knetic/govaluate"
+)
+
+// Labeled is implemented by values whose labels can be read by the label functions.
+type Labeled interface {
+	GetLabel(name string) (string, bool)
+}
+
+// Functions returns the standard function library. Every function checks the
+// number and the types of its arguments and returns an *ArgCountError,
+// *ArgTypeError or *ArgValueError instead of panicking.
+//
+// Label functions accept a Labeled value or a map[string]string:
+//
+//	getByLabel(result, 'name')           value of a label, '' if missing
+//	hasLabel(result, 'name')             whether a label is set
+//
+// String functions:
+//
+//	match('^asi_.*', name)               regular expression match
+//	stringInSlice(s, 'a,b,c')            s is in a list
+//	stringNotInSlice(s, 'a,b,c')         s is not in a list
+//
+// Lists are comma separated strings or array literals such as ('a', 'b').
+// Numeric functions:
+//
+//	abs(x), floor(x), ceil(x), round(x), min(x, ...), max(x, ...)
+//
+// Time functions, with times in unix seconds and durations in seconds:
+//
+//	now(), since(t), parseTime('2006-01-02T15:04:05Z'), duration('5m')
+func Functions() map[string]govaluate.ExpressionFunction {
+	return map[string]govaluate.ExpressionFunction{
+		"getByLabel":       getByLabel,
+		"hasLabel":         hasLabel,
+		"match":            match,
+		"stringInSlice":    stringInSlice,
+		"stringNotInSlice": stringNotInSlice,
+		"abs":              unary("abs", math.Abs),
+		"floor":            unary("floor", math.Floor),
+		"ceil":             unary("ceil", math.Ceil),
+		"round":            unary("round", math.Round),
+		"min":              fold("min", math.Min),
+		"max":              fold("max", math.Max),
+		"now":              now,
+		"since":            since,
+		"parseTime":        parseTime,
+		"duration":         duration,
+	}
+}
+
+// Signatures returns the signatures of the standard functions.
+func Signatures() map[string]Signature {
+	labeled := Type{Kind: LabeledType}
+	number := func(n int) Signature {
+		args := make([]Type, n)
+		for i := range args {
+			args[i] = numberType
+		}
+		return Signature{Args: args, Result: numberType}
+	}
+
+	return map[string]Signature{
+		"getByLabel":       {Args: []Type{labeled, stringType}, Result: stringType},
+		"hasLabel":         {Args: []Type{labeled, stringType}, Result: boolType},
+		"match":            {Args: []Type{stringType, stringType}, Result: boolType},
+		"stringInSlice":    {Args: []Type{stringType, anyType}, Result: boolType},
+		"stringNotInSlice": {Args: []Type{stringType, anyType}, Result: boolType},
+		"abs":              number(1),
+		"floor":            number(1),
+		"ceil":             number(1),
+		"round":            number(1),
+		"min":              {Args: []Type{numberType, numberType}, Variadic: true, Result: numberType},
+		"max":              {Args: []Type{numberType, numberType}, Variadic: true, Result: numberType},
+		"now":              number(0),
+		"since":            number(1),
+		"parseTime":        {Args: []Type{stringType}, Result: numberType},
+		"duration":         {Args: []Type{stringType}, Result: numberType},
+	}
+}
+
+func getByLabel(args ...interface{}) (interface{}, error) {
+	value, _, err := label("getByLabel", args)
+	return value, err
+}
+
+func hasLabel(args ...interface{}) (interface{}, error) {
+	_, exist, err := label("hasLabel", args)
+	return exist, err
+}
+
+func label(fn string, args []interface{}) (string, bool, error) {
+	if err := argCount(fn, args, 2, 2); err != nil {
+		return "", false, err
+	}
+
+	name, err := stringArg(fn, args, 1)
+	if err != nil {
+		return "", false, err
+	}
+
+	switch obj := args[0].(type) {
+	case Labeled:
+		value, exist := obj.GetLabel(name)
+		return value, exist, nil
+	case map[string]string:
+		value, exist := obj[name]
+		return value, exist, nil
+	}
+
+	return "", false, &ArgTypeError{Func: fn, Index: 0, Want: "a labeled value", Got: args[0]}
+}
+
+// regexpCacheSize bounds the patterns of match kept compiled. Patterns are
+// usually literals, but may come from labels or parameters.
+const regexpCacheSize = 256
+
+// regexps caches the most recently used patterns of match.
+var regexps = struct {
+	sync.Mutex
+	lru *lru
+}{lru: newLRU(regexpCacheSize)}
+
+// compileRegexp returns the compiled pattern, from the cache if it's there.
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	regexps.Lock()
+	re, ok := regexps.lru.get(pattern)
+	regexps.Unlock()
+	if ok {
+		return re.(*regexp.Regexp), nil
+	}
+
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	regexps.Lock()
+	defer regexps.Unlock()
+	if _, ok := regexps.lru.get(pattern); !ok {
+		regexps.lru.add(pattern, compiled)
+	}
+	return compiled, nil
+}
+
+func match(args ...interface{}) (interface{}, error) {
+	if err := argCount("match", args, 2, 2); err != nil {
+		return nil, err
+	}
+
+	pattern, err := stringArg("match", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	s, err := stringArg("match", args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	re, err := compileRegexp(pattern)
+	if err != nil {
+		return nil, &ArgValueError{Func: "match", Index: 0, Err: err}
+	}
+
+	return re.MatchString(s), nil
+}
+
+func stringInSlice(args ...interface{}) (interface{}, error) {
+	return inSlice("stringInSlice", args)
+}
+
+func stringNotInSlice(args ...interface{}) (interface{}, error) {
+	in, err := inSlice("stringNotInSlice", args)
+	if err != nil {
+		return nil, err
+	}
+	return !in, nil
+}
+
+func inSlice(fn string, args []interface{}) (bool, error) {
+	if err := argCount(fn, args, 2, 2); err != nil {
+		return false, err
+	}
+
+	s, err := stringArg(fn, args, 0)
+	if err != nil {
+		return false, err
+	}
+
+	switch list := args[1].(type) {
+	case string:
+		for _, d := range strings.Split(list, ",") {
+			if s == d {
+				return true, nil
+			}
+		}
+		return false, nil
+	case []interface{}:
+		for _, d := range list {
+			if s == d {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	return false, &ArgTypeError{Func: fn, Index: 1, Want: "a list", Got: args[1]}
+}
+
+func unary(fn string, f func(float64) float64) govaluate.ExpressionFunction {
+	return func(args ...interface{}) (interface{}, error) {
+		if err := argCount(fn, args, 1, 1); err != nil {
+			return nil, err
+		}
+
+		x, err := numberArg(fn, args, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		return f(x), nil
+	}
+}
+
+func fold(fn string, f func(float64, float64) float64) govaluate.ExpressionFunction {
+	return func(args ...interface{}) (interface{}, error) {
+		if err := argCount(fn, args, 1, -1); err != nil {
+			return nil, err
+		}
+
+		result, err := numberArg(fn, args, 0)
+		if err != nil {
+			return nil, err
+		}
+		for i := 1; i < len(args); i++ {
+			x, err := numberArg(fn, args, i)
+			if err != nil {
+				return nil, err
+			}
+			result = f(result, x)
+		}
+
+		return result, nil
+	}
+}
+
+func now(args ...interface{}) (interface{}, error) {
+	if err := argCount("now", args, 0, 0); err != nil {
+		return nil, err
+	}
+
+	return unixSeconds(time.Now()), nil
+}
+
+func since(args ...interface{}) (interface{}, error) {
+	if err := argCount("since", args, 1, 1); err != nil {
+		return nil, err
+	}
+
+	t, err := numberArg("since", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return unixSeconds(time.Now()) - t, nil
+}
+
+func parseTime(args ...interface{}) (interface{}, error) {
+	if err := argCount("parseTime", args, 1, 1); err != nil {
+		return nil, err
+	}
+
+	s, err := stringArg("parseTime", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, &ArgValueError{Func: "parseTime", Index: 0, Err: err}
+	}
+
+	return unixSeconds(t), nil
+}
+
+func duration(args ...interface{}) (interface{}, error) {
+	if err := argCount("duration", args, 1, 1); err != nil {
+		return nil, err
+	}
+
+	s, err := stringArg("duration", args, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return nil, &ArgValueError{Func: "duration", Index: 0, Err: err}
+	}
+
+	return d.Seconds(), nil
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// argCount checks that fn got between min and max arguments, max < 0 meaning no limit.
+func argCount(fn string, args []interface{}, min, max int) error {
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		return &ArgCountError{Func: fn, Min: min, Max: max, Got: len(args)}
+	}
+	return nil
+}
+
+func stringArg(fn string, args []interface{}, i int) (string, error) {
+	s, ok := args[i].(string)
+	if !ok {
+		return "", &ArgTypeError{Func: fn, Index: i, Want: "a string", Got: args[i]}
+	}
+	return s, nil
+}
+
+// numberArg returns the i-th argument as float64, the type govaluate uses for
+// all numeric literals.
+func numberArg(fn string, args []interface{}, i int) (float64, error) {
+	switch x := args[i].(type) {
+	case float64:
+		return x, nil
+	case float32:
+		return float64(x), nil
+	case int:
+		return float64(x), nil
+	case int32:
+		return float64(x), nil
+	case int64:
+		return float64(x), nil
+	case uint:
+		return float64(x), nil
+	case uint32:
+		return float64(x), nil
+	case uint64:
+		return float64(x), nil
+	}
+	return 0, &ArgTypeError{Func: fn, Index: i, Want: "a number", Got: args[i]}
+}
@@ -0,0 +1,168 @@
+package evaluator
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+type labeledValue map[string]string
+
+func (l labeledValue) GetLabel(name string) (string, bool) {
+	value, exist := l[name]
+	return value, exist
+}
+
+func TestFunctions(t *testing.T) {
+	functions := Functions()
+	labels := map[string]string{"name": "test", "empty": ""}
+
+	cases := []struct {
+		fn   string
+		args []interface{}
+		want interface{}
+	}{
+		{"getByLabel", []interface{}{labels, "name"}, "test"},
+		{"getByLabel", []interface{}{labels, "nope"}, ""},
+		{"getByLabel", []interface{}{labeledValue(labels), "name"}, "test"},
+		{"hasLabel", []interface{}{labels, "empty"}, true},
+		{"hasLabel", []interface{}{labeledValue(labels), "nope"}, false},
+		{"match", []interface{}{"^asi_", "asi_sh"}, true},
+		{"match", []interface{}{"^asi_", "sh_asi_"}, false},
+		{"stringInSlice", []interface{}{"b", "a,b,c"}, true},
+		{"stringInSlice", []interface{}{"d", []interface{}{"a", "b"}}, false},
+		{"stringNotInSlice", []interface{}{"d", "a,b,c"}, true},
+		{"stringNotInSlice", []interface{}{"a", []interface{}{"a", "b"}}, false},
+		{"abs", []interface{}{-1.5}, 1.5},
+		{"floor", []interface{}{int64(-3)}, -3.0},
+		{"ceil", []interface{}{float32(1.5)}, 2.0},
+		{"round", []interface{}{uint(2)}, 2.0},
+		{"min", []interface{}{3.0, 1, int32(2)}, 1.0},
+		{"max", []interface{}{3.0}, 3.0},
+		{"max", []interface{}{3.0, uint64(5), uint32(4)}, 5.0},
+		{"parseTime", []interface{}{"1970-01-01T00:01:00Z"}, 60.0},
+		{"duration", []interface{}{"1m30s"}, 90.0},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%s%v", c.fn, c.args), func(t *testing.T) {
+			got, err := functions[c.fn](c.args...)
+			if err != nil {
+				t.Fatalf("%s failed: %v", c.fn, err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("%s = %#v, want %#v", c.fn, got, c.want)
+			}
+		})
+	}
+}
+
+func TestFunctionErrors(t *testing.T) {
+	functions := Functions()
+	labels := map[string]string{}
+
+	cases := []struct {
+		fn   string
+		args []interface{}
+		// want is the *ArgCountError, *ArgTypeError or *ArgValueError the
+		// function returns, with the Err of ArgValueError left out
+		want error
+		msg  string
+	}{
+		// argument counts
+		{"getByLabel", []interface{}{labels}, &ArgCountError{Func: "getByLabel", Min: 2, Max: 2, Got: 1}, "getByLabel: expected 2 arguments, got 1"},
+		{"hasLabel", []interface{}{labels, "a", "b"}, &ArgCountError{Func: "hasLabel", Min: 2, Max: 2, Got: 3}, "hasLabel: expected 2 arguments, got 3"},
+		{"match", nil, &ArgCountError{Func: "match", Min: 2, Max: 2, Got: 0}, "match: expected 2 arguments, got 0"},
+		{"stringInSlice", []interface{}{"a"}, &ArgCountError{Func: "stringInSlice", Min: 2, Max: 2, Got: 1}, "stringInSlice: expected 2 arguments, got 1"},
+		{"stringNotInSlice", []interface{}{"a"}, &ArgCountError{Func: "stringNotInSlice", Min: 2, Max: 2, Got: 1}, "stringNotInSlice: expected 2 arguments, got 1"},
+		{"abs", nil, &ArgCountError{Func: "abs", Min: 1, Max: 1, Got: 0}, "abs: expected 1 arguments, got 0"},
+		{"round", []interface{}{1.0, 2.0}, &ArgCountError{Func: "round", Min: 1, Max: 1, Got: 2}, "round: expected 1 arguments, got 2"},
+		{"min", nil, &ArgCountError{Func: "min", Min: 1, Max: -1, Got: 0}, "min: expected at least 1 arguments, got 0"},
+		{"now", []interface{}{1.0}, &ArgCountError{Func: "now", Min: 0, Max: 0, Got: 1}, "now: expected 0 arguments, got 1"},
+		{"since", nil, &ArgCountError{Func: "since", Min: 1, Max: 1, Got: 0}, "since: expected 1 arguments, got 0"},
+		{"parseTime", nil, &ArgCountError{Func: "parseTime", Min: 1, Max: 1, Got: 0}, "parseTime: expected 1 arguments, got 0"},
+		{"duration", []interface{}{"1s", "2s"}, &ArgCountError{Func: "duration", Min: 1, Max: 1, Got: 2}, "duration: expected 1 arguments, got 2"},
+
+		// argument types
+		{"getByLabel", []interface{}{"labels", "a"}, &ArgTypeError{Func: "getByLabel", Index: 0, Want: "a labeled value", Got: "labels"}, "getByLabel: argument 1 must be a labeled value, got string (labels)"},
+		{"hasLabel", []interface{}{map[string]int{}, "a"}, &ArgTypeError{Func: "hasLabel", Index: 0, Want: "a labeled value", Got: map[string]int{}}, "hasLabel: argument 1 must be a labeled value, got map[string]int (map[])"},
+		{"getByLabel", []interface{}{labels, 1.0}, &ArgTypeError{Func: "getByLabel", Index: 1, Want: "a string", Got: 1.0}, "getByLabel: argument 2 must be a string, got float64 (1)"},
+		{"match", []interface{}{1.0, "a"}, &ArgTypeError{Func: "match", Index: 0, Want: "a string", Got: 1.0}, "match: argument 1 must be a string, got float64 (1)"},
+		{"match", []interface{}{"a", true}, &ArgTypeError{Func: "match", Index: 1, Want: "a string", Got: true}, "match: argument 2 must be a string, got bool (true)"},
+		{"stringInSlice", []interface{}{1.0, "a"}, &ArgTypeError{Func: "stringInSlice", Index: 0, Want: "a string", Got: 1.0}, "stringInSlice: argument 1 must be a string, got float64 (1)"},
+		{"stringNotInSlice", []interface{}{"a", 1.0}, &ArgTypeError{Func: "stringNotInSlice", Index: 1, Want: "a list", Got: 1.0}, "stringNotInSlice: argument 2 must be a list, got float64 (1)"},
+		{"abs", []interface{}{"1"}, &ArgTypeError{Func: "abs", Index: 0, Want: "a number", Got: "1"}, "abs: argument 1 must be a number, got string (1)"},
+		{"max", []interface{}{1.0, 2.0, "3"}, &ArgTypeError{Func: "max", Index: 2, Want: "a number", Got: "3"}, "max: argument 3 must be a number, got string (3)"},
+		{"min", []interface{}{nil}, &ArgTypeError{Func: "min", Index: 0, Want: "a number", Got: nil}, "min: argument 1 must be a number, got <nil> (<nil>)"},
+		{"since", []interface{}{"1"}, &ArgTypeError{Func: "since", Index: 0, Want: "a number", Got: "1"}, "since: argument 1 must be a number, got string (1)"},
+		{"parseTime", []interface{}{60.0}, &ArgTypeError{Func: "parseTime", Index: 0, Want: "a string", Got: 60.0}, "parseTime: argument 1 must be a string, got float64 (60)"},
+		{"duration", []interface{}{60.0}, &ArgTypeError{Func: "duration", Index: 0, Want: "a string", Got: 60.0}, "duration: argument 1 must be a string, got float64 (60)"},
+
+		// argument values
+		{"match", []interface{}{"(", "a"}, &ArgValueError{Func: "match", Index: 0}, "match: invalid argument 1: error parsing regexp: missing closing ): `(`"},
+		{"parseTime", []interface{}{"yesterday"}, &ArgValueError{Func: "parseTime", Index: 0}, `parseTime: invalid argument 1: parsing time "yesterday" as "2006-01-02T15:04:05Z07:00": cannot parse "yesterday" as "2006"`},
+		{"duration", []interface{}{"5"}, &ArgValueError{Func: "duration", Index: 0}, `duration: invalid argument 1: time: missing unit in duration "5"`},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%s%v", c.fn, c.args), func(t *testing.T) {
+			_, err := functions[c.fn](c.args...)
+			if err == nil {
+				t.Fatalf("%s succeeded", c.fn)
+			}
+			if err.Error() != c.msg {
+				t.Errorf("err = %q, want %q", err, c.msg)
+			}
+
+			got := err
+			var valueErr *ArgValueError
+			if errors.As(err, &valueErr) {
+				if valueErr.Err == nil {
+					t.Errorf("ArgValueError without the error it wraps")
+				}
+				copied := *valueErr
+				copied.Err = nil
+				got = &copied
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("err = %#v, want %#v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestMatchCacheIsBounded(t *testing.T) {
+	match := Functions()["match"]
+
+	for i := 0; i < 2*regexpCacheSize; i++ {
+		got, err := match(fmt.Sprintf("^%d$", i), fmt.Sprint(i))
+		if err != nil || got != true {
+			t.Fatalf("match = %v, %v, want true", got, err)
+		}
+	}
+
+	regexps.Lock()
+	size := regexps.lru.len()
+	_, oldest := regexps.lru.get("^0$")
+	_, newest := regexps.lru.get(fmt.Sprintf("^%d$", 2*regexpCacheSize-1))
+	regexps.Unlock()
+
+	if size != regexpCacheSize {
+		t.Errorf("%d patterns cached, want %d", size, regexpCacheSize)
+	}
+	if oldest || !newest {
+		t.Errorf("oldest pattern cached: %v, newest: %v, want only the newest", oldest, newest)
+	}
+
+	// invalid patterns aren't cached
+	if _, err := match("(", "a"); err == nil {
+		t.Fatal("match of an invalid pattern succeeded")
+	}
+	regexps.Lock()
+	_, cached := regexps.lru.get("(")
+	regexps.Unlock()
+	if cached {
+		t.Error("invalid pattern cached")
+	}
+}
@@ -0,0 +1,316 @@
+package evaluator
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MatchType is the operator of a PromQL label matcher.
+type MatchType string
+
+const (
+	MatchEqual     MatchType = "="
+	MatchNotEqual  MatchType = "!="
+	MatchRegexp    MatchType = "=~"
+	MatchNotRegexp MatchType = "!~"
+)
+
+// Matcher is a PromQL label matcher, like name="test".
+type Matcher struct {
+	Name  string
+	Type  MatchType
+	Value string
+}
+
+func (m Matcher) String() string {
+	return m.Name + string(m.Type) + strconv.Quote(m.Value)
+}
+
+// Matches tells whether a series with labels is selected by m. Like in
+// Prometheus, missing labels have the empty value and regular expressions
+// are anchored.
+func (m Matcher) Matches(labels map[string]string) bool {
+	value := labels[m.Name]
+
+	switch m.Type {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	}
+
+	re, err := regexp.Compile("^(?:" + m.Value + ")$")
+	if err != nil {
+		return false
+	}
+	return re.MatchString(value) == (m.Type == MatchRegexp)
+}
+
+// Matchers are the matchers of a series selector, which all have to match.
+type Matchers []Matcher
+
+// Selector returns the PromQL series selector of metric with the matchers.
+func (ms Matchers) Selector(metric string) string {
+	parts := make([]string, 0, len(ms))
+	for _, m := range ms {
+		parts = append(parts, m.String())
+	}
+	return metric + "{" + strings.Join(parts, ",") + "}"
+}
+
+// Matches tells whether a series with labels is selected by all matchers.
+func (ms Matchers) Matches(labels map[string]string) bool {
+	for _, m := range ms {
+		if !m.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// TranslateError tells why a sub-expression can't be pushed down to PromQL.
+type TranslateError struct {
+	Pos    int
+	Text   string
+	Reason string
+}
+
+func (e *TranslateError) Error() string {
+	return fmt.Sprintf("column %d: %s: %s", e.Pos+1, e.Text, e.Reason)
+}
+
+// ToMatchers translates node into PromQL label matchers that select the same
+// series the expression is true for, when parameter is bound to the labels of
+// each series. The supported subset is a conjunction (&&) of
+//
+//	getByLabel(p, 'l') == 'v', != 'v', =~ 're', !~ 're' and in ('a', 'b')
+//	stringInSlice(getByLabel(p, 'l'), 'a,b') and stringNotInSlice
+//	match('re', getByLabel(p, 'l'))
+//	hasLabel(p, 'l')
+//
+// and their negations with !. Anything else returns a *TranslateError.
+//
+// Prometheus doesn't store labels with an empty value, so hasLabel(p, 'l')
+// becomes l!="". The two only differ for labels set to the empty value,
+// which hasLabel reports as set but no series selected by l!="" has.
+func ToMatchers(node *Node, parameter string) (Matchers, error) {
+	t := &translator{parameter: parameter}
+	if err := t.translate(node, false); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(t.matchers, func(i, j int) bool {
+		return t.matchers[i].Name < t.matchers[j].Name
+	})
+	return t.matchers, nil
+}
+
+type translator struct {
+	parameter string
+	matchers  Matchers
+}
+
+func (t *translator) errorf(node *Node, format string, args ...interface{}) error {
+	return &TranslateError{Pos: node.Pos, Text: node.Text, Reason: fmt.Sprintf(format, args...)}
+}
+
+func (t *translator) add(name string, typ MatchType, value string, negate bool) {
+	if negate {
+		switch typ {
+		case MatchEqual:
+			typ = MatchNotEqual
+		case MatchNotEqual:
+			typ = MatchEqual
+		case MatchRegexp:
+			typ = MatchNotRegexp
+		case MatchNotRegexp:
+			typ = MatchRegexp
+		}
+	}
+	t.matchers = append(t.matchers, Matcher{Name: name, Type: typ, Value: value})
+}
+
+func (t *translator) translate(node *Node, negate bool) error {
+	switch node.Kind {
+	case UnaryNode:
+		if node.Op != "!" {
+			return t.errorf(node, "operator %s has no label matcher", node.Op)
+		}
+		return t.translate(node.Args[0], !negate)
+
+	case BinaryNode:
+		switch node.Op {
+		case "&&":
+			if negate {
+				return t.errorf(node, "a negated conjunction is a disjunction, which a single selector can't express")
+			}
+			if err := t.translate(node.Args[0], false); err != nil {
+				return err
+			}
+			return t.translate(node.Args[1], false)
+		case "||":
+			return t.errorf(node, "a selector can't express a disjunction")
+		case "==", "!=", "=~", "!~":
+			return t.comparison(node, negate)
+		case "in":
+			return t.in(node, negate)
+		}
+		return t.errorf(node, "operator %s has no label matcher", node.Op)
+
+	case CallNode:
+		switch node.Name {
+		case "stringInSlice", "stringNotInSlice":
+			return t.inSlice(node, negate)
+		case "match":
+			return t.match(node, negate)
+		case "hasLabel":
+			if len(node.Args) != 2 || !t.isParameter(node.Args[0]) {
+				return t.errorf(node, "expected hasLabel(%s, 'label')", t.parameter)
+			}
+			name, ok := stringLiteral(node.Args[1])
+			if !ok {
+				return t.errorf(node.Args[1], "label name must be a string literal")
+			}
+			t.add(name, MatchNotEqual, "", negate)
+			return nil
+		}
+		return t.errorf(node, "function %s has no label matcher", node.Name)
+	}
+
+	return t.errorf(node, "%s is not a label condition", node.Kind)
+}
+
+func (t *translator) comparison(node *Node, negate bool) error {
+	label, value := node.Args[0], node.Args[1]
+	name, ok := t.label(label)
+	if !ok {
+		// literals may be on the left of equality comparisons
+		if name, ok = t.label(value); !ok || node.Op == "=~" || node.Op == "!~" {
+			return t.errorf(node, "only labels read with getByLabel(%s, 'label') can be pushed down", t.parameter)
+		}
+		value = label
+	}
+
+	s, ok := stringLiteral(value)
+	if !ok {
+		return t.errorf(value, "only string literals can be pushed down")
+	}
+
+	switch node.Op {
+	case "==":
+		t.add(name, MatchEqual, s, negate)
+	case "!=":
+		t.add(name, MatchNotEqual, s, negate)
+	case "=~":
+		t.add(name, MatchRegexp, unanchored(s), negate)
+	case "!~":
+		t.add(name, MatchNotRegexp, unanchored(s), negate)
+	}
+	return nil
+}
+
+func (t *translator) in(node *Node, negate bool) error {
+	name, ok := t.label(node.Args[0])
+	if !ok {
+		return t.errorf(node.Args[0], "only labels read with getByLabel(%s, 'label') can be pushed down", t.parameter)
+	}
+
+	items := []*Node{node.Args[1]}
+	if node.Args[1].Kind == ListNode {
+		items = node.Args[1].Args
+	}
+
+	values := make([]string, 0, len(items))
+	for _, item := range items {
+		s, ok := stringLiteral(item)
+		if !ok {
+			return t.errorf(item, "only string literals can be pushed down")
+		}
+		values = append(values, s)
+	}
+
+	t.add(name, MatchRegexp, alternation(values), negate)
+	return nil
+}
+
+func (t *translator) inSlice(node *Node, negate bool) error {
+	if len(node.Args) != 2 {
+		return t.errorf(node, "expected %s(getByLabel(%s, 'label'), 'a,b')", node.Name, t.parameter)
+	}
+
+	name, ok := t.label(node.Args[0])
+	if !ok {
+		return t.errorf(node.Args[0], "only labels read with getByLabel(%s, 'label') can be pushed down", t.parameter)
+	}
+	list, ok := stringLiteral(node.Args[1])
+	if !ok {
+		return t.errorf(node.Args[1], "only comma separated string literals can be pushed down")
+	}
+
+	if node.Name == "stringNotInSlice" {
+		negate = !negate
+	}
+	t.add(name, MatchRegexp, alternation(strings.Split(list, ",")), negate)
+	return nil
+}
+
+func (t *translator) match(node *Node, negate bool) error {
+	if len(node.Args) != 2 {
+		return t.errorf(node, "expected match('re', getByLabel(%s, 'label'))", t.parameter)
+	}
+
+	pattern, ok := stringLiteral(node.Args[0])
+	if !ok {
+		return t.errorf(node.Args[0], "only string literal patterns can be pushed down")
+	}
+	name, ok := t.label(node.Args[1])
+	if !ok {
+		return t.errorf(node.Args[1], "only labels read with getByLabel(%s, 'label') can be pushed down", t.parameter)
+	}
+
+	t.add(name, MatchRegexp, unanchored(pattern), negate)
+	return nil
+}
+
+// label returns the label name of getByLabel(parameter, 'name').
+func (t *translator) label(node *Node) (string, bool) {
+	if node.Kind != CallNode || node.Name != "getByLabel" || len(node.Args) != 2 || !t.isParameter(node.Args[0]) {
+		return "", false
+	}
+	return stringLiteral(node.Args[1])
+}
+
+func (t *translator) isParameter(node *Node) bool {
+	return node.Kind == VariableNode && node.Name == t.parameter
+}
+
+func stringLiteral(node *Node) (string, bool) {
+	if node.Kind != LiteralNode {
+		return "", false
+	}
+	switch v := node.Value.(type) {
+	case string:
+		return v, true
+	case *regexp.Regexp:
+		// right sides of =~ are compiled by govaluate
+		return v.String(), true
+	}
+	return "", false
+}
+
+// unanchored turns a pattern matched anywhere in a value, as by govaluate,
+// into a PromQL pattern, which must match the whole value.
+func unanchored(pattern string) string {
+	return "(?s:.*)(?:" + pattern + ")(?s:.*)"
+}
+
+func alternation(values []string) string {
+	quoted := make([]string, 0, len(values))
+	for _, v := range values {
+		quoted = append(quoted, regexp.QuoteMeta(v))
+	}
+	return strings.Join(quoted, "|")
+}
@@ -0,0 +1,115 @@
+package evaluator
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+// labelSet generates random labels of a series, drawing from few values so
+// that expressions match some of them. Like in Prometheus, no label has the
+// empty value.
+type labelSet map[string]string
+
+func (labelSet) Generate(r *rand.Rand, size int) reflect.Value {
+	values := map[string][]string{
+		"name":    {"test", "prod", "test-1"},
+		"cluster": {"asi_zjk_core_b", "asi_sh_flink_h01", "asi_sh_flink_a01"},
+		"env":     {"dev", "staging"},
+	}
+
+	ls := labelSet{}
+	for name, vs := range values {
+		// leave some labels out
+		if i := r.Intn(len(vs) + 1); i < len(vs) {
+			ls[name] = vs[i]
+		}
+	}
+	return reflect.ValueOf(ls)
+}
+
+func TestToMatchersAgreesWithEvaluator(t *testing.T) {
+	for _, expression := range []string{
+		"getByLabel(result, 'name') == 'test' && stringNotInSlice(getByLabel(result, 'cluster'), 'asi_sh_flink_h01,asi_sh_flink_a01')",
+		"getByLabel(result, 'name') =~ '^test' && ! hasLabel(result, 'env') && getByLabel(result, 'cluster') in ('asi_zjk_core_b', 'asi_sh_flink_h01')",
+		"! match('flink', getByLabel(result, 'cluster')) && 'dev' != getByLabel(result, 'env')",
+		"hasLabel(result, 'name') && getByLabel(result, 'name') !~ 'test.*'",
+		"stringInSlice(getByLabel(result, 'env'), 'dev')",
+	} {
+		node, err := Parse(expression, Standard)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", expression, err)
+		}
+		matchers, err := ToMatchers(node, "result")
+		if err != nil {
+			t.Fatalf("ToMatchers(%q) failed: %v", expression, err)
+		}
+		expr, err := New(expression)
+		if err != nil {
+			t.Fatalf("New(%q) failed: %v", expression, err)
+		}
+
+		// the matchers select the series the expression is true for
+		agree := func(ls labelSet) bool {
+			inMemory, err := expr.Evaluate(map[string]interface{}{
+				"result": map[string]string(ls),
+			})
+			return err == nil && inMemory == matchers.Matches(ls)
+		}
+		if err := quick.Check(agree, &quick.Config{MaxCount: 1000}); err != nil {
+			t.Fatalf("%s: %s and the evaluator differ: %v", expression, matchers.Selector("m"), err)
+		}
+	}
+}
+
+func TestToMatchersUnsupported(t *testing.T) {
+	for _, expression := range []string{
+		"getByLabel(result, 'name') == 'test' || getByLabel(result, 'env') == 'dev'",
+		"getByLabel(other, 'name') == 'test'",
+		"getByLabel(result, 'name') == getByLabel(result, 'env')",
+	} {
+		node, err := Parse(expression, Standard)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", expression, err)
+		}
+		if _, err := ToMatchers(node, "result"); err == nil {
+			t.Fatalf("ToMatchers(%q) succeeded, want a *TranslateError", expression)
+		} else if _, ok := err.(*TranslateError); !ok {
+			t.Fatalf("ToMatchers(%q) err = %v, want a *TranslateError", expression, err)
+		}
+	}
+}
+
+// TestHasLabelEmptyValue pins down the documented difference of hasLabel:
+// a label set to the empty value is set for the evaluator, but not for
+// Prometheus, which doesn't store such labels.
+func TestHasLabelEmptyValue(t *testing.T) {
+	node, err := Parse("hasLabel(result, 'env')", Standard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matchers, err := ToMatchers(node, "result")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := matchers.Selector("m"); got != `m{env!=""}` {
+		t.Fatalf("Selector = %s, want m{env!=\"\"}", got)
+	}
+
+	expr, err := New("hasLabel(result, 'env')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]string{"env": ""}
+	inMemory, err := expr.Evaluate(map[string]interface{}{"result": labels})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inMemory != true {
+		t.Fatalf("hasLabel of an empty label = %v, want true", inMemory)
+	}
+	if matchers.Matches(labels) {
+		t.Fatal("env!=\"\" matches an empty label, which Prometheus never stores")
+	}
+}
@@ -0,0 +1,156 @@
+package evaluator
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/Knetic/govaluate"
+)
+
+// FunctionSet is a named set of expression functions. Expressions compiled
+// with sets of the same name share registry entries, so a name must always
+// denote the same functions.
+type FunctionSet struct {
+	Name      string
+	Functions map[string]govaluate.ExpressionFunction
+	// Signatures are used by Check, functions without one are not checked.
+	Signatures map[string]Signature
+}
+
+// Standard is the set of the standard functions returned by Functions.
+var Standard = FunctionSet{
+	Name:       "standard",
+	Functions:  Functions(),
+	Signatures: Signatures(),
+}
+
+// Stats are the counters of a Registry.
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Size      int
+}
+
+type registryKey struct {
+	set        string
+	expression string
+}
+
+// lru holds up to capacity values, evicting the least recently used one. It
+// isn't safe for concurrent use.
+type lru struct {
+	capacity int
+	list     *list.List
+	entries  map[interface{}]*list.Element
+}
+
+type lruEntry struct {
+	key   interface{}
+	value interface{}
+}
+
+func newLRU(capacity int) *lru {
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	return &lru{
+		capacity: capacity,
+		list:     list.New(),
+		entries:  make(map[interface{}]*list.Element),
+	}
+}
+
+// get returns the value of key and marks it as the most recently used.
+func (c *lru) get(key interface{}) (interface{}, bool) {
+	elem, exist := c.entries[key]
+	if !exist {
+		return nil, false
+	}
+	c.list.MoveToFront(elem)
+	return elem.Value.(*lruEntry).value, true
+}
+
+// add adds the value of key, which must not be held yet, and returns the
+// number of values evicted.
+func (c *lru) add(key, value interface{}) (evicted int) {
+	c.entries[key] = c.list.PushFront(&lruEntry{key: key, value: value})
+	for c.list.Len() > c.capacity {
+		oldest := c.list.Back()
+		c.list.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+		evicted++
+	}
+	return evicted
+}
+
+func (c *lru) len() int {
+	return c.list.Len()
+}
+
+// Registry compiles expressions once and keeps the most recently used ones.
+// It is safe for concurrent use, and so are the expressions it returns.
+type Registry struct {
+	mu    sync.Mutex
+	lru   *lru
+	stats Stats
+}
+
+// NewRegistry returns a registry holding up to capacity expressions.
+func NewRegistry(capacity int) *Registry {
+	return &Registry{lru: newLRU(capacity)}
+}
+
+// Compile returns the expression compiled with the functions of set, parsing
+// it only if it isn't registered yet. Expressions that fail to parse are not
+// registered.
+func (r *Registry) Compile(expression string, set FunctionSet) (*govaluate.EvaluableExpression, error) {
+	key := registryKey{set: set.Name, expression: expression}
+
+	r.mu.Lock()
+	if expr, exist := r.lru.get(key); exist {
+		r.stats.Hits++
+		r.mu.Unlock()
+		return expr.(*govaluate.EvaluableExpression), nil
+	}
+	r.stats.Misses++
+	r.mu.Unlock()
+
+	// parse without holding the lock, a concurrent miss of the same key
+	// parses it again and the one registered first is kept
+	expr, err := govaluate.NewEvaluableExpressionWithFunctions(expression, set.Functions)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if registered, exist := r.lru.get(key); exist {
+		return registered.(*govaluate.EvaluableExpression), nil
+	}
+	r.stats.Evictions += uint64(r.lru.add(key, expr))
+
+	return expr, nil
+}
+
+// Evaluate compiles expression with set and evaluates it with parameters.
+func (r *Registry) Evaluate(expression string, set FunctionSet, parameters map[string]interface{}) (interface{}, error) {
+	expr, err := r.Compile(expression, set)
+	if err != nil {
+		return nil, err
+	}
+
+	return expr.Evaluate(parameters)
+}
+
+// Stats returns the current counters of the registry.
+func (r *Registry) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := r.stats
+	stats.Size = r.lru.len()
+	return stats
+}
@@ -0,0 +1,199 @@
+package evaluator
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/Knetic/govaluate"
+)
+
+const routingExpression = "getByLabel(result, 'name') == 'test' && stringNotInSlice(getByLabel(result, 'cluster'), 'asi_sh_flink_h01,asi_sh_flink_a01')"
+
+var routingParameters = map[string]interface{}{
+	"result": map[string]string{
+		"name":    "test",
+		"cluster": "asi_zjk_core_b",
+	},
+}
+
+// constantSet returns a set named name whose function f returns value.
+func constantSet(name string, value float64) FunctionSet {
+	return FunctionSet{
+		Name: name,
+		Functions: map[string]govaluate.ExpressionFunction{
+			"f": func(args ...interface{}) (interface{}, error) { return value, nil },
+		},
+	}
+}
+
+func TestRegistryHitsAndMisses(t *testing.T) {
+	registry := NewRegistry(8)
+
+	first, err := registry.Compile(routingExpression, Standard)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	second, err := registry.Compile(routingExpression, Standard)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	if first != second {
+		t.Errorf("Compile of a registered expression parsed it again")
+	}
+
+	got, err := registry.Evaluate(routingExpression, Standard, routingParameters)
+	if err != nil {
+		t.Fatalf("Evaluate failed: %v", err)
+	}
+	if got != true {
+		t.Errorf("Evaluate = %v, want true", got)
+	}
+
+	if stats, want := registry.Stats(), (Stats{Hits: 2, Misses: 1, Size: 1}); stats != want {
+		t.Errorf("Stats = %+v, want %+v", stats, want)
+	}
+}
+
+func TestRegistryKeying(t *testing.T) {
+	registry := NewRegistry(8)
+
+	cases := []struct {
+		name       string
+		expression string
+		set        FunctionSet
+		want       float64
+		hit        bool
+	}{
+		{"first", "f() + 1", constantSet("one", 1), 2, false},
+		{"same text and set", "f() + 1", constantSet("one", 1), 2, true},
+		{"other set", "f() + 1", constantSet("two", 2), 3, false},
+		{"other text", "f() + 2", constantSet("one", 1), 3, false},
+		{"other spacing", "f()+1", constantSet("one", 1), 2, false},
+		// the name is the key, a set must always denote the same functions
+		{"same name, other functions", "f() + 1", constantSet("two", 20), 3, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			before := registry.Stats()
+			got, err := registry.Evaluate(c.expression, c.set, nil)
+			if err != nil {
+				t.Fatalf("Evaluate failed: %v", err)
+			}
+			if got != c.want {
+				t.Errorf("Evaluate = %v, want %v", got, c.want)
+			}
+			if hit := registry.Stats().Hits > before.Hits; hit != c.hit {
+				t.Errorf("hit = %v, want %v", hit, c.hit)
+			}
+		})
+	}
+
+	if stats := registry.Stats(); stats.Size != 4 {
+		t.Errorf("Size = %d, want 4", stats.Size)
+	}
+}
+
+func TestRegistryEvictsLeastRecentlyUsed(t *testing.T) {
+	registry := NewRegistry(2)
+
+	steps := []struct {
+		expression string
+		hit        bool
+	}{
+		{"1 + 1", false},
+		{"2 + 2", false},
+		// 1 + 1 is used again, so 2 + 2 is the oldest
+		{"1 + 1", true},
+		{"3 + 3", false},
+		{"1 + 1", true},
+		{"2 + 2", false},
+		// 3 + 3 was evicted by 2 + 2, and evicts 1 + 1
+		{"3 + 3", false},
+		{"1 + 1", false},
+		{"3 + 3", true},
+	}
+
+	for i, step := range steps {
+		before := registry.Stats()
+		if _, err := registry.Compile(step.expression, Standard); err != nil {
+			t.Fatalf("step %d: Compile failed: %v", i, err)
+		}
+		if hit := registry.Stats().Hits > before.Hits; hit != step.hit {
+			t.Errorf("step %d: hit of %s = %v, want %v", i, step.expression, hit, step.hit)
+		}
+	}
+
+	if stats, want := registry.Stats(), (Stats{Hits: 3, Misses: 6, Evictions: 4, Size: 2}); stats != want {
+		t.Errorf("Stats = %+v, want %+v", stats, want)
+	}
+}
+
+func TestRegistryDoesNotRegisterErrors(t *testing.T) {
+	registry := NewRegistry(0)
+
+	for i := 0; i < 2; i++ {
+		if _, err := registry.Compile("1 +", Standard); err == nil {
+			t.Fatal("Compile of an invalid expression succeeded")
+		}
+	}
+	if _, err := registry.Compile("1 + 1", Standard); err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	if _, err := registry.Compile("2 + 2", Standard); err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+
+	// a capacity below 1 holds one expression
+	if stats, want := registry.Stats(), (Stats{Misses: 4, Evictions: 1, Size: 1}); stats != want {
+		t.Errorf("Stats = %+v, want %+v", stats, want)
+	}
+}
+
+func TestRegistryConcurrent(t *testing.T) {
+	registry := NewRegistry(2)
+	expressions := []string{"1 + 1", "2 + 2", "3 + 3"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := registry.Evaluate(expressions[(i+j)%len(expressions)], Standard, nil); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	stats := registry.Stats()
+	if stats.Hits+stats.Misses != 800 || stats.Size != 2 {
+		t.Errorf("Stats = %+v, want 800 lookups and 2 expressions", stats)
+	}
+}
+
+func BenchmarkRegistryUncached(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		expr, err := New(routingExpression)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := expr.Evaluate(routingParameters); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRegistryCached(b *testing.B) {
+	registry := NewRegistry(512)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := registry.Evaluate(routingExpression, Standard, routingParameters); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
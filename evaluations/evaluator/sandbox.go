@@ -0,0 +1,154 @@
+package evaluator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+var (
+	// ErrStepLimit is returned when an evaluation exceeds Policy.MaxSteps.
+	ErrStepLimit = errors.New("evaluation step limit exceeded")
+	// ErrTimeout is returned when an evaluation exceeds Policy.Timeout.
+	ErrTimeout = errors.New("evaluation timed out")
+)
+
+// PolicyError is returned when an expression does something its policy denies.
+type PolicyError struct {
+	Text string
+	Msg  string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Text, e.Msg)
+}
+
+// Policy restricts what untrusted expressions may do. Functions, and fields
+// and methods of parameters, are denied unless they are listed.
+type Policy struct {
+	// Fields are the fields that may be read, by struct type.
+	Fields map[reflect.Type][]string
+	// Methods are the methods that may be called, by struct type.
+	Methods map[reflect.Type][]string
+	// Functions are the functions of the set that may be called, none of
+	// them if nil.
+	Functions []string
+	// MaxSteps bounds the number of sub-expressions evaluated, unlimited if zero.
+	MaxSteps int
+	// Timeout bounds the duration of an evaluation, unlimited if zero. It is
+	// checked between sub-expressions, so a slow function call isn't interrupted.
+	Timeout time.Duration
+}
+
+func allowed(allowlist map[reflect.Type][]string, t reflect.Type, name string) bool {
+	for _, n := range allowlist[t] {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// limits tracks the budget of one evaluation.
+type limits struct {
+	policy *Policy
+	ctx    context.Context
+	steps  int
+}
+
+func (l *limits) step() error {
+	l.steps++
+	if l.policy.MaxSteps > 0 && l.steps > l.policy.MaxSteps {
+		return ErrStepLimit
+	}
+
+	select {
+	case <-l.ctx.Done():
+		if l.ctx.Err() == context.DeadlineExceeded {
+			return ErrTimeout
+		}
+		return l.ctx.Err()
+	default:
+	}
+	return nil
+}
+
+// Sandbox compiles expressions that are evaluated under a policy.
+type Sandbox struct {
+	set    FunctionSet
+	policy Policy
+}
+
+// NewSandbox returns a sandbox for expressions using the functions of set.
+func NewSandbox(set FunctionSet, policy Policy) *Sandbox {
+	return &Sandbox{set: set, policy: policy}
+}
+
+// SandboxedExpression is an expression that is evaluated under a policy.
+type SandboxedExpression struct {
+	sandbox *Sandbox
+	node    *Node
+}
+
+// Compile parses expression and checks that it only calls allowed functions.
+func (s *Sandbox) Compile(expression string) (*SandboxedExpression, error) {
+	node, err := Parse(expression, s.set)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.checkFunctions(node); err != nil {
+		return nil, err
+	}
+
+	return &SandboxedExpression{sandbox: s, node: node}, nil
+}
+
+func (s *Sandbox) checkFunctions(node *Node) error {
+	if node == nil {
+		return nil
+	}
+
+	if node.Kind == CallNode {
+		allowed := false
+		for _, name := range s.policy.Functions {
+			if name == node.Name {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &PolicyError{Text: node.Text, Msg: fmt.Sprintf("function %s is not allowed", node.Name)}
+		}
+	}
+
+	for _, arg := range node.Args {
+		if err := s.checkFunctions(arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Evaluate evaluates the expression with parameters. It stops with
+// ErrStepLimit, ErrTimeout or the error of ctx once a limit is reached, and
+// with a *PolicyError when a denied field or method is accessed.
+func (e *SandboxedExpression) Evaluate(ctx context.Context, parameters map[string]interface{}) (interface{}, error) {
+	policy := &e.sandbox.policy
+	if policy.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.Timeout)
+		defer cancel()
+	}
+
+	in := &interpreter{
+		functions:  e.sandbox.set,
+		parameters: parameters,
+		limits:     &limits{policy: policy, ctx: ctx},
+	}
+
+	value, _, err := in.eval(e.node)
+	return value, err
+}
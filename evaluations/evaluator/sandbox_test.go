@@ -0,0 +1,54 @@
+package evaluator
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Knetic/govaluate"
+)
+
+func TestSandboxDeniesUnlistedFunctions(t *testing.T) {
+	for _, functions := range [][]string{nil, {"stringInSlice"}} {
+		sandbox := NewSandbox(Standard, Policy{Functions: functions})
+		_, err := sandbox.Compile("getByLabel(result, 'name') == 'test'")
+		var policyErr *PolicyError
+		if !errors.As(err, &policyErr) {
+			t.Errorf("Compile with functions %v: err = %v, want a *PolicyError", functions, err)
+		}
+	}
+
+	sandbox := NewSandbox(Standard, Policy{Functions: []string{"getByLabel"}})
+	expr, err := sandbox.Compile("getByLabel(result, 'name') == 'test'")
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	got, err := expr.Evaluate(context.Background(), map[string]interface{}{
+		"result": map[string]string{"name": "test"},
+	})
+	if err != nil || got != true {
+		t.Errorf("Evaluate = %v, %v, want true", got, err)
+	}
+}
+
+func TestSandboxRecoversFunctionPanics(t *testing.T) {
+	set := FunctionSet{
+		Name: "panicking",
+		Functions: map[string]govaluate.ExpressionFunction{
+			"boom": func(args ...interface{}) (interface{}, error) {
+				panic("boom")
+			},
+		},
+	}
+	sandbox := NewSandbox(set, Policy{Functions: []string{"boom"}})
+	expr, err := sandbox.Compile("boom() == 1")
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+
+	_, err = expr.Evaluate(context.Background(), nil)
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("Evaluate err = %v, want the recovered panic", err)
+	}
+}
@@ -0,0 +1,137 @@
+package evaluator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/Knetic/govaluate"
+)
+
+// Trace is the evaluation of a node of an expression, with the traces of the
+// nodes it evaluated.
+type Trace struct {
+	Text  string      `json:"text"`
+	Kind  string      `json:"kind"`
+	Op    string      `json:"op,omitempty"`
+	Value interface{} `json:"value"`
+	Error string      `json:"error,omitempty"`
+	// ShortCircuit is set on operators that didn't evaluate all operands.
+	ShortCircuit bool `json:"short_circuit,omitempty"`
+	// Skipped is set on operands that weren't evaluated.
+	Skipped  bool     `json:"skipped,omitempty"`
+	Children []*Trace `json:"children,omitempty"`
+}
+
+func newTrace(node *Node) *Trace {
+	return &Trace{
+		Text: node.Text,
+		Kind: node.Kind.String(),
+		Op:   node.Op,
+	}
+}
+
+func (t *Trace) setResult(value interface{}, err error) {
+	if re, ok := value.(*regexp.Regexp); ok {
+		value = re.String()
+	}
+	t.Value = value
+	if err != nil {
+		t.Error = err.Error()
+	}
+}
+
+// Explain evaluates expression with parameters like govaluate does and
+// returns the result together with the trace of every sub-expression. The
+// result is checked against govaluate's, a *MismatchError is returned with
+// the trace if they differ, or if only one of them fails.
+func Explain(expression string, set FunctionSet, parameters map[string]interface{}) (interface{}, *Trace, error) {
+	node, err := Parse(expression, set)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	in := &interpreter{functions: set, parameters: parameters, trace: true}
+	value, trace, err := in.eval(node)
+
+	expr, parseErr := govaluate.NewEvaluableExpressionWithFunctions(expression, set.Functions)
+	if parseErr != nil {
+		return nil, trace, &MismatchError{Expression: expression, Explained: value, ExplainedErr: err, EvaluatedErr: parseErr}
+	}
+	evaluated, evalErr := evaluate(expr, parameters)
+	if (err == nil) != (evalErr == nil) || (err == nil && !sameValue(value, evaluated)) {
+		return nil, trace, &MismatchError{
+			Expression:   expression,
+			Explained:    value,
+			ExplainedErr: err,
+			Evaluated:    evaluated,
+			EvaluatedErr: evalErr,
+		}
+	}
+	return value, trace, err
+}
+
+// evaluate evaluates expr, turning a panic of a function into an error like
+// the interpreter does.
+func evaluate(expr *govaluate.EvaluableExpression, parameters map[string]interface{}) (value interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			value, err = nil, fmt.Errorf("evaluate panicked: %v", r)
+		}
+	}()
+
+	return expr.Evaluate(parameters)
+}
+
+// sameValue compares results, regular expressions by their pattern.
+func sameValue(a, b interface{}) bool {
+	if re, ok := a.(*regexp.Regexp); ok {
+		a = re.String()
+	}
+	if re, ok := b.(*regexp.Regexp); ok {
+		b = re.String()
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// String renders the trace as an indented tree, one node per line.
+func (t *Trace) String() string {
+	b := &strings.Builder{}
+	t.write(b, 0)
+	return b.String()
+}
+
+func (t *Trace) write(b *strings.Builder, depth int) {
+	b.WriteString(strings.Repeat("  ", depth))
+	switch {
+	case t.Skipped:
+		fmt.Fprintf(b, "%s => skipped", t.Text)
+	case t.Error != "":
+		fmt.Fprintf(b, "%s => error: %s", t.Text, t.Error)
+	default:
+		fmt.Fprintf(b, "%s => %#v", t.Text, t.Value)
+	}
+	if t.ShortCircuit {
+		b.WriteString(" (short-circuit)")
+	}
+	b.WriteString("\n")
+
+	for _, c := range t.Children {
+		c.write(b, depth+1)
+	}
+}
+
+// JSON renders the trace as indented JSON.
+func (t *Trace) JSON() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(t); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -2,4 +2,8 @@ module github.com/fatsheep9146/go-best-practise/evaluations
 
 go 1.14
 
-require github.com/Knetic/govaluate v3.0.1-0.20171022003610-9aa49832a739+incompatible
+require (
+	github.com/Knetic/govaluate v3.0.1-0.20171022003610-9aa49832a739+incompatible
+	github.com/ghodss/yaml v1.0.0
+	gopkg.in/yaml.v2 v2.4.0 // indirect
+)
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/Knetic/govaluate"
+
+	"github.com/fatsheep9146/go-best-practise/evaluations/evaluator"
+	"github.com/fatsheep9146/go-best-practise/evaluations/rules"
 )
 
 func basicUsage() {
@@ -29,11 +38,18 @@ type Result struct {
 	Value  int
 }
 
-func getByLabel(args ...interface{}) (interface{}, error) {
-	result := args[0].(Result)
-	key := args[1].(string)
+// GetLabel implements evaluator.Labeled.
+func (r Result) GetLabel(name string) (string, bool) {
+	value, exist := r.Labels[name]
+	return value, exist
+}
 
-	return result.Labels[key], nil
+// SetLabel implements rules.Record.
+func (r *Result) SetLabel(name, value string) {
+	if r.Labels == nil {
+		r.Labels = make(map[string]string)
+	}
+	r.Labels[name] = value
 }
 
 func (r Result) Func1(key string) string {
@@ -45,11 +61,7 @@ func (r Result) Func2() string {
 }
 
 func functionUsage() {
-	functions := map[string]govaluate.ExpressionFunction{
-		"getByLabel": getByLabel,
-	}
-
-	expr, err := govaluate.NewEvaluableExpressionWithFunctions("getByLabel(result, 'name') == 'test'", functions)
+	expr, err := evaluator.New("getByLabel(result, 'name') == 'test'")
 	if err != nil {
 		fmt.Printf("govaluate.NewEvaluableExpression failed: %v\n", err)
 		return
@@ -110,59 +122,271 @@ func methodUsage() {
 	fmt.Printf("result: %v\n", result)
 }
 
-func stringInSlice(args ...interface{}) (interface{}, error) {
-	s := args[0].(string)
-	dstr := args[1].(string)
+func regUsage() {
+	expr, err := evaluator.New("(1<2) && ! stringInSlice('asi_zjk_core_b', 'asi_sh_flink_h01,asi_sh_flink_a01')")
+	if err != nil {
+		fmt.Printf("govaluate.NewEvaluableExpression failed: %v\n", err)
+		return
+	}
 
-	ds := strings.Split(dstr, ",")
+	result, err := expr.Evaluate(map[string]interface{}{
+		"foo": dummyParameterInstance,
+	})
+	if err != nil {
+		fmt.Printf("unable to evaluate expression: %v", err)
+		return
+	}
 
-	for _, d := range ds {
-		if s == d {
-			return true, nil
-		}
+	fmt.Printf("result: %v\n", result)
+}
+
+func errorUsage() {
+	expr, err := evaluator.New("getByLabel('name', result)")
+	if err != nil {
+		fmt.Printf("evaluator.New failed: %v\n", err)
+		return
 	}
 
-	return false, nil
+	// arguments are swapped, which is reported instead of panicking
+	_, err = expr.Evaluate(map[string]interface{}{
+		"result": Result{},
+	})
+	fmt.Printf("err: %v\n", err)
 }
 
-func stringNotInSlice(args ...interface{}) (interface{}, error) {
-	s := args[0].(string)
-	dstr := args[1].(string)
+const routingExpression = "getByLabel(result, 'name') == 'test' && stringNotInSlice(getByLabel(result, 'cluster'), 'asi_sh_flink_h01,asi_sh_flink_a01')"
+
+func registryUsage() {
+	registry := evaluator.NewRegistry(512)
+	parameters := map[string]interface{}{
+		"result": Result{
+			Labels: map[string]string{
+				"name":    "test",
+				"cluster": "asi_zjk_core_b",
+			},
+		},
+	}
+
+	for i := 0; i < 3; i++ {
+		matched, err := registry.Evaluate(routingExpression, evaluator.Standard, parameters)
+		fmt.Printf("matched: %v, err: %v\n", matched, err)
+	}
+	fmt.Printf("registry: %+v\n", registry.Stats())
+}
 
-	ds := strings.Split(dstr, ",")
+func batchUsage() {
+	results := []Result{
+		{Labels: map[string]string{"name": "test", "cluster": "asi_zjk_core_b"}, Value: 1},
+		{Labels: map[string]string{"name": "test", "cluster": "asi_sh_flink_h01"}, Value: 2},
+		{Labels: map[string]string{"name": "prod", "cluster": "asi_zjk_core_b"}, Value: 3},
+	}
 
-	for _, d := range ds {
-		if s == d {
-			return false, nil
+	items := make([]evaluator.Labeled, 0, len(results))
+	for _, r := range results {
+		items = append(items, r)
+	}
+	batch := evaluator.NewBatch(items)
+
+	for _, expression := range []string{
+		// answered from the label index
+		"getByLabel(result, 'name') == 'test' && getByLabel(result, 'cluster') == 'asi_zjk_core_b'",
+		// evaluated by the worker pool
+		routingExpression,
+		"getByLabel(result, 'name')",
+	} {
+		expr, err := evaluator.New(expression)
+		if err != nil {
+			fmt.Printf("evaluator.New failed: %v\n", err)
+			return
 		}
+
+		matched, errs := batch.Filter(expr)
+		fmt.Printf("%s\n  matched: %v\n  errors: %v\n", expression, matched, errs)
+	}
+}
+
+func checkUsage() {
+	schema := evaluator.Schema{
+		"result": reflect.TypeOf(Result{}),
+		"foo":    reflect.TypeOf(dummyParameter{}),
 	}
 
-	return true, nil
+	for _, expression := range []string{
+		"foo.Func() + 'hi'",
+		"getByLabel(result, 'name') == 'test'",
+		// unknown method, wrong arity, operands and undeclared variable
+		"foo.Fun() + 'hi'",
+		"getByLabel(result) == 'test' && foo.Int > 'one'",
+		"getByLabel(foo, 'name') == bar",
+	} {
+		_, err := evaluator.Compile(expression, evaluator.Standard, schema)
+		fmt.Printf("%s\n  err: %v\n", expression, err)
+	}
 }
 
-func regUsage() {
-	functions := map[string]govaluate.ExpressionFunction{
-		"stringInSlice":    stringInSlice,
-		"stringNotInSlice": stringNotInSlice,
+func explainUsage() {
+	result, trace, err := evaluator.Explain(
+		"(1>2) && ! stringInSlice('asi_zjk_core_b', 'asi_sh_flink_h01,asi_zjk_core_b') || getByLabel(result, 'name') == 'prod'",
+		evaluator.Standard,
+		map[string]interface{}{
+			"result": Result{Labels: map[string]string{"name": "test"}},
+		},
+	)
+	if err != nil {
+		fmt.Printf("evaluator.Explain failed: %v\n", err)
+		return
 	}
 
-	expr, err := govaluate.NewEvaluableExpressionWithFunctions("(1<2) && ! stringInSlice('asi_zjk_core_b', 'asi_sh_flink_h01,asi_sh_flink_a01')", functions)
+	fmt.Printf("result: %v\n%s", result, trace)
+
+	raw, err := trace.JSON()
 	if err != nil {
-		fmt.Printf("govaluate.NewEvaluableExpression failed: %v\n", err)
+		fmt.Printf("trace.JSON failed: %v\n", err)
 		return
 	}
+	fmt.Println(string(raw))
+}
 
-	result, err := expr.Evaluate(map[string]interface{}{
-		"foo": dummyParameterInstance,
+func sandboxUsage() {
+	sandbox := evaluator.NewSandbox(evaluator.Standard, evaluator.Policy{
+		Fields: map[reflect.Type][]string{
+			reflect.TypeOf(dummyParameter{}): {"String", "Int"},
+		},
+		Functions: []string{"getByLabel", "stringInSlice", "stringNotInSlice"},
+		MaxSteps:  100,
+		Timeout:   10 * time.Millisecond,
 	})
+
+	for _, expression := range []string{
+		"foo.String + 'hi'",
+		// methods are denied unless allowed
+		"foo.Func() + 'hi'",
+		"foo.BoolFalse",
+		"now() > 0",
+		"1" + strings.Repeat(" + 1", 100),
+	} {
+		expr, err := sandbox.Compile(expression)
+		if err != nil {
+			fmt.Printf("sandbox.Compile failed: %v\n", err)
+			continue
+		}
+
+		result, err := expr.Evaluate(context.Background(), map[string]interface{}{
+			"foo": dummyParameterInstance,
+		})
+		fmt.Printf("result: %v, err: %v\n", result, err)
+	}
+}
+
+func translateUsage() {
+	for _, expression := range []string{
+		"getByLabel(result, 'name') == 'test' && stringNotInSlice(getByLabel(result, 'cluster'), 'asi_sh_flink_h01,asi_sh_flink_a01')",
+		"getByLabel(result, 'name') =~ '^test' && ! hasLabel(result, 'env') && getByLabel(result, 'cluster') in ('asi_zjk_core_b', 'asi_sh_flink_h01')",
+		"! match('flink', getByLabel(result, 'cluster')) && 'dev' != getByLabel(result, 'env')",
+		// not supported
+		"getByLabel(result, 'name') == 'test' || getByLabel(result, 'env') == 'dev'",
+		"result.Value > 1",
+	} {
+		node, err := evaluator.Parse(expression, evaluator.Standard)
+		if err != nil {
+			fmt.Printf("evaluator.Parse failed: %v\n", err)
+			return
+		}
+
+		matchers, err := evaluator.ToMatchers(node, "result")
+		if err != nil {
+			fmt.Printf("%s\n  can't push down: %v\n", expression, err)
+			continue
+		}
+		fmt.Printf("%s\n  %s\n", expression, matchers.Selector("test_count_vector"))
+	}
+}
+
+const ruleFile = `
+mode: all-match
+rules:
+- name: drop-test
+  priority: 100
+  condition: getByLabel(result, 'name') == 'test' && getByLabel(result, 'env') == 'dev'
+  actions:
+  - drop: true
+- name: flink
+  priority: 10
+  condition: stringInSlice(getByLabel(result, 'cluster'), 'asi_sh_flink_h01,asi_sh_flink_a01')
+  actions:
+  - set_label: {name: team, value: flink}
+  - route_to: flink-oncall
+- name: default
+  condition: "true"
+  actions:
+  - route_to: default-oncall
+`
+
+func ruleUsage() {
+	dir, err := ioutil.TempDir("", "rules")
 	if err != nil {
-		fmt.Printf("unable to evaluate expression: %v", err)
+		fmt.Printf("ioutil.TempDir failed: %v\n", err)
 		return
 	}
+	defer os.RemoveAll(dir)
 
-	fmt.Printf("result: %v\n", result)
+	path := filepath.Join(dir, "rules.yaml")
+	if err := ioutil.WriteFile(path, []byte(ruleFile), 0644); err != nil {
+		fmt.Printf("ioutil.WriteFile failed: %v\n", err)
+		return
+	}
+
+	rs, err := rules.Load(path)
+	if err != nil {
+		fmt.Printf("rules.Load failed: %v\n", err)
+		return
+	}
+	engine := rules.NewEngine(rs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		engine.Watch(ctx, path, 100*time.Millisecond, func(err error) {
+			fmt.Printf("watch rules failed: %v\n", err)
+		})
+	}()
+	// stop watching before the rule file is removed
+	defer func() {
+		cancel()
+		<-watched
+	}()
+
+	run := func() {
+		for _, labels := range []map[string]string{
+			{"name": "test", "env": "dev", "cluster": "asi_zjk_core_b"},
+			{"name": "test", "env": "staging", "cluster": "asi_sh_flink_h01"},
+		} {
+			record := &Result{Labels: labels}
+			outcome, err := engine.Run(record)
+			fmt.Printf("outcome: %+v, labels: %v, err: %v\n", outcome, record.Labels, err)
+		}
+	}
+	run()
+
+	// switch to first-match, which is picked up by the watcher
+	if err := ioutil.WriteFile(path, []byte(strings.Replace(ruleFile, "all-match", "first-match", 1)), 0644); err != nil {
+		fmt.Printf("ioutil.WriteFile failed: %v\n", err)
+		return
+	}
+	time.Sleep(300 * time.Millisecond)
+	fmt.Printf("reloaded mode: %v\n", engine.Rules().Mode)
+	run()
 }
 
 func main() {
 	regUsage()
+	errorUsage()
+	registryUsage()
+	batchUsage()
+	checkUsage()
+	explainUsage()
+	sandboxUsage()
+	translateUsage()
+	ruleUsage()
 }
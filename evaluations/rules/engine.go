@@ -0,0 +1,140 @@
+package rules
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/fatsheep9146/go-best-practise/evaluations/evaluator"
+)
+
+// Record is a labeled value rules are run over.
+type Record interface {
+	evaluator.Labeled
+	SetLabel(name, value string)
+}
+
+// Outcome is what the rules did to a record.
+type Outcome struct {
+	// Fired are the names of the rules that fired, in order.
+	Fired   []string
+	Dropped bool
+	// Routes are the receivers the record was routed to.
+	Routes []string
+}
+
+// Engine runs a rule set, which can be replaced while it's running.
+type Engine struct {
+	mu    sync.RWMutex
+	rules *RuleSet
+}
+
+// NewEngine returns an engine running rules.
+func NewEngine(rules *RuleSet) *Engine {
+	return &Engine{rules: rules}
+}
+
+// Rules returns the current rule set.
+func (e *Engine) Rules() *RuleSet {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.rules
+}
+
+// SetRules replaces the rule set, records being run keep the previous one.
+func (e *Engine) SetRules(rules *RuleSet) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rules = rules
+}
+
+// Run runs the rules over record and applies the actions of the rules that
+// fire. It stops at the first condition that can't be evaluated, returning
+// the outcome so far.
+func (e *Engine) Run(record Record) (Outcome, error) {
+	rs := e.Rules()
+	outcome := Outcome{}
+
+	for _, rule := range rs.Rules {
+		value, err := rule.expr.Evaluate(map[string]interface{}{
+			rs.Parameter: record,
+		})
+		if err != nil {
+			return outcome, fmt.Errorf("rule %s: %v", rule.Name, err)
+		}
+		matched, ok := value.(bool)
+		if !ok {
+			return outcome, fmt.Errorf("rule %s: condition returned %T (%v), not bool", rule.Name, value, value)
+		}
+		if !matched {
+			continue
+		}
+
+		outcome.Fired = append(outcome.Fired, rule.Name)
+		for _, a := range rule.Actions {
+			switch {
+			case a.SetLabel != nil:
+				record.SetLabel(a.SetLabel.Name, a.SetLabel.Value)
+			case a.RouteTo != "":
+				outcome.Routes = append(outcome.Routes, a.RouteTo)
+			case a.Drop:
+				outcome.Dropped = true
+			}
+		}
+
+		if outcome.Dropped || rs.Mode == FirstMatch {
+			break
+		}
+	}
+
+	return outcome, nil
+}
+
+// Watch reloads the rule file at path whenever its content changes,
+// checking every interval until ctx is done. A file that fails to load keeps
+// the current rules, and the error is passed to onError if it isn't nil.
+//
+// Changes are told by the digest of the content rather than the modification
+// time, which may not change for a rewrite within its granularity. A file
+// the current rules were loaded from isn't reloaded, even if it was written
+// before Watch started.
+func (e *Engine) Watch(ctx context.Context, path string, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// last is the digest of the content last loaded or failed to load, so
+	// that a bad file is reported once
+	last := e.Rules().digest
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			if onError != nil {
+				onError(err)
+			}
+			continue
+		}
+		digest := sha256.Sum256(raw)
+		if digest == last {
+			continue
+		}
+		last = digest
+
+		rules, err := Parse(raw)
+		if err != nil {
+			if onError != nil {
+				onError(fmt.Errorf("reload %s failed: %v", path, err))
+			}
+			continue
+		}
+		e.SetRules(rules)
+	}
+}
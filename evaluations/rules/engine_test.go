@@ -0,0 +1,286 @@
+package rules
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testRecord map[string]string
+
+func (r testRecord) GetLabel(name string) (string, bool) {
+	value, exist := r[name]
+	return value, exist
+}
+
+func (r testRecord) SetLabel(name, value string) {
+	r[name] = value
+}
+
+const testRules = `
+mode: %s
+rules:
+- name: default
+  condition: "true"
+  actions:
+  - route_to: default-oncall
+- name: prod
+  priority: 10
+  condition: getByLabel(result, 'env') == 'prod'
+  actions:
+  - set_label: {name: severity, value: high}
+  - route_to: prod-oncall
+- name: test
+  priority: 20
+  condition: getByLabel(result, 'name') == 'test'
+  actions:
+  - drop: true
+  - route_to: test-oncall
+- name: team
+  priority: 10
+  condition: hasLabel(result, 'team')
+  actions:
+  - route_to: team-oncall
+`
+
+func mustParse(t *testing.T, mode Mode) *RuleSet {
+	t.Helper()
+
+	rs, err := Parse([]byte(strings.Replace(testRules, "%s", string(mode), 1)))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	return rs
+}
+
+func TestRun(t *testing.T) {
+	cases := []struct {
+		name   string
+		mode   Mode
+		record testRecord
+		want   Outcome
+		labels testRecord
+	}{
+		{
+			name:   "first match",
+			mode:   FirstMatch,
+			record: testRecord{"env": "prod", "team": "a"},
+			want:   Outcome{Fired: []string{"prod"}, Routes: []string{"prod-oncall"}},
+			labels: testRecord{"env": "prod", "team": "a", "severity": "high"},
+		},
+		{
+			name:   "first match of the lowest priority",
+			mode:   FirstMatch,
+			record: testRecord{"env": "dev"},
+			want:   Outcome{Fired: []string{"default"}, Routes: []string{"default-oncall"}},
+			labels: testRecord{"env": "dev"},
+		},
+		{
+			name:   "all match by priority",
+			mode:   AllMatch,
+			record: testRecord{"env": "prod", "team": "a"},
+			want:   Outcome{Fired: []string{"prod", "team", "default"}, Routes: []string{"prod-oncall", "team-oncall", "default-oncall"}},
+			labels: testRecord{"env": "prod", "team": "a", "severity": "high"},
+		},
+		{
+			// the actions of the dropping rule are all applied
+			name:   "drop stops all match",
+			mode:   AllMatch,
+			record: testRecord{"name": "test", "env": "prod"},
+			want:   Outcome{Fired: []string{"test"}, Dropped: true, Routes: []string{"test-oncall"}},
+			labels: testRecord{"name": "test", "env": "prod"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e := NewEngine(mustParse(t, c.mode))
+			got, err := e.Run(c.record)
+			if err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Run = %+v, want %+v", got, c.want)
+			}
+			if !reflect.DeepEqual(c.record, c.labels) {
+				t.Errorf("labels = %v, want %v", c.record, c.labels)
+			}
+		})
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	rs, err := Parse([]byte(`
+mode: all-match
+parameter: record
+rules:
+- name: first
+  priority: 2
+  condition: "true"
+  actions:
+  - route_to: first
+- name: timeout
+  priority: 1
+  condition: duration(getByLabel(record, 'timeout')) > 60
+- name: label
+  condition: getByLabel(record, 'timeout')
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	e := NewEngine(rs)
+
+	// the outcome so far is returned with the error
+	want := Outcome{Fired: []string{"first"}, Routes: []string{"first"}}
+	got, err := e.Run(testRecord{"timeout": "soon"})
+	if err == nil || !strings.HasPrefix(err.Error(), "rule timeout: ") {
+		t.Errorf("Run err = %v, want an error of rule timeout", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Run = %+v, want %+v", got, want)
+	}
+
+	got, err = e.Run(testRecord{"timeout": "1s"})
+	if err == nil || err.Error() != "rule label: condition returned string (1s), not bool" {
+		t.Errorf("Run err = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Run = %+v, want %+v", got, want)
+	}
+}
+
+// watch runs e.Watch of path until the test ends, and returns the errors it
+// reports.
+func watch(t *testing.T, e *Engine, path string) <-chan error {
+	t.Helper()
+
+	errs := make(chan error, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		e.Watch(ctx, path, time.Millisecond, func(err error) { errs <- err })
+	}()
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	return errs
+}
+
+// waitFor waits until the engine has rules of mode.
+func waitFor(t *testing.T, e *Engine, mode Mode) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for e.Rules().Mode != mode {
+		if time.Now().After(deadline) {
+			t.Fatalf("rules weren't reloaded to %s", mode)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func writeFile(t *testing.T, path string, raw []byte, modified time.Time) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(path, raw, 0644); err != nil {
+		t.Fatalf("write rules failed: %v", err)
+	}
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatalf("chtimes failed: %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "rules.yaml")
+
+	// the same modification time for every write, as a rewrite within its
+	// granularity has
+	modified := time.Unix(1600000000, 0)
+	raw := func(mode Mode) []byte { return []byte(strings.Replace(testRules, "%s", string(mode), 1)) }
+	writeFile(t, path, raw(FirstMatch), modified)
+
+	rs, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	e := NewEngine(rs)
+	errs := watch(t, e, path)
+
+	writeFile(t, path, raw(AllMatch), modified)
+	waitFor(t, e, AllMatch)
+
+	// a bad file keeps the current rules, and is reported once
+	writeFile(t, path, []byte("mode: any-match"), modified)
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), `unknown mode "any-match"`) {
+			t.Errorf("reload err = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("bad rules weren't reported")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if e.Rules().Mode != AllMatch {
+		t.Errorf("mode = %s after a bad reload, want all-match", e.Rules().Mode)
+	}
+	if len(errs) != 0 {
+		t.Errorf("bad rules reported %d more times", len(errs))
+	}
+
+	writeFile(t, path, raw(FirstMatch), modified)
+	waitFor(t, e, FirstMatch)
+
+	// a missing file keeps the current rules
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	select {
+	case err := <-errs:
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("reload err = %v, want not exist", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("missing rules weren't reported")
+	}
+	if e.Rules().Mode != FirstMatch {
+		t.Errorf("mode = %s after the file was removed, want first-match", e.Rules().Mode)
+	}
+}
+
+func TestWatchKeepsLoadedRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "rules.yaml")
+	writeFile(t, path, []byte(strings.Replace(testRules, "%s", string(AllMatch), 1)), time.Now())
+
+	rs, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	e := NewEngine(rs)
+	watch(t, e, path)
+
+	// the file the rules were loaded from isn't reloaded
+	time.Sleep(20 * time.Millisecond)
+	if e.Rules() != rs {
+		t.Error("unchanged rules were reloaded")
+	}
+}
@@ -0,0 +1,157 @@
+// Package rules runs rules made of a condition expression and actions over
+// labeled records.
+package rules
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/Knetic/govaluate"
+	"github.com/ghodss/yaml"
+
+	"github.com/fatsheep9146/go-best-practise/evaluations/evaluator"
+)
+
+// Mode decides which of the matching rules fire.
+type Mode string
+
+const (
+	// FirstMatch fires the matching rule with the highest priority only.
+	FirstMatch Mode = "first-match"
+	// AllMatch fires all matching rules by decreasing priority.
+	AllMatch Mode = "all-match"
+)
+
+// SetLabelAction sets a label of the record.
+type SetLabelAction struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Action is what a rule does to a record it fires for. Exactly one of the
+// fields is set.
+type Action struct {
+	SetLabel *SetLabelAction `json:"set_label,omitempty"`
+	// Drop drops the record, no rule fires for it afterwards.
+	Drop bool `json:"drop,omitempty"`
+	// RouteTo routes the record to a receiver.
+	RouteTo string `json:"route_to,omitempty"`
+}
+
+// Rule fires its actions for records its condition is true for.
+type Rule struct {
+	Name      string   `json:"name"`
+	Condition string   `json:"condition"`
+	Priority  int      `json:"priority"`
+	Actions   []Action `json:"actions"`
+
+	expr *govaluate.EvaluableExpression
+}
+
+// RuleSet is a rule file.
+//
+//	mode: first-match
+//	parameter: result
+//	rules:
+//	- name: flink
+//	  priority: 10
+//	  condition: stringInSlice(getByLabel(result, 'cluster'), 'asi_sh_flink_h01,asi_sh_flink_a01')
+//	  actions:
+//	  - set_label: {name: team, value: flink}
+//	  - route_to: flink-oncall
+type RuleSet struct {
+	Mode Mode `json:"mode"`
+	// Parameter is the name records are bound to in conditions, "result" if empty.
+	Parameter string  `json:"parameter"`
+	Rules     []*Rule `json:"rules"`
+
+	// digest is the digest of the file the rules were parsed from.
+	digest [sha256.Size]byte
+}
+
+// Parse parses a rule file and compiles the conditions of its rules with the
+// standard functions. Rules are sorted by decreasing priority, rules of the
+// same priority keep their order.
+func Parse(raw []byte) (*RuleSet, error) {
+	rs := &RuleSet{digest: sha256.Sum256(raw)}
+	if err := yaml.Unmarshal(raw, rs); err != nil {
+		return nil, fmt.Errorf("unmarshal rules failed: %v", err)
+	}
+
+	switch rs.Mode {
+	case "":
+		rs.Mode = FirstMatch
+	case FirstMatch, AllMatch:
+	default:
+		return nil, fmt.Errorf("unknown mode %q", rs.Mode)
+	}
+	if rs.Parameter == "" {
+		rs.Parameter = "result"
+	}
+
+	names := make(map[string]bool)
+	for i, rule := range rs.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rule %d has no name", i)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("rule %s is defined twice", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("rule %s: %v", rule.Name, err)
+		}
+
+		expr, err := evaluator.New(rule.Condition)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: parse condition failed: %v", rule.Name, err)
+		}
+		rule.expr = expr
+	}
+
+	sort.SliceStable(rs.Rules, func(i, j int) bool {
+		return rs.Rules[i].Priority > rs.Rules[j].Priority
+	})
+
+	return rs, nil
+}
+
+// Load reads and parses a rule file.
+func Load(path string) (*RuleSet, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(raw)
+}
+
+func (r *Rule) validate() error {
+	if r.Condition == "" {
+		return errors.New("no condition")
+	}
+
+	for i, a := range r.Actions {
+		set := 0
+		if a.SetLabel != nil {
+			if a.SetLabel.Name == "" {
+				return fmt.Errorf("action %d sets a label without name", i)
+			}
+			set++
+		}
+		if a.Drop {
+			set++
+		}
+		if a.RouteTo != "" {
+			set++
+		}
+		if set != 1 {
+			return fmt.Errorf("action %d must have exactly one of set_label, drop or route_to", i)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	rs, err := Parse([]byte(`
+rules:
+- name: low
+  priority: 1
+  condition: "true"
+- name: high
+  priority: 10
+  condition: "true"
+- name: default
+  condition: "true"
+- name: first-of-1
+  priority: 1
+  condition: "true"
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if rs.Mode != FirstMatch || rs.Parameter != "result" {
+		t.Errorf("mode = %s, parameter = %s, want first-match and result", rs.Mode, rs.Parameter)
+	}
+
+	// by decreasing priority, rules of the same priority keep their order
+	names := make([]string, 0, len(rs.Rules))
+	for _, rule := range rs.Rules {
+		names = append(names, rule.Name)
+	}
+	if got, want := strings.Join(names, ","), "high,low,first-of-1,default"; got != want {
+		t.Errorf("rules = %s, want %s", got, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  string
+		err  string
+	}{
+		{"yaml", "rules: [", "unmarshal rules failed"},
+		{"mode", "mode: any-match", `unknown mode "any-match"`},
+		{"no name", "rules: [{condition: 'true'}]", "rule 0 has no name"},
+		{"twice", "rules: [{name: a, condition: 'true'}, {name: a, condition: 'true'}]", "rule a is defined twice"},
+		{"no condition", "rules: [{name: a}]", "rule a: no condition"},
+		{"condition", "rules: [{name: a, condition: '1 +'}]", "rule a: parse condition failed"},
+		{"unknown function", "rules: [{name: a, condition: 'nope(result)'}]", "rule a: parse condition failed"},
+		{"label name", "rules: [{name: a, condition: 'true', actions: [{set_label: {value: b}}]}]", "rule a: action 0 sets a label without name"},
+		{"no action", "rules: [{name: a, condition: 'true', actions: [{}]}]", "rule a: action 0 must have exactly one of set_label, drop or route_to"},
+		{"two actions", "rules: [{name: a, condition: 'true', actions: [{drop: true}, {drop: true, route_to: b}]}]", "rule a: action 1 must have exactly one of set_label, drop or route_to"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := Parse([]byte(c.raw))
+			if err == nil || !strings.HasPrefix(err.Error(), c.err) {
+				t.Errorf("Parse err = %v, want %s", err, c.err)
+			}
+		})
+	}
+}
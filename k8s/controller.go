@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/fatsheep9146/go-best-practise/k8s/controller"
+	"github.com/fatsheep9146/go-best-practise/k8s/queue"
+)
+
+// ControllerDemo reconciles the params of QueueDemo with a controller, which
+// gives up on t2 and t3 after 3 retries instead of retrying them forever.
+func ControllerDemo() {
+	params := map[string]*param{
+		"t1": {name: "t1", result: true},
+		"t2": {name: "t2", result: true, err: fmt.Errorf("t2 failed")},
+		"t3": {name: "t3", result: true, err: fmt.Errorf("t3 failed")},
+		"t4": {name: "t4"},
+	}
+
+	var (
+		mu       sync.Mutex
+		attempts = make(map[string]int)
+	)
+	reconcile := func(ctx context.Context, key string) error {
+		mu.Lock()
+		attempts[key]++
+		mu.Unlock()
+
+		p := params[key]
+		if p.name == "t4" {
+			panic("t4 has no result")
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+		return p.err
+	}
+
+	q := queue.NewTypedRateLimitingQueue[string](
+		workqueue.NewItemExponentialFailureRateLimiter(5*time.Millisecond, time.Second), "controller")
+	c := controller.New[string](q, reconcile, controller.Options[string]{
+		Workers:    2,
+		MaxRetries: 3,
+		DeadLetter: func(key string, err error) {
+			var panicErr *controller.PanicError
+			fmt.Printf("dead letter %s: %v (panic: %v)\n", key, err, errors.As(err, &panicErr))
+		},
+		DrainTimeout: time.Second,
+	})
+
+	for key := range params {
+		q.Add(key)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	c.Run(ctx)
+
+	fmt.Printf("drained in %v, attempts: %v\n", time.Since(start).Round(100*time.Millisecond), attempts)
+}
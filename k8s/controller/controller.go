@@ -0,0 +1,210 @@
+// Package controller runs reconcile functions over the keys of a work queue
+// with a pool of workers, bounded retries and graceful shutdown.
+package controller
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/fatsheep9146/go-best-practise/k8s/queue"
+)
+
+// ReconcileFunc brings the state of key to the desired one. Keys it fails
+// for are retried with the rate limiter of the queue.
+type ReconcileFunc[T comparable] func(ctx context.Context, key T) error
+
+// PanicError is the error of a reconcile that panicked.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("reconcile panicked: %v", e.Value)
+}
+
+// Options configures a Controller.
+type Options[T comparable] struct {
+	// Workers is the number of keys reconciled concurrently, 1 if zero.
+	Workers int
+	// MaxRetries is how many times a failing key is retried before it's
+	// given to DeadLetter, 5 if zero. Negative values retry forever.
+	// Retries are counted until the key is reconciled, whichever rate
+	// limiter the queue has.
+	MaxRetries int
+	// OnFailure is called for every failed reconcile before the key is
+	// retried, for example to let the rate limiter see the error.
+	OnFailure func(key T, err error)
+	// DeadLetter is called for keys that still fail after MaxRetries, and
+	// for keys that fail while shutting down or are still waiting to be
+	// retried once the queue is drained, since they can't be retried.
+	DeadLetter func(key T, err error)
+	// DrainTimeout bounds how long Run waits for in-flight and queued keys
+	// once its context is done. Reconciles still running afterwards have
+	// their context canceled. Zero waits forever.
+	DrainTimeout time.Duration
+}
+
+// Controller reconciles the keys of a queue.
+type Controller[T comparable] struct {
+	queue     queue.Interface[T]
+	reconcile ReconcileFunc[T]
+	opts      Options[T]
+
+	mu sync.Mutex
+	// backoff are the keys waiting to be retried with their last error,
+	// which the queue drops when it's shut down
+	backoff map[T]error
+	// retries are how many times failing keys were retried. The rate
+	// limiter of the queue may not count them, a token bucket doesn't.
+	retries map[T]int
+}
+
+// New returns a controller reconciling the keys added to q.
+func New[T comparable](q queue.Interface[T], reconcile ReconcileFunc[T], opts Options[T]) *Controller[T] {
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = 5
+	}
+
+	return &Controller[T]{queue: q, reconcile: reconcile, opts: opts, backoff: make(map[T]error), retries: make(map[T]int)}
+}
+
+// Run runs the workers until ctx is done, then shuts the queue down and
+// waits for the queued keys to be reconciled. Keys are reconciled with a
+// context that outlives ctx, so that the drain can finish them. Keys still
+// waiting to be retried aren't queued anymore and are given to DeadLetter.
+func (c *Controller[T]) Run(ctx context.Context) {
+	defer c.deadLetterBackoff()
+
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+
+	var wg sync.WaitGroup
+	for i := 0; i < c.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c.processNext(workCtx) {
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	c.queue.ShutDown()
+
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+
+	if c.opts.DrainTimeout <= 0 {
+		<-drained
+		return
+	}
+	select {
+	case <-drained:
+	case <-time.After(c.opts.DrainTimeout):
+		cancelWork()
+		<-drained
+	}
+}
+
+// processNext reconciles the next key, returning false once the queue is
+// shut down and drained.
+func (c *Controller[T]) processNext(ctx context.Context) bool {
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	c.mu.Lock()
+	delete(c.backoff, key)
+	c.mu.Unlock()
+
+	err := c.safeReconcile(ctx, key)
+	if err == nil {
+		c.forget(key)
+		return true
+	}
+
+	if c.opts.OnFailure != nil {
+		c.opts.OnFailure(key, err)
+	}
+
+	if c.queue.ShuttingDown() {
+		// the queue ignores keys added while shutting down
+		c.forget(key)
+		c.deadLetter(key, fmt.Errorf("shutting down: %w", err))
+		return true
+	}
+
+	c.mu.Lock()
+	// the queue may know of retries from before the controller started,
+	// like a durable queue does
+	retries := c.retries[key]
+	if n := c.queue.NumRequeues(key); n > retries {
+		retries = n
+	}
+	retry := c.opts.MaxRetries < 0 || retries < c.opts.MaxRetries
+	if retry {
+		// tracked before it's added, since another worker may get it
+		// right away
+		c.retries[key] = retries + 1
+		c.backoff[key] = err
+	}
+	c.mu.Unlock()
+
+	if retry {
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.forget(key)
+	c.deadLetter(key, fmt.Errorf("giving up after %d retries: %w", c.opts.MaxRetries, err))
+	return true
+}
+
+// forget stops counting the retries of key, in the controller and in the
+// rate limiter of the queue.
+func (c *Controller[T]) forget(key T) {
+	c.mu.Lock()
+	delete(c.retries, key)
+	c.mu.Unlock()
+	c.queue.Forget(key)
+}
+
+func (c *Controller[T]) safeReconcile(ctx context.Context, key T) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return c.reconcile(ctx, key)
+}
+
+// deadLetterBackoff gives the keys still waiting to be retried, once the
+// workers are done, to DeadLetter.
+func (c *Controller[T]) deadLetterBackoff() {
+	c.mu.Lock()
+	backoff := c.backoff
+	c.backoff = make(map[T]error)
+	c.mu.Unlock()
+
+	for key, err := range backoff {
+		c.forget(key)
+		c.deadLetter(key, fmt.Errorf("shut down while waiting to be retried: %w", err))
+	}
+}
+
+func (c *Controller[T]) deadLetter(key T, err error) {
+	if c.opts.DeadLetter != nil {
+		c.opts.DeadLetter(key, err)
+	}
+}
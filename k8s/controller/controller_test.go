@@ -0,0 +1,197 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/fatsheep9146/go-best-practise/k8s/queue"
+	"github.com/fatsheep9146/go-best-practise/k8s/ratelimit"
+)
+
+var errReconcile = errors.New("reconcile failed")
+
+// deadLetters records the keys given to DeadLetter.
+type deadLetters struct {
+	mu   sync.Mutex
+	errs map[string]error
+}
+
+func (d *deadLetters) add(key string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.errs == nil {
+		d.errs = make(map[string]error)
+	}
+	d.errs[key] = err
+}
+
+func (d *deadLetters) get(key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.errs[key]
+}
+
+func TestRunGivesUpAfterMaxRetries(t *testing.T) {
+	q := queue.NewTypedRateLimitingQueue[string](workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Millisecond), "test")
+	var (
+		mu       sync.Mutex
+		attempts int
+		dead     deadLetters
+		done     = make(chan struct{})
+	)
+	c := New[string](q, func(ctx context.Context, key string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		return errReconcile
+	}, Options[string]{
+		MaxRetries: 2,
+		DeadLetter: func(key string, err error) {
+			dead.add(key, err)
+			close(done)
+		},
+	})
+	q.Add("a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-done
+		cancel()
+	}()
+	c.Run(ctx)
+
+	if attempts != 3 {
+		t.Errorf("attempts = %d, want 3", attempts)
+	}
+	if err := dead.get("a"); !errors.Is(err, errReconcile) {
+		t.Errorf("dead letter of a = %v, want it to wrap the reconcile error", err)
+	}
+}
+
+func TestRunCountsRetriesOfTokenBucket(t *testing.T) {
+	// a token bucket doesn't count failures, NumRequeues is always 0
+	q := queue.NewTypedRateLimitingQueue[string](ratelimit.NewTokenBucket(1000, 1000, clock.RealClock{}), "test")
+	var (
+		mu       sync.Mutex
+		attempts = make(map[string]int)
+		dead     deadLetters
+		done     = make(chan struct{})
+	)
+	c := New[string](q, func(ctx context.Context, key string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[key]++
+		// b succeeds on its second attempt, and fails from then on
+		if key == "b" && attempts[key] == 2 {
+			q.Add("b")
+			return nil
+		}
+		return errReconcile
+	}, Options[string]{
+		MaxRetries: 2,
+		DeadLetter: func(key string, err error) {
+			dead.add(key, err)
+			if key == "b" {
+				close(done)
+			}
+		},
+	})
+	q.Add("a")
+	q.Add("b")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("b wasn't given up")
+		}
+		cancel()
+	}()
+	c.Run(ctx)
+
+	if err := dead.get("a"); err == nil || err.Error() != "giving up after 2 retries: reconcile failed" {
+		t.Errorf("dead letter of a = %v", err)
+	}
+	// the retries of b are counted again after it succeeded
+	if attempts["a"] != 3 || attempts["b"] != 5 {
+		t.Errorf("attempts = %v, want 3 of a and 5 of b", attempts)
+	}
+	if len(c.retries) != 0 {
+		t.Errorf("retries of %v are still counted", c.retries)
+	}
+}
+
+func TestRunDeadLettersKeysInBackoff(t *testing.T) {
+	// failed keys wait an hour to be retried, longer than the test runs
+	q := queue.NewTypedRateLimitingQueue[string](workqueue.NewItemExponentialFailureRateLimiter(time.Hour, time.Hour), "test")
+	var (
+		dead   deadLetters
+		failed = make(chan struct{})
+		once   sync.Once
+	)
+	c := New[string](q, func(ctx context.Context, key string) error {
+		if key == "fail" {
+			once.Do(func() { close(failed) })
+			return errReconcile
+		}
+		return nil
+	}, Options[string]{DeadLetter: dead.add})
+	q.Add("fail")
+	q.Add("ok")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-failed
+		// let the worker queue the key for a retry
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	c.Run(ctx)
+
+	if err := dead.get("fail"); !errors.Is(err, errReconcile) {
+		t.Errorf("dead letter of the key in backoff = %v, want it to wrap the reconcile error", err)
+	}
+	if err := dead.get("ok"); err != nil {
+		t.Errorf("dead letter of the reconciled key = %v, want none", err)
+	}
+	if n := q.NumRequeues("fail"); n != 0 {
+		t.Errorf("requeues of the dead lettered key = %d, want it forgotten", n)
+	}
+}
+
+func TestRunRecoversPanics(t *testing.T) {
+	q := queue.NewTypedRateLimitingQueue[string](workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Millisecond), "test")
+	var (
+		dead deadLetters
+		done = make(chan struct{})
+	)
+	c := New[string](q, func(ctx context.Context, key string) error {
+		panic("boom")
+	}, Options[string]{
+		MaxRetries: 1,
+		DeadLetter: func(key string, err error) {
+			dead.add(key, err)
+			close(done)
+		},
+	})
+	q.Add("a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-done
+		cancel()
+	}()
+	c.Run(ctx)
+
+	var panicErr *PanicError
+	if err := dead.get("a"); !errors.As(err, &panicErr) || panicErr.Value != "boom" {
+		t.Errorf("dead letter of a = %v, want a *PanicError of boom", err)
+	}
+}
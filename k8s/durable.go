@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/fatsheep9146/go-best-practise/k8s/queue"
+)
+
+// DurableQueueDemo crashes while t2 is rate limited, t3 is in flight and t4
+// is delayed, then reopens the journal and processes them again, t2 and t4
+// once the rest of their delays passed.
+func DurableQueueDemo() {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		fmt.Println("err", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+
+	newLimiter := func() workqueue.RateLimiter {
+		return workqueue.NewItemExponentialFailureRateLimiter(300*time.Millisecond, 10*time.Second)
+	}
+	q, err := queue.OpenDurableRateLimitingQueue[string](path, newLimiter(), "durable", queue.DurableOptions{})
+	if err != nil {
+		fmt.Println("err", err)
+		return
+	}
+	start := time.Now()
+	for _, name := range []string{"t1", "t2", "t3"} {
+		q.Add(name)
+	}
+	q.AddAfter("t4", 600*time.Millisecond)
+
+	t1, _ := q.Get()
+	q.Forget(t1)
+	q.Done(t1)
+	t2, _ := q.Get()
+	q.AddRateLimited(t2)
+	q.Done(t2)
+	t3, _ := q.Get()
+	fmt.Printf("processing %s when crashing, journal has %d records\n", t3, countLines(path))
+
+	// crash: the journal as it's on disk now is what the next run sees, so
+	// it's copied before the queue goes away, and the copy is reopened
+	// rather than the journal the old queue still writes
+	crashed := filepath.Join(dir, "crashed")
+	if err := copyFile(path, crashed); err != nil {
+		fmt.Println("err", err)
+		return
+	}
+	q.Close()
+	path = crashed
+
+	q, err = queue.OpenDurableRateLimitingQueue[string](path, newLimiter(), "durable", queue.DurableOptions{})
+	if err != nil {
+		fmt.Println("err", err)
+		return
+	}
+	defer q.Close()
+	fmt.Printf("reopened with %d pending, %d queued, requeues of t2: %d, journal compacted to %d records\n",
+		q.Pending(), q.Len(), q.NumRequeues("t2"), countLines(path))
+
+	for i := 0; i < 3; i++ {
+		name, _ := q.Get()
+		fmt.Printf("got %s after %v\n", name, time.Since(start).Round(100*time.Millisecond))
+		q.Forget(name)
+		q.Done(name)
+	}
+	fmt.Printf("pending after processing: %d\n", q.Pending())
+
+	if err := q.Close(); err != nil {
+		fmt.Println("err", err)
+	}
+	fmt.Printf("journal has %d records after close\n", countLines(path))
+}
+
+func countLines(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	var n int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		n++
+	}
+	return n
+}
+
+func copyFile(src, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, data, 0644)
+}
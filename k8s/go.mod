@@ -1,7 +1,34 @@
 module github.com/fatsheep9146/go-best-practise/k8s
 
-go 1.14
+go 1.18
 
-replace k8s.io/client-go => k8s.io/client-go v0.18.6
+replace (
+	github.com/fatsheep9146/go-best-practise/prometheus/simple => ../prometheus/simple
+	k8s.io/client-go => k8s.io/client-go v0.18.6
+)
 
-require k8s.io/client-go v0.0.0-00010101000000-000000000000
+require (
+	github.com/fatsheep9146/go-best-practise/prometheus/simple v0.0.0-00010101000000-000000000000
+	github.com/prometheus/client_golang v1.14.0
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
+	k8s.io/apimachinery v0.18.6
+	k8s.io/client-go v0.18.6
+	sigs.k8s.io/yaml v1.2.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.3.0 // indirect
+	github.com/prometheus/common v0.37.0 // indirect
+	github.com/prometheus/procfs v0.8.0 // indirect
+	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a // indirect
+	google.golang.org/protobuf v1.28.1 // indirect
+)
+
+require (
+	gopkg.in/yaml.v2 v2.4.0 // indirect
+	k8s.io/klog v1.0.0 // indirect
+)
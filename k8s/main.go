@@ -1,5 +1,13 @@
 package main
 
+import "flag"
+
 func main() {
+	flag.Parse()
+	serveMetrics()
+
+	ControllerDemo()
+	RateLimiterDemo()
+	DurableQueueDemo()
 	QueueDemo()
 }
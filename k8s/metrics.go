@@ -0,0 +1,28 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/fatsheep9146/go-best-practise/prometheus/simple/queuemetrics"
+)
+
+var metricsAddr = flag.String("metrics-address", ":8081", "The address to serve the workqueue metrics on.")
+
+// serveMetrics sets the Prometheus provider of the workqueues, labeling their
+// metrics by queue name, and exposes them on /metrics. It must run before
+// the queues are created.
+func serveMetrics() {
+	if _, err := queuemetrics.Register(prometheus.DefaultRegisterer); err != nil {
+		log.Fatal(err)
+	}
+
+	go func() {
+		http.Handle("/metrics", promhttp.Handler())
+		log.Fatal(http.ListenAndServe(*metricsAddr, nil))
+	}()
+}
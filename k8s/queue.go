@@ -1,12 +1,17 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"time"
 
 	"k8s.io/client-go/util/workqueue"
+
+	"github.com/fatsheep9146/go-best-practise/k8s/queue"
 )
 
+var queueJournal = flag.String("queue-journal", "", "The file QueueDemo journals its queue to, if set, to resume after a crash.")
+
 func fake(name string, result bool, err error) (bool, error) {
 	fmt.Printf("execute fake func [%v] result [%v], err [%v] in [%v]\n", name, result, err, time.Now())
 	time.Sleep(time.Duration(5) * time.Second)
@@ -19,51 +24,62 @@ type param struct {
 	err    error
 }
 
+// QueueDemo processes the params until killed. With -queue-journal, the
+// queue is journaled, so that params pending when it's killed are processed
+// again by the next run.
 func QueueDemo() {
-	ps := []*param{
-		{
+	ps := map[string]*param{
+		"t1": {
 			name:   "t1",
 			result: true,
 			err:    nil,
 		},
-		{
+		"t2": {
 			name:   "t2",
 			result: true,
 			err:    fmt.Errorf("t2 failed"),
 		},
-		{
+		"t3": {
 			name:   "t3",
 			result: true,
 			err:    fmt.Errorf("t3 failed"),
 		},
 	}
 
-	var queue workqueue.RateLimitingInterface
-
-	queue = workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "test")
+	var q queue.Interface[string]
+	if *queueJournal != "" {
+		durable, err := queue.OpenDurableRateLimitingQueue[string](*queueJournal, workqueue.DefaultControllerRateLimiter(), "test", queue.DurableOptions{})
+		if err != nil {
+			fmt.Println("err", err)
+			return
+		}
+		fmt.Printf("journal %s has %d pending params\n", *queueJournal, durable.Pending())
+		q = durable
+	} else {
+		q = queue.NewTypedRateLimitingQueue[string](workqueue.DefaultControllerRateLimiter(), "test")
+	}
 
 	go func() {
-		for i, _ := range ps {
-			queue.Add(ps[i])
+		for name := range ps {
+			q.Add(name)
 		}
 	}()
 
 	for {
-		p, quit := queue.Get()
+		name, quit := q.Get()
 		if quit {
 			break
 		}
 
-		pa := p.(*param)
-
-		_, err := fake(pa.name, pa.result, pa.err)
+		p := ps[name]
+		_, err := fake(p.name, p.result, p.err)
 		if err == nil {
-			queue.Forget(p)
+			q.Forget(name)
 		} else {
-			queue.AddRateLimited(p)
+			q.AddRateLimited(name)
 		}
 
-		queue.Done(p)
+		q.Done(name)
 	}
 
 }
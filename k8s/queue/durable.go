@@ -0,0 +1,547 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/fatsheep9146/go-best-practise/k8s/ratelimit"
+)
+
+const (
+	opAdd            = "add"
+	opAddAfter       = "add_after"
+	opAddRateLimited = "add_rate_limited"
+	opGet            = "get"
+	opDone           = "done"
+	opForget         = "forget"
+	// opState records the whole entry of an item, written by compaction.
+	opState = "state"
+)
+
+// record is a line of the journal.
+type record[T comparable] struct {
+	Op         string      `json:"op"`
+	Item       T           `json:"item"`
+	At         time.Time   `json:"at"`
+	Until      *time.Time  `json:"until,omitempty"`
+	Ready      bool        `json:"ready,omitempty"`
+	Processing bool        `json:"processing,omitempty"`
+	Delays     []time.Time `json:"delays,omitempty"`
+	Requeues   int         `json:"requeues,omitempty"`
+}
+
+// entry is what the journal knows about an item.
+type entry struct {
+	// ready is set while the item is queued, or to be queued again once
+	// it's done processing.
+	ready      bool
+	processing bool
+	// delays are when the item is to be added, by AddAfter and
+	// AddRateLimited. Delays that passed are the same as ready.
+	delays   []time.Time
+	requeues int
+}
+
+func (e *entry) empty() bool {
+	return !e.ready && !e.processing && len(e.delays) == 0 && e.requeues == 0
+}
+
+// DurableOptions configures a DurableRateLimitingQueue.
+type DurableOptions struct {
+	// CompactInterval is how often the journal is rewritten to hold only
+	// the items still pending, 1m if zero. Negative values only compact
+	// when the queue is opened and closed.
+	CompactInterval time.Duration
+	// Sync fsyncs every record before returning, so that the journal also
+	// survives a crash of the machine rather than only of the process.
+	Sync bool
+}
+
+// DurableRateLimitingQueue is a rate limiting queue that journals what is
+// done to its items to an append-only file, so that the items pending when
+// the process crashed are queued again when the journal is reopened: queued
+// and in-flight items right away, delayed and rate limited items once the
+// rest of their delay passed, with the rate limiter counting their failures
+// where it left off if ratelimit.Restore can restore it. NumRequeues counts
+// them from the journal either way.
+//
+// Items are journaled as JSON, so T must round trip through encoding/json,
+// which rules out pointers. Items added or still delayed once the queue is
+// shut down aren't processed, but stay in the journal for the next run. Once
+// the queue is shut down and the items in flight are done, the journal is
+// compacted and closed.
+type DurableRateLimitingQueue[T comparable] struct {
+	q           workqueue.DelayingInterface
+	rateLimiter workqueue.RateLimiter
+	path        string
+	opts        DurableOptions
+	now         func() time.Time
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	file     *os.File
+	entries  map[T]*entry
+	timers   map[*time.Timer]struct{}
+	inFlight int
+	err      error
+	stop     chan struct{}
+	stopped  bool
+	closed   bool
+}
+
+// OpenDurableRateLimitingQueue opens the journal at path, creating it if it
+// doesn't exist, and returns a queue holding the items pending in it. Its
+// metrics, if a provider is set, are named name. Delays are kept by the
+// queue rather than by a workqueue, so retries are counted once delayed
+// items are queued rather than when they're added.
+func OpenDurableRateLimitingQueue[T comparable](path string, rateLimiter workqueue.RateLimiter, name string, opts DurableOptions) (*DurableRateLimitingQueue[T], error) {
+	if opts.CompactInterval == 0 {
+		opts.CompactInterval = time.Minute
+	}
+
+	q := &DurableRateLimitingQueue[T]{
+		q:           workqueue.NewNamedDelayingQueue(name),
+		rateLimiter: rateLimiter,
+		path:        path,
+		opts:        opts,
+		now:         time.Now,
+		entries:     make(map[T]*entry),
+		timers:      make(map[*time.Timer]struct{}),
+		stop:        make(chan struct{}),
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	if err := q.replay(); err != nil {
+		return nil, err
+	}
+
+	q.mu.Lock()
+	now := q.now()
+	for item, e := range q.entries {
+		if e.requeues > 0 {
+			ratelimit.Restore(rateLimiter, item, e.requeues)
+		}
+		// in-flight items didn't finish, so they're processed again
+		if e.processing {
+			e.processing = false
+			e.ready = true
+		}
+		if e.ready {
+			q.q.Add(item)
+		}
+		for _, until := range e.delays {
+			q.schedule(item, until.Sub(now))
+		}
+	}
+	err := q.compact()
+	q.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.CompactInterval > 0 {
+		go q.compactLoop()
+	}
+	return q, nil
+}
+
+// replay rebuilds the entries from the journal. The last line is skipped if
+// it can't be decoded, since the process may have crashed while writing it.
+func (q *DurableRateLimitingQueue[T]) replay() error {
+	f, err := os.Open(q.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open journal failed, err: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var (
+		line   int
+		broken error
+	)
+	for scanner.Scan() {
+		line++
+		if broken != nil {
+			return broken
+		}
+		var r record[T]
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			broken = fmt.Errorf("decode journal line %d failed, err: %v", line, err)
+			continue
+		}
+		q.apply(&r)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read journal failed, err: %v", err)
+	}
+	return nil
+}
+
+// apply updates the entry of the item of r as r says.
+func (q *DurableRateLimitingQueue[T]) apply(r *record[T]) {
+	e, exist := q.entries[r.Item]
+	if !exist {
+		e = &entry{}
+		q.entries[r.Item] = e
+	}
+
+	switch r.Op {
+	case opAdd:
+		e.ready = true
+	case opAddAfter, opAddRateLimited:
+		if r.Op == opAddRateLimited {
+			e.requeues++
+		}
+		if r.Until == nil || !r.Until.After(r.At) {
+			e.ready = true
+		} else {
+			e.delays = append(e.delays, *r.Until)
+		}
+	case opGet:
+		e.ready = false
+		e.processing = true
+		// delays that passed got the item queued, which is what's taken
+		delays := e.delays[:0]
+		for _, until := range e.delays {
+			if until.After(r.At) {
+				delays = append(delays, until)
+			}
+		}
+		e.delays = delays
+	case opDone:
+		e.processing = false
+	case opForget:
+		e.requeues = 0
+	case opState:
+		e.ready = r.Ready
+		e.processing = r.Processing
+		e.delays = r.Delays
+		e.requeues = r.Requeues
+	}
+
+	if e.empty() {
+		delete(q.entries, r.Item)
+	}
+}
+
+// record applies r and appends it to the journal. The first error writing
+// the journal is kept and returned by Err and Close.
+func (q *DurableRateLimitingQueue[T]) record(r record[T]) {
+	r.At = q.now()
+	q.apply(&r)
+	if q.file == nil || q.err != nil {
+		return
+	}
+
+	data, err := json.Marshal(&r)
+	if err != nil {
+		q.err = fmt.Errorf("encode journal record failed, err: %v", err)
+		return
+	}
+	if _, err := q.file.Write(append(data, '\n')); err != nil {
+		q.err = fmt.Errorf("write journal failed, err: %v", err)
+		return
+	}
+	if q.opts.Sync {
+		if err := q.file.Sync(); err != nil {
+			q.err = fmt.Errorf("sync journal failed, err: %v", err)
+		}
+	}
+}
+
+// compact replaces the journal with one holding a record per pending item.
+func (q *DurableRateLimitingQueue[T]) compact() error {
+	tmp := q.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("create journal failed, err: %v", err)
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	now := q.now()
+	for item, e := range q.entries {
+		err = enc.Encode(&record[T]{
+			Op:         opState,
+			Item:       item,
+			At:         now,
+			Ready:      e.ready,
+			Processing: e.processing,
+			Delays:     e.delays,
+			Requeues:   e.requeues,
+		})
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, q.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("compact journal failed, err: %v", err)
+	}
+
+	if q.file != nil {
+		q.file.Close()
+	}
+	q.file, err = os.OpenFile(q.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("open journal failed, err: %v", err)
+	}
+	return nil
+}
+
+func (q *DurableRateLimitingQueue[T]) compactLoop() {
+	ticker := time.NewTicker(q.opts.CompactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+			q.mu.Lock()
+			// ShutDown may have stopped the loop while it waited
+			if !q.stopped {
+				if err := q.compact(); err != nil && q.err == nil {
+					q.err = err
+				}
+			}
+			q.mu.Unlock()
+		}
+	}
+}
+
+// schedule adds item to the queue once delay passed. Items are added with
+// AddAfter of the workqueue, which counts them as retries.
+func (q *DurableRateLimitingQueue[T]) schedule(item T, delay time.Duration) {
+	if delay <= 0 {
+		q.q.AddAfter(item, 0)
+		q.cond.Broadcast()
+		return
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		delete(q.timers, t)
+		if e, exist := q.entries[item]; exist {
+			e.ready = true
+		}
+		q.q.AddAfter(item, 0)
+		q.cond.Broadcast()
+	})
+	q.timers[t] = struct{}{}
+}
+
+// Add marks item as needing processing.
+func (q *DurableRateLimitingQueue[T]) Add(item T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.record(record[T]{Op: opAdd, Item: item})
+	q.q.Add(item)
+	q.cond.Broadcast()
+}
+
+// AddAfter adds item after duration has passed.
+func (q *DurableRateLimitingQueue[T]) AddAfter(item T, duration time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	until := q.now().Add(duration)
+	q.record(record[T]{Op: opAddAfter, Item: item, Until: &until})
+	if !q.q.ShuttingDown() {
+		q.schedule(item, duration)
+	}
+}
+
+// AddRateLimited adds item after the rate limiter says it's ok.
+func (q *DurableRateLimitingQueue[T]) AddRateLimited(item T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	duration := q.rateLimiter.When(item)
+	until := q.now().Add(duration)
+	q.record(record[T]{Op: opAddRateLimited, Item: item, Until: &until})
+	if !q.q.ShuttingDown() {
+		q.schedule(item, duration)
+	}
+}
+
+// Get blocks until it can return an item to be processed. If shutdown is
+// true, the queue is shutting down and the caller should end.
+func (q *DurableRateLimitingQueue[T]) Get() (item T, shutdown bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// the lock is held from the check to the journal record, so the
+	// underlying Get doesn't block and the journal sees what it returns
+	for q.q.Len() == 0 && !q.q.ShuttingDown() {
+		q.cond.Wait()
+	}
+	i, shutdown := q.q.Get()
+	if shutdown {
+		q.release()
+		return item, true
+	}
+	// only items of type T are ever added
+	item = i.(T)
+	q.inFlight++
+	q.record(record[T]{Op: opGet, Item: item})
+	return item, false
+}
+
+// Done marks item as done processing. If it was added again while being
+// processed, it's queued again.
+func (q *DurableRateLimitingQueue[T]) Done(item T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.record(record[T]{Op: opDone, Item: item})
+	q.q.Done(item)
+	q.inFlight--
+	q.cond.Broadcast()
+	if q.q.ShuttingDown() {
+		q.release()
+	}
+}
+
+// Forget makes the rate limiter stop tracking item, which is typically
+// called once it's processed successfully.
+func (q *DurableRateLimitingQueue[T]) Forget(item T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.record(record[T]{Op: opForget, Item: item})
+	q.rateLimiter.Forget(item)
+}
+
+// NumRequeues returns how many times item was rate limited since it was
+// last forgotten, including by previous runs, even if the rate limiter
+// couldn't be restored or doesn't track items.
+func (q *DurableRateLimitingQueue[T]) NumRequeues(item T) int {
+	n := q.rateLimiter.NumRequeues(item)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if e, exist := q.entries[item]; exist && e.requeues > n {
+		n = e.requeues
+	}
+	return n
+}
+
+// Len returns the number of items waiting to be processed.
+func (q *DurableRateLimitingQueue[T]) Len() int {
+	return q.q.Len()
+}
+
+// Pending returns the number of items in the journal: queued, in-flight,
+// delayed, or only still counted by the rate limiter.
+func (q *DurableRateLimitingQueue[T]) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+// ShutDown makes Get return shutdown once the queue is drained, new and
+// delayed items aren't queued anymore. The journal isn't compacted anymore,
+// and it's closed once the items in flight are done.
+func (q *DurableRateLimitingQueue[T]) ShutDown() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for t := range q.timers {
+		t.Stop()
+		delete(q.timers, t)
+	}
+	if !q.stopped {
+		q.stopped = true
+		close(q.stop)
+	}
+	q.q.ShutDown()
+	q.cond.Broadcast()
+	q.release()
+}
+
+// release compacts and closes the journal once the queue is shut down and
+// nothing is queued or in flight anymore.
+func (q *DurableRateLimitingQueue[T]) release() {
+	if q.closed || q.q.Len() > 0 || q.inFlight > 0 {
+		return
+	}
+	if err := q.close(); err != nil && q.err == nil {
+		q.err = err
+	}
+}
+
+// close compacts and closes the journal.
+func (q *DurableRateLimitingQueue[T]) close() error {
+	q.closed = true
+	err := q.compact()
+	if q.file != nil {
+		q.file.Close()
+		q.file = nil
+	}
+	return err
+}
+
+// ShuttingDown tells whether ShutDown was called.
+func (q *DurableRateLimitingQueue[T]) ShuttingDown() bool {
+	return q.q.ShuttingDown()
+}
+
+// Compact rewrites the journal to hold only the items still pending.
+func (q *DurableRateLimitingQueue[T]) Compact() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.compact()
+}
+
+// Err returns the first error journaling the items, after which the journal
+// isn't written anymore.
+func (q *DurableRateLimitingQueue[T]) Err() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.err
+}
+
+// Close shuts the queue down, compacts the journal and closes it without
+// waiting for the items in flight. The items still pending are queued again
+// when the journal is reopened.
+func (q *DurableRateLimitingQueue[T]) Close() error {
+	q.ShutDown()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return q.err
+	}
+
+	err := q.close()
+	if q.err != nil {
+		return q.err
+	}
+	return err
+}
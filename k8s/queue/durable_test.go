@@ -0,0 +1,283 @@
+package queue
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/fatsheep9146/go-best-practise/k8s/ratelimit"
+)
+
+func TestDurableRateLimitingQueueResumes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	q, err := OpenDurableRateLimitingQueue[string](path, newTestLimiter(), "durable", DurableOptions{})
+	if err != nil {
+		t.Fatalf("OpenDurableRateLimitingQueue failed: %v", err)
+	}
+	q.Add("a")
+	q.Add("b")
+	q.AddAfter("c", time.Hour)
+	q.Add("d")
+	// a is processed, b is in flight when the queue stops
+	item, _ := q.Get()
+	q.Done(item)
+	q.Forget(item)
+	if item, _ = q.Get(); item != "b" {
+		t.Fatalf("Get = %s, want b", item)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	q, err = OpenDurableRateLimitingQueue[string](path, newTestLimiter(), "durable", DurableOptions{})
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer q.Close()
+	if n := q.Pending(); n != 3 {
+		t.Errorf("Pending = %d, want 3 for b, c and d", n)
+	}
+	var got []string
+	for q.Len() > 0 {
+		item, _ := q.Get()
+		got = append(got, item)
+		q.Done(item)
+	}
+	if fmt.Sprint(got) != "[b d]" && fmt.Sprint(got) != "[d b]" {
+		t.Errorf("got %v after reopening, want b and d, c being delayed", got)
+	}
+}
+
+func TestDurableShutDownClosesJournal(t *testing.T) {
+	q, err := OpenDurableRateLimitingQueue[string](filepath.Join(t.TempDir(), "journal"), newTestLimiter(), "durable", DurableOptions{CompactInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("OpenDurableRateLimitingQueue failed: %v", err)
+	}
+	q.Add("a")
+	q.Add("b")
+	a, _ := q.Get()
+
+	q.ShutDown()
+	select {
+	case <-q.stop:
+	default:
+		t.Error("compaction isn't stopped by ShutDown")
+	}
+
+	// the journal is kept open for the items queued and in flight
+	b, _ := q.Get()
+	q.Done(b)
+	q.mu.Lock()
+	open := q.file != nil
+	q.mu.Unlock()
+	if !open {
+		t.Fatal("journal closed while a is in flight")
+	}
+
+	q.Done(a)
+	q.mu.Lock()
+	open = q.file != nil
+	q.mu.Unlock()
+	if open {
+		t.Error("journal still open once the queue is drained")
+	}
+	if _, shutdown := q.Get(); !shutdown {
+		t.Error("Get after ShutDown didn't return shutdown")
+	}
+	if err := q.Close(); err != nil {
+		t.Errorf("Close after the journal was closed failed: %v", err)
+	}
+}
+
+func TestDurableRetriesMetric(t *testing.T) {
+	const name = "durable-retries"
+	limiter := workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Millisecond)
+	q, err := OpenDurableRateLimitingQueue[string](filepath.Join(t.TempDir(), "journal"), limiter, name, DurableOptions{})
+	if err != nil {
+		t.Fatalf("OpenDurableRateLimitingQueue failed: %v", err)
+	}
+	defer q.Close()
+
+	q.AddRateLimited("a")
+	q.AddAfter("b", 0)
+	for i := 0; i < 2; i++ {
+		item, _ := q.Get()
+		q.Done(item)
+	}
+
+	if retries, _ := globalMetrics.metric(name, "retries").get(); retries != 2 {
+		t.Errorf("retries = %v, want 2", retries)
+	}
+	if adds, _ := globalMetrics.metric(name, "adds").get(); adds != 2 {
+		t.Errorf("adds = %v, want 2", adds)
+	}
+}
+
+// crash returns a copy of the journal at path as a process crashing now
+// would leave it, uncompacted, with torn appended to its last line.
+func crash(t *testing.T, path, torn string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read journal failed: %v", err)
+	}
+	crashed := path + ".crashed"
+	if err := os.WriteFile(crashed, append(data, torn...), 0644); err != nil {
+		t.Fatalf("write journal failed: %v", err)
+	}
+	return crashed
+}
+
+// openTestQueue opens a queue that is only compacted when opened and closed,
+// closing it once the test is done.
+func openTestQueue(t *testing.T, path string, limiter workqueue.RateLimiter) *DurableRateLimitingQueue[string] {
+	t.Helper()
+
+	q, err := OpenDurableRateLimitingQueue[string](path, limiter, "durable", DurableOptions{CompactInterval: -1})
+	if err != nil {
+		t.Fatalf("OpenDurableRateLimitingQueue failed: %v", err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q
+}
+
+// drain gets and finishes the queued items, sorted.
+func drain(q *DurableRateLimitingQueue[string]) []string {
+	var got []string
+	for q.Len() > 0 {
+		item, _ := q.Get()
+		got = append(got, item)
+		q.Done(item)
+		q.Forget(item)
+	}
+	sort.Strings(got)
+	return got
+}
+
+func TestDurableTornLastLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	q := openTestQueue(t, path, newTestLimiter())
+	q.Add("a")
+	q.Add("b")
+	item, _ := q.Get()
+	q.Done(item)
+	q.Forget(item)
+
+	crashed := crash(t, path, `{"op":"add","item":"c","at":"20`)
+	if data, _ := os.ReadFile(crashed); strings.Count(string(data), "\n") < 5 {
+		t.Fatalf("journal was compacted:\n%s", data)
+	}
+
+	q = openTestQueue(t, crashed, newTestLimiter())
+	if n := q.Pending(); n != 1 {
+		t.Errorf("Pending = %d, want 1", n)
+	}
+	if got := drain(q); fmt.Sprint(got) != "[b]" {
+		t.Errorf("got %v after reopening, want [b], c being torn", got)
+	}
+	if err := q.Err(); err != nil {
+		t.Errorf("Err = %v", err)
+	}
+}
+
+func TestDurableBrokenLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	q := openTestQueue(t, path, newTestLimiter())
+	q.Add("a")
+
+	// only the last line may be torn, a broken line before it is corruption
+	crashed := crash(t, path, "{\"op\":\n"+`{"op":"add","item":"b"}`+"\n")
+	if _, err := OpenDurableRateLimitingQueue[string](crashed, newTestLimiter(), "durable", DurableOptions{}); err == nil || !strings.Contains(err.Error(), "decode journal line") {
+		t.Fatalf("OpenDurableRateLimitingQueue err = %v, want a decode error", err)
+	}
+}
+
+func TestDurableInFlightAtCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	q := openTestQueue(t, path, newTestLimiter())
+	q.Add("a")
+	q.Add("b")
+	q.Add("c")
+	// a and b are in flight, b was added again while processed
+	a, _ := q.Get()
+	b, _ := q.Get()
+	if a != "a" || b != "b" {
+		t.Fatalf("Get = %s, %s, want a, b", a, b)
+	}
+	q.Add("b")
+
+	q = openTestQueue(t, crash(t, path, ""), newTestLimiter())
+	if n := q.Pending(); n != 3 {
+		t.Errorf("Pending = %d, want 3", n)
+	}
+	// every item is processed once, b's second add is the same as its retry
+	if got := drain(q); fmt.Sprint(got) != "[a b c]" {
+		t.Errorf("got %v after reopening, want [a b c]", got)
+	}
+	if n := q.Pending(); n != 0 {
+		t.Errorf("Pending = %d once processed, want 0", n)
+	}
+}
+
+func TestDurableRestoresRequeues(t *testing.T) {
+	newLimiter := func(fakeClock *clock.FakeClock) workqueue.RateLimiter {
+		return ratelimit.MaxOf(
+			ratelimit.NewExponentialJitter(time.Millisecond, time.Millisecond, 0, rand.New(rand.NewSource(1))),
+			ratelimit.NewTokenBucket(1, 1, fakeClock),
+		)
+	}
+
+	for _, test := range []struct {
+		name    string
+		limiter func(*clock.FakeClock) workqueue.RateLimiter
+		// requeues is NumRequeues of the limiter once reopened
+		requeues int
+	}{
+		{name: "restorable", limiter: newLimiter, requeues: 3},
+		{name: "token bucket", limiter: func(c *clock.FakeClock) workqueue.RateLimiter { return ratelimit.NewTokenBucket(1, 1, c) }},
+		{name: "client-go", limiter: func(*clock.FakeClock) workqueue.RateLimiter { return workqueue.DefaultControllerRateLimiter() }},
+	} {
+		path := filepath.Join(t.TempDir(), "journal")
+		fakeClock := clock.NewFakeClock(time.Now())
+		q := openTestQueue(t, path, test.limiter(fakeClock))
+		for i := 0; i < 3; i++ {
+			q.AddRateLimited("a")
+		}
+		q.AddRateLimited("b")
+		q.Forget("b")
+
+		fakeClock = clock.NewFakeClock(time.Now())
+		limiter := test.limiter(fakeClock)
+		q = openTestQueue(t, crash(t, path, ""), limiter)
+		if n := q.NumRequeues("a"); n != 3 {
+			t.Errorf("%s: NumRequeues = %d, want 3 from the journal", test.name, n)
+		}
+		if n := q.NumRequeues("b"); n != 0 {
+			t.Errorf("%s: NumRequeues of a forgotten item = %d, want 0", test.name, n)
+		}
+		if n := limiter.NumRequeues("a"); n != test.requeues {
+			t.Errorf("%s: NumRequeues of the limiter = %d, want %d", test.name, n, test.requeues)
+		}
+		// the bucket wasn't drained by restoring a's failures
+		if d := limiter.When("c"); d >= time.Second {
+			t.Errorf("%s: delay of another item = %v, want the bucket full", test.name, d)
+		}
+		q.AddRateLimited("a")
+		if n := q.NumRequeues("a"); n != 4 {
+			t.Errorf("%s: NumRequeues after another failure = %d, want 4", test.name, n)
+		}
+		q.Forget("a")
+		if n := q.NumRequeues("a"); n != 0 {
+			t.Errorf("%s: NumRequeues after Forget = %d, want 0", test.name, n)
+		}
+	}
+}
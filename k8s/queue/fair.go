@@ -0,0 +1,411 @@
+package queue
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+// FairOptions configures a FairQueue.
+type FairOptions[T comparable] struct {
+	// Priority returns the priority level of item, higher levels are taken
+	// first. All items are of level 0 if nil.
+	Priority func(item T) int
+	// Tenant returns the tenant of item. Within a level, tenants take turns
+	// in proportion to their weights, so a burst of one tenant doesn't
+	// starve the others. All items are of the same tenant if nil.
+	Tenant func(item T) string
+	// Weights are the weights of tenants, 1 for tenants not in it.
+	Weights map[string]int
+	// MaxWait bounds how long an item waits while items of higher levels
+	// are taken: items waiting longer are taken first, oldest first. Zero
+	// never takes items out of turn, so lower levels can be starved.
+	MaxWait time.Duration
+}
+
+type waiting[T comparable] struct {
+	item  T
+	since time.Time
+}
+
+// tenantQueue holds the items of a tenant at a level in FIFO order.
+type tenantQueue[T comparable] struct {
+	name   string
+	weight int
+	// current is the credit of the tenant for the smooth weighted round
+	// robin among the tenants of its level.
+	current int
+	items   []waiting[T]
+}
+
+type level[T comparable] struct {
+	priority int
+	// tenants with items, in the order they got them to break ties
+	tenants []*tenantQueue[T]
+	byName  map[string]*tenantQueue[T]
+	len     int
+}
+
+// FairQueue is a rate limiting queue taking items by priority level, and
+// within a level by weighted fair sharing among tenants. It keeps the
+// semantics of workqueue: an item is queued at most once, an item added
+// while being processed is queued again once it's Done, and items are
+// processed by one worker at a time.
+type FairQueue[T comparable] struct {
+	rateLimiter workqueue.RateLimiter
+	opts        FairOptions[T]
+	now         func() time.Time
+	metrics     *fairMetrics[T]
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	levels       []*level[T]
+	dirty        map[T]struct{}
+	processing   map[T]struct{}
+	len          int
+	timers       map[*time.Timer]struct{}
+	shuttingDown bool
+}
+
+// NewFairQueue returns a queue rate limiting items with rateLimiter and
+// taking them as opts says. It reports the metrics of workqueue, named name,
+// to provider, or none if provider is nil.
+func NewFairQueue[T comparable](rateLimiter workqueue.RateLimiter, name string, provider workqueue.MetricsProvider, opts FairOptions[T]) *FairQueue[T] {
+	q := &FairQueue[T]{
+		rateLimiter: rateLimiter,
+		opts:        opts,
+		now:         time.Now,
+		dirty:       make(map[T]struct{}),
+		processing:  make(map[T]struct{}),
+		timers:      make(map[*time.Timer]struct{}),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	if provider != nil {
+		q.metrics = newFairMetrics[T](name, provider)
+	}
+	return q
+}
+
+// fairMetrics reports the metrics of a FairQueue the way workqueue does.
+type fairMetrics[T comparable] struct {
+	depth                   workqueue.GaugeMetric
+	adds                    workqueue.CounterMetric
+	latency                 workqueue.HistogramMetric
+	workDuration            workqueue.HistogramMetric
+	unfinishedWorkSeconds   workqueue.SettableGaugeMetric
+	longestRunningProcessor workqueue.SettableGaugeMetric
+	retries                 workqueue.CounterMetric
+
+	addTimes             map[T]time.Time
+	processingStartTimes map[T]time.Time
+}
+
+func newFairMetrics[T comparable](name string, provider workqueue.MetricsProvider) *fairMetrics[T] {
+	return &fairMetrics[T]{
+		depth:                   provider.NewDepthMetric(name),
+		adds:                    provider.NewAddsMetric(name),
+		latency:                 provider.NewLatencyMetric(name),
+		workDuration:            provider.NewWorkDurationMetric(name),
+		unfinishedWorkSeconds:   provider.NewUnfinishedWorkSecondsMetric(name),
+		longestRunningProcessor: provider.NewLongestRunningProcessorSecondsMetric(name),
+		retries:                 provider.NewRetriesMetric(name),
+		addTimes:                make(map[T]time.Time),
+		processingStartTimes:    make(map[T]time.Time),
+	}
+}
+
+func (m *fairMetrics[T]) add(item T, now time.Time) {
+	if m == nil {
+		return
+	}
+	m.adds.Inc()
+	m.depth.Inc()
+	if _, exist := m.addTimes[item]; !exist {
+		m.addTimes[item] = now
+	}
+}
+
+func (m *fairMetrics[T]) get(item T, now time.Time) {
+	if m == nil {
+		return
+	}
+	m.depth.Dec()
+	m.processingStartTimes[item] = now
+	if start, exist := m.addTimes[item]; exist {
+		m.latency.Observe(now.Sub(start).Seconds())
+		delete(m.addTimes, item)
+	}
+	m.updateUnfinishedWork(now)
+}
+
+func (m *fairMetrics[T]) done(item T, now time.Time) {
+	if m == nil {
+		return
+	}
+	if start, exist := m.processingStartTimes[item]; exist {
+		m.workDuration.Observe(now.Sub(start).Seconds())
+		delete(m.processingStartTimes, item)
+	}
+	m.updateUnfinishedWork(now)
+}
+
+func (m *fairMetrics[T]) retry() {
+	if m == nil {
+		return
+	}
+	m.retries.Inc()
+}
+
+// updateUnfinishedWork is run on every Get and Done, rather than
+// periodically like workqueue does, so the queue needs no goroutine.
+func (m *fairMetrics[T]) updateUnfinishedWork(now time.Time) {
+	var total, oldest float64
+	for _, start := range m.processingStartTimes {
+		age := now.Sub(start).Seconds()
+		total += age
+		if age > oldest {
+			oldest = age
+		}
+	}
+	m.unfinishedWorkSeconds.Set(total)
+	m.longestRunningProcessor.Set(oldest)
+}
+
+// push queues item at the end of the queue of its tenant.
+func (q *FairQueue[T]) push(item T) {
+	var priority int
+	if q.opts.Priority != nil {
+		priority = q.opts.Priority(item)
+	}
+	var tenant string
+	if q.opts.Tenant != nil {
+		tenant = q.opts.Tenant(item)
+	}
+
+	i := sort.Search(len(q.levels), func(i int) bool { return q.levels[i].priority <= priority })
+	if i == len(q.levels) || q.levels[i].priority != priority {
+		l := &level[T]{priority: priority, byName: make(map[string]*tenantQueue[T])}
+		q.levels = append(q.levels, nil)
+		copy(q.levels[i+1:], q.levels[i:])
+		q.levels[i] = l
+	}
+	l := q.levels[i]
+
+	tq, exist := l.byName[tenant]
+	if !exist {
+		weight, ok := q.opts.Weights[tenant]
+		if !ok || weight <= 0 {
+			weight = 1
+		}
+		tq = &tenantQueue[T]{name: tenant, weight: weight}
+		l.byName[tenant] = tq
+		l.tenants = append(l.tenants, tq)
+	}
+
+	tq.items = append(tq.items, waiting[T]{item: item, since: q.now()})
+	l.len++
+	q.len++
+}
+
+// pop takes the next item, which there must be.
+func (q *FairQueue[T]) pop() T {
+	if q.opts.MaxWait > 0 {
+		if l, tq := q.oldest(); tq != nil && q.now().Sub(tq.items[0].since) >= q.opts.MaxWait {
+			return q.take(l, tq)
+		}
+	}
+
+	for _, l := range q.levels {
+		if l.len == 0 {
+			continue
+		}
+		// smooth weighted round robin: every tenant with items earns its
+		// weight, the richest is taken and pays what was earned in total
+		var (
+			total int
+			next  *tenantQueue[T]
+		)
+		for _, tq := range l.tenants {
+			tq.current += tq.weight
+			total += tq.weight
+			if next == nil || tq.current > next.current {
+				next = tq
+			}
+		}
+		next.current -= total
+		return q.take(l, next)
+	}
+	panic("pop from an empty queue")
+}
+
+// oldest returns the tenant queue whose first item waits the longest.
+func (q *FairQueue[T]) oldest() (*level[T], *tenantQueue[T]) {
+	var (
+		oldestLevel  *level[T]
+		oldestTenant *tenantQueue[T]
+	)
+	for _, l := range q.levels {
+		for _, tq := range l.tenants {
+			if oldestTenant == nil || tq.items[0].since.Before(oldestTenant.items[0].since) {
+				oldestLevel, oldestTenant = l, tq
+			}
+		}
+	}
+	return oldestLevel, oldestTenant
+}
+
+func (q *FairQueue[T]) take(l *level[T], tq *tenantQueue[T]) T {
+	item := tq.items[0].item
+	tq.items[0] = waiting[T]{}
+	tq.items = tq.items[1:]
+	// a tenant that ran out of items is dropped along with its credit
+	if len(tq.items) == 0 {
+		delete(l.byName, tq.name)
+		for i := range l.tenants {
+			if l.tenants[i] == tq {
+				l.tenants = append(l.tenants[:i], l.tenants[i+1:]...)
+				break
+			}
+		}
+	}
+	l.len--
+	q.len--
+	// so are levels, so that many distinct priorities don't pile up
+	if l.len == 0 {
+		for i := range q.levels {
+			if q.levels[i] == l {
+				q.levels = append(q.levels[:i], q.levels[i+1:]...)
+				break
+			}
+		}
+	}
+	return item
+}
+
+// Add marks item as needing processing.
+func (q *FairQueue[T]) Add(item T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.add(item)
+}
+
+func (q *FairQueue[T]) add(item T) {
+	if q.shuttingDown {
+		return
+	}
+	if _, exist := q.dirty[item]; exist {
+		return
+	}
+	q.metrics.add(item, q.now())
+	q.dirty[item] = struct{}{}
+	if _, exist := q.processing[item]; exist {
+		return
+	}
+	q.push(item)
+	q.cond.Signal()
+}
+
+// AddAfter adds item after duration has passed.
+func (q *FairQueue[T]) AddAfter(item T, duration time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.shuttingDown {
+		return
+	}
+	// like workqueue, every delayed add counts as a retry
+	q.metrics.retry()
+	if duration <= 0 {
+		q.add(item)
+		return
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(duration, func() {
+		q.mu.Lock()
+		delete(q.timers, t)
+		q.mu.Unlock()
+		q.Add(item)
+	})
+	q.timers[t] = struct{}{}
+}
+
+// AddRateLimited adds item after the rate limiter says it's ok.
+func (q *FairQueue[T]) AddRateLimited(item T) {
+	q.AddAfter(item, q.rateLimiter.When(item))
+}
+
+// Get blocks until it can return an item to be processed. If shutdown is
+// true, the queue is shutting down and the caller should end.
+func (q *FairQueue[T]) Get() (item T, shutdown bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.len == 0 && !q.shuttingDown {
+		q.cond.Wait()
+	}
+	if q.len == 0 {
+		return item, true
+	}
+
+	item = q.pop()
+	q.processing[item] = struct{}{}
+	delete(q.dirty, item)
+	q.metrics.get(item, q.now())
+	return item, false
+}
+
+// Done marks item as done processing. If it was added again while being
+// processed, it's queued again.
+func (q *FairQueue[T]) Done(item T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.processing, item)
+	q.metrics.done(item, q.now())
+	if _, exist := q.dirty[item]; exist {
+		q.push(item)
+		q.cond.Signal()
+	}
+}
+
+// Forget makes the rate limiter stop tracking item, which is typically
+// called once it's processed successfully.
+func (q *FairQueue[T]) Forget(item T) {
+	q.rateLimiter.Forget(item)
+}
+
+// NumRequeues returns how many times item was rate limited.
+func (q *FairQueue[T]) NumRequeues(item T) int {
+	return q.rateLimiter.NumRequeues(item)
+}
+
+// Len returns the number of items waiting to be processed.
+func (q *FairQueue[T]) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.len
+}
+
+// ShutDown makes Get return shutdown once the queue is drained, new and
+// delayed items are ignored.
+func (q *FairQueue[T]) ShutDown() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for t := range q.timers {
+		t.Stop()
+		delete(q.timers, t)
+	}
+	q.shuttingDown = true
+	q.cond.Broadcast()
+}
+
+// ShuttingDown tells whether ShutDown was called.
+func (q *FairQueue[T]) ShuttingDown() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.shuttingDown
+}
@@ -0,0 +1,218 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestFairQueueMetrics(t *testing.T) {
+	metrics := newTestMetricsProvider()
+	// no delays, so that no timer reads the clock of the test
+	limiter := workqueue.NewItemExponentialFailureRateLimiter(0, 0)
+	q := NewFairQueue[string](limiter, "fair", metrics, FairOptions[string]{})
+	now := time.Unix(0, 0)
+	q.now = func() time.Time { return now }
+
+	q.Add("a")
+	q.Add("a")
+	q.Add("b")
+	if depth, _ := metrics.metric("fair", "depth").get(); depth != 2 {
+		t.Errorf("depth = %v, want 2", depth)
+	}
+
+	now = now.Add(time.Second)
+	a, _ := q.Get()
+	now = now.Add(2 * time.Second)
+	q.Done(a)
+	q.AddRateLimited("c")
+	q.AddAfter("d", 0)
+
+	for _, tc := range []struct {
+		metric string
+		value  float64
+		count  int
+	}{
+		// b, c and d are queued, a is done
+		{metric: "depth", value: 3},
+		{metric: "adds", value: 4},
+		{metric: "retries", value: 2},
+		{metric: "latency", value: 1, count: 1},
+		{metric: "work_duration", value: 2, count: 1},
+	} {
+		value, count := metrics.metric("fair", tc.metric).get()
+		if value != tc.value || count != tc.count {
+			t.Errorf("%s = %v with %d observations, want %v with %d", tc.metric, value, count, tc.value, tc.count)
+		}
+	}
+
+	b, _ := q.Get()
+	now = now.Add(time.Second)
+	q.Get()
+	if unfinished, _ := metrics.metric("fair", "unfinished_work").get(); unfinished != 1 {
+		t.Errorf("unfinished work = %v, want the 1s %s is in flight", unfinished, b)
+	}
+
+	// a nil provider reports nothing
+	q = NewFairQueue[string](newTestLimiter(), "none", nil, FairOptions[string]{})
+	q.Add("a")
+	q.Get()
+}
+
+func TestFairQueueDropsEmptyLevels(t *testing.T) {
+	q := NewFairQueue[int](newTestLimiter(), "fair", nil, FairOptions[int]{
+		Priority: func(item int) int { return item },
+	})
+
+	for i := 0; i < 100; i++ {
+		q.Add(i)
+		item, _ := q.Get()
+		q.Done(item)
+	}
+	q.Add(1)
+	q.Add(2)
+	if n := len(q.levels); n != 2 {
+		t.Errorf("levels = %d, want 2 for the items queued", n)
+	}
+	for _, want := range []int{2, 1} {
+		if item, _ := q.Get(); item != want {
+			t.Errorf("Get = %d, want %d, higher levels first", item, want)
+		}
+	}
+	if n := len(q.levels); n != 0 {
+		t.Errorf("levels = %d once drained, want 0", n)
+	}
+}
+
+// fairItem is an item of a priority level and tenant.
+type fairItem struct {
+	priority int
+	tenant   string
+	n        int
+}
+
+func newFairTestQueue(weights map[string]int, maxWait time.Duration) *FairQueue[fairItem] {
+	return NewFairQueue[fairItem](newTestLimiter(), "fair", nil, FairOptions[fairItem]{
+		Priority: func(item fairItem) int { return item.priority },
+		Tenant:   func(item fairItem) string { return item.tenant },
+		Weights:  weights,
+		MaxWait:  maxWait,
+	})
+}
+
+// burst adds 20 items of tenant a, then 4 of b and c each.
+func burst(q *FairQueue[fairItem]) {
+	for i := 0; i < 20; i++ {
+		q.Add(fairItem{tenant: "a", n: i})
+	}
+	for i := 0; i < 4; i++ {
+		q.Add(fairItem{tenant: "b", n: i})
+		q.Add(fairItem{tenant: "c", n: i})
+	}
+}
+
+// takeTenants gets n items from q and returns their tenants.
+func takeTenants(q *FairQueue[fairItem], n int) string {
+	var tenants string
+	for i := 0; i < n; i++ {
+		item, _ := q.Get()
+		tenants += item.tenant
+		q.Done(item)
+	}
+	return tenants
+}
+
+func TestFairQueueInterleavesBurst(t *testing.T) {
+	q := newFairTestQueue(nil, 0)
+	burst(q)
+
+	// b and c aren't stuck behind the burst of a
+	if got, want := takeTenants(q, 12), "abcabcabcabc"; got != want {
+		t.Errorf("tenants = %s, want %s", got, want)
+	}
+	// once they're done, a has the queue to itself, in order
+	for i := 4; i < 20; i++ {
+		if item, _ := q.Get(); item.tenant != "a" || item.n != i {
+			t.Fatalf("Get = %+v, want item %d of a", item, i)
+		}
+	}
+}
+
+func TestFairQueueWeightedShares(t *testing.T) {
+	q := newFairTestQueue(map[string]int{"a": 2}, 0)
+	burst(q)
+
+	got := takeTenants(q, 12)
+	shares := make(map[rune]int)
+	for _, tenant := range got {
+		shares[tenant]++
+	}
+	if shares['a'] != 6 || shares['b'] != 3 || shares['c'] != 3 {
+		t.Errorf("shares of %s = a:%d b:%d c:%d, want 6, 3 and 3 for weights 2, 1 and 1", got, shares['a'], shares['b'], shares['c'])
+	}
+	// smooth round robin spreads the share of a rather than taking it at once
+	if got != "abcaabcaabca" {
+		t.Errorf("tenants = %s, want abcaabcaabca", got)
+	}
+}
+
+func TestFairQueueMaxWait(t *testing.T) {
+	for _, tc := range []struct {
+		maxWait time.Duration
+		// served is how many high priority items are taken before the low
+		// priority one, -1 if never
+		served int
+	}{
+		{maxWait: 0, served: -1},
+		{maxWait: 50 * time.Millisecond, served: 10},
+	} {
+		q := newFairTestQueue(nil, tc.maxWait)
+		now := time.Unix(0, 0)
+		q.now = func() time.Time { return now }
+
+		for i := 0; i < 3; i++ {
+			q.Add(fairItem{priority: 1, tenant: "a", n: i})
+		}
+		q.Add(fairItem{tenant: "b"})
+
+		// every high priority item taken takes 5ms and brings a new one
+		served := -1
+		for n := 0; n < 100; n++ {
+			item, _ := q.Get()
+			if item.priority == 0 {
+				served = n
+				q.Done(item)
+				break
+			}
+			now = now.Add(5 * time.Millisecond)
+			q.Done(item)
+			q.Add(fairItem{priority: 1, tenant: "a", n: n + 3})
+		}
+
+		if served != tc.served {
+			t.Errorf("max wait %v: low priority item served after %d items, want %d", tc.maxWait, served, tc.served)
+		}
+		if tc.maxWait > 0 {
+			if waited := time.Duration(served) * 5 * time.Millisecond; waited > tc.maxWait {
+				t.Errorf("max wait %v: low priority item waited %v", tc.maxWait, waited)
+			}
+		}
+	}
+}
+
+func TestFairQueueRequeuesOnce(t *testing.T) {
+	q := newFairTestQueue(nil, 0)
+	item := fairItem{tenant: "a"}
+	q.Add(item)
+	got, _ := q.Get()
+	q.Add(got)
+	q.Add(got)
+	if n := q.Len(); n != 0 {
+		t.Errorf("len while processing = %d, want 0", n)
+	}
+	q.Done(got)
+	if n := q.Len(); n != 1 {
+		t.Errorf("len after done = %d, want 1", n)
+	}
+}
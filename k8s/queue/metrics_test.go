@@ -0,0 +1,102 @@
+package queue
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+// testMetric is a metric of testMetricsProvider.
+type testMetric struct {
+	mu    sync.Mutex
+	value float64
+	count int
+}
+
+func (m *testMetric) Inc() { m.add(1) }
+func (m *testMetric) Dec() { m.add(-1) }
+
+func (m *testMetric) Set(v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.value = v
+}
+
+func (m *testMetric) Observe(v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.value += v
+	m.count++
+}
+
+func (m *testMetric) add(v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.value += v
+}
+
+func (m *testMetric) get() (value float64, count int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.value, m.count
+}
+
+// testMetricsProvider records the metrics of queues by queue name.
+type testMetricsProvider struct {
+	mu      sync.Mutex
+	metrics map[string]*testMetric
+}
+
+func newTestMetricsProvider() *testMetricsProvider {
+	return &testMetricsProvider{metrics: make(map[string]*testMetric)}
+}
+
+func (p *testMetricsProvider) metric(name, kind string) *testMetric {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m, exist := p.metrics[name+"/"+kind]
+	if !exist {
+		m = &testMetric{}
+		p.metrics[name+"/"+kind] = m
+	}
+	return m
+}
+
+func (p *testMetricsProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return p.metric(name, "depth")
+}
+
+func (p *testMetricsProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return p.metric(name, "adds")
+}
+
+func (p *testMetricsProvider) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return p.metric(name, "latency")
+}
+
+func (p *testMetricsProvider) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return p.metric(name, "work_duration")
+}
+
+func (p *testMetricsProvider) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return p.metric(name, "unfinished_work")
+}
+
+func (p *testMetricsProvider) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return p.metric(name, "longest_running_processor")
+}
+
+func (p *testMetricsProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return p.metric(name, "retries")
+}
+
+// globalMetrics is the provider of the workqueues, which can only be set
+// once per process.
+var globalMetrics = newTestMetricsProvider()
+
+func TestMain(m *testing.M) {
+	workqueue.SetProvider(globalMetrics)
+	os.Exit(m.Run())
+}
@@ -0,0 +1,100 @@
+// Package queue provides work queues for controllers on top of client-go's
+// workqueue.
+package queue
+
+import (
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Interface is a rate limiting queue of items of type T, implemented by
+// TypedRateLimitingQueue and DurableRateLimitingQueue.
+type Interface[T comparable] interface {
+	Add(item T)
+	AddAfter(item T, duration time.Duration)
+	AddRateLimited(item T)
+	Get() (item T, shutdown bool)
+	Done(item T)
+	Forget(item T)
+	NumRequeues(item T) int
+	Len() int
+	ShutDown()
+	ShuttingDown() bool
+}
+
+// TypedRateLimitingQueue is a workqueue.RateLimitingInterface holding items
+// of type T only, so that workers don't have to type assert what they Get.
+// It keeps the semantics of the underlying queue: an item is queued at most
+// once, an item added while being processed is queued again once it's Done,
+// and items are processed by one worker at a time.
+type TypedRateLimitingQueue[T comparable] struct {
+	q workqueue.RateLimitingInterface
+}
+
+// NewTypedRateLimitingQueue returns a queue rate limiting items with
+// rateLimiter. Its metrics, if a provider is set, are named name.
+func NewTypedRateLimitingQueue[T comparable](rateLimiter workqueue.RateLimiter, name string) *TypedRateLimitingQueue[T] {
+	return &TypedRateLimitingQueue[T]{
+		q: workqueue.NewNamedRateLimitingQueue(rateLimiter, name),
+	}
+}
+
+// Add marks item as needing processing.
+func (q *TypedRateLimitingQueue[T]) Add(item T) {
+	q.q.Add(item)
+}
+
+// AddAfter adds item after duration has passed.
+func (q *TypedRateLimitingQueue[T]) AddAfter(item T, duration time.Duration) {
+	q.q.AddAfter(item, duration)
+}
+
+// AddRateLimited adds item after the rate limiter says it's ok.
+func (q *TypedRateLimitingQueue[T]) AddRateLimited(item T) {
+	q.q.AddRateLimited(item)
+}
+
+// Get blocks until it can return an item to be processed. If shutdown is
+// true, the queue is shutting down and the caller should end.
+func (q *TypedRateLimitingQueue[T]) Get() (item T, shutdown bool) {
+	i, shutdown := q.q.Get()
+	if shutdown {
+		return item, true
+	}
+	// only items of type T are ever added
+	return i.(T), false
+}
+
+// Done marks item as done processing. If it was added again while being
+// processed, it's queued again.
+func (q *TypedRateLimitingQueue[T]) Done(item T) {
+	q.q.Done(item)
+}
+
+// Forget makes the rate limiter stop tracking item, which is typically
+// called once it's processed successfully.
+func (q *TypedRateLimitingQueue[T]) Forget(item T) {
+	q.q.Forget(item)
+}
+
+// NumRequeues returns how many times item was rate limited.
+func (q *TypedRateLimitingQueue[T]) NumRequeues(item T) int {
+	return q.q.NumRequeues(item)
+}
+
+// Len returns the number of items waiting to be processed.
+func (q *TypedRateLimitingQueue[T]) Len() int {
+	return q.q.Len()
+}
+
+// ShutDown makes Get return shutdown once the queue is drained, new items
+// are ignored.
+func (q *TypedRateLimitingQueue[T]) ShutDown() {
+	q.q.ShutDown()
+}
+
+// ShuttingDown tells whether ShutDown was called.
+func (q *TypedRateLimitingQueue[T]) ShuttingDown() bool {
+	return q.q.ShuttingDown()
+}
@@ -0,0 +1,171 @@
+package queue
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+// untypedQueue adapts a workqueue.RateLimitingInterface of strings to
+// Interface, so that the queues of this package can be checked against it.
+type untypedQueue struct {
+	workqueue.RateLimitingInterface
+}
+
+func (q untypedQueue) Add(item string) {
+	q.RateLimitingInterface.Add(item)
+}
+
+func (q untypedQueue) AddAfter(item string, duration time.Duration) {
+	q.RateLimitingInterface.AddAfter(item, duration)
+}
+
+func (q untypedQueue) AddRateLimited(item string) {
+	q.RateLimitingInterface.AddRateLimited(item)
+}
+
+func (q untypedQueue) Done(item string) {
+	q.RateLimitingInterface.Done(item)
+}
+
+func (q untypedQueue) Forget(item string) {
+	q.RateLimitingInterface.Forget(item)
+}
+
+func (q untypedQueue) NumRequeues(item string) int {
+	return q.RateLimitingInterface.NumRequeues(item)
+}
+
+func (q untypedQueue) Get() (string, bool) {
+	item, shutdown := q.RateLimitingInterface.Get()
+	if shutdown {
+		return "", true
+	}
+	return item.(string), false
+}
+
+func newTestLimiter() workqueue.RateLimiter {
+	return workqueue.NewItemExponentialFailureRateLimiter(5*time.Millisecond, time.Second)
+}
+
+// queueScenario exercises q and records what it observes.
+func queueScenario(q Interface[string]) []string {
+	var log []string
+	logf := func(format string, args ...interface{}) {
+		log = append(log, fmt.Sprintf(format, args...))
+	}
+
+	// items are deduplicated
+	q.Add("a")
+	q.Add("a")
+	q.Add("b")
+	logf("len after adding a, a, b: %d", q.Len())
+
+	// an item added while being processed is queued again once it's done
+	item, _ := q.Get()
+	q.Add(item)
+	logf("got %s, len after adding it again: %d", item, q.Len())
+	q.Done(item)
+	logf("len after done: %d", q.Len())
+	for q.Len() > 0 {
+		item, _ := q.Get()
+		logf("got %s", item)
+		q.Done(item)
+	}
+
+	// rate limited items are counted until forgotten
+	q.AddRateLimited("c")
+	q.AddRateLimited("c")
+	logf("requeues of c: %d", q.NumRequeues("c"))
+	q.Forget("c")
+	logf("requeues of c after forget: %d", q.NumRequeues("c"))
+
+	// delayed items are queued once the delay passed
+	q.AddAfter("d", 20*time.Millisecond)
+	logf("len right after add after: %d", q.Len())
+	time.Sleep(100 * time.Millisecond)
+	logf("len after the delay: %d", q.Len())
+
+	// shutting down drains the queue before Get returns shutdown
+	q.ShutDown()
+	logf("shutting down: %v", q.ShuttingDown())
+	for {
+		item, shutdown := q.Get()
+		if shutdown {
+			logf("shutdown")
+			break
+		}
+		logf("got %s", item)
+		q.Done(item)
+	}
+	q.Add("e")
+	logf("len after adding e once shut down: %d", q.Len())
+
+	return log
+}
+
+// TestQueueContract checks that the queues of this package behave like
+// workqueue.
+func TestQueueContract(t *testing.T) {
+	want := queueScenario(untypedQueue{workqueue.NewNamedRateLimitingQueue(newTestLimiter(), "untyped")})
+
+	for _, tc := range []struct {
+		name string
+		new  func(t *testing.T) Interface[string]
+	}{
+		{
+			name: "typed",
+			new: func(t *testing.T) Interface[string] {
+				return NewTypedRateLimitingQueue[string](newTestLimiter(), "typed")
+			},
+		},
+		{
+			name: "durable",
+			new: func(t *testing.T) Interface[string] {
+				q, err := OpenDurableRateLimitingQueue[string](filepath.Join(t.TempDir(), "journal"), newTestLimiter(), "durable", DurableOptions{})
+				if err != nil {
+					t.Fatalf("OpenDurableRateLimitingQueue failed: %v", err)
+				}
+				t.Cleanup(func() { q.Close() })
+				return q
+			},
+		},
+		{
+			name: "fair",
+			new: func(t *testing.T) Interface[string] {
+				return NewFairQueue[string](newTestLimiter(), "fair", nil, FairOptions[string]{})
+			},
+		},
+		{
+			name: "fair with priorities and tenants",
+			new: func(t *testing.T) Interface[string] {
+				return NewFairQueue[string](newTestLimiter(), "fair", nil, FairOptions[string]{
+					// a single level and tenant keep the order FIFO
+					Priority: func(string) int { return 1 },
+					Tenant:   func(string) string { return "tenant" },
+					Weights:  map[string]int{"tenant": 3},
+					MaxWait:  time.Hour,
+				})
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := queueScenario(tc.new(t))
+			for i := range want {
+				if i >= len(got) {
+					t.Errorf("step %d: got nothing, want %q", i, want[i])
+					continue
+				}
+				if got[i] != want[i] {
+					t.Errorf("step %d: got %q, want %q", i, got[i], want[i])
+				}
+			}
+			for i := len(want); i < len(got); i++ {
+				t.Errorf("step %d: got %q, want nothing", i, got[i])
+			}
+		})
+	}
+}
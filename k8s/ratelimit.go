@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+
+	"github.com/fatsheep9146/go-best-practise/k8s/controller"
+	"github.com/fatsheep9146/go-best-practise/k8s/queue"
+	"github.com/fatsheep9146/go-best-practise/k8s/ratelimit"
+)
+
+const rateLimiterConfig = `
+type: max_of
+limiters:
+- type: error_class
+  transient: {type: exponential, base: 5ms, max: 1s, jitter: 0.2, seed: 1}
+  permanent: {type: fast_slow, fast: 50ms, slow: 200ms, fast_attempts: 2}
+- type: token_bucket
+  qps: 100
+  burst: 10
+`
+
+// RateLimiterDemo runs fake params through a controller with the configured
+// limiter, retrying the transient failure of t2 faster than the permanent one
+// of t3.
+func RateLimiterDemo() {
+	cfg, err := ratelimit.Parse([]byte(rateLimiterConfig))
+	if err != nil {
+		fmt.Println("err", err)
+		return
+	}
+	limiter, err := ratelimit.Build(cfg, clock.RealClock{})
+	if err != nil {
+		fmt.Println("err", err)
+		return
+	}
+
+	params := map[string]*param{
+		"t1": {name: "t1", result: true},
+		"t2": {name: "t2", result: true, err: fmt.Errorf("t2 failed")},
+		"t3": {name: "t3", result: true, err: ratelimit.Permanent(fmt.Errorf("t3 failed"))},
+	}
+	attempts := make(map[string][]time.Duration)
+	start := time.Now()
+
+	q := queue.NewTypedRateLimitingQueue[string](limiter, "ratelimit")
+	c := controller.New[string](q, func(ctx context.Context, key string) error {
+		attempts[key] = append(attempts[key], time.Since(start).Round(10*time.Millisecond))
+		return params[key].err
+	}, controller.Options[string]{
+		MaxRetries: 3,
+		OnFailure: func(key string, err error) {
+			ratelimit.Observe(limiter, key, err)
+		},
+	})
+	for key := range params {
+		q.Add(key)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c.Run(ctx)
+
+	for _, key := range []string{"t1", "t2", "t3"} {
+		fmt.Printf("%s attempted at %v\n", key, attempts[key])
+	}
+}
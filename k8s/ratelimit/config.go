@@ -0,0 +1,139 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/yaml"
+)
+
+// Duration is a time.Duration written like 5ms or 1m30s in configuration.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Config configures a rate limiter.
+//
+//	type: max_of
+//	limiters:
+//	- type: error_class
+//	  transient: {type: exponential, base: 5ms, max: 1m, jitter: 0.2}
+//	  permanent: {type: fast_slow, fast: 1m, slow: 10m, fast_attempts: 3}
+//	- type: token_bucket
+//	  qps: 10
+//	  burst: 100
+type Config struct {
+	// Type is exponential, token_bucket, fast_slow, max_of or error_class.
+	Type string `json:"type"`
+
+	// exponential
+	Base   Duration `json:"base,omitempty"`
+	Max    Duration `json:"max,omitempty"`
+	Jitter float64  `json:"jitter,omitempty"`
+	// Seed seeds the jitter, the current time if zero.
+	Seed int64 `json:"seed,omitempty"`
+
+	// token_bucket
+	QPS   float64 `json:"qps,omitempty"`
+	Burst int     `json:"burst,omitempty"`
+
+	// fast_slow
+	Fast         Duration `json:"fast,omitempty"`
+	Slow         Duration `json:"slow,omitempty"`
+	FastAttempts int      `json:"fast_attempts,omitempty"`
+
+	// max_of
+	Limiters []Config `json:"limiters,omitempty"`
+
+	// error_class
+	Transient *Config `json:"transient,omitempty"`
+	Permanent *Config `json:"permanent,omitempty"`
+}
+
+// Parse parses a YAML or JSON rate limiter configuration.
+func Parse(raw []byte) (*Config, error) {
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(raw, cfg); err != nil {
+		return nil, fmt.Errorf("unmarshal rate limiter config failed, err: %v", err)
+	}
+	return cfg, nil
+}
+
+// Build returns the rate limiter configured by cfg, reading time from clk.
+func Build(cfg *Config, clk clock.Clock) (workqueue.RateLimiter, error) {
+	switch cfg.Type {
+	case "exponential":
+		if cfg.Base <= 0 || cfg.Max < cfg.Base {
+			return nil, fmt.Errorf("exponential: base must be positive and not above max")
+		}
+		if cfg.Jitter < 0 || cfg.Jitter > 1 {
+			return nil, fmt.Errorf("exponential: jitter must be within [0, 1]")
+		}
+		seed := cfg.Seed
+		if seed == 0 {
+			seed = clk.Now().UnixNano()
+		}
+		return NewExponentialJitter(time.Duration(cfg.Base), time.Duration(cfg.Max), cfg.Jitter, rand.New(rand.NewSource(seed))), nil
+
+	case "token_bucket":
+		if cfg.QPS <= 0 || cfg.Burst <= 0 {
+			return nil, fmt.Errorf("token_bucket: qps and burst must be positive")
+		}
+		return NewTokenBucket(cfg.QPS, cfg.Burst, clk), nil
+
+	case "fast_slow":
+		if cfg.Fast <= 0 || cfg.Slow < cfg.Fast || cfg.FastAttempts <= 0 {
+			return nil, fmt.Errorf("fast_slow: fast and fast_attempts must be positive and slow not below fast")
+		}
+		return FastSlow(time.Duration(cfg.Fast), time.Duration(cfg.Slow), cfg.FastAttempts), nil
+
+	case "max_of":
+		if len(cfg.Limiters) == 0 {
+			return nil, fmt.Errorf("max_of: no limiters")
+		}
+		limiters := make([]workqueue.RateLimiter, 0, len(cfg.Limiters))
+		for i := range cfg.Limiters {
+			l, err := Build(&cfg.Limiters[i], clk)
+			if err != nil {
+				return nil, fmt.Errorf("max_of: limiter %d: %v", i, err)
+			}
+			limiters = append(limiters, l)
+		}
+		return MaxOf(limiters...), nil
+
+	case "error_class":
+		if cfg.Transient == nil || cfg.Permanent == nil {
+			return nil, fmt.Errorf("error_class: transient and permanent are required")
+		}
+		transient, err := Build(cfg.Transient, clk)
+		if err != nil {
+			return nil, fmt.Errorf("error_class: transient: %v", err)
+		}
+		permanent, err := Build(cfg.Permanent, clk)
+		if err != nil {
+			return nil, fmt.Errorf("error_class: permanent: %v", err)
+		}
+		return NewErrorClass(transient, permanent), nil
+	}
+
+	return nil, fmt.Errorf("unknown rate limiter type %q", cfg.Type)
+}
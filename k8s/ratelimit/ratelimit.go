@@ -0,0 +1,287 @@
+// Package ratelimit provides workqueue rate limiters beyond the ones of
+// client-go, built from configuration and driven by a clock that tests can
+// replace.
+package ratelimit
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// ExponentialJitter delays the failures of an item exponentially, from Base
+// up to Max, spreading each delay randomly by up to a Jitter fraction so
+// that items failing together aren't retried together.
+type ExponentialJitter struct {
+	base, max time.Duration
+	jitter    float64
+
+	mu       sync.Mutex
+	rand     *rand.Rand
+	failures map[interface{}]int
+}
+
+// NewExponentialJitter returns an ExponentialJitter drawing jitter from rnd.
+func NewExponentialJitter(base, max time.Duration, jitter float64, rnd *rand.Rand) *ExponentialJitter {
+	return &ExponentialJitter{
+		base:     base,
+		max:      max,
+		jitter:   jitter,
+		rand:     rnd,
+		failures: make(map[interface{}]int),
+	}
+}
+
+func (r *ExponentialJitter) When(item interface{}) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	exp := r.failures[item]
+	r.failures[item]++
+
+	backoff := float64(r.base) * math.Pow(2, float64(exp))
+	if backoff > float64(r.max) {
+		backoff = float64(r.max)
+	}
+	// jitter within [-jitter, +jitter) of the backoff, never beyond max
+	backoff *= 1 + r.jitter*(2*r.rand.Float64()-1)
+	if backoff > float64(r.max) {
+		backoff = float64(r.max)
+	}
+	return time.Duration(backoff)
+}
+
+func (r *ExponentialJitter) NumRequeues(item interface{}) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failures[item]
+}
+
+func (r *ExponentialJitter) Forget(item interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.failures, item)
+}
+
+// Restore sets the failures of item, so that its next delay follows them.
+func (r *ExponentialJitter) Restore(item interface{}, failures int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if failures > 0 {
+		r.failures[item] = failures
+	}
+}
+
+// TokenBucket limits the rate of retries of all items together.
+type TokenBucket struct {
+	limiter *rate.Limiter
+	clock   clock.Clock
+}
+
+// NewTokenBucket returns a TokenBucket allowing qps retries per second with
+// bursts of burst.
+func NewTokenBucket(qps float64, burst int, clk clock.Clock) *TokenBucket {
+	return &TokenBucket{limiter: rate.NewLimiter(rate.Limit(qps), burst), clock: clk}
+}
+
+func (r *TokenBucket) When(item interface{}) time.Duration {
+	now := r.clock.Now()
+	return r.limiter.ReserveN(now, 1).DelayFrom(now)
+}
+
+// NumRequeues is always 0, the bucket doesn't track items.
+func (r *TokenBucket) NumRequeues(item interface{}) int {
+	return 0
+}
+
+func (r *TokenBucket) Forget(item interface{}) {}
+
+// Restore does nothing, the bucket doesn't track items. Taking tokens for
+// past failures would delay every other item.
+func (r *TokenBucket) Restore(item interface{}, failures int) {}
+
+// Observer is implemented by limiters that delay items depending on the
+// error they failed with.
+type Observer interface {
+	Observe(item interface{}, err error)
+}
+
+// Observe reports the error item failed with to limiter, if it's an
+// Observer. It should be called before AddRateLimited.
+func Observe(limiter workqueue.RateLimiter, item interface{}, err error) {
+	if o, ok := limiter.(Observer); ok {
+		o.Observe(item, err)
+	}
+}
+
+// Restorer is implemented by limiters that can resume counting the failures
+// of an item where a previous process left off.
+type Restorer interface {
+	Restore(item interface{}, failures int)
+}
+
+// Restore makes limiter count failures of item, and tells whether it could.
+// Limiters of client-go that only count failures of the item are restored
+// by calling When, bucket limiters have nothing to restore. Other limiters
+// can't be restored unless they're Restorers.
+func Restore(limiter workqueue.RateLimiter, item interface{}, failures int) bool {
+	switch l := limiter.(type) {
+	case Restorer:
+		l.Restore(item, failures)
+	case *workqueue.ItemExponentialFailureRateLimiter, *workqueue.ItemFastSlowRateLimiter:
+		for i := l.NumRequeues(item); i < failures; i++ {
+			l.When(item)
+		}
+	case *workqueue.BucketRateLimiter:
+	default:
+		return false
+	}
+	return true
+}
+
+type maxOf struct {
+	limiters []workqueue.RateLimiter
+}
+
+// MaxOf returns the longest delay of limiters, like
+// workqueue.NewMaxOfRateLimiter, and passes observed errors on to them.
+func MaxOf(limiters ...workqueue.RateLimiter) workqueue.RateLimiter {
+	return &maxOf{limiters: limiters}
+}
+
+func (r *maxOf) When(item interface{}) time.Duration {
+	var max time.Duration
+	for _, l := range r.limiters {
+		if d := l.When(item); d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+func (r *maxOf) NumRequeues(item interface{}) int {
+	var max int
+	for _, l := range r.limiters {
+		if n := l.NumRequeues(item); n > max {
+			max = n
+		}
+	}
+	return max
+}
+
+func (r *maxOf) Forget(item interface{}) {
+	for _, l := range r.limiters {
+		l.Forget(item)
+	}
+}
+
+func (r *maxOf) Observe(item interface{}, err error) {
+	for _, l := range r.limiters {
+		Observe(l, item, err)
+	}
+}
+
+// Restore restores the limiters that can be, the others start over.
+func (r *maxOf) Restore(item interface{}, failures int) {
+	for _, l := range r.limiters {
+		Restore(l, item, failures)
+	}
+}
+
+// FastSlow retries an item after fast delays for its first attempts, then
+// after slow delays.
+func FastSlow(fast, slow time.Duration, fastAttempts int) workqueue.RateLimiter {
+	return workqueue.NewItemFastSlowRateLimiter(fast, slow, fastAttempts)
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as permanent, retrying won't help soon.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent tells whether err was marked with Permanent.
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// ErrorClass delays items with the limiter of the class of their last
+// error: transient errors, which may go away quickly, and permanent errors,
+// which need a human or another component to fix something first. Failures
+// must be reported with Observe before AddRateLimited, items without an
+// observed error are transient.
+type ErrorClass struct {
+	transient workqueue.RateLimiter
+	permanent workqueue.RateLimiter
+
+	mu         sync.Mutex
+	permanents map[interface{}]bool
+}
+
+// NewErrorClass returns an ErrorClass delaying transient and permanent
+// errors with their own limiters.
+func NewErrorClass(transient, permanent workqueue.RateLimiter) *ErrorClass {
+	return &ErrorClass{
+		transient:  transient,
+		permanent:  permanent,
+		permanents: make(map[interface{}]bool),
+	}
+}
+
+// Observe records the error item failed with.
+func (r *ErrorClass) Observe(item interface{}, err error) {
+	r.mu.Lock()
+	r.permanents[item] = IsPermanent(err)
+	r.mu.Unlock()
+
+	Observe(r.transient, item, err)
+	Observe(r.permanent, item, err)
+}
+
+func (r *ErrorClass) limiter(item interface{}) workqueue.RateLimiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.permanents[item] {
+		return r.permanent
+	}
+	return r.transient
+}
+
+// Restore restores the failures as transient, the class of items without
+// an observed error.
+func (r *ErrorClass) Restore(item interface{}, failures int) {
+	Restore(r.transient, item, failures)
+}
+
+func (r *ErrorClass) When(item interface{}) time.Duration {
+	return r.limiter(item).When(item)
+}
+
+func (r *ErrorClass) NumRequeues(item interface{}) int {
+	return r.transient.NumRequeues(item) + r.permanent.NumRequeues(item)
+}
+
+func (r *ErrorClass) Forget(item interface{}) {
+	r.mu.Lock()
+	delete(r.permanents, item)
+	r.mu.Unlock()
+
+	r.transient.Forget(item)
+	r.permanent.Forget(item)
+}
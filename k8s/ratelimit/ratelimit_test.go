@@ -0,0 +1,286 @@
+package ratelimit
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestExponentialJitter(t *testing.T) {
+	const (
+		base   = 10 * time.Millisecond
+		max    = time.Second
+		jitter = 0.2
+	)
+	r := NewExponentialJitter(base, max, jitter, rand.New(rand.NewSource(1)))
+	same := NewExponentialJitter(base, max, jitter, rand.New(rand.NewSource(1)))
+
+	for i := 0; i < 12; i++ {
+		d := r.When("a")
+		if d > max {
+			t.Errorf("failure %d: delay %v above max %v", i, d, max)
+		}
+		nominal := math.Min(float64(base)*math.Pow(2, float64(i)), float64(max))
+		if lo, hi := nominal*(1-jitter), nominal*(1+jitter); float64(d) < lo || float64(d) > hi {
+			t.Errorf("failure %d: delay %v not within [%v, %v]", i, d, time.Duration(lo), time.Duration(hi))
+		}
+		// the same seed gives the same delays
+		if d2 := same.When("a"); d2 != d {
+			t.Errorf("failure %d: delay %v with the same seed, want %v", i, d2, d)
+		}
+	}
+
+	if n := r.NumRequeues("a"); n != 12 {
+		t.Errorf("NumRequeues = %d, want 12", n)
+	}
+	r.Forget("a")
+	if n := r.NumRequeues("a"); n != 0 {
+		t.Errorf("NumRequeues after Forget = %d, want 0", n)
+	}
+	if d := r.When("a"); float64(d) > float64(base)*(1+jitter) {
+		t.Errorf("delay after Forget = %v, want about %v", d, base)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	r := NewTokenBucket(1, 2, fakeClock)
+
+	want := []time.Duration{0, 0, time.Second, 2 * time.Second}
+	for i, w := range want {
+		if d := r.When(i); d != w {
+			t.Errorf("retry %d: delay %v, want %v", i, d, w)
+		}
+	}
+
+	// the 2 reserved tokens are paid back after 2s, another one is earned
+	fakeClock.Step(3 * time.Second)
+	if d := r.When("a"); d != 0 {
+		t.Errorf("delay after 3s = %v, want 0", d)
+	}
+	if d := r.When("b"); d != time.Second {
+		t.Errorf("delay once the bucket is empty again = %v, want 1s", d)
+	}
+	if n := r.NumRequeues("a"); n != 0 {
+		t.Errorf("NumRequeues = %d, want 0", n)
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	transient := workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Second)
+	permanent := workqueue.NewItemFastSlowRateLimiter(time.Minute, time.Hour, 1)
+	r := NewErrorClass(transient, permanent)
+
+	// items without an observed error are transient
+	if d := r.When("a"); d != time.Millisecond {
+		t.Errorf("delay without an observed error = %v, want 1ms", d)
+	}
+
+	r.Observe("a", errors.New("conflict"))
+	if d := r.When("a"); d != 2*time.Millisecond {
+		t.Errorf("delay of a transient error = %v, want 2ms", d)
+	}
+
+	r.Observe("a", Permanent(errors.New("invalid spec")))
+	if d := r.When("a"); d != time.Minute {
+		t.Errorf("delay of a permanent error = %v, want 1m", d)
+	}
+	if d := r.When("a"); d != time.Hour {
+		t.Errorf("delay of a second permanent error = %v, want 1h", d)
+	}
+
+	// other items aren't affected
+	if d := r.When("b"); d != time.Millisecond {
+		t.Errorf("delay of another item = %v, want 1ms", d)
+	}
+
+	if n := r.NumRequeues("a"); n != 4 {
+		t.Errorf("NumRequeues = %d, want 4 for 2 transient and 2 permanent failures", n)
+	}
+	r.Forget("a")
+	if n := r.NumRequeues("a"); n != 0 {
+		t.Errorf("NumRequeues after Forget = %d, want 0", n)
+	}
+	if d := r.When("a"); d != time.Millisecond {
+		t.Errorf("delay after Forget = %v, want the transient 1ms", d)
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	err := errors.New("invalid spec")
+	if Permanent(nil) != nil {
+		t.Error("Permanent(nil) != nil")
+	}
+	if IsPermanent(err) {
+		t.Error("IsPermanent of an unmarked error")
+	}
+	wrapped := Permanent(err)
+	if !IsPermanent(wrapped) || !errors.Is(wrapped, err) || wrapped.Error() != err.Error() {
+		t.Errorf("Permanent(%v) = %v, want a permanent error wrapping it", err, wrapped)
+	}
+}
+
+// observer records the errors observed for items.
+type observer struct {
+	workqueue.RateLimiter
+	observed map[interface{}]error
+}
+
+func (o *observer) Observe(item interface{}, err error) {
+	o.observed[item] = err
+}
+
+func TestMaxOf(t *testing.T) {
+	errorClass := NewErrorClass(
+		workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Second),
+		workqueue.NewItemFastSlowRateLimiter(time.Minute, time.Hour, 1),
+	)
+	recorder := &observer{
+		RateLimiter: workqueue.NewItemExponentialFailureRateLimiter(10*time.Millisecond, time.Second),
+		observed:    make(map[interface{}]error),
+	}
+	r := MaxOf(errorClass, recorder)
+
+	if d := r.When("a"); d != 10*time.Millisecond {
+		t.Errorf("delay = %v, want the longest of 1ms and 10ms", d)
+	}
+
+	err := Permanent(errors.New("invalid spec"))
+	Observe(r, "a", err)
+	if recorder.observed["a"] != err {
+		t.Errorf("observed %v, want %v passed on", recorder.observed["a"], err)
+	}
+	if d := r.When("a"); d != time.Minute {
+		t.Errorf("delay of a permanent error = %v, want the 1m of the error class", d)
+	}
+
+	if n := r.NumRequeues("a"); n != 2 {
+		t.Errorf("NumRequeues = %d, want 2", n)
+	}
+	r.Forget("a")
+	if n := r.NumRequeues("a"); n != 0 {
+		t.Errorf("NumRequeues after Forget = %d, want 0", n)
+	}
+
+	// limiters that aren't observers are ignored
+	Observe(workqueue.DefaultItemBasedRateLimiter(), "a", err)
+}
+
+func TestRestore(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	jitter := NewExponentialJitter(time.Millisecond, time.Second, 0, rand.New(rand.NewSource(1)))
+	exponential := workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Second)
+	bucket := NewTokenBucket(1, 1, fakeClock)
+	errorClass := NewErrorClass(workqueue.NewItemFastSlowRateLimiter(time.Millisecond, time.Minute, 2), jitter)
+
+	for _, test := range []struct {
+		name     string
+		limiter  workqueue.RateLimiter
+		restored bool
+		// requeues is NumRequeues after restoring 3 failures
+		requeues int
+	}{
+		{name: "exponential jitter", limiter: jitter, restored: true, requeues: 3},
+		{name: "client-go exponential", limiter: exponential, restored: true, requeues: 3},
+		{name: "fast slow", limiter: FastSlow(time.Millisecond, time.Minute, 2), restored: true, requeues: 3},
+		{name: "token bucket", limiter: bucket, restored: true},
+		{name: "client-go max of", limiter: workqueue.DefaultControllerRateLimiter(), restored: false},
+		{name: "max of", limiter: MaxOf(bucket, exponential), restored: true, requeues: 3},
+		{name: "error class", limiter: errorClass, restored: true, requeues: 3},
+	} {
+		if restored := Restore(test.limiter, test.name, 3); restored != test.restored {
+			t.Errorf("%s: Restore = %v, want %v", test.name, restored, test.restored)
+		}
+		if n := test.limiter.NumRequeues(test.name); n != test.requeues {
+			t.Errorf("%s: NumRequeues = %d, want %d", test.name, n, test.requeues)
+		}
+	}
+
+	// restoring doesn't take tokens of the bucket
+	if d := bucket.When("a"); d != 0 {
+		t.Errorf("delay of the bucket = %v after restoring, want 0", d)
+	}
+	// the next delay follows the restored failures
+	if d := exponential.When("max of"); d != 8*time.Millisecond {
+		t.Errorf("delay after 3 failures = %v, want 8ms", d)
+	}
+	if d := errorClass.When("error class"); d != time.Minute {
+		t.Errorf("delay after 3 failures = %v, want the slow 1m", d)
+	}
+}
+
+func TestParseAndBuild(t *testing.T) {
+	cfg, err := Parse([]byte(`
+type: max_of
+limiters:
+- type: error_class
+  transient: {type: exponential, base: 5ms, max: 1s, jitter: 0.2, seed: 1}
+  permanent: {type: fast_slow, fast: 50ms, slow: 200ms, fast_attempts: 2}
+- type: token_bucket
+  qps: 100
+  burst: 10
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if cfg.Limiters[0].Transient.Base != Duration(5*time.Millisecond) {
+		t.Errorf("base = %v, want 5ms", time.Duration(cfg.Limiters[0].Transient.Base))
+	}
+
+	r, err := Build(cfg, clock.NewFakeClock(time.Now()))
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	Observe(r, "a", Permanent(errors.New("invalid spec")))
+	if d := r.When("a"); d != 50*time.Millisecond {
+		t.Errorf("delay of a permanent error = %v, want 50ms", d)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, raw := range []string{
+		// unknown fields are rejected, so that typos aren't ignored
+		"type: exponential\nbase: 5ms\nmax: 1s\njiter: 0.2",
+		"type: exponential\nbase: 5",
+		"type: exponential\nbase: soon",
+		"[",
+	} {
+		if _, err := Parse([]byte(raw)); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", raw)
+		}
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	ms := Duration(time.Millisecond)
+	exponential := Config{Type: "exponential", Base: ms, Max: 10 * ms}
+
+	for _, tc := range []struct {
+		cfg  Config
+		want string
+	}{
+		{Config{Type: "linear"}, `unknown rate limiter type "linear"`},
+		{Config{}, `unknown rate limiter type ""`},
+		{Config{Type: "exponential", Base: 10 * ms, Max: ms}, "base must be positive"},
+		{Config{Type: "exponential", Max: ms}, "base must be positive"},
+		{Config{Type: "exponential", Base: ms, Max: ms, Jitter: 1.5}, "jitter must be within [0, 1]"},
+		{Config{Type: "exponential", Base: ms, Max: ms, Jitter: -0.1}, "jitter must be within [0, 1]"},
+		{Config{Type: "token_bucket", QPS: 10}, "qps and burst must be positive"},
+		{Config{Type: "fast_slow", Fast: 10 * ms, Slow: ms, FastAttempts: 1}, "slow not below fast"},
+		{Config{Type: "max_of"}, "no limiters"},
+		{Config{Type: "max_of", Limiters: []Config{exponential, {Type: "linear"}}}, "limiter 1"},
+		{Config{Type: "error_class", Transient: &exponential}, "transient and permanent are required"},
+		{Config{Type: "error_class", Transient: &exponential, Permanent: &Config{Type: "linear"}}, "permanent"},
+	} {
+		_, err := Build(&tc.cfg, clock.RealClock{})
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("Build(%+v) err = %v, want one containing %q", tc.cfg, err, tc.want)
+		}
+	}
+}
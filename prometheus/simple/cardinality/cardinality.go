@@ -0,0 +1,363 @@
+// Package cardinality wraps metric vectors to bound the number of their
+// series, so that unbounded label values like request IDs can't blow up
+// Prometheus.
+package cardinality
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Limits are the limits of a vector.
+type Limits struct {
+	// MaxSeries is the maximum number of label combinations, unlimited if
+	// zero.
+	MaxSeries int
+	// Allowed are the allowed values of labels, labels without an entry
+	// accept any value.
+	Allowed map[string][]string
+	// Overflow replaces label values that aren't allowed, and is the value
+	// of every label of the single overflow series new combinations over
+	// MaxSeries are recorded with, which isn't counted against MaxSeries. If
+	// empty, they are rejected.
+	Overflow string
+}
+
+// LimitError is returned for a new label combination of a vector that
+// already has its maximum number of series.
+type LimitError struct {
+	Metric string
+	Limit  int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("metric %s already has the maximum of %d series", e.Metric, e.Limit)
+}
+
+// ValueError is returned for a label value that isn't allowed.
+type ValueError struct {
+	Metric string
+	Label  string
+	Value  string
+}
+
+func (e *ValueError) Error() string {
+	return fmt.Sprintf("value %q of label %s of metric %s is not allowed", e.Value, e.Label, e.Metric)
+}
+
+const (
+	reasonLimit = "limit"
+	reasonValue = "value"
+)
+
+// vec is implemented by the metric vectors of client_golang.
+type vec interface {
+	prometheus.Collector
+	DeleteLabelValues(lvs ...string) bool
+}
+
+// guard admits the label values of a vector.
+type guard struct {
+	name       string
+	labelNames []string
+	limits     Limits
+	allowed    []map[string]bool
+	vec        vec
+
+	// overflow are the label values of the overflow series, all of them
+	// the overflow value
+	overflow []string
+
+	mu     sync.Mutex
+	series map[string]bool
+	// overflowing tells whether the overflow series exists outside series
+	overflowing bool
+	rejected    map[string]float64
+	overflowed  map[string]float64
+
+	seriesDesc     *prometheus.Desc
+	limitDesc      *prometheus.Desc
+	rejectedDesc   *prometheus.Desc
+	overflowedDesc *prometheus.Desc
+}
+
+func newGuard(name string, labelNames []string, limits Limits, v vec) *guard {
+	g := &guard{
+		name:       name,
+		labelNames: labelNames,
+		limits:     limits,
+		allowed:    make([]map[string]bool, len(labelNames)),
+		vec:        v,
+		series:     make(map[string]bool),
+		rejected:   make(map[string]float64),
+		overflowed: make(map[string]float64),
+		seriesDesc: prometheus.NewDesc(
+			"cardinality_series",
+			"Number of series of a metric counted against its limit, excluding the overflow series.",
+			nil, prometheus.Labels{"metric": name},
+		),
+		limitDesc: prometheus.NewDesc(
+			"cardinality_series_limit",
+			"Maximum number of series of a metric, 0 if unlimited.",
+			nil, prometheus.Labels{"metric": name},
+		),
+		rejectedDesc: prometheus.NewDesc(
+			"cardinality_rejected_total",
+			"Number of updates of a metric rejected because of the series limit or a label value that isn't allowed.",
+			[]string{"reason"}, prometheus.Labels{"metric": name},
+		),
+		overflowedDesc: prometheus.NewDesc(
+			"cardinality_overflowed_total",
+			"Number of updates of a metric redirected to the overflow label value.",
+			[]string{"reason"}, prometheus.Labels{"metric": name},
+		),
+	}
+
+	if limits.Overflow != "" {
+		g.overflow = make([]string, len(labelNames))
+		for i := range g.overflow {
+			g.overflow[i] = limits.Overflow
+		}
+	}
+	for i, name := range labelNames {
+		values, exist := limits.Allowed[name]
+		if !exist {
+			continue
+		}
+		g.allowed[i] = make(map[string]bool, len(values))
+		for _, v := range values {
+			g.allowed[i][v] = true
+		}
+		if limits.Overflow != "" {
+			g.allowed[i][limits.Overflow] = true
+		}
+	}
+
+	return g
+}
+
+// admit returns the label values lvs are recorded with, which replace
+// values that aren't allowed with the overflow value and collapse
+// combinations over the limit into the overflow series, and runs f with
+// them with the lock held.
+func (g *guard) admit(lvs []string, f func(lvs []string) error) error {
+	if len(lvs) != len(g.labelNames) {
+		// let the vector report the inconsistent cardinality
+		return f(lvs)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var admitted []string
+	for i, v := range lvs {
+		if g.allowed[i] == nil || g.allowed[i][v] {
+			continue
+		}
+		if g.limits.Overflow == "" {
+			g.rejected[reasonValue]++
+			return &ValueError{Metric: g.name, Label: g.labelNames[i], Value: v}
+		}
+		if admitted == nil {
+			admitted = append([]string(nil), lvs...)
+		}
+		admitted[i] = g.limits.Overflow
+	}
+	if admitted != nil {
+		g.overflowed[reasonValue]++
+		lvs = admitted
+	}
+
+	key := strings.Join(lvs, "\xff")
+	if !g.series[key] && g.limits.MaxSeries > 0 && len(g.series) >= g.limits.MaxSeries {
+		if g.limits.Overflow == "" {
+			g.rejected[reasonLimit]++
+			return &LimitError{Metric: g.name, Limit: g.limits.MaxSeries}
+		}
+		g.overflowed[reasonLimit]++
+
+		// every new combination over the limit shares the single overflow
+		// series, which doesn't take a slot
+		if err := f(g.overflow); err != nil {
+			return err
+		}
+		g.overflowing = true
+		return nil
+	}
+
+	if err := f(lvs); err != nil {
+		return err
+	}
+	g.series[key] = true
+	return nil
+}
+
+// DeleteLabelValues deletes the series of lvs, which frees its slot.
+func (g *guard) DeleteLabelValues(lvs ...string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := strings.Join(lvs, "\xff")
+	delete(g.series, key)
+	if g.overflowing && key == strings.Join(g.overflow, "\xff") {
+		g.overflowing = false
+	}
+	return g.vec.DeleteLabelValues(lvs...)
+}
+
+// Len returns the number of series counted against the limit, which
+// excludes the overflow series.
+func (g *guard) Len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.series)
+}
+
+// Describe implements prometheus.Collector.
+func (g *guard) Describe(ch chan<- *prometheus.Desc) {
+	g.vec.Describe(ch)
+	ch <- g.seriesDesc
+	ch <- g.limitDesc
+	ch <- g.rejectedDesc
+	ch <- g.overflowedDesc
+}
+
+// Collect implements prometheus.Collector, collecting the series of the
+// vector and the guard's own metrics.
+func (g *guard) Collect(ch chan<- prometheus.Metric) {
+	g.vec.Collect(ch)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(g.seriesDesc, prometheus.GaugeValue, float64(len(g.series)))
+	ch <- prometheus.MustNewConstMetric(g.limitDesc, prometheus.GaugeValue, float64(g.limits.MaxSeries))
+	for _, reason := range []string{reasonLimit, reasonValue} {
+		ch <- prometheus.MustNewConstMetric(g.rejectedDesc, prometheus.CounterValue, g.rejected[reason], reason)
+		ch <- prometheus.MustNewConstMetric(g.overflowedDesc, prometheus.CounterValue, g.overflowed[reason], reason)
+	}
+}
+
+// GaugeVec is a prometheus.GaugeVec with limited cardinality. Register the
+// GaugeVec itself, not the vector it wraps.
+type GaugeVec struct {
+	*guard
+	vec *prometheus.GaugeVec
+}
+
+// NewGaugeVec returns a GaugeVec with limits.
+func NewGaugeVec(opts prometheus.GaugeOpts, labelNames []string, limits Limits) *GaugeVec {
+	v := prometheus.NewGaugeVec(opts, labelNames)
+	return &GaugeVec{
+		guard: newGuard(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), labelNames, limits, v),
+		vec:   v,
+	}
+}
+
+// GetMetricWithLabelValues returns the gauge lvs are recorded with, or a
+// *LimitError or *ValueError if they are rejected.
+func (v *GaugeVec) GetMetricWithLabelValues(lvs ...string) (prometheus.Gauge, error) {
+	var m prometheus.Gauge
+	err := v.admit(lvs, func(lvs []string) (err error) {
+		m, err = v.vec.GetMetricWithLabelValues(lvs...)
+		return err
+	})
+	return m, err
+}
+
+// WithLabelValues is like GetMetricWithLabelValues, but returns a gauge that
+// discards updates if lvs are rejected. Rejections are counted by the
+// cardinality_rejected_total metric. Like prometheus.GaugeVec, it panics
+// for a wrong number of label values.
+func (v *GaugeVec) WithLabelValues(lvs ...string) prometheus.Gauge {
+	m, err := v.GetMetricWithLabelValues(lvs...)
+	if err != nil {
+		if !rejected(err) {
+			panic(err)
+		}
+		// an unregistered gauge is never collected
+		return prometheus.NewGauge(prometheus.GaugeOpts{Name: "discarded", Help: "discarded"})
+	}
+	return m
+}
+
+// With is like WithLabelValues with the label values given by name.
+func (v *GaugeVec) With(labels prometheus.Labels) prometheus.Gauge {
+	return v.WithLabelValues(labelValues(v.labelNames, labels)...)
+}
+
+// CounterVec is a prometheus.CounterVec with limited cardinality, like
+// GaugeVec.
+type CounterVec struct {
+	*guard
+	vec *prometheus.CounterVec
+}
+
+// NewCounterVec returns a CounterVec with limits.
+func NewCounterVec(opts prometheus.CounterOpts, labelNames []string, limits Limits) *CounterVec {
+	v := prometheus.NewCounterVec(opts, labelNames)
+	return &CounterVec{
+		guard: newGuard(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), labelNames, limits, v),
+		vec:   v,
+	}
+}
+
+// GetMetricWithLabelValues returns the counter lvs are recorded with, or a
+// *LimitError or *ValueError if they are rejected.
+func (v *CounterVec) GetMetricWithLabelValues(lvs ...string) (prometheus.Counter, error) {
+	var m prometheus.Counter
+	err := v.admit(lvs, func(lvs []string) (err error) {
+		m, err = v.vec.GetMetricWithLabelValues(lvs...)
+		return err
+	})
+	return m, err
+}
+
+// WithLabelValues is like GetMetricWithLabelValues, but returns a counter
+// that discards updates if lvs are rejected. Like prometheus.CounterVec, it
+// panics for a wrong number of label values.
+func (v *CounterVec) WithLabelValues(lvs ...string) prometheus.Counter {
+	m, err := v.GetMetricWithLabelValues(lvs...)
+	if err != nil {
+		if !rejected(err) {
+			panic(err)
+		}
+		// an unregistered counter is never collected
+		return prometheus.NewCounter(prometheus.CounterOpts{Name: "discarded", Help: "discarded"})
+	}
+	return m
+}
+
+// With is like WithLabelValues with the label values given by name.
+func (v *CounterVec) With(labels prometheus.Labels) prometheus.Counter {
+	return v.WithLabelValues(labelValues(v.labelNames, labels)...)
+}
+
+// rejected tells whether err rejects label values because of the limits.
+func rejected(err error) bool {
+	switch err.(type) {
+	case *LimitError, *ValueError:
+		return true
+	}
+	return false
+}
+
+// labelValues returns the values of labels in the order of labelNames. Like
+// client_golang, it panics if labels aren't exactly labelNames.
+func labelValues(labelNames []string, labels prometheus.Labels) []string {
+	if len(labels) != len(labelNames) {
+		panic(fmt.Errorf("inconsistent label cardinality: expected %d label values but got %d in %v", len(labelNames), len(labels), labels))
+	}
+	lvs := make([]string, len(labelNames))
+	for i, name := range labelNames {
+		value, exist := labels[name]
+		if !exist {
+			panic(fmt.Errorf("label name %q missing in label map", name))
+		}
+		lvs[i] = value
+	}
+	return lvs
+}
@@ -0,0 +1,230 @@
+package cardinality
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gather returns the values of the series of metric collected from c by
+// their label values joined with commas.
+func gather(t *testing.T, c prometheus.Collector, metric string) map[string]float64 {
+	t.Helper()
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+
+	series := make(map[string]float64)
+	for _, mf := range families {
+		if mf.GetName() != metric {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			var lvs []string
+			for _, l := range m.GetLabel() {
+				if l.GetName() != "metric" {
+					lvs = append(lvs, l.GetName()+"="+l.GetValue())
+				}
+			}
+			series[strings.Join(lvs, ",")] = m.GetGauge().GetValue() + m.GetCounter().GetValue()
+		}
+	}
+	return series
+}
+
+func newRequests(limits Limits) *CounterVec {
+	return NewCounterVec(
+		prometheus.CounterOpts{Name: "requests_total", Help: "Requests by method and request ID."},
+		[]string{"method", "request_id"},
+		limits,
+	)
+}
+
+func TestLimit(t *testing.T) {
+	v := newRequests(Limits{MaxSeries: 2})
+
+	for _, id := range []string{"1", "2"} {
+		if _, err := v.GetMetricWithLabelValues("GET", id); err != nil {
+			t.Fatalf("GetMetricWithLabelValues(GET, %s) failed: %v", id, err)
+		}
+	}
+	// existing series are still admitted
+	if _, err := v.GetMetricWithLabelValues("GET", "1"); err != nil {
+		t.Fatalf("GetMetricWithLabelValues of an existing series failed: %v", err)
+	}
+
+	_, err := v.GetMetricWithLabelValues("GET", "3")
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Limit != 2 || limitErr.Metric != "requests_total" {
+		t.Fatalf("err = %v, want a LimitError", err)
+	}
+	// rejected updates are discarded
+	v.WithLabelValues("GET", "3").Inc()
+
+	if got := v.Len(); got != 2 {
+		t.Errorf("Len = %d, want 2", got)
+	}
+	want := map[string]float64{"reason=limit": 2, "reason=value": 0}
+	if got := gather(t, v, "cardinality_rejected_total"); !reflect.DeepEqual(got, want) {
+		t.Errorf("cardinality_rejected_total = %v, want %v", got, want)
+	}
+	if got := gather(t, v, "requests_total"); len(got) != 2 {
+		t.Errorf("requests_total = %v, want 2 series", got)
+	}
+}
+
+func TestAllowedValues(t *testing.T) {
+	v := newRequests(Limits{Allowed: map[string][]string{"method": {"GET", "POST"}}})
+
+	if _, err := v.GetMetricWithLabelValues("POST", "1"); err != nil {
+		t.Fatalf("GetMetricWithLabelValues of an allowed value failed: %v", err)
+	}
+	_, err := v.GetMetricWithLabelValues("BREW", "1")
+	var valueErr *ValueError
+	if !errors.As(err, &valueErr) || valueErr.Label != "method" || valueErr.Value != "BREW" {
+		t.Fatalf("err = %v, want a ValueError", err)
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	v := newRequests(Limits{
+		MaxSeries: 3,
+		Allowed:   map[string][]string{"method": {"GET", "POST"}},
+		Overflow:  "other",
+	})
+
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		v.WithLabelValues("GET", id).Inc()
+	}
+	// combinations over the limit share the overflow series whatever their
+	// allowed values
+	v.WithLabelValues("POST", "6").Inc()
+	v.WithLabelValues("BREW", "7").Inc()
+
+	want := map[string]float64{
+		"method=GET,request_id=1":       1,
+		"method=GET,request_id=2":       1,
+		"method=GET,request_id=3":       1,
+		"method=other,request_id=other": 4,
+	}
+	if got := gather(t, v, "requests_total"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("requests_total = %v, want %v", got, want)
+	}
+	if got := gather(t, v, "cardinality_series"); got[""] != 3 {
+		t.Errorf("cardinality_series = %v, want 3", got)
+	}
+	want = map[string]float64{"reason=limit": 4, "reason=value": 1}
+	if got := gather(t, v, "cardinality_overflowed_total"); !reflect.DeepEqual(got, want) {
+		t.Errorf("cardinality_overflowed_total = %v, want %v", got, want)
+	}
+}
+
+func TestOverflowValueWithinLimit(t *testing.T) {
+	v := newRequests(Limits{
+		MaxSeries: 3,
+		Allowed:   map[string][]string{"method": {"GET", "POST"}},
+		Overflow:  "other",
+	})
+
+	// a value that isn't allowed is replaced, and the series takes a slot
+	v.WithLabelValues("BREW", "1").Inc()
+	want := map[string]float64{"method=other,request_id=1": 1}
+	if got := gather(t, v, "requests_total"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("requests_total = %v, want %v", got, want)
+	}
+	if got := v.Len(); got != 1 {
+		t.Fatalf("Len = %d, want 1", got)
+	}
+}
+
+func TestAllLabelsAllowed(t *testing.T) {
+	v := NewGaugeVec(
+		prometheus.GaugeOpts{Name: "in_flight", Help: "In flight requests by method."},
+		[]string{"method"},
+		Limits{
+			MaxSeries: 1,
+			Allowed:   map[string][]string{"method": {"GET", "POST", "PUT"}},
+			Overflow:  "other",
+		},
+	)
+
+	v.WithLabelValues("GET").Inc()
+	v.WithLabelValues("POST").Inc()
+	v.WithLabelValues("PUT").Inc()
+
+	want := map[string]float64{"method=GET": 1, "method=other": 2}
+	if got := gather(t, v, "in_flight"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("in_flight = %v, want %v", got, want)
+	}
+	if got := v.Len(); got != 1 {
+		t.Fatalf("Len = %d, want 1", got)
+	}
+}
+
+func TestDeleteFreesSlot(t *testing.T) {
+	v := NewGaugeVec(
+		prometheus.GaugeOpts{Name: "in_flight", Help: "In flight requests by method."},
+		[]string{"method"},
+		Limits{MaxSeries: 1},
+	)
+
+	if _, err := v.GetMetricWithLabelValues("GET"); err != nil {
+		t.Fatalf("GetMetricWithLabelValues(GET) failed: %v", err)
+	}
+	if _, err := v.GetMetricWithLabelValues("POST"); err == nil {
+		t.Fatal("GetMetricWithLabelValues(POST) over the limit succeeded")
+	}
+	if !v.DeleteLabelValues("GET") {
+		t.Fatal("DeleteLabelValues(GET) found no series")
+	}
+	if _, err := v.GetMetricWithLabelValues("POST"); err != nil {
+		t.Fatalf("GetMetricWithLabelValues(POST) after delete failed: %v", err)
+	}
+}
+
+func TestDeleteOverflowSeries(t *testing.T) {
+	v := NewGaugeVec(
+		prometheus.GaugeOpts{Name: "in_flight", Help: "In flight requests by method."},
+		[]string{"method"},
+		Limits{MaxSeries: 1, Overflow: "other"},
+	)
+
+	v.WithLabelValues("GET").Inc()
+	v.WithLabelValues("POST").Inc()
+	if !v.DeleteLabelValues("other") {
+		t.Fatal("DeleteLabelValues(other) found no series")
+	}
+	// the slot of GET is still taken
+	v.WithLabelValues("PUT").Inc()
+
+	want := map[string]float64{"method=GET": 1, "method=other": 1}
+	if got := gather(t, v, "in_flight"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("in_flight = %v, want %v", got, want)
+	}
+}
+
+func TestWrongLabelCountPanics(t *testing.T) {
+	v := newRequests(Limits{MaxSeries: 1})
+
+	for name, f := range map[string]func(){
+		"WithLabelValues": func() { v.WithLabelValues("GET") },
+		"With":            func() { v.With(prometheus.Labels{"method": "GET"}) },
+		"With wrong name": func() { v.With(prometheus.Labels{"method": "GET", "id": "1"}) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s didn't panic", name)
+				}
+			}()
+			f()
+		}()
+	}
+}
@@ -0,0 +1,278 @@
+// Package churn compares the series that exist in consecutive time windows
+// to find the series that are created and deleted, and what drives it.
+package churn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/fatsheep9146/go-best-practise/prometheus/simple/client"
+)
+
+// Window is the series that existed between Start and End.
+type Window struct {
+	Start  time.Time
+	End    time.Time
+	Series []model.LabelSet
+}
+
+// Collect queries the series matching any of matches in count consecutive
+// windows of width ending at end.
+func Collect(ctx context.Context, cli *client.Client, matches []string, end time.Time, width time.Duration, count int) ([]Window, error) {
+	windows := make([]Window, 0, count)
+	start := end.Add(-time.Duration(count) * width)
+
+	for i := 0; i < count; i++ {
+		w := Window{Start: start.Add(time.Duration(i) * width)}
+		w.End = w.Start.Add(width)
+
+		series, _, err := cli.Series(ctx, matches, w.Start, w.End)
+		if err != nil {
+			return nil, fmt.Errorf("query series of window %s - %s failed, err: %v",
+				w.Start.Format(time.RFC3339), w.End.Format(time.RFC3339), err)
+		}
+		w.Series = series
+		windows = append(windows, w)
+	}
+
+	return windows, nil
+}
+
+// WindowReport is the churn of a window compared to the previous one.
+type WindowReport struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Series int       `json:"series"`
+	// Births are the series that didn't exist in the previous window.
+	Births int `json:"births"`
+	// Deaths are the series of the previous window that don't exist anymore.
+	Deaths int `json:"deaths"`
+}
+
+// LabelChurn is how often the values of a label of a metric changed.
+type LabelChurn struct {
+	Metric string `json:"metric"`
+	Label  string `json:"label"`
+	// New and Gone count values appearing in and disappearing from a window.
+	New  int `json:"new"`
+	Gone int `json:"gone"`
+}
+
+// Offender is a metric with many series.
+type Offender struct {
+	Metric string `json:"metric"`
+	// Series is the largest number of series the metric had in a window.
+	Series int `json:"series"`
+	// Labels are the number of distinct values of each label in that window.
+	Labels map[string]int `json:"labels"`
+}
+
+// Report is the churn over consecutive windows.
+type Report struct {
+	Windows []WindowReport `json:"windows"`
+	Births  int            `json:"births"`
+	Deaths  int            `json:"deaths"`
+	// Labels are sorted by decreasing churn.
+	Labels []LabelChurn `json:"labels"`
+	// Top are the metrics with the most series, by decreasing series.
+	Top []Offender `json:"top"`
+}
+
+// Analyze diffs the series of consecutive windows, keeping the top metrics
+// and the top labels driving the churn.
+func Analyze(windows []Window, top int) *Report {
+	r := &Report{}
+	labels := make(map[[2]string]*LabelChurn)
+	offenders := make(map[string]*Offender)
+
+	var previous map[model.Fingerprint]model.LabelSet
+	for i, w := range windows {
+		current := make(map[model.Fingerprint]model.LabelSet, len(w.Series))
+		for _, ls := range w.Series {
+			current[ls.Fingerprint()] = ls
+		}
+
+		wr := WindowReport{Start: w.Start, End: w.End, Series: len(current)}
+		if i > 0 {
+			for fp := range current {
+				if _, exist := previous[fp]; !exist {
+					wr.Births++
+				}
+			}
+			for fp := range previous {
+				if _, exist := current[fp]; !exist {
+					wr.Deaths++
+				}
+			}
+
+			prevValues, curValues := labelValues(previous), labelValues(current)
+			for key, values := range curValues {
+				for v := range values {
+					if !prevValues[key][v] {
+						labelChurn(labels, key).New++
+					}
+				}
+			}
+			for key, values := range prevValues {
+				for v := range values {
+					if !curValues[key][v] {
+						labelChurn(labels, key).Gone++
+					}
+				}
+			}
+		}
+		r.Windows = append(r.Windows, wr)
+		r.Births += wr.Births
+		r.Deaths += wr.Deaths
+
+		for metric, o := range cardinality(current) {
+			if best, exist := offenders[metric]; !exist || o.Series > best.Series {
+				offenders[metric] = o
+			}
+		}
+
+		previous = current
+	}
+
+	for _, lc := range labels {
+		r.Labels = append(r.Labels, *lc)
+	}
+	sort.Slice(r.Labels, func(i, j int) bool {
+		a, b := r.Labels[i], r.Labels[j]
+		if a.New+a.Gone != b.New+b.Gone {
+			return a.New+a.Gone > b.New+b.Gone
+		}
+		if a.Metric != b.Metric {
+			return a.Metric < b.Metric
+		}
+		return a.Label < b.Label
+	})
+	if top > 0 && len(r.Labels) > top {
+		r.Labels = r.Labels[:top]
+	}
+
+	for _, o := range offenders {
+		r.Top = append(r.Top, *o)
+	}
+	sort.Slice(r.Top, func(i, j int) bool {
+		if r.Top[i].Series != r.Top[j].Series {
+			return r.Top[i].Series > r.Top[j].Series
+		}
+		return r.Top[i].Metric < r.Top[j].Metric
+	})
+	if top > 0 && len(r.Top) > top {
+		r.Top = r.Top[:top]
+	}
+
+	return r
+}
+
+// labelValues returns the values of the labels of each metric, keyed by
+// metric and label name.
+func labelValues(series map[model.Fingerprint]model.LabelSet) map[[2]string]map[model.LabelValue]bool {
+	values := make(map[[2]string]map[model.LabelValue]bool)
+	for _, ls := range series {
+		metric := string(ls[model.MetricNameLabel])
+		for name, value := range ls {
+			if name == model.MetricNameLabel {
+				continue
+			}
+			key := [2]string{metric, string(name)}
+			if values[key] == nil {
+				values[key] = make(map[model.LabelValue]bool)
+			}
+			values[key][value] = true
+		}
+	}
+	return values
+}
+
+func labelChurn(labels map[[2]string]*LabelChurn, key [2]string) *LabelChurn {
+	lc, exist := labels[key]
+	if !exist {
+		lc = &LabelChurn{Metric: key[0], Label: key[1]}
+		labels[key] = lc
+	}
+	return lc
+}
+
+func cardinality(series map[model.Fingerprint]model.LabelSet) map[string]*Offender {
+	offenders := make(map[string]*Offender)
+	for key, values := range labelValues(series) {
+		o := offender(offenders, key[0])
+		o.Labels[key[1]] = len(values)
+	}
+	for _, ls := range series {
+		offender(offenders, string(ls[model.MetricNameLabel])).Series++
+	}
+	return offenders
+}
+
+func offender(offenders map[string]*Offender, metric string) *Offender {
+	o, exist := offenders[metric]
+	if !exist {
+		o = &Offender{Metric: metric, Labels: make(map[string]int)}
+		offenders[metric] = o
+	}
+	return o
+}
+
+// WriteText writes the report as tables.
+func (r *Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "WINDOW\tSERIES\tBIRTHS\tDEATHS\n")
+	for _, wr := range r.Windows {
+		fmt.Fprintf(tw, "%s - %s\t%d\t%d\t%d\n",
+			wr.Start.Format(time.RFC3339), wr.End.Format(time.RFC3339), wr.Series, wr.Births, wr.Deaths)
+	}
+	fmt.Fprintf(tw, "total\t\t%d\t%d\n\n", r.Births, r.Deaths)
+
+	fmt.Fprintf(tw, "METRIC\tLABEL\tNEW VALUES\tGONE VALUES\n")
+	for _, lc := range r.Labels {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\n", lc.Metric, lc.Label, lc.New, lc.Gone)
+	}
+	fmt.Fprintln(tw)
+
+	fmt.Fprintf(tw, "METRIC\tSERIES\tLABEL VALUES\n")
+	for _, o := range r.Top {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", o.Metric, o.Series, formatLabels(o.Labels))
+	}
+
+	return tw.Flush()
+}
+
+// WriteJSON writes the report as indented JSON.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// formatLabels formats the label cardinalities by decreasing cardinality.
+func formatLabels(labels map[string]int) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if labels[names[i]] != labels[names[j]] {
+			return labels[names[i]] > labels[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%d", name, labels[name]))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,208 @@
+package churn
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/fatsheep9146/go-best-practise/prometheus/simple/client"
+	"github.com/fatsheep9146/go-best-practise/prometheus/simple/mini"
+)
+
+func labelSet(name string, labels ...string) model.LabelSet {
+	ls := model.LabelSet{model.MetricNameLabel: model.LabelValue(name)}
+	for i := 0; i+1 < len(labels); i += 2 {
+		ls[model.LabelName(labels[i])] = model.LabelValue(labels[i+1])
+	}
+	return ls
+}
+
+// testWindows are three windows of a minute: instances of up come and go,
+// and the path and then the code of requests change.
+func testWindows() []Window {
+	start := time.Unix(0, 0).UTC()
+	window := func(i int, series ...model.LabelSet) Window {
+		return Window{
+			Start:  start.Add(time.Duration(i) * time.Minute),
+			End:    start.Add(time.Duration(i+1) * time.Minute),
+			Series: series,
+		}
+	}
+	return []Window{
+		window(0,
+			labelSet("up", "instance", "a"),
+			labelSet("up", "instance", "b"),
+			labelSet("requests", "path", "/x", "code", "200"),
+		),
+		window(1,
+			labelSet("up", "instance", "a"),
+			labelSet("up", "instance", "c"),
+			labelSet("requests", "path", "/x", "code", "200"),
+			labelSet("requests", "path", "/y", "code", "200"),
+		),
+		window(2,
+			labelSet("up", "instance", "c"),
+			labelSet("requests", "path", "/y", "code", "500"),
+		),
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	windows := testWindows()
+	report := func(i, series, births, deaths int) WindowReport {
+		return WindowReport{Start: windows[i].Start, End: windows[i].End, Series: series, Births: births, Deaths: deaths}
+	}
+
+	for _, test := range []struct {
+		name string
+		top  int
+		want *Report
+	}{
+		{
+			name: "all",
+			want: &Report{
+				Windows: []WindowReport{report(0, 3, 0, 0), report(1, 4, 2, 1), report(2, 2, 1, 3)},
+				Births:  3,
+				Deaths:  4,
+				Labels: []LabelChurn{
+					{Metric: "up", Label: "instance", New: 1, Gone: 2},
+					{Metric: "requests", Label: "code", New: 1, Gone: 1},
+					{Metric: "requests", Label: "path", New: 1, Gone: 1},
+				},
+				// up had as many series in the first window as in the
+				// second, the first is kept
+				Top: []Offender{
+					{Metric: "requests", Series: 2, Labels: map[string]int{"path": 2, "code": 1}},
+					{Metric: "up", Series: 2, Labels: map[string]int{"instance": 2}},
+				},
+			},
+		},
+		{
+			name: "top",
+			top:  1,
+			want: &Report{
+				Windows: []WindowReport{report(0, 3, 0, 0), report(1, 4, 2, 1), report(2, 2, 1, 3)},
+				Births:  3,
+				Deaths:  4,
+				Labels:  []LabelChurn{{Metric: "up", Label: "instance", New: 1, Gone: 2}},
+				Top:     []Offender{{Metric: "requests", Series: 2, Labels: map[string]int{"path": 2, "code": 1}}},
+			},
+		},
+	} {
+		if got := Analyze(windows, test.top); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: Analyze = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAnalyzeWithoutChurn(t *testing.T) {
+	windows := testWindows()[:1]
+	windows = append(windows, windows[0])
+	// the same series in any order and with duplicates are the same
+	windows[1].Series = append([]model.LabelSet{windows[0].Series[2]}, windows[0].Series...)
+
+	r := Analyze(windows, 0)
+	if r.Births != 0 || r.Deaths != 0 || len(r.Labels) != 0 {
+		t.Fatalf("Analyze = %+v, want no churn", r)
+	}
+	if r.Windows[1].Series != 3 {
+		t.Fatalf("second window has %d series, want 3", r.Windows[1].Series)
+	}
+
+	if r := Analyze(nil, 0); len(r.Windows) != 0 || len(r.Top) != 0 {
+		t.Fatalf("Analyze(nil) = %+v, want an empty report", r)
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	var b bytes.Buffer
+	if err := Analyze(testWindows(), 0).WriteText(&b); err != nil {
+		t.Fatalf("WriteText failed: %v", err)
+	}
+
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(b.String(), "\n") {
+		lines[strings.Join(strings.Fields(line), " ")] = true
+	}
+	for _, want := range []string{
+		"WINDOW SERIES BIRTHS DEATHS",
+		"1970-01-01T00:01:00Z - 1970-01-01T00:02:00Z 4 2 1",
+		"total 3 4",
+		"up instance 1 2",
+		"requests 2 path=2 code=1",
+		"up 2 instance=2",
+	} {
+		if !lines[want] {
+			t.Errorf("WriteText has no line %q:\n%s", want, b.String())
+		}
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	want := Analyze(testWindows(), 0)
+
+	var b bytes.Buffer
+	if err := want.WriteJSON(&b); err != nil {
+		t.Fatalf("WriteJSON failed: %v", err)
+	}
+	got := &Report{}
+	if err := json.Unmarshal(b.Bytes(), got); err != nil {
+		t.Fatalf("unmarshal report failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("WriteJSON decodes as %+v, want %+v", got, want)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	storage := mini.NewStorage()
+	for _, s := range []struct {
+		metric model.Metric
+		at     []int64
+	}{
+		{metric: model.Metric{model.MetricNameLabel: "up", "instance": "a"}, at: []int64{10, 50}},
+		{metric: model.Metric{model.MetricNameLabel: "up", "instance": "b"}, at: []int64{150}},
+		{metric: model.Metric{model.MetricNameLabel: "up", "instance": "c"}, at: []int64{250, 290}},
+		{metric: model.Metric{model.MetricNameLabel: "other"}, at: []int64{10, 150, 250}},
+	} {
+		for _, at := range s.at {
+			storage.Append(s.metric, model.TimeFromUnix(at), 1)
+		}
+	}
+	server := httptest.NewServer(mini.NewAPI(storage, mini.NewEngine(storage)))
+	t.Cleanup(server.Close)
+	cli, err := client.New(client.Config{Address: server.URL})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	windows, err := Collect(context.Background(), cli, []string{"up"}, time.Unix(300, 0), 100*time.Second, 3)
+	if err != nil {
+		t.Fatalf("Collect failed: %v", err)
+	}
+	if len(windows) != 3 {
+		t.Fatalf("Collect returned %d windows, want 3", len(windows))
+	}
+	for i, instance := range []string{"a", "b", "c"} {
+		w := windows[i]
+		if !w.Start.Equal(time.Unix(int64(100*i), 0)) || !w.End.Equal(time.Unix(int64(100*(i+1)), 0)) {
+			t.Errorf("window %d is %v - %v", i, w.Start, w.End)
+		}
+		want := []model.LabelSet{labelSet("up", "instance", instance)}
+		if !reflect.DeepEqual(w.Series, want) {
+			t.Errorf("window %d has %v, want %v", i, w.Series, want)
+		}
+	}
+
+	_, err = Collect(context.Background(), cli, []string{"up{"}, time.Unix(300, 0), 100*time.Second, 3)
+	if err == nil || !strings.Contains(err.Error(), "query series of window") {
+		t.Fatalf("Collect of a bad selector err = %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+// Package client is a Prometheus HTTP API client with typed query helpers,
+// authentication, timeouts and retries.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+)
+
+// Config configures a Client. Only Address is required.
+type Config struct {
+	// Address is the URL of the Prometheus server, like http://localhost:9090.
+	Address string
+
+	// Username and Password enable basic authentication if Username is set.
+	Username string
+	Password string
+	// BearerToken is sent in the Authorization header if set.
+	BearerToken string
+
+	// DialTimeout limits connecting to the server, 5s if zero.
+	DialTimeout time.Duration
+	// Timeout limits each request, including reading the response. Zero
+	// means no limit besides the context.
+	Timeout time.Duration
+
+	// Retries is how many times a request failing with a server or network
+	// error is retried.
+	Retries int
+	// MinBackoff is the wait before the first retry, 100ms if zero. The wait
+	// doubles after each retry up to MaxBackoff, 5s if zero.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Client queries the HTTP API of a Prometheus server.
+type Client struct {
+	api v1.API
+	cfg Config
+}
+
+// New returns a client for the server at cfg.Address.
+func New(cfg Config) (*Client, error) {
+	if cfg.Address == "" {
+		return nil, errors.New("no address")
+	}
+	if cfg.Username != "" && cfg.BearerToken != "" {
+		return nil, errors.New("at most one of basic authentication and bearer token may be configured")
+	}
+	if cfg.DialTimeout == 0 {
+		cfg.DialTimeout = 5 * time.Second
+	}
+	if cfg.MinBackoff == 0 {
+		cfg.MinBackoff = 100 * time.Millisecond
+	}
+	if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = 5 * time.Second
+	}
+
+	var rt http.RoundTripper = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	switch {
+	case cfg.Username != "":
+		rt = config.NewBasicAuthRoundTripper(cfg.Username, config.Secret(cfg.Password), "", rt)
+	case cfg.BearerToken != "":
+		rt = config.NewAuthorizationCredentialsRoundTripper("Bearer", config.Secret(cfg.BearerToken), rt)
+	}
+
+	c, err := api.NewClient(api.Config{
+		Address:      cfg.Address,
+		RoundTripper: rt,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create client failed, err: %v", err)
+	}
+
+	return &Client{api: v1.NewAPI(c), cfg: cfg}, nil
+}
+
+// API returns the underlying API, which neither retries nor limits requests.
+func (c *Client) API() v1.API {
+	return c.api
+}
+
+// Series returns the label sets of the series matching any of matches
+// between start and end.
+func (c *Client) Series(ctx context.Context, matches []string, start, end time.Time) ([]model.LabelSet, v1.Warnings, error) {
+	var series []model.LabelSet
+	warnings, err := c.do(ctx, func(ctx context.Context) (v1.Warnings, error) {
+		var (
+			warnings v1.Warnings
+			err      error
+		)
+		series, warnings, err = c.api.Series(ctx, matches, start, end)
+		return warnings, err
+	})
+	return series, warnings, err
+}
+
+// Query evaluates an instant query at ts, which must return an instant
+// vector.
+func (c *Client) Query(ctx context.Context, query string, ts time.Time) (model.Vector, v1.Warnings, error) {
+	var value model.Value
+	warnings, err := c.do(ctx, func(ctx context.Context) (v1.Warnings, error) {
+		var (
+			warnings v1.Warnings
+			err      error
+		)
+		value, warnings, err = c.api.Query(ctx, query, ts)
+		return warnings, err
+	})
+	if err != nil {
+		return nil, warnings, err
+	}
+
+	vector, ok := value.(model.Vector)
+	if !ok {
+		return nil, warnings, fmt.Errorf("query %s returned %s, not vector", query, value.Type())
+	}
+	return vector, warnings, nil
+}
+
+// QueryRange evaluates a range query, which must return a range vector.
+func (c *Client) QueryRange(ctx context.Context, query string, r v1.Range) (model.Matrix, v1.Warnings, error) {
+	var value model.Value
+	warnings, err := c.do(ctx, func(ctx context.Context) (v1.Warnings, error) {
+		var (
+			warnings v1.Warnings
+			err      error
+		)
+		value, warnings, err = c.api.QueryRange(ctx, query, r)
+		return warnings, err
+	})
+	if err != nil {
+		return nil, warnings, err
+	}
+
+	matrix, ok := value.(model.Matrix)
+	if !ok {
+		return nil, warnings, fmt.Errorf("query %s returned %s, not matrix", query, value.Type())
+	}
+	return matrix, warnings, nil
+}
+
+// LabelValues returns the values of label between start and end.
+func (c *Client) LabelValues(ctx context.Context, label string, start, end time.Time) (model.LabelValues, v1.Warnings, error) {
+	var values model.LabelValues
+	warnings, err := c.do(ctx, func(ctx context.Context) (v1.Warnings, error) {
+		var (
+			warnings v1.Warnings
+			err      error
+		)
+		values, warnings, err = c.api.LabelValues(ctx, label, nil, start, end)
+		return warnings, err
+	})
+	return values, warnings, err
+}
+
+// do runs request, retrying it with backoff while it fails with a retryable
+// error and ctx isn't done.
+func (c *Client) do(ctx context.Context, request func(context.Context) (v1.Warnings, error)) (v1.Warnings, error) {
+	backoff := c.cfg.MinBackoff
+	for attempt := 0; ; attempt++ {
+		warnings, err := c.attempt(ctx, request)
+		if err == nil || attempt >= c.cfg.Retries || !retryable(ctx, err) {
+			return warnings, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return warnings, err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > c.cfg.MaxBackoff {
+			backoff = c.cfg.MaxBackoff
+		}
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, request func(context.Context) (v1.Warnings, error)) (v1.Warnings, error) {
+	if c.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.cfg.Timeout)
+		defer cancel()
+	}
+	return request(ctx)
+}
+
+// retryable tells whether a request that failed with err may succeed if
+// sent again: server errors and network errors are, client errors and bad
+// queries aren't.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var apiErr *v1.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Type == v1.ErrServer
+	}
+	// errors of the transport, including the timeout of an attempt
+	return true
+}
@@ -0,0 +1,390 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+var standInSeries = []map[string]string{
+	{"__name__": "test_count_vector", "label1": "v1", "label2": "v2"},
+	{"__name__": "test_count_vector", "label1": "v3", "label2": "v4"},
+}
+
+// standIn is a stand-in Prometheus server serving the series, query,
+// query_range and label values endpoints of the HTTP API with canned data.
+type standIn struct {
+	*httptest.Server
+
+	// fail handles the first failures requests instead of the API.
+	fail     http.HandlerFunc
+	failures int32
+	// delay is waited before serving each request, unless the request is
+	// canceled first.
+	delay time.Duration
+
+	requests int32
+
+	mu            sync.Mutex
+	authorization string
+}
+
+func newStandIn(t *testing.T, fail http.HandlerFunc, failures int32) *standIn {
+	s := &standIn{fail: fail, failures: failures}
+
+	respond := func(w http.ResponseWriter, data interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   data,
+		})
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/series", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, standInSeries)
+	})
+	mux.HandleFunc("/api/v1/query", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("query") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"status":    "error",
+				"errorType": "bad_data",
+				"error":     "empty query",
+			})
+			return
+		}
+		ts := r.Form.Get("time")
+		respond(w, map[string]interface{}{
+			"resultType": "vector",
+			"result": []map[string]interface{}{
+				{"metric": standInSeries[0], "value": []interface{}{json.Number(ts), "1"}},
+			},
+		})
+	})
+	mux.HandleFunc("/api/v1/query_range", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+		end, _ := strconv.ParseFloat(r.Form.Get("end"), 64)
+		step, _ := strconv.ParseFloat(r.Form.Get("step"), 64)
+
+		var values [][]interface{}
+		for t := start; step > 0 && t <= end; t += step {
+			values = append(values, []interface{}{t, "1"})
+		}
+		respond(w, map[string]interface{}{
+			"resultType": "matrix",
+			"result": []map[string]interface{}{
+				{"metric": standInSeries[0], "values": values},
+			},
+		})
+	})
+	mux.HandleFunc("/api/v1/label/", func(w http.ResponseWriter, r *http.Request) {
+		label := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/label/"), "/values")
+		values := []string{}
+		for _, s := range standInSeries {
+			if v, ok := s[label]; ok {
+				values = append(values, v)
+			}
+		}
+		respond(w, values)
+	})
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.authorization = r.Header.Get("Authorization")
+		s.mu.Unlock()
+
+		if atomic.AddInt32(&s.requests, 1) <= s.failures {
+			s.fail(w, r)
+			return
+		}
+		if s.delay > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(s.delay):
+			}
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *standIn) Requests() int {
+	return int(atomic.LoadInt32(&s.requests))
+}
+
+func (s *standIn) Authorization() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.authorization
+}
+
+func unavailable(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+// hangUp closes the connection without responding.
+func hangUp(w http.ResponseWriter, r *http.Request) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	conn.Close()
+}
+
+func newTestClient(t *testing.T, cfg Config) *Client {
+	t.Helper()
+
+	if cfg.MinBackoff == 0 {
+		cfg.MinBackoff = time.Millisecond
+	}
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	return c
+}
+
+func TestNewErrors(t *testing.T) {
+	if _, err := New(Config{}); err == nil {
+		t.Error("New without address succeeded")
+	}
+	if _, err := New(Config{Address: "http://localhost:9090", Username: "admin", BearerToken: "token"}); err == nil {
+		t.Error("New with basic authentication and bearer token succeeded")
+	}
+}
+
+func TestRetries(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		fail     http.HandlerFunc
+		failures int32
+		retries  int
+		// requests is how many requests the server should see
+		requests int
+		ok       bool
+		// errType is the API error type expected if not ok, empty for
+		// transport errors
+		errType v1.ErrorType
+	}{
+		{name: "server errors retried", fail: unavailable, failures: 2, retries: 3, requests: 3, ok: true},
+		{name: "server errors exhaust retries", fail: unavailable, failures: 10, retries: 2, requests: 3, errType: v1.ErrServer},
+		{name: "transport errors retried", fail: hangUp, failures: 2, retries: 3, requests: 3, ok: true},
+		{name: "transport errors exhaust retries", fail: hangUp, failures: 10, retries: 2, requests: 3},
+		{name: "client errors not retried", fail: unauthorized, failures: 10, retries: 3, requests: 1, errType: v1.ErrClient},
+		{name: "no retries", fail: unavailable, failures: 10, retries: 0, requests: 1, errType: v1.ErrServer},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStandIn(t, test.fail, test.failures)
+			c := newTestClient(t, Config{Address: s.URL, Retries: test.retries})
+
+			_, _, err := c.LabelValues(context.Background(), "label1", time.Now().Add(-time.Minute), time.Now())
+			if got := s.Requests(); got != test.requests {
+				t.Errorf("requests = %d, want %d", got, test.requests)
+			}
+			if test.ok {
+				if err != nil {
+					t.Fatalf("LabelValues failed: %v", err)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatal("LabelValues succeeded")
+			}
+			var apiErr *v1.Error
+			if errors.As(err, &apiErr) {
+				if apiErr.Type != test.errType {
+					t.Fatalf("error type = %s, want %s: %v", apiErr.Type, test.errType, err)
+				}
+			} else if test.errType != "" {
+				t.Fatalf("err = %v, want error type %s", err, test.errType)
+			}
+		})
+	}
+}
+
+func TestBadQueryNotRetried(t *testing.T) {
+	s := newStandIn(t, nil, 0)
+	c := newTestClient(t, Config{Address: s.URL, Retries: 3})
+
+	_, _, err := c.Query(context.Background(), "", time.Now())
+	var apiErr *v1.Error
+	if !errors.As(err, &apiErr) || apiErr.Type != v1.ErrBadData {
+		t.Fatalf("err = %v, want %s", err, v1.ErrBadData)
+	}
+	if got := s.Requests(); got != 1 {
+		t.Fatalf("requests = %d, want 1", got)
+	}
+}
+
+func TestRetriesStopWithContext(t *testing.T) {
+	s := newStandIn(t, unavailable, 1000)
+	c := newTestClient(t, Config{
+		Address:    s.URL,
+		Retries:    1000,
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := c.LabelValues(ctx, "label1", time.Now().Add(-time.Minute), time.Now()); err == nil {
+		t.Fatal("LabelValues succeeded")
+	}
+	if got := s.Requests(); got >= 20 {
+		t.Fatalf("requests = %d, want retries to stop with the context", got)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{name: "none", cfg: Config{}, want: ""},
+		{name: "basic", cfg: Config{Username: "admin", Password: "secret"}, want: "Basic YWRtaW46c2VjcmV0"},
+		{name: "bearer", cfg: Config{BearerToken: "token"}, want: "Bearer token"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStandIn(t, nil, 0)
+			test.cfg.Address = s.URL
+			c := newTestClient(t, test.cfg)
+
+			if _, _, err := c.LabelValues(context.Background(), "label1", time.Now().Add(-time.Minute), time.Now()); err != nil {
+				t.Fatalf("LabelValues failed: %v", err)
+			}
+			if got := s.Authorization(); got != test.want {
+				t.Fatalf("Authorization = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	s := newStandIn(t, nil, 0)
+	s.delay = time.Second
+	c := newTestClient(t, Config{Address: s.URL, Timeout: 20 * time.Millisecond, Retries: 1})
+
+	start := time.Now()
+	_, _, err := c.LabelValues(context.Background(), "label1", time.Now().Add(-time.Minute), time.Now())
+	if err == nil {
+		t.Fatal("LabelValues succeeded")
+	}
+	if elapsed := time.Since(start); elapsed >= s.delay {
+		t.Fatalf("LabelValues returned after %v, want the timeout enforced", elapsed)
+	}
+	// a timed out attempt is retried
+	if got := s.Requests(); got != 2 {
+		t.Fatalf("requests = %d, want 2", got)
+	}
+}
+
+func TestSeries(t *testing.T) {
+	s := newStandIn(t, nil, 0)
+	c := newTestClient(t, Config{Address: s.URL})
+
+	series, _, err := c.Series(context.Background(), []string{"test_count_vector"}, time.Now().Add(-time.Minute), time.Now())
+	if err != nil {
+		t.Fatalf("Series failed: %v", err)
+	}
+	var want []model.LabelSet
+	for _, s := range standInSeries {
+		ls := model.LabelSet{}
+		for name, value := range s {
+			ls[model.LabelName(name)] = model.LabelValue(value)
+		}
+		want = append(want, ls)
+	}
+	if !reflect.DeepEqual(series, want) {
+		t.Fatalf("Series = %v, want %v", series, want)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	s := newStandIn(t, nil, 0)
+	c := newTestClient(t, Config{Address: s.URL})
+
+	ts := time.Unix(1600000000, 0)
+	vector, _, err := c.Query(context.Background(), "test_count_vector", ts)
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	want := model.Vector{{
+		Metric:    model.Metric{"__name__": "test_count_vector", "label1": "v1", "label2": "v2"},
+		Value:     1,
+		Timestamp: model.TimeFromUnix(ts.Unix()),
+	}}
+	if !reflect.DeepEqual(vector, want) {
+		t.Fatalf("Query = %v, want %v", vector, want)
+	}
+}
+
+func TestQueryRange(t *testing.T) {
+	s := newStandIn(t, nil, 0)
+	c := newTestClient(t, Config{Address: s.URL})
+
+	start := time.Unix(1600000000, 0)
+	matrix, _, err := c.QueryRange(context.Background(), "test_count_vector", v1.Range{
+		Start: start,
+		End:   start.Add(time.Minute),
+		Step:  20 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("QueryRange failed: %v", err)
+	}
+	if len(matrix) != 1 {
+		t.Fatalf("QueryRange returned %d series, want 1", len(matrix))
+	}
+	if got := matrix[0].Metric["label1"]; got != "v1" {
+		t.Errorf("label1 = %q, want v1", got)
+	}
+	var got []model.Time
+	for _, v := range matrix[0].Values {
+		if v.Value != 1 {
+			t.Errorf("value at %v = %v, want 1", v.Timestamp, v.Value)
+		}
+		got = append(got, v.Timestamp)
+	}
+	var want []model.Time
+	for i := 0; i < 4; i++ {
+		want = append(want, model.TimeFromUnix(start.Unix()+int64(i)*20))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("timestamps = %v, want %v", got, want)
+	}
+}
+
+func TestLabelValues(t *testing.T) {
+	s := newStandIn(t, nil, 0)
+	c := newTestClient(t, Config{Address: s.URL})
+
+	values, _, err := c.LabelValues(context.Background(), "label1", time.Now().Add(-time.Minute), time.Now())
+	if err != nil {
+		t.Fatalf("LabelValues failed: %v", err)
+	}
+	if want := (model.LabelValues{"v1", "v3"}); !reflect.DeepEqual(values, want) {
+		t.Fatalf("LabelValues = %v, want %v", values, want)
+	}
+}
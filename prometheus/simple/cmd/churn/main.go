@@ -0,0 +1,83 @@
+// Command churn reports the series churn of a Prometheus server: the series
+// created and deleted between consecutive windows, the labels driving it and
+// the metrics with the most series.
+//
+//	churn -address http://localhost:9090 -match 'etcd_cluster_info' -window 10m -windows 6
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fatsheep9146/go-best-practise/prometheus/simple/churn"
+	"github.com/fatsheep9146/go-best-practise/prometheus/simple/client"
+)
+
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+func main() {
+	var matches stringsFlag
+	flag.Var(&matches, "match", "Series selector of the series to analyze, may be repeated.")
+	address := flag.String("address", "http://localhost:9090", "The address of the Prometheus server.")
+	username := flag.String("username", "", "The username of basic authentication.")
+	password := flag.String("password", "", "The password of basic authentication.")
+	token := flag.String("bearer-token", "", "The bearer token sent in requests.")
+	timeout := flag.Duration("timeout", 30*time.Second, "The timeout of each request.")
+	window := flag.Duration("window", 10*time.Minute, "The width of each window.")
+	windows := flag.Int("windows", 6, "The number of consecutive windows ending now.")
+	top := flag.Int("top", 10, "The number of labels and metrics to report.")
+	output := flag.String("output", "text", "The output format, text or json.")
+	flag.Parse()
+
+	if len(matches) == 0 {
+		fmt.Fprintln(os.Stderr, "at least one -match is required")
+		os.Exit(2)
+	}
+	if *output != "text" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "unknown output %q\n", *output)
+		os.Exit(2)
+	}
+
+	cli, err := client.New(client.Config{
+		Address:     *address,
+		Username:    *username,
+		Password:    *password,
+		BearerToken: *token,
+		Timeout:     *timeout,
+		Retries:     3,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	ws, err := churn.Collect(context.Background(), cli, matches, time.Now(), *window, *windows)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	report := churn.Analyze(ws, *top)
+	if *output == "json" {
+		err = report.WriteJSON(os.Stdout)
+	} else {
+		err = report.WriteText(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
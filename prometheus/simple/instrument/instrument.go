@@ -0,0 +1,144 @@
+// Package instrument records the latency of HTTP requests in histograms with
+// trace ID exemplars, and serves metrics in the format the scraper asks for,
+// including OpenMetrics and the protobuf format carrying native histograms.
+package instrument
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Options configures a Middleware. The zero value is valid.
+type Options struct {
+	// Namespace prefixes the metric names.
+	Namespace string
+	// Registerer registers the metrics, prometheus.DefaultRegisterer if nil.
+	Registerer prometheus.Registerer
+	// Buckets are the buckets of the classic histogram,
+	// prometheus.DefBuckets if nil.
+	Buckets []float64
+	// NativeBucketFactor is the maximum ratio between the bounds of
+	// consecutive buckets of the native histogram, 1.1 if zero.
+	NativeBucketFactor float64
+	// NativeMaxBuckets limits the buckets of the native histogram, which
+	// are made wider once reached, 160 if zero.
+	NativeMaxBuckets uint32
+	// TraceID returns the trace ID of a request, added as exemplar to its
+	// observations if not empty. TraceIDFromRequest if nil.
+	TraceID func(r *http.Request) string
+}
+
+// Middleware records the requests and their latency by handler, method and
+// status code.
+type Middleware struct {
+	duration *prometheus.HistogramVec
+	requests *prometheus.CounterVec
+	traceID  func(r *http.Request) string
+}
+
+// New returns a middleware, registering its metrics.
+func New(opts Options) (*Middleware, error) {
+	if opts.Registerer == nil {
+		opts.Registerer = prometheus.DefaultRegisterer
+	}
+	if opts.Buckets == nil {
+		opts.Buckets = prometheus.DefBuckets
+	}
+	if opts.NativeBucketFactor == 0 {
+		opts.NativeBucketFactor = 1.1
+	}
+	if opts.NativeMaxBuckets == 0 {
+		opts.NativeMaxBuckets = 160
+	}
+	if opts.TraceID == nil {
+		opts.TraceID = TraceIDFromRequest
+	}
+
+	m := &Middleware{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: opts.Namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests.",
+			Buckets:   opts.Buckets,
+			// a native histogram is exposed in addition to the classic one
+			NativeHistogramBucketFactor:     opts.NativeBucketFactor,
+			NativeHistogramMaxBucketNumber:  opts.NativeMaxBuckets,
+			NativeHistogramMinResetDuration: time.Hour,
+		}, []string{"handler", "method", "code"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: opts.Namespace,
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests.",
+		}, []string{"handler", "method", "code"}),
+		traceID: opts.TraceID,
+	}
+
+	for _, c := range []prometheus.Collector{m.duration, m.requests} {
+		if err := opts.Registerer.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Wrap returns next instrumented with the handler label. The instrumentation
+// of promhttp is used, whose response writer keeps the http.Flusher,
+// http.Hijacker and io.ReaderFrom of the one it wraps, so streaming and
+// websocket handlers still work.
+func (m *Middleware) Wrap(handler string, next http.Handler) http.Handler {
+	curried := prometheus.Labels{"handler": handler}
+	exemplar := promhttp.WithExemplarFromContext(func(ctx context.Context) prometheus.Labels {
+		if id, _ := ctx.Value(traceIDKey{}).(string); id != "" {
+			return prometheus.Labels{"trace_id": id}
+		}
+		return nil
+	})
+	instrumented := promhttp.InstrumentHandlerCounter(
+		m.requests.MustCurryWith(curried),
+		promhttp.InstrumentHandlerDuration(m.duration.MustCurryWith(curried), next, exemplar),
+		exemplar,
+	)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := m.traceID(r); id != "" {
+			r = r.WithContext(context.WithValue(r.Context(), traceIDKey{}, id))
+		}
+		instrumented.ServeHTTP(w, r)
+	})
+}
+
+// traceIDKey is the context key of the trace ID of a request.
+type traceIDKey struct{}
+
+// Handler serves the metrics of g in the format negotiated with the Accept
+// header: OpenMetrics text with exemplars, protobuf with native histograms,
+// or the classic text format.
+func Handler(g prometheus.Gatherer) http.Handler {
+	return promhttp.HandlerFor(g, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	})
+}
+
+var (
+	// traceparent is the W3C trace context header: version-traceid-spanid-flags
+	traceparent = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-[0-9a-f]{16}-[0-9a-f]{2}$`)
+	traceIDChar = regexp.MustCompile(`^[0-9A-Za-z_-]{1,64}$`)
+)
+
+// TraceIDFromRequest returns the trace ID of the traceparent header, or of
+// the X-Trace-Id header if there is none.
+func TraceIDFromRequest(r *http.Request) string {
+	if m := traceparent.FindStringSubmatch(r.Header.Get("traceparent")); m != nil {
+		return m[1]
+	}
+	// exemplar labels are limited to 128 runes, which long ids would exceed
+	if id := r.Header.Get("X-Trace-Id"); traceIDChar.MatchString(id) {
+		return id
+	}
+	return ""
+}
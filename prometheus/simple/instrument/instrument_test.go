@@ -0,0 +1,276 @@
+package instrument
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+const (
+	testTraceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testTraceparent = "00-" + testTraceID + "-00f067aa0ba902b7-01"
+)
+
+func TestTraceIDFromRequest(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{name: "none"},
+		{name: "traceparent", headers: map[string]string{"traceparent": testTraceparent}, want: testTraceID},
+		{
+			name:    "traceparent first",
+			headers: map[string]string{"traceparent": testTraceparent, "X-Trace-Id": "other"},
+			want:    testTraceID,
+		},
+		{
+			name:    "bad traceparent",
+			headers: map[string]string{"traceparent": "00-" + strings.ToUpper(testTraceID) + "-00f067aa0ba902b7-01", "X-Trace-Id": "fallback"},
+			want:    "fallback",
+		},
+		{name: "x-trace-id", headers: map[string]string{"X-Trace-Id": "abc_DEF-123"}, want: "abc_DEF-123"},
+		{name: "too long", headers: map[string]string{"X-Trace-Id": strings.Repeat("a", 65)}},
+		{name: "bad character", headers: map[string]string{"X-Trace-Id": "a b"}},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for name, value := range test.headers {
+			r.Header.Set(name, value)
+		}
+		if got := TraceIDFromRequest(r); got != test.want {
+			t.Errorf("%s: TraceIDFromRequest = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// serve instruments a handler answering code as handler, and sends it a
+// request with headers.
+func serve(t *testing.T, m *Middleware, handler string, code int, headers map[string]string) {
+	t.Helper()
+
+	h := m.Wrap(handler, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), r)
+}
+
+// family returns the metric family name gathered from g.
+func family(t *testing.T, g prometheus.Gatherer, name string) *dto.MetricFamily {
+	t.Helper()
+
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	for _, mf := range families {
+		if mf.GetName() == name {
+			return mf
+		}
+	}
+	t.Fatalf("no metric family %s", name)
+	return nil
+}
+
+// metric returns the metric of mf with the handler label.
+func metric(t *testing.T, mf *dto.MetricFamily, handler string) *dto.Metric {
+	t.Helper()
+
+	for _, m := range mf.GetMetric() {
+		for _, l := range m.GetLabel() {
+			if l.GetName() == "handler" && l.GetValue() == handler {
+				return m
+			}
+		}
+	}
+	t.Fatalf("no %s metric of handler %s", mf.GetName(), handler)
+	return nil
+}
+
+func exemplarTraceID(e *dto.Exemplar) string {
+	for _, l := range e.GetLabel() {
+		if l.GetName() == "trace_id" {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+func TestExemplars(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := New(Options{Namespace: "test", Registerer: reg})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	serve(t, m, "traced", http.StatusCreated, map[string]string{"traceparent": testTraceparent})
+	serve(t, m, "untraced", http.StatusOK, nil)
+
+	requests := family(t, reg, "test_http_requests_total")
+	if e := metric(t, requests, "traced").GetCounter().GetExemplar(); exemplarTraceID(e) != testTraceID {
+		t.Errorf("counter exemplar = %v, want trace_id %s", e, testTraceID)
+	}
+	if e := metric(t, requests, "untraced").GetCounter().GetExemplar(); e != nil {
+		t.Errorf("counter exemplar of an untraced request = %v, want none", e)
+	}
+
+	duration := family(t, reg, "test_http_request_duration_seconds")
+	traced := metric(t, duration, "traced")
+	found := false
+	for _, b := range traced.GetHistogram().GetBucket() {
+		if exemplarTraceID(b.GetExemplar()) == testTraceID {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("no bucket exemplar with trace_id %s in %v", testTraceID, traced)
+	}
+	for _, b := range metric(t, duration, "untraced").GetHistogram().GetBucket() {
+		if b.GetExemplar() != nil {
+			t.Errorf("bucket exemplar of an untraced request = %v, want none", b.GetExemplar())
+		}
+	}
+
+	for _, l := range traced.GetLabel() {
+		if l.GetName() == "code" && l.GetValue() != "201" {
+			t.Errorf("code = %s, want 201", l.GetValue())
+		}
+	}
+}
+
+func TestCustomTraceID(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := New(Options{
+		Registerer: reg,
+		TraceID:    func(r *http.Request) string { return r.Header.Get("Request-Id") },
+	})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	serve(t, m, "h", http.StatusOK, map[string]string{"Request-Id": "r1", "traceparent": testTraceparent})
+	e := metric(t, family(t, reg, "http_requests_total"), "h").GetCounter().GetExemplar()
+	if exemplarTraceID(e) != "r1" {
+		t.Fatalf("counter exemplar = %v, want trace_id r1", e)
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	if _, err := New(Options{Registerer: reg}); err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	_, err := New(Options{Registerer: reg})
+	var already prometheus.AlreadyRegisteredError
+	if !errors.As(err, &already) {
+		t.Fatalf("New of registered metrics err = %v, want AlreadyRegisteredError", err)
+	}
+}
+
+func TestWrapKeepsFlusher(t *testing.T) {
+	m, err := New(Options{Registerer: prometheus.NewRegistry()})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	flushed := false
+	h := m.Wrap("stream", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, ok := w.(http.Flusher)
+		if !ok {
+			t.Errorf("response writer isn't an http.Flusher")
+			return
+		}
+		f.Flush()
+		flushed = true
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if !flushed || !w.Flushed {
+		t.Fatalf("response not flushed")
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := New(Options{Registerer: reg})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	serve(t, m, "h", http.StatusOK, map[string]string{"traceparent": testTraceparent})
+
+	server := httptest.NewServer(Handler(reg))
+	t.Cleanup(server.Close)
+	get := func(accept string) (string, []byte) {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatalf("new request failed: %v", err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("read body failed: %v", err)
+		}
+		return resp.Header.Get("Content-Type"), body
+	}
+
+	// the classic text format has no exemplars
+	contentType, body := get("")
+	if expfmt.Format(contentType) != expfmt.FmtText {
+		t.Errorf("Content-Type = %q, want %q", contentType, expfmt.FmtText)
+	}
+	if strings.Contains(string(body), "trace_id") {
+		t.Errorf("text format has exemplars:\n%s", body)
+	}
+
+	contentType, body = get("application/openmetrics-text; version=0.0.1")
+	if !strings.HasPrefix(contentType, "application/openmetrics-text") {
+		t.Errorf("Content-Type = %q, want OpenMetrics", contentType)
+	}
+	if !strings.Contains(string(body), `# {trace_id="`+testTraceID+`"}`) || !strings.HasSuffix(string(body), "# EOF\n") {
+		t.Errorf("OpenMetrics has no exemplars:\n%s", body)
+	}
+
+	// the protobuf format carries the native histogram next to the buckets
+	contentType, body = get(string(expfmt.FmtProtoDelim))
+	if expfmt.Format(contentType) != expfmt.FmtProtoDelim {
+		t.Fatalf("Content-Type = %q, want %q", contentType, expfmt.FmtProtoDelim)
+	}
+	dec := expfmt.NewDecoder(strings.NewReader(string(body)), expfmt.FmtProtoDelim)
+	for {
+		mf := &dto.MetricFamily{}
+		if err := dec.Decode(mf); err != nil {
+			t.Fatalf("no duration histogram in protobuf, decode err: %v", err)
+		}
+		if mf.GetName() != "http_request_duration_seconds" {
+			continue
+		}
+		h := metric(t, mf, "h").GetHistogram()
+		if len(h.GetBucket()) == 0 {
+			t.Errorf("histogram has no classic buckets")
+		}
+		if len(h.GetPositiveSpan()) == 0 && h.GetZeroCount() == 0 {
+			t.Errorf("histogram has no native buckets: %v", h)
+		}
+		if h.GetSchema() != 3 {
+			t.Errorf("schema = %d, want 3 for a bucket factor of 1.1", h.GetSchema())
+		}
+		break
+	}
+}
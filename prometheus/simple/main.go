@@ -1,79 +1,602 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/prometheus/client_golang/api"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/fatsheep9146/go-best-practise/prometheus/simple/cardinality"
+	"github.com/fatsheep9146/go-best-practise/prometheus/simple/churn"
+	"github.com/fatsheep9146/go-best-practise/prometheus/simple/client"
+	"github.com/fatsheep9146/go-best-practise/prometheus/simple/instrument"
+	"github.com/fatsheep9146/go-best-practise/prometheus/simple/mini"
+	"github.com/fatsheep9146/go-best-practise/prometheus/simple/pushgateway"
+	"github.com/fatsheep9146/go-best-practise/prometheus/simple/queuemetrics"
+	"github.com/fatsheep9146/go-best-practise/prometheus/simple/remote"
+	"github.com/fatsheep9146/go-best-practise/prometheus/simple/stale"
 )
 
 var (
-	addr = flag.String("listen-address", ":8080", "The address to listen on for HTTP requests.")
+	addr           = flag.String("listen-address", ":8080", "The address to listen on for HTTP requests.")
+	prometheusAddr = flag.String("prometheus-address", "http://localhost:9090", "The address of the Prometheus server to query.")
+	remoteWriteURL = flag.String("remote-write-url", "", "The remote write endpoint the registered metrics are pushed to, if set.")
+	receiveWrites  = flag.Bool("remote-write-receiver", false, "Receive remote writes on /api/v1/write.")
+	pushURL        = flag.String("push-url", "", "The Pushgateway the registered metrics are pushed to once, instead of being served, if set.")
+	pushJob        = flag.String("push-job", "simple", "The job grouping label of pushed metrics.")
+	pushInstance   = flag.String("push-instance", "", "The instance grouping label of pushed metrics, the hostname if empty.")
+	pushMode       = flag.String("push-mode", "replace", "replace replaces all metrics of the group, merge only the pushed ones.")
 )
 
 var (
-	testCountVector = prometheus.NewGaugeVec(
+	testCountVector = stale.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "test_count_vector",
 			Help: "",
 		},
 		[]string{"label1", "label2"},
+		10*time.Second,
 	)
 )
 
 func init() {
 	prometheus.MustRegister(testCountVector)
 
+	// named workqueues report depth, latency and retries from now on
+	if _, err := queuemetrics.Register(prometheus.DefaultRegisterer); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func runServer() {
 	flag.Parse()
 
-	go func() {
-		fmt.Println("add metric series with label1=v1, label2=v2")
-		testCountVector.WithLabelValues([]string{"v1", "v2"}...).Set(1)
-		time.Sleep(10 * time.Second)
-		fmt.Println("delete metric series with label1=v1, label2=v2")
-		testCountVector.DeleteLabelValues([]string{"v1", "v2"}...)
-	}()
+	// series that aren't set again are deleted 10s after the last update
+	go testCountVector.Run(context.Background(), time.Second)
+
+	fmt.Println("add metric series with label1=v1, label2=v2")
+	testCountVector.WithLabelValues([]string{"v1", "v2"}...).Set(1)
 
-	// Expose the registered metrics via HTTP.
-	http.Handle("/metrics", promhttp.Handler())
+	if *remoteWriteURL != "" {
+		sender, err := remote.NewSender(remote.Config{
+			URL:      *remoteWriteURL,
+			Gatherer: prometheus.DefaultGatherer,
+			OnError: func(err error) {
+				log.Printf("remote write: %v", err)
+			},
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		prometheus.MustRegister(sender)
+		go sender.Run(context.Background())
+	}
+	if *receiveWrites {
+		http.Handle("/api/v1/write", remote.NewReceiver())
+	}
+
+	middleware, err := instrument.New(instrument.Options{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	http.Handle("/hello", middleware.Wrap("hello", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "hello")
+	})))
+
+	// Expose the registered metrics via HTTP, in OpenMetrics or protobuf
+	// too if the scraper asks for it.
+	http.Handle("/metrics", instrument.Handler(prometheus.DefaultGatherer))
 	log.Fatal(http.ListenAndServe(*addr, nil))
 }
 
+// runPush pushes the metrics of g to the Pushgateway once, grouped by job and
+// instance.
+func runPush(g prometheus.Gatherer) error {
+	instance := *pushInstance
+	if instance == "" {
+		var err error
+		if instance, err = os.Hostname(); err != nil {
+			return err
+		}
+	}
+
+	pusher := push.New(*pushURL, *pushJob).
+		Gatherer(g).
+		Grouping("instance", instance)
+
+	switch *pushMode {
+	case "replace":
+		return pusher.Push()
+	case "merge":
+		return pusher.Add()
+	}
+	return fmt.Errorf("unknown push mode %q", *pushMode)
+}
+
 func runSeries() {
+	cli, err := client.New(client.Config{
+		Address: *prometheusAddr,
+		Timeout: 10 * time.Second,
+		Retries: 2,
+	})
+	if err != nil {
+		fmt.Println("err", err)
+		return
+	}
+
+	ctx := context.Background()
+	matches := []string{"etcd_cluster_info"}
+
+	lbs, _, err := cli.Series(ctx, matches, time.Now().Add(-60*time.Second), time.Now())
+	if err != nil {
+		fmt.Println("err", err)
+		return
+	}
+
+	fmt.Println(lbs)
+}
+
+func staleUsage() {
+	registry := prometheus.NewRegistry()
+	requests := stale.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "stale_usage_requests_total",
+			Help: "Requests by client.",
+		},
+		[]string{"client"},
+		100*time.Millisecond,
+	)
+	registry.MustRegister(requests)
+
+	a := requests.WithLabelValues("a")
+	a.Inc()
+	requests.WithLabelValues("b").Inc()
+	time.Sleep(60 * time.Millisecond)
+	// keeps a alive, b isn't updated anymore
+	a.Inc()
+	time.Sleep(60 * time.Millisecond)
+	fmt.Printf("expired %d series, %d tracked\n", requests.Expire(), requests.Len())
+
+	// a handle of an expired series recreates it
+	time.Sleep(120 * time.Millisecond)
+	fmt.Printf("expired %d series, %d tracked\n", requests.Expire(), requests.Len())
+	a.Inc()
+
+	families, err := registry.Gather()
+	if err != nil {
+		fmt.Println("err", err)
+		return
+	}
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			value := m.GetGauge().GetValue() + m.GetCounter().GetValue()
+			fmt.Printf("%s%v %v\n", mf.GetName(), m.GetLabel(), value)
+		}
+	}
+}
+
+func cardinalityUsage() {
+	registry := prometheus.NewRegistry()
+	requests := cardinality.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cardinality_usage_requests_total",
+			Help: "Requests by method and request ID.",
+		},
+		[]string{"method", "request_id"},
+		cardinality.Limits{
+			MaxSeries: 3,
+			Allowed:   map[string][]string{"method": {"GET", "POST"}},
+			Overflow:  "other",
+		},
+	)
+	registry.MustRegister(requests)
+
+	for i := 0; i < 10; i++ {
+		requests.WithLabelValues("GET", fmt.Sprintf("req-%d", i)).Inc()
+	}
+	requests.WithLabelValues("BREW", "req-10").Inc()
+
+	strict := cardinality.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cardinality_usage_in_flight",
+			Help: "In flight requests by method.",
+		},
+		[]string{"method"},
+		cardinality.Limits{
+			MaxSeries: 1,
+			Allowed:   map[string][]string{"method": {"GET", "POST"}},
+		},
+	)
+	registry.MustRegister(strict)
+
+	_, err := strict.GetMetricWithLabelValues("GET")
+	fmt.Printf("GET err: %v\n", err)
+	_, err = strict.GetMetricWithLabelValues("POST")
+	fmt.Printf("POST err: %v\n", err)
+	_, err = strict.GetMetricWithLabelValues("BREW")
+	fmt.Printf("BREW err: %v\n", err)
+	// deleting a series frees its slot
+	strict.DeleteLabelValues("GET")
+	_, err = strict.GetMetricWithLabelValues("POST")
+	fmt.Printf("POST after delete err: %v\n", err)
+
+	families, err := registry.Gather()
+	if err != nil {
+		fmt.Println("err", err)
+		return
+	}
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			value := m.GetGauge().GetValue() + m.GetCounter().GetValue()
+			fmt.Printf("%s%v %v\n", mf.GetName(), m.GetLabel(), value)
+		}
+	}
+}
+
+func churnUsage() {
+	end := time.Now().Truncate(time.Minute)
+	width := 10 * time.Minute
+
+	// every window a pod is replaced by a new one, etcd_cluster_info is stable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+		window := int(end.Sub(time.Unix(int64(start), 0)) / width)
+
+		series := []map[string]string{
+			{"__name__": "etcd_cluster_info", "cluster": "asi_zjk_core_b"},
+		}
+		for pod := 10 - window; pod < 13-window; pod++ {
+			series = append(series, map[string]string{
+				"__name__": "app_requests_total",
+				"pod":      fmt.Sprintf("app-%d", pod),
+				"job":      "app",
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "data": series})
+	}))
+	defer server.Close()
+
+	cli, err := client.New(client.Config{Address: server.URL})
+	if err != nil {
+		fmt.Println("err", err)
+		return
+	}
+
+	windows, err := churn.Collect(context.Background(), cli, []string{"etcd_cluster_info", "app_requests_total"}, end, width, 4)
+	if err != nil {
+		fmt.Println("err", err)
+		return
+	}
+
+	report := churn.Analyze(windows, 3)
+	fmt.Printf("births: %d, deaths: %d\n", report.Births, report.Deaths)
+	fmt.Printf("top churn label: %s %s\n", report.Labels[0].Metric, report.Labels[0].Label)
+	report.WriteText(os.Stdout)
+}
+
+func remoteWriteUsage() {
+	receiver := remote.NewReceiver()
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first request fails and is retried
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		receiver.ServeHTTP(w, r)
+	}))
+	defer server.Close()
 
-	client, err = api.NewClient(api.Config{
-		Address: "http://47.112.190.225:9090/",
+	registry := prometheus.NewRegistry()
+	temperature := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "edge_temperature_celsius",
+			Help: "Temperature of an edge node.",
+		},
+		[]string{"sensor"},
+	)
+	registry.MustRegister(temperature)
+	temperature.WithLabelValues("cpu").Set(55)
+	temperature.WithLabelValues("disk").Set(38)
+
+	sender, err := remote.NewSender(remote.Config{
+		URL:            server.URL,
+		Gatherer:       registry,
+		Interval:       50 * time.Millisecond,
+		ExternalLabels: map[string]string{"node": "edge-1"},
+		MinBackoff:     10 * time.Millisecond,
 	})
-	
 	if err != nil {
-		return cli, err
+		fmt.Println("err", err)
+		return
 	}
 
-	cli = v1.NewAPI(client)
+	ctx, cancel := context.WithCancel(context.Background())
+	go sender.Run(ctx)
+	time.Sleep(80 * time.Millisecond)
+	temperature.WithLabelValues("cpu").Set(60)
+	time.Sleep(80 * time.Millisecond)
+	cancel()
 
-	matches := []string{"etcd_cluster_info"} 
+	for _, ts := range receiver.Series() {
+		values := make([]float64, 0, len(ts.Samples))
+		for _, s := range ts.Samples {
+			values = append(values, s.Value)
+		}
+		fmt.Printf("received %s %v\n", ts, values)
+	}
+	fmt.Printf("received %d samples in %d requests\n", receiver.Samples(), atomic.LoadInt32(&requests))
+}
 
-	lbs, _, err := cli.Series(ctx, matches, Add(time.Duration(-60)*time.Second), time.Now())	
+func instrumentUsage() {
+	registry := prometheus.NewRegistry()
+	middleware, err := instrument.New(instrument.Options{
+		Namespace:  "usage",
+		Registerer: registry,
+		Buckets:    []float64{0.005, 0.01, 0.05},
+	})
 	if err != nil {
 		fmt.Println("err", err)
 		return
 	}
 
-	fmt.Println(lbs)
+	mux := http.NewServeMux()
+	mux.Handle("/slow", middleware.Wrap("slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusAccepted)
+	})))
+	mux.Handle("/metrics", instrument.Handler(registry))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/slow", nil)
+		req.Header.Set("traceparent", fmt.Sprintf("00-4bf92f3577b34da6a3ce929d0e0e%04d-00f067aa0ba902b7-01", i))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Println("err", err)
+			return
+		}
+		resp.Body.Close()
+	}
+
+	// OpenMetrics carries the exemplars
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Println("err", err)
+		return
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	fmt.Println("content type:", resp.Header.Get("Content-Type"))
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.Contains(line, "trace_id") {
+			fmt.Println(line)
+		}
+	}
+
+	// protobuf carries the native histogram
+	req, _ = http.NewRequest(http.MethodGet, server.URL+"/metrics", nil)
+	req.Header.Set("Accept", "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Println("err", err)
+		return
+	}
+	defer resp.Body.Close()
+	dec := expfmt.NewDecoder(resp.Body, expfmt.ResponseFormat(resp.Header))
+	for {
+		var mf dto.MetricFamily
+		if err := dec.Decode(&mf); err != nil {
+			break
+		}
+		if mf.GetType() != dto.MetricType_HISTOGRAM {
+			continue
+		}
+		h := mf.GetMetric()[0].GetHistogram()
+		fmt.Printf("%s: count %d, schema %d, %d positive spans\n",
+			mf.GetName(), h.GetSampleCount(), h.GetSchema(), len(h.GetPositiveSpan()))
+	}
 }
 
-func main() {
+func miniUsage() {
+	registry := prometheus.NewRegistry()
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mini_requests_total",
+		Help: "Requests by code.",
+	}, []string{"code"})
+	latency := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mini_request_duration_seconds",
+		Help:    "Latency of requests.",
+		Buckets: []float64{0.1, 0.2, 0.5, 1},
+	})
+	registry.MustRegister(requests, latency)
 
-	runSeries()
+	// five minutes of scrapes every 15s, with 10 requests/s of which 1 fails
+	storage := mini.NewStorage()
+	now := time.Now()
+	start := now.Add(-5 * time.Minute)
+	for t := start; !t.After(now); t = t.Add(15 * time.Second) {
+		requests.WithLabelValues("200").Add(135)
+		requests.WithLabelValues("500").Add(15)
+		for i := 0; i < 150; i++ {
+			latency.Observe(float64(i%10) / 10)
+		}
+		if err := storage.Scrape(registry, t); err != nil {
+			fmt.Println("err", err)
+			return
+		}
+	}
+
+	server := httptest.NewServer(mini.NewAPI(storage, mini.NewEngine(storage)))
+	defer server.Close()
+	cli, err := client.New(client.Config{Address: server.URL})
+	if err != nil {
+		fmt.Println("err", err)
+		return
+	}
+	ctx := context.Background()
+
+	series, _, err := cli.Series(ctx, []string{`{__name__=~"mini_requests.*"}`}, start, now)
+	fmt.Printf("series: %v, err: %v\n", series, err)
+
+	for _, query := range []string{
+		`sum by (code) (rate(mini_requests_total[1m]))`,
+		`histogram_quantile(0.9, sum by (le) (rate(mini_request_duration_seconds_bucket[5m])))`,
+		// an error ratio alert
+		`sum without (code) (rate(mini_requests_total{code=~"5.."}[1m])) / sum without (code) (rate(mini_requests_total[1m])) > 0.05`,
+		`absent(mini_requests_total{code="404"})`,
+		`sum(rate(mini_requests_total[1m])`,
+	} {
+		vector, _, err := cli.Query(ctx, query, now)
+		fmt.Printf("%s: %v, err: %v\n", query, vector, err)
+	}
+
+	matrix, _, err := cli.QueryRange(ctx, `increase(mini_requests_total{code="500"}[1m])`, v1.Range{
+		Start: now.Add(-2 * time.Minute),
+		End:   now,
+		Step:  time.Minute,
+	})
+	fmt.Printf("query range: %v, err: %v\n", matrix, err)
+
+	// deleted series are marked stale by the next scrape
+	requests.DeleteLabelValues("500")
+	storage.Scrape(registry, now.Add(15*time.Second))
+	vector, _, err := cli.Query(ctx, `mini_requests_total`, now.Add(15*time.Second))
+	fmt.Printf("after delete: %v, err: %v\n", vector, err)
 }
 
+func pushUsage() {
+	gateway := pushgateway.NewHandler()
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	registry := prometheus.NewRegistry()
+	duration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "backup_duration_seconds",
+		Help: "Duration of the last backup.",
+	})
+	processed := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "backup_processed_files_total",
+		Help: "Files processed by the last backup.",
+	})
+	registry.MustRegister(duration, processed)
 
+	duration.Set(42)
+	processed.Add(1000)
+	fmt.Println("push err:", push.New(server.URL, "backup").Gatherer(registry).Grouping("instance", "db-1").Push())
+
+	// merging replaces backup_duration_seconds only
+	last := prometheus.NewRegistry()
+	succeeded := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "backup_duration_seconds",
+		Help: "Duration of the last backup.",
+	})
+	last.MustRegister(succeeded)
+	succeeded.Set(7)
+	fmt.Println("add err:", push.New(server.URL, "backup").Gatherer(last).Grouping("instance", "db-1").Add())
+
+	// grouping values with slashes are base64 encoded
+	fmt.Println("push err:", push.New(server.URL, "backup").Gatherer(last).Grouping("instance", "db/2").Push())
+
+	families, _ := gateway.Gather()
+	for _, mf := range families {
+		if mf.GetName() == "push_time_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			fmt.Printf("%s%v %v\n", mf.GetName(), m.GetLabel(), m.GetGauge().GetValue()+m.GetCounter().GetValue())
+		}
+	}
+
+	// replacing drops backup_processed_files_total of the group
+	fmt.Println("push err:", push.New(server.URL, "backup").Gatherer(last).Grouping("instance", "db-1").Push())
+	families, _ = gateway.Gather()
+	fmt.Println("families after replace:", len(families))
+}
+
+func workqueueUsage() {
+	q := workqueue.NewNamedRateLimitingQueue(
+		workqueue.NewItemExponentialFailureRateLimiter(10*time.Millisecond, time.Second), "test")
+	for _, item := range []string{"t1", "t2", "t3"} {
+		q.Add(item)
+	}
+
+	// t2 fails twice before succeeding
+	failures := map[string]int{"t2": 2}
+	for done := 0; done < 3; {
+		item, _ := q.Get()
+		time.Sleep(5 * time.Millisecond)
+		if key := item.(string); failures[key] > 0 {
+			failures[key]--
+			q.AddRateLimited(item)
+		} else {
+			q.Forget(item)
+			done++
+		}
+		q.Done(item)
+	}
+	q.ShutDown()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		fmt.Println("err", err)
+		return
+	}
+	for _, mf := range families {
+		if !strings.HasPrefix(mf.GetName(), "workqueue_") {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			switch {
+			case m.GetHistogram() != nil:
+				fmt.Printf("%s%v count %d, sum %.3fs\n", mf.GetName(), m.GetLabel(),
+					m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum())
+			default:
+				fmt.Printf("%s%v %v\n", mf.GetName(), m.GetLabel(), m.GetGauge().GetValue()+m.GetCounter().GetValue())
+			}
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	if *pushURL != "" {
+		if err := runPush(prometheus.DefaultGatherer); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	staleUsage()
+	cardinalityUsage()
+	churnUsage()
+	remoteWriteUsage()
+	instrumentUsage()
+	miniUsage()
+	pushUsage()
+	workqueueUsage()
+	runSeries()
+}
@@ -0,0 +1,198 @@
+package mini
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// API serves the query, query_range, series, labels and label values
+// endpoints of the Prometheus HTTP API.
+type API struct {
+	storage *Storage
+	engine  *Engine
+	mux     *http.ServeMux
+}
+
+// NewAPI returns the API of storage, evaluating queries with engine.
+func NewAPI(storage *Storage, engine *Engine) *API {
+	a := &API{storage: storage, engine: engine, mux: http.NewServeMux()}
+	a.mux.HandleFunc("/api/v1/query", a.query)
+	a.mux.HandleFunc("/api/v1/query_range", a.queryRange)
+	a.mux.HandleFunc("/api/v1/series", a.series)
+	a.mux.HandleFunc("/api/v1/labels", a.labels)
+	a.mux.HandleFunc("/api/v1/label/", a.labelValues)
+	return a
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+type apiError struct {
+	typ string
+	err error
+}
+
+func badData(format string, args ...interface{}) *apiError {
+	return &apiError{typ: "bad_data", err: fmt.Errorf(format, args...)}
+}
+
+func (a *API) query(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	ts, err := parseTime(r.Form.Get("time"), time.Now())
+	if err != nil {
+		respondError(w, badData("invalid parameter \"time\": %v", err))
+		return
+	}
+
+	value, err := a.engine.Query(r.Form.Get("query"), ts)
+	if err != nil {
+		respondError(w, badData("%v", err))
+		return
+	}
+	respond(w, map[string]interface{}{
+		"resultType": value.Type().String(),
+		"result":     value,
+	})
+}
+
+func (a *API) queryRange(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	start, err := parseTime(r.Form.Get("start"), time.Time{})
+	if err != nil {
+		respondError(w, badData("invalid parameter \"start\": %v", err))
+		return
+	}
+	end, err := parseTime(r.Form.Get("end"), time.Time{})
+	if err != nil {
+		respondError(w, badData("invalid parameter \"end\": %v", err))
+		return
+	}
+	step, err := parseDuration(r.Form.Get("step"))
+	if err != nil {
+		respondError(w, badData("invalid parameter \"step\": %v", err))
+		return
+	}
+
+	matrix, err := a.engine.QueryRange(r.Form.Get("query"), start, end, step)
+	if err != nil {
+		respondError(w, badData("%v", err))
+		return
+	}
+	respond(w, map[string]interface{}{
+		"resultType": model.ValMatrix.String(),
+		"result":     matrix,
+	})
+}
+
+func (a *API) series(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if len(r.Form["match[]"]) == 0 {
+		respondError(w, badData("no match[] parameter provided"))
+		return
+	}
+	start, err := parseTime(r.Form.Get("start"), time.Unix(0, 0))
+	if err != nil {
+		respondError(w, badData("invalid parameter \"start\": %v", err))
+		return
+	}
+	end, err := parseTime(r.Form.Get("end"), time.Now())
+	if err != nil {
+		respondError(w, badData("invalid parameter \"end\": %v", err))
+		return
+	}
+
+	seen := make(map[model.Fingerprint]bool)
+	result := []model.Metric{}
+	for _, match := range r.Form["match[]"] {
+		expr, err := parse(match)
+		if err != nil {
+			respondError(w, badData("%v", err))
+			return
+		}
+		vs, ok := expr.(*vectorSelector)
+		if !ok || vs.rng != 0 {
+			respondError(w, badData("invalid series selector %q", match))
+			return
+		}
+		for _, m := range a.storage.Series(vs.matchers, start, end) {
+			if fp := m.Fingerprint(); !seen[fp] {
+				seen[fp] = true
+				result = append(result, m)
+			}
+		}
+	}
+	respond(w, result)
+}
+
+func (a *API) labels(w http.ResponseWriter, r *http.Request) {
+	respond(w, a.storage.LabelNames())
+}
+
+func (a *API) labelValues(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/label/")
+	if !strings.HasSuffix(name, "/values") {
+		http.NotFound(w, r)
+		return
+	}
+	name = strings.TrimSuffix(name, "/values")
+	if !model.LabelName(name).IsValid() {
+		respondError(w, badData("invalid label name: %q", name))
+		return
+	}
+	respond(w, a.storage.LabelValues(name))
+}
+
+func respond(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"data":   data,
+	})
+}
+
+func respondError(w http.ResponseWriter, e *apiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    "error",
+		"errorType": e.typ,
+		"error":     e.err.Error(),
+	})
+}
+
+// parseTime parses unix seconds or RFC3339, returning def if s is empty.
+func parseTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		if def.IsZero() {
+			return def, fmt.Errorf("missing timestamp")
+		}
+		return def, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// parseDuration parses seconds or a duration like 1m.
+func parseDuration(s string) (time.Duration, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	if d, err := model.ParseDuration(s); err == nil {
+		return time.Duration(d), nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+}
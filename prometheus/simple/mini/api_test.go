@@ -0,0 +1,167 @@
+package mini
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+
+	"github.com/fatsheep9146/go-best-practise/prometheus/simple/client"
+)
+
+// newTestAPI serves the API of testStorage, returning a client of it.
+func newTestAPI(t *testing.T) *client.Client {
+	t.Helper()
+
+	storage := testStorage()
+	server := httptest.NewServer(NewAPI(storage, NewEngine(storage)))
+	t.Cleanup(server.Close)
+
+	c, err := client.New(client.Config{Address: server.URL})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	return c
+}
+
+func TestAPISeries(t *testing.T) {
+	c := newTestAPI(t)
+
+	for _, test := range []struct {
+		matches []string
+		start   time.Time
+		want    []string
+	}{
+		{
+			matches: []string{"temperature"},
+			want:    []string{`{__name__="temperature", sensor="cpu"}`, `{__name__="temperature", sensor="disk"}`},
+		},
+		{
+			matches: []string{`temperature{sensor="cpu"}`, `{sensor=~"c.*"}`, `http_requests_total{job="web"}`},
+			want:    []string{`{__name__="temperature", sensor="cpu"}`, `{__name__="http_requests_total", code="200", job="web"}`},
+		},
+		// gone has no sample after 150s
+		{matches: []string{"gone"}, start: time.Unix(200, 0), want: []string{}},
+		{matches: []string{"gone"}, start: time.Unix(100, 0), want: []string{`{__name__="gone"}`}},
+	} {
+		series, _, err := c.Series(context.Background(), test.matches, test.start, time.Unix(300, 0))
+		if err != nil {
+			t.Errorf("Series(%v) failed: %v", test.matches, err)
+			continue
+		}
+		got := make(map[string]bool)
+		for _, s := range series {
+			got[s.String()] = true
+		}
+		if len(got) != len(series) || len(got) != len(test.want) {
+			t.Errorf("Series(%v) = %v, want %v", test.matches, series, test.want)
+			continue
+		}
+		for _, w := range test.want {
+			if !got[w] {
+				t.Errorf("Series(%v) = %v, want %v", test.matches, series, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestAPIQuery(t *testing.T) {
+	c := newTestAPI(t)
+
+	vector, _, err := c.Query(context.Background(), "sum by (job) (rate(http_requests_total[1m]))", time.Unix(300, 0))
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	want := map[string]float64{`{job="api"}`: 11.0 / 15, `{job="web"}`: 20.0 / 15}
+	if got := results(t, vector); !sameResults(got, want) {
+		t.Fatalf("Query = %v, want %v", got, want)
+	}
+	for _, s := range vector {
+		if s.Timestamp != model.TimeFromUnix(300) {
+			t.Fatalf("Query returned sample at %v, want 300", s.Timestamp)
+		}
+	}
+
+	// a scalar isn't a vector
+	if _, _, err := c.Query(context.Background(), "1 + 1", time.Unix(300, 0)); err == nil {
+		t.Fatalf("Query of a scalar succeeded")
+	}
+}
+
+func TestAPIQueryRange(t *testing.T) {
+	c := newTestAPI(t)
+
+	matrix, _, err := c.QueryRange(context.Background(), `http_requests_total{code="500"}`, v1.Range{
+		Start: time.Unix(0, 0),
+		End:   time.Unix(60, 0),
+		Step:  30 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("QueryRange failed: %v", err)
+	}
+	if len(matrix) != 1 {
+		t.Fatalf("QueryRange returned %d series, want 1", len(matrix))
+	}
+	if got, want := matrix[0].Metric.String(), `http_requests_total{code="500", job="api"}`; got != want {
+		t.Fatalf("QueryRange returned %s, want %s", got, want)
+	}
+	want := []model.SamplePair{
+		{Timestamp: model.TimeFromUnix(0), Value: 0},
+		{Timestamp: model.TimeFromUnix(30), Value: 2},
+		{Timestamp: model.TimeFromUnix(60), Value: 4},
+	}
+	if len(matrix[0].Values) != len(want) {
+		t.Fatalf("QueryRange = %v, want %v", matrix[0].Values, want)
+	}
+	for i, p := range matrix[0].Values {
+		if !p.Equal(&want[i]) {
+			t.Fatalf("QueryRange = %v, want %v", matrix[0].Values, want)
+		}
+	}
+}
+
+func TestAPILabelValues(t *testing.T) {
+	c := newTestAPI(t)
+
+	values, _, err := c.LabelValues(context.Background(), "sensor", time.Unix(0, 0), time.Unix(300, 0))
+	if err != nil {
+		t.Fatalf("LabelValues failed: %v", err)
+	}
+	if len(values) != 2 || values[0] != "cpu" || values[1] != "disk" {
+		t.Fatalf("LabelValues = %v, want [cpu disk]", values)
+	}
+}
+
+func TestAPIBadData(t *testing.T) {
+	c := newTestAPI(t)
+
+	for name, request := range map[string]func() error{
+		"bad query": func() error {
+			_, _, err := c.Query(context.Background(), "rate(x)", time.Unix(300, 0))
+			return err
+		},
+		"bad range query": func() error {
+			_, _, err := c.QueryRange(context.Background(), "x{", v1.Range{Start: time.Unix(0, 0), End: time.Unix(60, 0), Step: time.Second})
+			return err
+		},
+		"range selector": func() error {
+			_, _, err := c.Series(context.Background(), []string{"x[1m]"}, time.Unix(0, 0), time.Unix(300, 0))
+			return err
+		},
+		"bad label name": func() error {
+			_, _, err := c.LabelValues(context.Background(), "0x", time.Unix(0, 0), time.Unix(300, 0))
+			return err
+		},
+	} {
+		err := request()
+		var apiErr *v1.Error
+		if !errors.As(err, &apiErr) || apiErr.Type != v1.ErrBadData {
+			t.Errorf("%s: err = %v, want %s", name, err, v1.ErrBadData)
+		}
+	}
+}
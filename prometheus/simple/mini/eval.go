@@ -0,0 +1,526 @@
+package mini
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+var (
+	posInf = math.Inf(1)
+	nan    = math.NaN()
+)
+
+type sample struct {
+	metric model.Metric
+	value  float64
+}
+
+type vector []sample
+
+type matrix struct {
+	series []*memSeries
+	// start and end are the bounds of the range, for extrapolation
+	start, end model.Time
+	rng        time.Duration
+}
+
+// Engine evaluates queries against a Storage.
+type Engine struct {
+	storage *Storage
+	// LookbackDelta is how far back instant selectors look for samples.
+	LookbackDelta time.Duration
+}
+
+// NewEngine returns an engine querying storage with the default lookback
+// delta of 5m.
+func NewEngine(storage *Storage) *Engine {
+	return &Engine{storage: storage, LookbackDelta: 5 * time.Minute}
+}
+
+// Query evaluates an instant query at t. It returns a *model.Scalar, a
+// model.Vector or, for range selectors, a model.Matrix.
+func (e *Engine) Query(query string, t time.Time) (model.Value, error) {
+	expr, err := parse(query)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := model.TimeFromUnixNano(t.UnixNano())
+	ev := &evaluator{engine: e, ts: ts}
+	value, err := ev.eval(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := value.(type) {
+	case float64:
+		return &model.Scalar{Value: model.SampleValue(v), Timestamp: ts}, nil
+	case vector:
+		result := make(model.Vector, 0, len(v))
+		for _, s := range v {
+			result = append(result, &model.Sample{Metric: s.metric, Value: model.SampleValue(s.value), Timestamp: ts})
+		}
+		sort.Slice(result, func(i, j int) bool {
+			return result[i].Metric.Before(result[j].Metric)
+		})
+		return result, nil
+	}
+
+	m := value.(matrix)
+	result := make(model.Matrix, 0, len(m.series))
+	for _, s := range m.series {
+		result = append(result, &model.SampleStream{Metric: s.metric, Values: s.samples})
+	}
+	return result, nil
+}
+
+// QueryRange evaluates query at every step from start to end. The query must
+// return a scalar or an instant vector.
+func (e *Engine) QueryRange(query string, start, end time.Time, step time.Duration) (model.Matrix, error) {
+	if step <= 0 {
+		return nil, errors.New("zero or negative query resolution step widths are not accepted")
+	}
+	if end.Before(start) {
+		return nil, errors.New("end timestamp must not be before start time")
+	}
+
+	expr, err := parse(query)
+	if err != nil {
+		return nil, err
+	}
+
+	streams := make(map[model.Fingerprint]*model.SampleStream)
+	for t := start; !t.After(end); t = t.Add(step) {
+		ts := model.TimeFromUnixNano(t.UnixNano())
+		ev := &evaluator{engine: e, ts: ts}
+		value, err := ev.eval(expr)
+		if err != nil {
+			return nil, err
+		}
+
+		var v vector
+		switch value := value.(type) {
+		case float64:
+			v = vector{{metric: model.Metric{}, value: value}}
+		case vector:
+			v = value
+		default:
+			return nil, errors.New("invalid expression type \"range vector\" for range query, must be Scalar or instant Vector")
+		}
+
+		for _, s := range v {
+			fp := s.metric.Fingerprint()
+			ss, exist := streams[fp]
+			if !exist {
+				ss = &model.SampleStream{Metric: s.metric}
+				streams[fp] = ss
+			}
+			ss.Values = append(ss.Values, model.SamplePair{Timestamp: ts, Value: model.SampleValue(s.value)})
+		}
+	}
+
+	result := make(model.Matrix, 0, len(streams))
+	for _, ss := range streams {
+		result = append(result, ss)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Metric.Before(result[j].Metric)
+	})
+	return result, nil
+}
+
+type evaluator struct {
+	engine *Engine
+	ts     model.Time
+}
+
+// eval returns a float64 for scalars, a vector or a matrix.
+func (ev *evaluator) eval(n node) (interface{}, error) {
+	switch n := n.(type) {
+	case *numberLiteral:
+		return n.value, nil
+
+	case *vectorSelector:
+		end := ev.ts.Add(-n.offset)
+		if n.rng > 0 {
+			m := matrix{start: end.Add(-n.rng), end: end, rng: n.rng}
+			for _, s := range ev.engine.storage.selectSeries(n.matchers, m.start, end) {
+				samples := s.samples[:0]
+				for _, sp := range s.samples {
+					if !isStale(float64(sp.Value)) {
+						samples = append(samples, sp)
+					}
+				}
+				if len(samples) > 0 {
+					m.series = append(m.series, &memSeries{metric: s.metric, samples: samples})
+				}
+			}
+			return m, nil
+		}
+
+		var v vector
+		for _, s := range ev.engine.storage.selectSeries(n.matchers, end.Add(-ev.engine.LookbackDelta), end) {
+			last := s.samples[len(s.samples)-1]
+			if !isStale(float64(last.Value)) {
+				v = append(v, sample{metric: s.metric, value: float64(last.Value)})
+			}
+		}
+		return v, nil
+
+	case *unary:
+		value, err := ev.eval(n.expr)
+		if err != nil {
+			return nil, err
+		}
+		switch value := value.(type) {
+		case float64:
+			return -value, nil
+		case vector:
+			result := make(vector, 0, len(value))
+			for _, s := range value {
+				result = append(result, sample{metric: dropName(s.metric), value: -s.value})
+			}
+			return result, nil
+		}
+		return nil, errors.New("unary expression only allowed on expressions of type scalar or instant vector")
+
+	case *call:
+		return ev.call(n)
+
+	case *aggregate:
+		return ev.aggregate(n)
+
+	case *binary:
+		return ev.binary(n)
+	}
+
+	return nil, fmt.Errorf("unknown node %T", n)
+}
+
+func (ev *evaluator) aggregate(n *aggregate) (interface{}, error) {
+	value, err := ev.eval(n.expr)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := value.(vector)
+	if !ok {
+		return nil, fmt.Errorf("expected instant vector in aggregation %s", n.op)
+	}
+
+	k := 0
+	if n.param != nil {
+		param, err := ev.eval(n.param)
+		if err != nil {
+			return nil, err
+		}
+		f, ok := param.(float64)
+		if !ok {
+			return nil, fmt.Errorf("expected scalar parameter in aggregation %s", n.op)
+		}
+		k = int(f)
+	}
+
+	type group struct {
+		metric model.Metric
+		value  float64
+		count  int
+		top    vector
+	}
+	groups := make(map[model.Fingerprint]*group)
+	var order []model.Fingerprint
+
+	for _, s := range v {
+		metric := grouping(s.metric, n.grouping, n.without)
+		fp := metric.Fingerprint()
+		g, exist := groups[fp]
+		if !exist {
+			g = &group{metric: metric, value: s.value}
+			groups[fp] = g
+			order = append(order, fp)
+		} else {
+			switch n.op {
+			case "sum", "avg":
+				g.value += s.value
+			case "min":
+				if s.value < g.value || math.IsNaN(g.value) {
+					g.value = s.value
+				}
+			case "max":
+				if s.value > g.value || math.IsNaN(g.value) {
+					g.value = s.value
+				}
+			}
+		}
+		g.count++
+		g.top = append(g.top, s)
+	}
+
+	var result vector
+	for _, fp := range order {
+		g := groups[fp]
+		switch n.op {
+		case "avg":
+			g.value /= float64(g.count)
+		case "count":
+			g.value = float64(g.count)
+		case "topk", "bottomk":
+			sort.SliceStable(g.top, func(i, j int) bool {
+				if n.op == "topk" {
+					return g.top[i].value > g.top[j].value
+				}
+				return g.top[i].value < g.top[j].value
+			})
+			if k < len(g.top) {
+				g.top = g.top[:k]
+			}
+			if k > 0 {
+				result = append(result, g.top...)
+			}
+			continue
+		}
+		result = append(result, sample{metric: g.metric, value: g.value})
+	}
+	return result, nil
+}
+
+// grouping returns the labels of metric an aggregation groups by.
+func grouping(metric model.Metric, labels []string, without bool) model.Metric {
+	result := model.Metric{}
+	if without {
+		for name, value := range metric {
+			result[name] = value
+		}
+		delete(result, model.MetricNameLabel)
+		for _, l := range labels {
+			delete(result, model.LabelName(l))
+		}
+		return result
+	}
+
+	for _, l := range labels {
+		if value, exist := metric[model.LabelName(l)]; exist {
+			result[model.LabelName(l)] = value
+		}
+	}
+	return result
+}
+
+func (ev *evaluator) binary(n *binary) (interface{}, error) {
+	lhs, err := ev.eval(n.lhs)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := ev.eval(n.rhs)
+	if err != nil {
+		return nil, err
+	}
+
+	lv, lvec := lhs.(vector)
+	rv, rvec := rhs.(vector)
+	ls, lscalar := lhs.(float64)
+	rs, rscalar := rhs.(float64)
+	if !(lvec || lscalar) || !(rvec || rscalar) {
+		return nil, fmt.Errorf("binary expression must contain only scalar and instant vector types")
+	}
+
+	switch n.op {
+	case "and", "or", "unless":
+		if !lvec || !rvec {
+			return nil, fmt.Errorf("set operator %q not allowed in binary scalar expression", n.op)
+		}
+		return ev.setOp(n, lv, rv), nil
+	}
+
+	comparison := isComparison(n.op)
+	switch {
+	case lscalar && rscalar:
+		if comparison && !n.returnBool {
+			return nil, errors.New("comparisons between scalars must use BOOL modifier")
+		}
+		return arithmetic(n.op, ls, rs), nil
+
+	case lvec && rvec:
+		return ev.vectorOp(n, lv, rv)
+	}
+
+	// one side is a scalar
+	v, scalarLeft := lv, lscalar
+	if !lvec {
+		v = rv
+	}
+	result := make(vector, 0, len(v))
+	for _, s := range v {
+		l, r := s.value, rs
+		if scalarLeft {
+			l, r = ls, s.value
+		}
+		value := arithmetic(n.op, l, r)
+
+		switch {
+		case comparison && n.returnBool:
+			result = append(result, sample{metric: dropName(s.metric), value: value})
+		case comparison:
+			if value == 1 {
+				result = append(result, s)
+			}
+		default:
+			result = append(result, sample{metric: dropName(s.metric), value: value})
+		}
+	}
+	return result, nil
+}
+
+// signature returns the labels of metric two vectors are matched on.
+func signature(metric model.Metric, on bool, matching []string) model.Fingerprint {
+	if on {
+		return grouping(metric, matching, false).Fingerprint()
+	}
+	return grouping(metric, matching, true).Fingerprint()
+}
+
+func (ev *evaluator) vectorOp(n *binary, lhs, rhs vector) (vector, error) {
+	right := make(map[model.Fingerprint]sample, len(rhs))
+	for _, s := range rhs {
+		sig := signature(s.metric, n.on, n.matching)
+		if _, dup := right[sig]; dup {
+			return nil, fmt.Errorf("found duplicate series for the match group on the right hand-side of the operation: %s", s.metric)
+		}
+		right[sig] = s
+	}
+
+	comparison := isComparison(n.op)
+	matched := make(map[model.Fingerprint]bool, len(lhs))
+	var result vector
+	for _, l := range lhs {
+		sig := signature(l.metric, n.on, n.matching)
+		r, exist := right[sig]
+		if !exist {
+			continue
+		}
+		if matched[sig] {
+			return nil, fmt.Errorf("found duplicate series for the match group on the left hand-side of the operation: %s", l.metric)
+		}
+		matched[sig] = true
+
+		value := arithmetic(n.op, l.value, r.value)
+		if comparison && !n.returnBool {
+			if value != 1 {
+				continue
+			}
+			value = l.value
+		}
+
+		metric := l.metric
+		if !comparison || n.returnBool {
+			metric = dropName(metric)
+		}
+		if n.on {
+			metric = grouping(metric, n.matching, false)
+		} else if len(n.matching) > 0 {
+			name, hasName := metric[model.MetricNameLabel]
+			metric = grouping(metric, n.matching, true)
+			if hasName {
+				metric[model.MetricNameLabel] = name
+			}
+		}
+		result = append(result, sample{metric: metric, value: value})
+	}
+	return result, nil
+}
+
+func (ev *evaluator) setOp(n *binary, lhs, rhs vector) vector {
+	sigs := func(v vector) map[model.Fingerprint]bool {
+		set := make(map[model.Fingerprint]bool, len(v))
+		for _, s := range v {
+			set[signature(s.metric, n.on, n.matching)] = true
+		}
+		return set
+	}
+
+	var result vector
+	switch n.op {
+	case "and":
+		right := sigs(rhs)
+		for _, s := range lhs {
+			if right[signature(s.metric, n.on, n.matching)] {
+				result = append(result, s)
+			}
+		}
+	case "or":
+		left := sigs(lhs)
+		result = append(result, lhs...)
+		for _, s := range rhs {
+			if !left[signature(s.metric, n.on, n.matching)] {
+				result = append(result, s)
+			}
+		}
+	case "unless":
+		right := sigs(rhs)
+		for _, s := range lhs {
+			if !right[signature(s.metric, n.on, n.matching)] {
+				result = append(result, s)
+			}
+		}
+	}
+	return result
+}
+
+func isComparison(op string) bool {
+	switch op {
+	case "==", "!=", ">", "<", ">=", "<=":
+		return true
+	}
+	return false
+}
+
+// arithmetic applies op, returning 1 or 0 for comparisons.
+func arithmetic(op string, l, r float64) float64 {
+	b := func(ok bool) float64 {
+		if ok {
+			return 1
+		}
+		return 0
+	}
+
+	switch op {
+	case "+":
+		return l + r
+	case "-":
+		return l - r
+	case "*":
+		return l * r
+	case "/":
+		return l / r
+	case "%":
+		return math.Mod(l, r)
+	case "^":
+		return math.Pow(l, r)
+	case "==":
+		return b(l == r)
+	case "!=":
+		return b(l != r)
+	case ">":
+		return b(l > r)
+	case "<":
+		return b(l < r)
+	case ">=":
+		return b(l >= r)
+	case "<=":
+		return b(l <= r)
+	}
+	return nan
+}
+
+func dropName(metric model.Metric) model.Metric {
+	if _, exist := metric[model.MetricNameLabel]; !exist {
+		return metric
+	}
+	result := metric.Clone()
+	delete(result, model.MetricNameLabel)
+	return result
+}
@@ -0,0 +1,331 @@
+package mini
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func testMetric(name string, labels ...string) model.Metric {
+	m := model.Metric{model.MetricNameLabel: model.LabelValue(name)}
+	for i := 0; i+1 < len(labels); i += 2 {
+		m[model.LabelName(labels[i])] = model.LabelValue(labels[i+1])
+	}
+	return m
+}
+
+// testStorage has five minutes of samples every 15s, from 0 to 300s:
+// counters of requests growing by 10, 1 and 20 per scrape, gauges of
+// temperatures, buckets of a histogram of latencies, a counter reset every
+// 10 scrapes and a series that ended at 165s.
+func testStorage() *Storage {
+	series := []struct {
+		metric model.Metric
+		value  func(i int) float64
+	}{
+		{testMetric("http_requests_total", "job", "api", "code", "200"), func(i int) float64 { return 10 * float64(i) }},
+		{testMetric("http_requests_total", "job", "api", "code", "500"), func(i int) float64 { return float64(i) }},
+		{testMetric("http_requests_total", "job", "web", "code", "200"), func(i int) float64 { return 20 * float64(i) }},
+		{testMetric("temperature", "sensor", "cpu"), func(i int) float64 { return 50 }},
+		{testMetric("temperature", "sensor", "disk"), func(i int) float64 { return 30 }},
+		{testMetric("latency_bucket", "le", "0.1"), func(i int) float64 { return float64(i) }},
+		{testMetric("latency_bucket", "le", "0.5"), func(i int) float64 { return 3 * float64(i) }},
+		{testMetric("latency_bucket", "le", "+Inf"), func(i int) float64 { return 4 * float64(i) }},
+		{testMetric("resets_total"), func(i int) float64 { return float64(i % 10) }},
+	}
+
+	s := NewStorage()
+	for i := 0; i <= 20; i++ {
+		ts := model.TimeFromUnix(int64(15 * i))
+		for _, series := range series {
+			s.Append(series.metric, ts, series.value(i))
+		}
+	}
+	for i := 0; i <= 10; i++ {
+		s.Append(testMetric("gone"), model.TimeFromUnix(int64(15*i)), 1)
+	}
+	s.Append(testMetric("gone"), model.TimeFromUnix(165), staleNaN)
+	return s
+}
+
+// results returns the samples of a scalar or vector by their metric, the
+// scalar by "scalar".
+func results(t *testing.T, value model.Value) map[string]float64 {
+	t.Helper()
+
+	result := make(map[string]float64)
+	switch v := value.(type) {
+	case *model.Scalar:
+		result["scalar"] = float64(v.Value)
+	case model.Vector:
+		for _, s := range v {
+			result[s.Metric.String()] = float64(s.Value)
+		}
+	default:
+		t.Fatalf("unexpected result %s", value.Type())
+	}
+	return result
+}
+
+func sameResults(got, want map[string]float64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for metric, w := range want {
+		g, exist := got[metric]
+		if !exist {
+			return false
+		}
+		if math.IsNaN(w) != math.IsNaN(g) || math.Abs(g-w) > 1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestQuery(t *testing.T) {
+	engine := NewEngine(testStorage())
+
+	for _, test := range []struct {
+		query string
+		want  map[string]float64
+	}{
+		// scalars
+		{query: "1 + 2 * 3", want: map[string]float64{"scalar": 7}},
+		{query: "(1 + 2) * 3", want: map[string]float64{"scalar": 9}},
+		{query: "2 ^ 3 ^ 2", want: map[string]float64{"scalar": 512}},
+		{query: "-2 ^ 2", want: map[string]float64{"scalar": -4}},
+		{query: "7 % 4 - 8 / 2", want: map[string]float64{"scalar": -1}},
+		{query: "1 < bool 2", want: map[string]float64{"scalar": 1}},
+		{query: "NaN", want: map[string]float64{"scalar": math.NaN()}},
+		{query: "time()", want: map[string]float64{"scalar": 300}},
+
+		// selectors
+		{query: "temperature", want: map[string]float64{`temperature{sensor="cpu"}`: 50, `temperature{sensor="disk"}`: 30}},
+		{query: `temperature{sensor="cpu"}`, want: map[string]float64{`temperature{sensor="cpu"}`: 50}},
+		{query: `temperature{sensor!="cpu"}`, want: map[string]float64{`temperature{sensor="disk"}`: 30}},
+		{query: `temperature{sensor=~"c.*"}`, want: map[string]float64{`temperature{sensor="cpu"}`: 50}},
+		{query: `temperature{sensor!~"c.*"}`, want: map[string]float64{`temperature{sensor="disk"}`: 30}},
+		{query: `temperature{sensor=~"c"}`, want: map[string]float64{}},
+		{query: `{__name__="temperature", sensor="cpu"}`, want: map[string]float64{`temperature{sensor="cpu"}`: 50}},
+		{query: `http_requests_total{code="500"} offset 1m`, want: map[string]float64{`http_requests_total{code="500", job="api"}`: 16}},
+		// stale series are gone, unless looked at before they went stale
+		{query: "gone", want: map[string]float64{}},
+		{query: "gone offset 3m", want: map[string]float64{"gone": 1}},
+
+		// range functions
+		{query: "rate(http_requests_total[1m])", want: map[string]float64{
+			`{code="200", job="api"}`: 10.0 / 15,
+			`{code="500", job="api"}`: 1.0 / 15,
+			`{code="200", job="web"}`: 20.0 / 15,
+		}},
+		{query: `increase(http_requests_total{code="500"}[1m])`, want: map[string]float64{`{code="500", job="api"}`: 4}},
+		{query: `irate(http_requests_total{code="500"}[1m])`, want: map[string]float64{`{code="500", job="api"}`: 1.0 / 15}},
+		{query: `delta(temperature{sensor="cpu"}[1m])`, want: map[string]float64{`{sensor="cpu"}`: 0}},
+		// 7, 8, 9, 0 increase by 2 in 45s, extrapolated to 60s
+		{query: "rate(resets_total[1m])", want: map[string]float64{"{}": 2.0 / 45}},
+		{query: `avg_over_time(http_requests_total{code="500"}[1m])`, want: map[string]float64{`{code="500", job="api"}`: 18.5}},
+		{query: `sum_over_time(temperature{sensor="cpu"}[1m])`, want: map[string]float64{`{sensor="cpu"}`: 200}},
+		{query: `count_over_time(temperature{sensor="cpu"}[1m])`, want: map[string]float64{`{sensor="cpu"}`: 4}},
+		{query: `min_over_time(http_requests_total{code="500"}[1m])`, want: map[string]float64{`{code="500", job="api"}`: 17}},
+		{query: `max_over_time(http_requests_total{code="500"}[1m])`, want: map[string]float64{`{code="500", job="api"}`: 20}},
+		// the stale marker isn't a sample
+		{query: "last_over_time(gone[5m])", want: map[string]float64{"{}": 1}},
+
+		// aggregations
+		{query: "sum(rate(http_requests_total[1m]))", want: map[string]float64{"{}": 31.0 / 15}},
+		{query: "sum by (job) (rate(http_requests_total[1m]))", want: map[string]float64{`{job="api"}`: 11.0 / 15, `{job="web"}`: 20.0 / 15}},
+		{query: "sum(rate(http_requests_total[1m])) without (code)", want: map[string]float64{`{job="api"}`: 11.0 / 15, `{job="web"}`: 20.0 / 15}},
+		{query: "avg(temperature)", want: map[string]float64{"{}": 40}},
+		{query: "min(temperature)", want: map[string]float64{"{}": 30}},
+		{query: "max(temperature)", want: map[string]float64{"{}": 50}},
+		{query: "count by (code) (http_requests_total)", want: map[string]float64{`{code="200"}`: 2, `{code="500"}`: 1}},
+		{query: "topk(1, temperature)", want: map[string]float64{`temperature{sensor="cpu"}`: 50}},
+		{query: "bottomk(1, temperature)", want: map[string]float64{`temperature{sensor="disk"}`: 30}},
+		{query: "topk(0, temperature)", want: map[string]float64{}},
+
+		// binary operators
+		{query: "temperature > 40", want: map[string]float64{`temperature{sensor="cpu"}`: 50}},
+		{query: "temperature > bool 40", want: map[string]float64{`{sensor="cpu"}`: 1, `{sensor="disk"}`: 0}},
+		{query: "100 - temperature", want: map[string]float64{`{sensor="cpu"}`: 50, `{sensor="disk"}`: 70}},
+		{query: "-temperature", want: map[string]float64{`{sensor="cpu"}`: -50, `{sensor="disk"}`: -30}},
+		{query: `temperature{sensor="cpu"} + temperature`, want: map[string]float64{`{sensor="cpu"}`: 100}},
+		{query: `http_requests_total{code="500"} / ignoring(code) http_requests_total{code="200"}`, want: map[string]float64{`{job="api"}`: 0.1}},
+		{query: `temperature{sensor="cpu"} - on() temperature{sensor="disk"}`, want: map[string]float64{"{}": 20}},
+		{query: `temperature and temperature{sensor="cpu"}`, want: map[string]float64{`temperature{sensor="cpu"}`: 50}},
+		{query: `temperature unless temperature{sensor="cpu"}`, want: map[string]float64{`temperature{sensor="disk"}`: 30}},
+		{query: `temperature{sensor="cpu"} or temperature`, want: map[string]float64{`temperature{sensor="cpu"}`: 50, `temperature{sensor="disk"}`: 30}},
+		{query: `http_requests_total and on(job) temperature`, want: map[string]float64{}},
+
+		// functions
+		{query: `abs(-temperature{sensor="cpu"})`, want: map[string]float64{`{sensor="cpu"}`: 50}},
+		{query: `sqrt(temperature{sensor="disk"} - 14)`, want: map[string]float64{`{sensor="disk"}`: 4}},
+		{query: "clamp_max(temperature, 40)", want: map[string]float64{`{sensor="cpu"}`: 40, `{sensor="disk"}`: 30}},
+		{query: "clamp_min(temperature, 40)", want: map[string]float64{`{sensor="cpu"}`: 50, `{sensor="disk"}`: 40}},
+		{query: "round(temperature / 7)", want: map[string]float64{`{sensor="cpu"}`: 7, `{sensor="disk"}`: 4}},
+		{query: "ceil(temperature / 7)", want: map[string]float64{`{sensor="cpu"}`: 8, `{sensor="disk"}`: 5}},
+		{query: "floor(temperature / 7)", want: map[string]float64{`{sensor="cpu"}`: 7, `{sensor="disk"}`: 4}},
+		{query: `exp(temperature{sensor="cpu"} * 0)`, want: map[string]float64{`{sensor="cpu"}`: 1}},
+		{query: `ln(temperature{sensor="disk"} - 29)`, want: map[string]float64{`{sensor="disk"}`: 0}},
+		{query: "vector(3)", want: map[string]float64{"{}": 3}},
+		{query: "scalar(temperature)", want: map[string]float64{"scalar": math.NaN()}},
+		{query: `scalar(temperature{sensor="cpu"})`, want: map[string]float64{"scalar": 50}},
+		{query: "absent(temperature)", want: map[string]float64{}},
+		{query: `absent(nope{job="x", code=~"5.."})`, want: map[string]float64{`{job="x"}`: 1}},
+		// of 4 requests per 15s, 1 is under 0.1s and 3 under 0.5s
+		{query: "histogram_quantile(0.25, rate(latency_bucket[1m]))", want: map[string]float64{"{}": 0.1}},
+		{query: "histogram_quantile(0.5, rate(latency_bucket[1m]))", want: map[string]float64{"{}": 0.3}},
+		{query: "histogram_quantile(0.9, rate(latency_bucket[1m]))", want: map[string]float64{"{}": 0.5}},
+	} {
+		value, err := engine.Query(test.query, time.Unix(300, 0))
+		if err != nil {
+			t.Errorf("Query(%s) failed: %v", test.query, err)
+			continue
+		}
+		if got := results(t, value); !sameResults(got, test.want) {
+			t.Errorf("Query(%s) = %v, want %v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestQueryMatrix(t *testing.T) {
+	engine := NewEngine(testStorage())
+
+	value, err := engine.Query(`http_requests_total{code="500"}[1m]`, time.Unix(300, 0))
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	matrix, ok := value.(model.Matrix)
+	if !ok || len(matrix) != 1 {
+		t.Fatalf("Query = %v, want a matrix of one series", value)
+	}
+	var values []float64
+	for _, v := range matrix[0].Values {
+		values = append(values, float64(v.Value))
+	}
+	if want := []float64{17, 18, 19, 20}; !equalFloats(values, want) {
+		t.Fatalf("values = %v, want %v", values, want)
+	}
+}
+
+func equalFloats(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.Abs(a[i]-b[i]) > 1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestQueryErrors(t *testing.T) {
+	engine := NewEngine(testStorage())
+
+	for _, test := range []struct {
+		query string
+		err   string
+	}{
+		{query: "1 > 2", err: "comparisons between scalars must use BOOL modifier"},
+		{query: "rate(temperature)", err: `expected type range vector in call to function "rate", got instant vector`},
+		{query: "abs(1)", err: `expected type instant vector in call to function "abs", got scalar`},
+		{query: "sum(temperature[1m])", err: "expected instant vector in aggregation sum"},
+		{query: "topk(temperature, temperature)", err: "expected scalar parameter in aggregation topk"},
+		{query: "temperature and 1", err: `set operator "and" not allowed in binary scalar expression`},
+		{query: "temperature[1m] + 1", err: "binary expression must contain only scalar and instant vector types"},
+		{query: "-temperature[1m]", err: "unary expression only allowed on expressions of type scalar or instant vector"},
+		{query: "http_requests_total + on() temperature", err: "found duplicate series for the match group"},
+		{query: "sum(", err: "parse error"},
+	} {
+		_, err := engine.Query(test.query, time.Unix(300, 0))
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("Query(%s) failed: %v", test.query, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("Query(%s) err = %v, want %q", test.query, err, test.err)
+		}
+	}
+}
+
+func TestQueryRange(t *testing.T) {
+	engine := NewEngine(testStorage())
+
+	matrix, err := engine.QueryRange(`increase(http_requests_total{code="500"}[1m])`, time.Unix(120, 0), time.Unix(300, 0), time.Minute)
+	if err != nil {
+		t.Fatalf("QueryRange failed: %v", err)
+	}
+	if len(matrix) != 1 || matrix[0].Metric.String() != `{code="500", job="api"}` {
+		t.Fatalf("QueryRange = %v, want one series", matrix)
+	}
+	var (
+		timestamps []model.Time
+		values     []float64
+	)
+	for _, v := range matrix[0].Values {
+		timestamps = append(timestamps, v.Timestamp)
+		values = append(values, float64(v.Value))
+	}
+	if want := []model.Time{120000, 180000, 240000, 300000}; !equalTimes(timestamps, want) {
+		t.Errorf("timestamps = %v, want %v", timestamps, want)
+	}
+	if want := []float64{4, 4, 4, 4}; !equalFloats(values, want) {
+		t.Errorf("values = %v, want %v", values, want)
+	}
+
+	// gone disappears at its stale marker
+	matrix, err = engine.QueryRange("gone", time.Unix(120, 0), time.Unix(180, 0), 15*time.Second)
+	if err != nil {
+		t.Fatalf("QueryRange failed: %v", err)
+	}
+	if len(matrix) != 1 || len(matrix[0].Values) != 3 {
+		t.Fatalf("QueryRange(gone) = %v, want 3 samples until 150s", matrix)
+	}
+
+	// scalars become series without labels
+	matrix, err = engine.QueryRange("time()", time.Unix(0, 0), time.Unix(60, 0), 30*time.Second)
+	if err != nil {
+		t.Fatalf("QueryRange failed: %v", err)
+	}
+	values = nil
+	for _, v := range matrix[0].Values {
+		values = append(values, float64(v.Value))
+	}
+	if want := []float64{0, 30, 60}; len(matrix) != 1 || !equalFloats(values, want) {
+		t.Fatalf("QueryRange(time()) = %v, want %v", matrix, want)
+	}
+}
+
+func equalTimes(a, b []model.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestQueryRangeErrors(t *testing.T) {
+	engine := NewEngine(testStorage())
+
+	for _, test := range []struct {
+		query      string
+		start, end int64
+		step       time.Duration
+	}{
+		{query: "temperature", start: 0, end: 60, step: 0},
+		{query: "temperature", start: 60, end: 0, step: time.Second},
+		{query: "temperature[1m]", start: 0, end: 60, step: time.Second},
+		{query: "sum(", start: 0, end: 60, step: time.Second},
+	} {
+		if _, err := engine.QueryRange(test.query, time.Unix(test.start, 0), time.Unix(test.end, 0), test.step); err == nil {
+			t.Errorf("QueryRange(%s, %d, %d, %v) succeeded", test.query, test.start, test.end, test.step)
+		}
+	}
+}
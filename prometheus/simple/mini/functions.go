@@ -0,0 +1,341 @@
+package mini
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/common/model"
+)
+
+var aggregations = map[string]bool{
+	"sum":     true,
+	"avg":     true,
+	"min":     true,
+	"max":     true,
+	"count":   true,
+	"topk":    true,
+	"bottomk": true,
+}
+
+type valueType string
+
+const (
+	typeScalar valueType = "scalar"
+	typeVector valueType = "instant vector"
+	typeMatrix valueType = "range vector"
+)
+
+type function struct {
+	args []valueType
+	call func(ev *evaluator, args []interface{}) interface{}
+}
+
+var functions map[string]function
+
+func init() {
+	functions = map[string]function{
+		"rate":     {[]valueType{typeMatrix}, rangeFunc(func(m matrix, s *memSeries) (float64, bool) { return extrapolatedRate(m, s, true, true) })},
+		"increase": {[]valueType{typeMatrix}, rangeFunc(func(m matrix, s *memSeries) (float64, bool) { return extrapolatedRate(m, s, true, false) })},
+		"delta":    {[]valueType{typeMatrix}, rangeFunc(func(m matrix, s *memSeries) (float64, bool) { return extrapolatedRate(m, s, false, false) })},
+		"irate":    {[]valueType{typeMatrix}, rangeFunc(instantRate)},
+
+		"avg_over_time":   {[]valueType{typeMatrix}, overTime(func(values []float64) float64 { return sum(values) / float64(len(values)) })},
+		"sum_over_time":   {[]valueType{typeMatrix}, overTime(sum)},
+		"count_over_time": {[]valueType{typeMatrix}, overTime(func(values []float64) float64 { return float64(len(values)) })},
+		"min_over_time":   {[]valueType{typeMatrix}, overTime(func(values []float64) float64 { return fold(values, math.Min) })},
+		"max_over_time":   {[]valueType{typeMatrix}, overTime(func(values []float64) float64 { return fold(values, math.Max) })},
+		"last_over_time":  {[]valueType{typeMatrix}, overTime(func(values []float64) float64 { return values[len(values)-1] })},
+
+		"abs":   {[]valueType{typeVector}, mathFunc(math.Abs)},
+		"ceil":  {[]valueType{typeVector}, mathFunc(math.Ceil)},
+		"floor": {[]valueType{typeVector}, mathFunc(math.Floor)},
+		"round": {[]valueType{typeVector}, mathFunc(math.Round)},
+		"sqrt":  {[]valueType{typeVector}, mathFunc(math.Sqrt)},
+		"exp":   {[]valueType{typeVector}, mathFunc(math.Exp)},
+		"ln":    {[]valueType{typeVector}, mathFunc(math.Log)},
+
+		"clamp_min": {[]valueType{typeVector, typeScalar}, func(ev *evaluator, args []interface{}) interface{} {
+			min := args[1].(float64)
+			return mathFunc(func(v float64) float64 { return math.Max(v, min) })(ev, args[:1])
+		}},
+		"clamp_max": {[]valueType{typeVector, typeScalar}, func(ev *evaluator, args []interface{}) interface{} {
+			max := args[1].(float64)
+			return mathFunc(func(v float64) float64 { return math.Min(v, max) })(ev, args[:1])
+		}},
+
+		"time": {nil, func(ev *evaluator, args []interface{}) interface{} {
+			return float64(ev.ts) / 1000
+		}},
+		"vector": {[]valueType{typeScalar}, func(ev *evaluator, args []interface{}) interface{} {
+			return vector{{metric: model.Metric{}, value: args[0].(float64)}}
+		}},
+		"scalar": {[]valueType{typeVector}, func(ev *evaluator, args []interface{}) interface{} {
+			if v := args[0].(vector); len(v) == 1 {
+				return v[0].value
+			}
+			return nan
+		}},
+		"absent": {[]valueType{typeVector}, func(ev *evaluator, args []interface{}) interface{} {
+			if len(args[0].(vector)) > 0 {
+				return vector{}
+			}
+			return vector{{metric: model.Metric{}, value: 1}}
+		}},
+		"histogram_quantile": {[]valueType{typeScalar, typeVector}, histogramQuantile},
+	}
+}
+
+func (ev *evaluator) call(n *call) (interface{}, error) {
+	fn := functions[n.fn]
+
+	args := make([]interface{}, 0, len(n.args))
+	for i, arg := range n.args {
+		value, err := ev.eval(arg)
+		if err != nil {
+			return nil, err
+		}
+
+		var typ valueType
+		switch value.(type) {
+		case float64:
+			typ = typeScalar
+		case vector:
+			typ = typeVector
+		case matrix:
+			typ = typeMatrix
+		}
+		if typ != fn.args[i] {
+			return nil, fmt.Errorf("expected type %s in call to function %q, got %s", fn.args[i], n.fn, typ)
+		}
+		args = append(args, value)
+	}
+
+	result := fn.call(ev, args)
+
+	// like in Prometheus, absent has the labels of the equality matchers of
+	// its selector
+	if n.fn == "absent" {
+		v := result.(vector)
+		if vs, ok := n.args[0].(*vectorSelector); ok && len(v) == 1 {
+			for _, m := range vs.matchers {
+				if m.Type == MatchEqual && m.Name != model.MetricNameLabel {
+					v[0].metric[model.LabelName(m.Name)] = model.LabelValue(m.Value)
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+func rangeFunc(f func(m matrix, s *memSeries) (float64, bool)) func(*evaluator, []interface{}) interface{} {
+	return func(ev *evaluator, args []interface{}) interface{} {
+		m := args[0].(matrix)
+		var result vector
+		for _, s := range m.series {
+			if value, ok := f(m, s); ok {
+				result = append(result, sample{metric: dropName(s.metric), value: value})
+			}
+		}
+		return result
+	}
+}
+
+// extrapolatedRate is the increase of a series over the range, extrapolated
+// to the bounds of the range as Prometheus does.
+func extrapolatedRate(m matrix, s *memSeries, isCounter, isRate bool) (float64, bool) {
+	samples := s.samples
+	if len(samples) < 2 {
+		return 0, false
+	}
+	first, last := samples[0], samples[len(samples)-1]
+
+	result := float64(last.Value - first.Value)
+	if isCounter {
+		for i := 1; i < len(samples); i++ {
+			// a counter reset
+			if samples[i].Value < samples[i-1].Value {
+				result += float64(samples[i-1].Value)
+			}
+		}
+	}
+
+	durationToStart := float64(first.Timestamp-m.start) / 1000
+	durationToEnd := float64(m.end-last.Timestamp) / 1000
+	sampledInterval := float64(last.Timestamp-first.Timestamp) / 1000
+	averageInterval := sampledInterval / float64(len(samples)-1)
+
+	// counters can't be extrapolated below zero
+	if isCounter && result > 0 && first.Value >= 0 {
+		if durationToZero := sampledInterval * (float64(first.Value) / result); durationToZero < durationToStart {
+			durationToStart = durationToZero
+		}
+	}
+
+	threshold := averageInterval * 1.1
+	interval := sampledInterval
+	if durationToStart < threshold {
+		interval += durationToStart
+	} else {
+		interval += averageInterval / 2
+	}
+	if durationToEnd < threshold {
+		interval += durationToEnd
+	} else {
+		interval += averageInterval / 2
+	}
+
+	result *= interval / sampledInterval
+	if isRate {
+		result /= m.rng.Seconds()
+	}
+	return result, true
+}
+
+func instantRate(m matrix, s *memSeries) (float64, bool) {
+	if len(s.samples) < 2 {
+		return 0, false
+	}
+	prev, last := s.samples[len(s.samples)-2], s.samples[len(s.samples)-1]
+
+	result := float64(last.Value - prev.Value)
+	if last.Value < prev.Value {
+		result = float64(last.Value)
+	}
+	return result / (float64(last.Timestamp-prev.Timestamp) / 1000), true
+}
+
+func overTime(f func(values []float64) float64) func(*evaluator, []interface{}) interface{} {
+	return rangeFunc(func(m matrix, s *memSeries) (float64, bool) {
+		values := make([]float64, 0, len(s.samples))
+		for _, sp := range s.samples {
+			values = append(values, float64(sp.Value))
+		}
+		return f(values), true
+	})
+}
+
+func mathFunc(f func(float64) float64) func(*evaluator, []interface{}) interface{} {
+	return func(ev *evaluator, args []interface{}) interface{} {
+		v := args[0].(vector)
+		result := make(vector, 0, len(v))
+		for _, s := range v {
+			result = append(result, sample{metric: dropName(s.metric), value: f(s.value)})
+		}
+		return result
+	}
+}
+
+func sum(values []float64) float64 {
+	var total float64
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
+
+func fold(values []float64, f func(a, b float64) float64) float64 {
+	result := values[0]
+	for _, v := range values[1:] {
+		result = f(result, v)
+	}
+	return result
+}
+
+type bucket struct {
+	upperBound float64
+	count      float64
+}
+
+// histogramQuantile computes the φ-quantile of the classic histograms of a
+// vector of _bucket series, grouped by their labels other than le.
+func histogramQuantile(ev *evaluator, args []interface{}) interface{} {
+	q := args[0].(float64)
+	v := args[1].(vector)
+
+	type histogram struct {
+		metric  model.Metric
+		buckets []bucket
+	}
+	histograms := make(map[model.Fingerprint]*histogram)
+	var order []model.Fingerprint
+
+	for _, s := range v {
+		le, err := strconv.ParseFloat(string(s.metric[model.BucketLabel]), 64)
+		if err != nil {
+			continue
+		}
+		metric := dropName(s.metric).Clone()
+		delete(metric, model.BucketLabel)
+
+		fp := metric.Fingerprint()
+		h, exist := histograms[fp]
+		if !exist {
+			h = &histogram{metric: metric}
+			histograms[fp] = h
+			order = append(order, fp)
+		}
+		h.buckets = append(h.buckets, bucket{upperBound: le, count: s.value})
+	}
+
+	var result vector
+	for _, fp := range order {
+		h := histograms[fp]
+		result = append(result, sample{metric: h.metric, value: bucketQuantile(q, h.buckets)})
+	}
+	return result
+}
+
+// bucketQuantile interpolates the quantile linearly within its bucket, like
+// Prometheus.
+func bucketQuantile(q float64, buckets []bucket) float64 {
+	switch {
+	case q < 0:
+		return math.Inf(-1)
+	case q > 1:
+		return math.Inf(1)
+	}
+
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].upperBound < buckets[j].upperBound
+	})
+	if len(buckets) < 2 || !math.IsInf(buckets[len(buckets)-1].upperBound, 1) {
+		return nan
+	}
+	// counts may be inconsistent if the buckets were scraped at different
+	// times
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i].count < buckets[i-1].count {
+			buckets[i].count = buckets[i-1].count
+		}
+	}
+
+	observations := buckets[len(buckets)-1].count
+	if observations == 0 {
+		return nan
+	}
+	rank := q * observations
+
+	b := sort.Search(len(buckets)-1, func(i int) bool {
+		return buckets[i].count >= rank
+	})
+	if b == len(buckets)-1 {
+		return buckets[len(buckets)-2].upperBound
+	}
+	if b == 0 && buckets[0].upperBound <= 0 {
+		return buckets[0].upperBound
+	}
+
+	var (
+		bucketStart float64
+		bucketEnd   = buckets[b].upperBound
+		count       = buckets[b].count
+	)
+	if b > 0 {
+		bucketStart = buckets[b-1].upperBound
+		count -= buckets[b-1].count
+		rank -= buckets[b-1].count
+	}
+	return bucketStart + (bucketEnd-bucketStart)*(rank/count)
+}
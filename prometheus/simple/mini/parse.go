@@ -0,0 +1,564 @@
+package mini
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/prometheus/common/model"
+)
+
+// The supported subset of PromQL is
+//
+//	number literals, and vector selectors with matchers, range and offset
+//	unary -, binary + - * / % ^, comparisons with bool, and/or/unless,
+//	with on(...) and ignoring(...) for one-to-one matching
+//	sum, avg, min, max, count, topk and bottomk, with by or without
+//	the functions listed in functions
+//
+// String literals are only allowed as matcher values.
+
+type node interface{}
+
+type numberLiteral struct {
+	value float64
+}
+
+type vectorSelector struct {
+	name     string
+	matchers []*Matcher
+	// rng is the range of range selectors, zero for instant selectors
+	rng    time.Duration
+	offset time.Duration
+}
+
+type call struct {
+	fn   string
+	args []node
+}
+
+type aggregate struct {
+	op       string
+	without  bool
+	grouping []string
+	param    node
+	expr     node
+}
+
+type binary struct {
+	op         string
+	lhs, rhs   node
+	returnBool bool
+	// on tells whether matching are the labels to match on, or the labels to
+	// ignore
+	on       bool
+	matching []string
+}
+
+type unary struct {
+	expr node
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokDuration
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// ParseError is a syntax error of a query.
+type ParseError struct {
+	Pos int
+	Msg string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse error at char %d: %s", e.Pos+1, e.Msg)
+}
+
+var operators = []string{
+	"==", "!=", "=~", "!~", ">=", "<=",
+	"(", ")", "{", "}", "[", "]", ",", "=", ">", "<", "+", "-", "*", "/", "%", "^",
+}
+
+func lex(input string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(input); {
+		c := rune(input[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+
+		case c == '"' || c == '\'' || c == '`':
+			j := i + 1
+			for j < len(input) && rune(input[j]) != c {
+				if input[j] == '\\' && c != '`' {
+					j++
+				}
+				j++
+			}
+			if j >= len(input) {
+				return nil, &ParseError{Pos: i, Msg: "unterminated string"}
+			}
+			tokens = append(tokens, token{tokString, input[i : j+1], i})
+			i = j + 1
+
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(input) && input[i+1] >= '0' && input[i+1] <= '9':
+			j := i
+			for j < len(input) && (isDigit(input[j]) || input[j] == '.' ||
+				(input[j] == 'e' || input[j] == 'E') && j+1 < len(input) && (isDigit(input[j+1]) || input[j+1] == '-' || input[j+1] == '+')) {
+				if input[j] == 'e' || input[j] == 'E' {
+					j++
+				}
+				j++
+			}
+			kind := tokNumber
+			// durations like 5m or 1h30m
+			for j < len(input) && strings.ContainsRune("smhdwy", rune(input[j])) {
+				kind = tokDuration
+				j++
+				for j < len(input) && isDigit(input[j]) {
+					j++
+				}
+			}
+			tokens = append(tokens, token{kind, input[i:j], i})
+			i = j
+
+		case c == '_' || c == ':' || unicode.IsLetter(c):
+			j := i
+			for j < len(input) && (input[j] == '_' || input[j] == ':' || isDigit(input[j]) || unicode.IsLetter(rune(input[j]))) {
+				j++
+			}
+			tokens = append(tokens, token{tokIdent, input[i:j], i})
+			i = j
+
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(input[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, &ParseError{Pos: i, Msg: fmt.Sprintf("unexpected character %q", c)}
+			}
+			tokens = append(tokens, token{tokOp, op, i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(input)}), nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parse parses a query into its syntax tree.
+func parse(query string) (node, error) {
+	tokens, err := lex(query)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	n, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %q", t.text)
+	}
+	return n, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return &ParseError{Pos: t.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) expect(text string) error {
+	if t := p.next(); t.text != text || t.kind == tokString {
+		return p.errorf(t, "expected %q, got %q", text, t.text)
+	}
+	return nil
+}
+
+// binary operators by increasing precedence
+var precedence = [][]string{
+	{"or"},
+	{"and", "unless"},
+	{"==", "!=", "<=", "<", ">=", ">"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *parser) binaryOp(level int) (string, bool) {
+	t := p.peek()
+	if t.kind != tokOp && t.kind != tokIdent {
+		return "", false
+	}
+	for _, op := range precedence[level] {
+		if t.text == op {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) binary(level int) (node, error) {
+	if level == len(precedence) {
+		return p.unary()
+	}
+
+	lhs, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op, ok := p.binaryOp(level)
+		if !ok {
+			return lhs, nil
+		}
+		p.next()
+
+		b := &binary{op: op, lhs: lhs}
+		if p.peek().text == "bool" {
+			if level != 2 {
+				return nil, p.errorf(p.peek(), "bool modifier can only be used on comparison operators")
+			}
+			p.next()
+			b.returnBool = true
+		}
+		if t := p.peek(); t.text == "on" || t.text == "ignoring" {
+			p.next()
+			b.on = t.text == "on"
+			if b.matching, err = p.labelList(); err != nil {
+				return nil, err
+			}
+		}
+
+		if b.rhs, err = p.binary(level + 1); err != nil {
+			return nil, err
+		}
+		lhs = b
+	}
+}
+
+func (p *parser) unary() (node, error) {
+	switch p.peek().text {
+	case "-":
+		p.next()
+		expr, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{expr: expr}, nil
+	case "+":
+		p.next()
+		return p.unary()
+	}
+
+	expr, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	// ^ binds tighter than unary minus and is right associative, so -2^2 is
+	// -(2^2) and 2^3^2 is 2^(3^2)
+	if p.peek().text == "^" {
+		p.next()
+		rhs, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &binary{op: "^", lhs: expr, rhs: rhs}, nil
+	}
+	return expr, nil
+}
+
+func (p *parser) primary() (node, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokNumber:
+		p.next()
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorf(t, "bad number %q", t.text)
+		}
+		return &numberLiteral{value: v}, nil
+
+	case t.text == "(":
+		p.next()
+		expr, err := p.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return p.rangeAndOffset(expr)
+
+	case t.text == "{":
+		return p.selector("")
+
+	case t.kind == tokIdent:
+		p.next()
+		switch {
+		case t.text == "Inf" || t.text == "inf":
+			return &numberLiteral{value: posInf}, nil
+		case t.text == "NaN" || t.text == "nan":
+			return &numberLiteral{value: nan}, nil
+		case aggregations[t.text]:
+			return p.aggregate(t)
+		case p.peek().text == "(":
+			return p.call(t)
+		}
+		return p.selector(t.text)
+	}
+
+	return nil, p.errorf(t, "unexpected %q", t.text)
+}
+
+func (p *parser) selector(name string) (node, error) {
+	vs := &vectorSelector{name: name}
+	if name != "" {
+		m, _ := NewMatcher(model.MetricNameLabel, MatchEqual, name)
+		vs.matchers = append(vs.matchers, m)
+	}
+
+	if p.peek().text == "{" {
+		p.next()
+		for p.peek().text != "}" {
+			label := p.next()
+			if label.kind != tokIdent {
+				return nil, p.errorf(label, "expected label name, got %q", label.text)
+			}
+			op := p.next()
+			switch MatchType(op.text) {
+			case MatchEqual, MatchNotEqual, MatchRegexp, MatchNotRegexp:
+			default:
+				return nil, p.errorf(op, "expected label matching operator, got %q", op.text)
+			}
+			value := p.next()
+			if value.kind != tokString {
+				return nil, p.errorf(value, "expected string, got %q", value.text)
+			}
+			s, err := unquote(value.text)
+			if err != nil {
+				return nil, p.errorf(value, "%v", err)
+			}
+			m, err := NewMatcher(label.text, MatchType(op.text), s)
+			if err != nil {
+				return nil, p.errorf(value, "%v", err)
+			}
+			vs.matchers = append(vs.matchers, m)
+
+			if p.peek().text == "," {
+				p.next()
+			} else if p.peek().text != "}" {
+				return nil, p.errorf(p.peek(), "expected \",\" or \"}\", got %q", p.peek().text)
+			}
+		}
+		p.next()
+	}
+
+	// like in Prometheus, a selector must not select every series
+	empty := true
+	for _, m := range vs.matchers {
+		if !m.Matches("") {
+			empty = false
+			break
+		}
+	}
+	if empty {
+		return nil, p.errorf(p.peek(), "vector selector must contain at least one non-empty matcher")
+	}
+	return p.rangeAndOffset(vs)
+}
+
+// rangeAndOffset parses the range and offset that may follow a selector.
+func (p *parser) rangeAndOffset(expr node) (node, error) {
+	vs, isSelector := expr.(*vectorSelector)
+
+	if p.peek().text == "[" {
+		t := p.next()
+		if !isSelector || vs.rng != 0 {
+			return nil, p.errorf(t, "ranges are only allowed for vector selectors")
+		}
+		d, err := p.duration()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		vs.rng = d
+	}
+
+	if p.peek().text == "offset" {
+		t := p.next()
+		if !isSelector {
+			return nil, p.errorf(t, "offset is only allowed for vector selectors")
+		}
+		d, err := p.duration()
+		if err != nil {
+			return nil, err
+		}
+		vs.offset = d
+	}
+
+	return expr, nil
+}
+
+func (p *parser) duration() (time.Duration, error) {
+	t := p.next()
+	if t.kind != tokDuration {
+		return 0, p.errorf(t, "expected duration, got %q", t.text)
+	}
+	d, err := model.ParseDuration(t.text)
+	if err != nil {
+		return 0, p.errorf(t, "%v", err)
+	}
+	return time.Duration(d), nil
+}
+
+func (p *parser) labelList() ([]string, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var labels []string
+	for p.peek().text != ")" {
+		t := p.next()
+		if t.kind != tokIdent {
+			return nil, p.errorf(t, "expected label name, got %q", t.text)
+		}
+		labels = append(labels, t.text)
+		if p.peek().text == "," {
+			p.next()
+		} else if p.peek().text != ")" {
+			return nil, p.errorf(p.peek(), "expected \",\" or \")\", got %q", p.peek().text)
+		}
+	}
+	p.next()
+	return labels, nil
+}
+
+func (p *parser) args() ([]node, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var args []node
+	for p.peek().text != ")" {
+		arg, err := p.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.peek().text == "," {
+			p.next()
+		} else if p.peek().text != ")" {
+			return nil, p.errorf(p.peek(), "expected \",\" or \")\", got %q", p.peek().text)
+		}
+	}
+	p.next()
+	return args, nil
+}
+
+func (p *parser) call(name token) (node, error) {
+	fn, exist := functions[name.text]
+	if !exist {
+		return nil, p.errorf(name, "unknown function %s", name.text)
+	}
+	args, err := p.args()
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != len(fn.args) {
+		return nil, p.errorf(name, "function %s expects %d arguments, got %d", name.text, len(fn.args), len(args))
+	}
+	return &call{fn: name.text, args: args}, nil
+}
+
+// aggregate parses an aggregation, whose grouping may come before or after
+// its arguments.
+func (p *parser) aggregate(op token) (node, error) {
+	agg := &aggregate{op: op.text}
+
+	grouping := func() error {
+		t := p.peek()
+		if t.text != "by" && t.text != "without" {
+			return nil
+		}
+		p.next()
+		agg.without = t.text == "without"
+		var err error
+		agg.grouping, err = p.labelList()
+		return err
+	}
+
+	if err := grouping(); err != nil {
+		return nil, err
+	}
+	args, err := p.args()
+	if err != nil {
+		return nil, err
+	}
+	if agg.grouping == nil && !agg.without {
+		if err := grouping(); err != nil {
+			return nil, err
+		}
+	}
+
+	want := 1
+	if op.text == "topk" || op.text == "bottomk" {
+		want = 2
+	}
+	if len(args) != want {
+		return nil, p.errorf(op, "aggregation %s expects %d arguments, got %d", op.text, want, len(args))
+	}
+	if want == 2 {
+		agg.param = args[0]
+	}
+	agg.expr = args[want-1]
+	return agg, nil
+}
+
+func unquote(s string) (string, error) {
+	switch s[0] {
+	case '`':
+		return s[1 : len(s)-1], nil
+	case '\'':
+		// strconv only unquotes single quoted characters
+		s = `"` + strings.Replace(strings.Replace(s[1:len(s)-1], `\'`, `'`, -1), `"`, `\"`, -1) + `"`
+	}
+	return strconv.Unquote(s)
+}
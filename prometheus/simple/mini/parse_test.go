@@ -0,0 +1,137 @@
+package mini
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	mustMatcher := func(name string, typ MatchType, value string) *Matcher {
+		m, err := NewMatcher(name, typ, value)
+		if err != nil {
+			t.Fatalf("NewMatcher failed: %v", err)
+		}
+		return m
+	}
+	name := func(value string) *Matcher {
+		return mustMatcher("__name__", MatchEqual, value)
+	}
+
+	for _, test := range []struct {
+		query string
+		want  node
+	}{
+		{query: "1.5", want: &numberLiteral{1.5}},
+		{
+			query: `x{a="b", c!~'d.*'}`,
+			want: &vectorSelector{name: "x", matchers: []*Matcher{
+				name("x"),
+				mustMatcher("a", MatchEqual, "b"),
+				mustMatcher("c", MatchNotRegexp, "d.*"),
+			}},
+		},
+		{
+			query: `{__name__=~"x|y"}[5m] offset 1h`,
+			want: &vectorSelector{
+				matchers: []*Matcher{mustMatcher("__name__", MatchRegexp, "x|y")},
+				rng:      5 * time.Minute,
+				offset:   time.Hour,
+			},
+		},
+		{
+			query: "sum without (a, b) (x)",
+			want:  &aggregate{op: "sum", without: true, grouping: []string{"a", "b"}, expr: &vectorSelector{name: "x", matchers: []*Matcher{name("x")}}},
+		},
+		{
+			query: "topk(3, x) by (a)",
+			want:  &aggregate{op: "topk", grouping: []string{"a"}, param: &numberLiteral{3}, expr: &vectorSelector{name: "x", matchers: []*Matcher{name("x")}}},
+		},
+		{
+			query: "rate(x[1m])",
+			want:  &call{fn: "rate", args: []node{&vectorSelector{name: "x", matchers: []*Matcher{name("x")}, rng: time.Minute}}},
+		},
+		{
+			query: "x / ignoring(a) y > bool 1",
+			want: &binary{
+				op: ">",
+				lhs: &binary{
+					op:       "/",
+					lhs:      &vectorSelector{name: "x", matchers: []*Matcher{name("x")}},
+					rhs:      &vectorSelector{name: "y", matchers: []*Matcher{name("y")}},
+					matching: []string{"a"},
+				},
+				rhs:        &numberLiteral{1},
+				returnBool: true,
+			},
+		},
+		{
+			query: "x and on(a) y or z",
+			want: &binary{
+				op: "or",
+				lhs: &binary{
+					op:       "and",
+					lhs:      &vectorSelector{name: "x", matchers: []*Matcher{name("x")}},
+					rhs:      &vectorSelector{name: "y", matchers: []*Matcher{name("y")}},
+					on:       true,
+					matching: []string{"a"},
+				},
+				rhs: &vectorSelector{name: "z", matchers: []*Matcher{name("z")}},
+			},
+		},
+		{query: "-x", want: &unary{&vectorSelector{name: "x", matchers: []*Matcher{name("x")}}}},
+	} {
+		got, err := parse(test.query)
+		if err != nil {
+			t.Errorf("parse(%q) failed: %v", test.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parse(%q) = %#v, want %#v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, test := range []struct {
+		query string
+		// pos is the expected position, 1-based like in the message
+		pos int
+		msg string
+	}{
+		{query: "nope(x)", pos: 1, msg: "unknown function nope"},
+		{query: "rate(x[1m], 2)", pos: 1, msg: "function rate expects 1 arguments, got 2"},
+		{query: "topk(x)", pos: 1, msg: "aggregation topk expects 2 arguments, got 1"},
+		{query: "x{", pos: 3, msg: `expected label name, got ""`},
+		{query: "x{a=b}", pos: 5, msg: `expected string, got "b"`},
+		{query: `x{a="b" c="d"}`, pos: 9, msg: `expected "," or "}"`},
+		{query: `x{a~"b"}`, pos: 4, msg: "unexpected character '~'"},
+		{query: `x{a,"b"}`, pos: 4, msg: "expected label matching operator"},
+		{query: `x{a=~"("}`, pos: 6, msg: "error parsing regexp"},
+		{query: "{}", pos: 3, msg: "vector selector must contain at least one non-empty matcher"},
+		{query: `{a=""}`, pos: 7, msg: "vector selector must contain at least one non-empty matcher"},
+		{query: `{a=~".*"}`, pos: 10, msg: "vector selector must contain at least one non-empty matcher"},
+		{query: "sum(x) by (", pos: 12, msg: `expected label name, got ""`},
+		{query: "1 +", pos: 4, msg: `unexpected ""`},
+		{query: "(1", pos: 3, msg: `expected ")"`},
+		{query: "x[1m][1m]", pos: 6, msg: `unexpected "["`},
+		{query: "x[1x]", pos: 3, msg: "expected duration"},
+		{query: "x + bool y", pos: 5, msg: "bool modifier can only be used on comparison operators"},
+		{query: `"a"`, pos: 1, msg: `unexpected "\"a\""`},
+		{query: "(x + 1) offset 1m", pos: 9, msg: "offset is only allowed for vector selectors"},
+		{query: "(x + 1)[1m]", pos: 8, msg: "ranges are only allowed for vector selectors"},
+		{query: "x y", pos: 3, msg: `unexpected "y"`},
+	} {
+		_, err := parse(test.query)
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("parse(%q) err = %v, want a ParseError", test.query, err)
+			continue
+		}
+		if parseErr.Pos+1 != test.pos || !strings.Contains(parseErr.Msg, test.msg) {
+			t.Errorf("parse(%q) err = %v, want %q at char %d", test.query, err, test.msg, test.pos)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+// Package mini is an in-process stand-in for a Prometheus server: it scrapes
+// registries into memory, evaluates a subset of PromQL and serves the query
+// endpoints of the HTTP API, so that code talking to Prometheus can be tested
+// offline.
+package mini
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// staleNaN marks the end of a series, like the staleness markers Prometheus
+// appends for series that disappear from a target.
+var staleNaN = math.Float64frombits(0x7ff0000000000002)
+
+func isStale(v float64) bool {
+	return math.Float64bits(v) == math.Float64bits(staleNaN)
+}
+
+// MatchType is the operator of a label matcher.
+type MatchType string
+
+const (
+	MatchEqual     MatchType = "="
+	MatchNotEqual  MatchType = "!="
+	MatchRegexp    MatchType = "=~"
+	MatchNotRegexp MatchType = "!~"
+)
+
+// Matcher is a label matcher of a series selector.
+type Matcher struct {
+	Name  string
+	Type  MatchType
+	Value string
+
+	re *regexp.Regexp
+}
+
+// NewMatcher returns a matcher, compiling its value if it's a regular
+// expression. Regular expressions are anchored like in Prometheus.
+func NewMatcher(name string, typ MatchType, value string) (*Matcher, error) {
+	m := &Matcher{Name: name, Type: typ, Value: value}
+	switch typ {
+	case MatchEqual, MatchNotEqual:
+	case MatchRegexp, MatchNotRegexp:
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, err
+		}
+		m.re = re
+	default:
+		return nil, fmt.Errorf("unknown match type %q", typ)
+	}
+	return m, nil
+}
+
+// Matches tells whether the value of the label is matched, missing labels
+// having the empty value.
+func (m *Matcher) Matches(value string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(value)
+	}
+	return !m.re.MatchString(value)
+}
+
+func (m *Matcher) String() string {
+	return fmt.Sprintf("%s%s%q", m.Name, m.Type, m.Value)
+}
+
+type memSeries struct {
+	metric  model.Metric
+	samples []model.SamplePair
+}
+
+// Storage keeps series and their samples in memory. Samples of a series
+// must be appended in time order.
+type Storage struct {
+	// Retention is how long samples are kept, forever if zero. Series
+	// without samples left are removed.
+	Retention time.Duration
+	// OnError is called with the errors of ScrapeEvery, ignored if nil.
+	OnError func(error)
+
+	mu     sync.RWMutex
+	series map[model.Fingerprint]*memSeries
+	// scraped are the series of the last scrape of each gatherer
+	scraped map[prometheus.Gatherer]map[model.Fingerprint]bool
+	// collected is when series past retention were last removed
+	collected model.Time
+}
+
+// NewStorage returns an empty storage.
+func NewStorage() *Storage {
+	return &Storage{
+		series:  make(map[model.Fingerprint]*memSeries),
+		scraped: make(map[prometheus.Gatherer]map[model.Fingerprint]bool),
+	}
+}
+
+// Append appends a sample to the series of metric, dropping it if it's not
+// newer than the last sample of the series.
+func (s *Storage) Append(metric model.Metric, t model.Time, v float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.append(metric, t, v)
+}
+
+func (s *Storage) append(metric model.Metric, t model.Time, v float64) model.Fingerprint {
+	fp := metric.Fingerprint()
+	ms, exist := s.series[fp]
+	if !exist {
+		ms = &memSeries{metric: metric.Clone()}
+		s.series[fp] = ms
+	}
+	if n := len(ms.samples); n > 0 && !t.After(ms.samples[n-1].Timestamp) {
+		return fp
+	}
+	ms.samples = append(ms.samples, model.SamplePair{Timestamp: t, Value: model.SampleValue(v)})
+
+	if s.Retention > 0 {
+		mint := t.Add(-s.Retention)
+		ms.trim(mint)
+		// other series are trimmed once per retention period, which
+		// removes the ones that aren't appended to anymore
+		if !t.Before(s.collected.Add(s.Retention)) {
+			s.collect(mint)
+			s.collected = t
+		}
+	}
+	return fp
+}
+
+// trim drops the samples before mint.
+func (ms *memSeries) trim(mint model.Time) {
+	i := sort.Search(len(ms.samples), func(i int) bool {
+		return !ms.samples[i].Timestamp.Before(mint)
+	})
+	ms.samples = ms.samples[i:]
+}
+
+// collect trims all series to mint and removes the ones left empty.
+func (s *Storage) collect(mint model.Time) {
+	for fp, ms := range s.series {
+		if ms.trim(mint); len(ms.samples) > 0 {
+			continue
+		}
+		delete(s.series, fp)
+		for _, scraped := range s.scraped {
+			delete(scraped, fp)
+		}
+	}
+}
+
+// Scrape gathers g and appends its samples at t. Histograms and summaries
+// are split into their series like in the text format. Series of the
+// previous scrape of g that are gone are marked stale.
+func (s *Storage) Scrape(g prometheus.Gatherer, t time.Time) error {
+	families, err := g.Gather()
+	if err != nil && len(families) == 0 {
+		return err
+	}
+	ts := model.TimeFromUnixNano(t.UnixNano())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scraped := make(map[model.Fingerprint]bool)
+	add := func(name string, labels []*dto.LabelPair, v float64, extra ...string) {
+		metric := model.Metric{model.MetricNameLabel: model.LabelValue(name)}
+		for _, l := range labels {
+			metric[model.LabelName(l.GetName())] = model.LabelValue(l.GetValue())
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			metric[model.LabelName(extra[i])] = model.LabelValue(extra[i+1])
+		}
+		scraped[s.append(metric, ts, v)] = true
+	}
+
+	for _, mf := range families {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			labels := m.GetLabel()
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, labels, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, labels, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, labels, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				sm := m.GetSummary()
+				for _, q := range sm.GetQuantile() {
+					add(name, labels, q.GetValue(), model.QuantileLabel, formatFloat(q.GetQuantile()))
+				}
+				add(name+"_sum", labels, sm.GetSampleSum())
+				add(name+"_count", labels, float64(sm.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				infSeen := false
+				for _, b := range h.GetBucket() {
+					if math.IsInf(b.GetUpperBound(), 1) {
+						infSeen = true
+					}
+					add(name+"_bucket", labels, float64(b.GetCumulativeCount()), model.BucketLabel, formatFloat(b.GetUpperBound()))
+				}
+				if !infSeen {
+					add(name+"_bucket", labels, float64(h.GetSampleCount()), model.BucketLabel, "+Inf")
+				}
+				add(name+"_sum", labels, h.GetSampleSum())
+				add(name+"_count", labels, float64(h.GetSampleCount()))
+			}
+		}
+	}
+
+	for fp := range s.scraped[g] {
+		if !scraped[fp] {
+			if ms, exist := s.series[fp]; exist {
+				s.append(ms.metric, ts, staleNaN)
+			}
+		}
+	}
+	s.scraped[g] = scraped
+
+	return err
+}
+
+// ScrapeEvery scrapes g every interval until ctx is done.
+func (s *Storage) ScrapeEvery(ctx context.Context, g prometheus.Gatherer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Scrape(g, time.Now()); err != nil && s.OnError != nil {
+			s.OnError(fmt.Errorf("scrape failed, err: %v", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// selectSeries returns the series matching all matchers with their samples
+// in (mint, maxt], staleness markers included.
+func (s *Storage) selectSeries(matchers []*Matcher, mint, maxt model.Time) []*memSeries {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var result []*memSeries
+	for _, ms := range s.series {
+		if !matches(ms.metric, matchers) {
+			continue
+		}
+		lo := sort.Search(len(ms.samples), func(i int) bool {
+			return ms.samples[i].Timestamp.After(mint)
+		})
+		hi := sort.Search(len(ms.samples), func(i int) bool {
+			return ms.samples[i].Timestamp.After(maxt)
+		})
+		if lo >= hi {
+			continue
+		}
+		result = append(result, &memSeries{
+			metric:  ms.metric,
+			samples: append([]model.SamplePair(nil), ms.samples[lo:hi]...),
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].metric.Before(result[j].metric)
+	})
+	return result
+}
+
+// Series returns the series matching all matchers that have samples in
+// [start, end].
+func (s *Storage) Series(matchers []*Matcher, start, end time.Time) []model.Metric {
+	mint := model.TimeFromUnixNano(start.UnixNano()) - 1
+	maxt := model.TimeFromUnixNano(end.UnixNano())
+
+	var result []model.Metric
+	for _, ms := range s.selectSeries(matchers, mint, maxt) {
+		result = append(result, ms.metric)
+	}
+	return result
+}
+
+// LabelValues returns the sorted values of label in all series.
+func (s *Storage) LabelValues(label string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	set := make(map[string]bool)
+	for _, ms := range s.series {
+		if v, exist := ms.metric[model.LabelName(label)]; exist {
+			set[string(v)] = true
+		}
+	}
+	return sortedKeys(set)
+}
+
+// LabelNames returns the sorted names of the labels of all series.
+func (s *Storage) LabelNames() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	set := make(map[string]bool)
+	for _, ms := range s.series {
+		for name := range ms.metric {
+			set[string(name)] = true
+		}
+	}
+	return sortedKeys(set)
+}
+
+func matches(metric model.Metric, matchers []*Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(string(metric[model.LabelName(m.Name)])) {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	return model.SampleValue(f).String()
+}
@@ -0,0 +1,258 @@
+// Package pushgateway is a stand-in for the Pushgateway: it accepts metrics
+// pushed to /metrics/job/<job>{/<label>/<value>} and exposes them with their
+// grouping labels, so that pushing batch jobs can be tested without one.
+package pushgateway
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+const base64Suffix = "@base64"
+
+// group is the metrics pushed with the same grouping key.
+type group struct {
+	labels   map[string]string
+	families map[string]*dto.MetricFamily
+	pushed   time.Time
+}
+
+// Handler is an in-memory Pushgateway. PUT replaces all metrics of a group,
+// POST replaces the metrics of the pushed names only and DELETE deletes a
+// group. GET /metrics exposes all groups. Handler is a prometheus.Gatherer
+// too.
+type Handler struct {
+	now func() time.Time
+
+	mu     sync.Mutex
+	groups map[string]*group
+}
+
+// NewHandler returns an empty Pushgateway.
+func NewHandler() *Handler {
+	return &Handler{now: time.Now, groups: make(map[string]*group)}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/metrics" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		promhttp.HandlerFor(h, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, "/metrics/") {
+		http.NotFound(w, r)
+		return
+	}
+	labels, err := groupingKey(strings.TrimPrefix(r.URL.EscapedPath(), "/metrics/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut, http.MethodPost:
+		families, err := decode(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.push(labels, families, r.Method == http.MethodPut); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		h.mu.Lock()
+		delete(h.groups, key(labels))
+		h.mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// groupingKey parses job/<job>{/<label>/<value>}, whose values may be url
+// escaped or base64 encoded if their label name has the @base64 suffix.
+func groupingKey(path string) (map[string]string, error) {
+	parts := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("odd number of components in grouping key %q", path)
+	}
+
+	labels := make(map[string]string, len(parts)/2)
+	for i := 0; i < len(parts); i += 2 {
+		name, value := parts[i], parts[i+1]
+		if strings.HasSuffix(name, base64Suffix) {
+			name = strings.TrimSuffix(name, base64Suffix)
+			decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+			if err != nil {
+				return nil, fmt.Errorf("invalid base64 value of label %s: %v", name, err)
+			}
+			value = string(decoded)
+		} else {
+			unescaped, err := url.PathUnescape(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value of label %s: %v", name, err)
+			}
+			value = unescaped
+		}
+		if !model.LabelName(name).IsValid() {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+		labels[name] = value
+	}
+
+	if parts[0] != "job" && parts[0] != "job"+base64Suffix {
+		return nil, fmt.Errorf("grouping key %q doesn't start with the job", path)
+	}
+	if labels["job"] == "" {
+		return nil, fmt.Errorf("job name is required")
+	}
+	return labels, nil
+}
+
+func key(labels map[string]string) string {
+	return model.LabelSet(toLabelSet(labels)).String()
+}
+
+func toLabelSet(labels map[string]string) model.LabelSet {
+	ls := make(model.LabelSet, len(labels))
+	for name, value := range labels {
+		ls[model.LabelName(name)] = model.LabelValue(value)
+	}
+	return ls
+}
+
+// decode decodes a pushed body in the text or the protobuf format.
+func decode(r *http.Request) (map[string]*dto.MetricFamily, error) {
+	format := expfmt.FmtText
+	mediatype, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil && mediatype == expfmt.ProtoType && params["proto"] == expfmt.ProtoProtocol && params["encoding"] == "delimited" {
+		format = expfmt.FmtProtoDelim
+	}
+
+	families := make(map[string]*dto.MetricFamily)
+	dec := expfmt.NewDecoder(r.Body, format)
+	for {
+		mf := &dto.MetricFamily{}
+		if err := dec.Decode(mf); err != nil {
+			if err == io.EOF {
+				return families, nil
+			}
+			return nil, fmt.Errorf("decode pushed metrics failed, err: %v", err)
+		}
+		families[mf.GetName()] = mf
+	}
+}
+
+func (h *Handler) push(labels map[string]string, families map[string]*dto.MetricFamily, replace bool) error {
+	for name, mf := range families {
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if _, exist := labels[l.GetName()]; exist {
+					return fmt.Errorf("pushed metric %s already contains grouping label %s", name, l.GetName())
+				}
+			}
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	k := key(labels)
+	for gk, g := range h.groups {
+		for name, mf := range families {
+			if existing, exist := g.families[name]; exist && gk != k && existing.GetType() != mf.GetType() {
+				return fmt.Errorf("pushed metric %s is a %s, but it's a %s in group %s", name, mf.GetType(), existing.GetType(), gk)
+			}
+		}
+	}
+
+	g, exist := h.groups[k]
+	if !exist || replace {
+		g = &group{labels: labels, families: make(map[string]*dto.MetricFamily)}
+		h.groups[k] = g
+	}
+	for name, mf := range families {
+		g.families[name] = mf
+	}
+	g.pushed = h.now()
+	return nil
+}
+
+// Gather implements prometheus.Gatherer, returning the pushed metrics with
+// their grouping labels and the push_time_seconds of each group.
+func (h *Handler) Gather() ([]*dto.MetricFamily, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.groups))
+	for k := range h.groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	merged := make(map[string]*dto.MetricFamily)
+	add := func(mf *dto.MetricFamily, labels map[string]string) {
+		out, exist := merged[mf.GetName()]
+		if !exist {
+			out = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+			merged[mf.GetName()] = out
+		}
+		for _, m := range mf.GetMetric() {
+			m = proto.Clone(m).(*dto.Metric)
+			for name, value := range labels {
+				m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+			}
+			sort.Slice(m.Label, func(i, j int) bool {
+				return m.Label[i].GetName() < m.Label[j].GetName()
+			})
+			out.Metric = append(out.Metric, m)
+		}
+	}
+
+	for _, k := range keys {
+		g := h.groups[k]
+		for _, mf := range g.families {
+			add(mf, g.labels)
+		}
+		add(&dto.MetricFamily{
+			Name: proto.String("push_time_seconds"),
+			Help: proto.String("Last Unix time when changing this group in the Pushgateway succeeded."),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{
+				Gauge: &dto.Gauge{Value: proto.Float64(float64(g.pushed.UnixNano()) / 1e9)},
+			}},
+		}, g.labels)
+	}
+
+	result := make([]*dto.MetricFamily, 0, len(merged))
+	for _, mf := range merged {
+		result = append(result, mf)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].GetName() < result[j].GetName()
+	})
+	return result, nil
+}
+
+var _ prometheus.Gatherer = (*Handler)(nil)
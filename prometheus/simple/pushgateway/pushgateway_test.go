@@ -0,0 +1,285 @@
+package pushgateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// newTestHandler serves a Handler whose clock is at 1000s.
+func newTestHandler(t *testing.T) (*Handler, *httptest.Server) {
+	t.Helper()
+
+	h := NewHandler()
+	h.now = func() time.Time { return time.Unix(1000, 0) }
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+	return h, server
+}
+
+// send sends body in the text format to path, returning the status code.
+func send(t *testing.T, server *httptest.Server, method, path, body string) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("new request failed: %v", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func mustSend(t *testing.T, server *httptest.Server, method, path, body string) {
+	t.Helper()
+
+	if code := send(t, server, method, path, body); code != http.StatusOK && code != http.StatusAccepted {
+		t.Fatalf("%s %s = %d", method, path, code)
+	}
+}
+
+func compare(t *testing.T, h *Handler, want string, names ...string) {
+	t.Helper()
+
+	if err := testutil.GatherAndCompare(h, strings.NewReader(want), names...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const (
+	bodyAB = "# TYPE a counter\na 1\n# TYPE b gauge\nb 2\n"
+	bodyA  = "# TYPE a counter\na 10\n"
+)
+
+func TestPutReplacesGroup(t *testing.T) {
+	h, server := newTestHandler(t)
+
+	mustSend(t, server, http.MethodPut, "/metrics/job/batch", bodyAB)
+	mustSend(t, server, http.MethodPut, "/metrics/job/batch", bodyA)
+	compare(t, h, `
+# TYPE a counter
+a{job="batch"} 10
+`, "a", "b")
+}
+
+func TestPostMergesGroup(t *testing.T) {
+	h, server := newTestHandler(t)
+
+	mustSend(t, server, http.MethodPut, "/metrics/job/batch", bodyAB)
+	mustSend(t, server, http.MethodPost, "/metrics/job/batch", bodyA)
+	compare(t, h, `
+# TYPE a counter
+a{job="batch"} 10
+# TYPE b gauge
+b{job="batch"} 2
+`, "a", "b")
+}
+
+func TestGroupsAreSeparate(t *testing.T) {
+	h, server := newTestHandler(t)
+
+	mustSend(t, server, http.MethodPut, "/metrics/job/batch/instance/1", bodyAB)
+	mustSend(t, server, http.MethodPut, "/metrics/job/batch/instance/2", bodyA)
+	compare(t, h, `
+# TYPE a counter
+a{instance="1",job="batch"} 1
+a{instance="2",job="batch"} 10
+# TYPE b gauge
+b{instance="1",job="batch"} 2
+`, "a", "b")
+}
+
+func TestDelete(t *testing.T) {
+	h, server := newTestHandler(t)
+
+	mustSend(t, server, http.MethodPut, "/metrics/job/batch/instance/1", bodyAB)
+	mustSend(t, server, http.MethodPut, "/metrics/job/batch/instance/2", bodyA)
+	if code := send(t, server, http.MethodDelete, "/metrics/job/batch/instance/1", ""); code != http.StatusAccepted {
+		t.Fatalf("DELETE = %d, want %d", code, http.StatusAccepted)
+	}
+	compare(t, h, `
+# TYPE a counter
+a{instance="2",job="batch"} 10
+`, "a", "b")
+
+	// deleting a group that doesn't exist is fine
+	mustSend(t, server, http.MethodDelete, "/metrics/job/nope", "")
+}
+
+func TestGroupingKey(t *testing.T) {
+	for _, test := range []struct {
+		path string
+		want map[string]string
+		err  string
+	}{
+		{path: "job/batch", want: map[string]string{"job": "batch"}},
+		{path: "job/batch/", want: map[string]string{"job": "batch"}},
+		{path: "job/batch/a/x%2Fy", want: map[string]string{"job": "batch", "a": "x/y"}},
+		// values which can't be in a path are base64 encoded, with or
+		// without padding
+		{path: "job@base64/YS9i/a@base64/eA", want: map[string]string{"job": "a/b", "a": "x"}},
+		{path: "job/batch/a@base64/eA==", want: map[string]string{"job": "batch", "a": "x"}},
+		{path: "job/batch/a@base64/=", want: map[string]string{"job": "batch", "a": ""}},
+		{path: "job/batch/a", err: "odd number of components"},
+		{path: "instance/1/job/batch", err: "doesn't start with the job"},
+		{path: "job/", err: "odd number of components"},
+		{path: "job@base64/", err: "odd number of components"},
+		{path: "job@base64/=", err: "job name is required"},
+		{path: "job/batch/a@base64/!", err: "invalid base64 value of label a"},
+		{path: "job/batch/a/%zz", err: "invalid value of label a"},
+		{path: "job/batch/0a/x", err: `invalid label name "0a"`},
+	} {
+		got, err := groupingKey(test.path)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("groupingKey(%q) err = %v, want %q", test.path, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("groupingKey(%q) failed: %v", test.path, err)
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("groupingKey(%q) = %v, want %v", test.path, got, test.want)
+			continue
+		}
+		for name, value := range test.want {
+			if got[name] != value {
+				t.Errorf("groupingKey(%q) = %v, want %v", test.path, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestPushClient(t *testing.T) {
+	h, server := newTestHandler(t)
+
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "runs_total", Help: "Runs."})
+	counter.Add(3)
+	// the client base64 encodes values containing a slash, and sends the
+	// protobuf format
+	err := push.New(server.URL, "batch/nightly").
+		Grouping("path", "/var/data").
+		Collector(counter).
+		Push()
+	if err != nil {
+		t.Fatalf("Push failed: %v", err)
+	}
+	compare(t, h, `
+# HELP runs_total Runs.
+# TYPE runs_total counter
+runs_total{job="batch/nightly",path="/var/data"} 3
+`, "runs_total")
+
+	if err := push.New(server.URL, "batch/nightly").Grouping("path", "/var/data").Delete(); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	compare(t, h, "", "runs_total")
+}
+
+func TestRejectsGroupingLabelInBody(t *testing.T) {
+	h, server := newTestHandler(t)
+
+	mustSend(t, server, http.MethodPut, "/metrics/job/batch/instance/1", bodyA)
+	for _, body := range []string{
+		`a{job="other"} 1` + "\n",
+		`a{instance="2"} 1` + "\n",
+	} {
+		if code := send(t, server, http.MethodPost, "/metrics/job/batch/instance/1", body); code != http.StatusBadRequest {
+			t.Errorf("push of %q = %d, want %d", body, code, http.StatusBadRequest)
+		}
+	}
+	compare(t, h, `
+# TYPE a counter
+a{instance="1",job="batch"} 10
+`, "a")
+}
+
+func TestRejectsTypeConflict(t *testing.T) {
+	h, server := newTestHandler(t)
+
+	mustSend(t, server, http.MethodPut, "/metrics/job/batch/instance/1", bodyA)
+
+	err := h.push(map[string]string{"job": "batch", "instance": "2"}, decodeText(t, "# TYPE a gauge\na 1\n"), false)
+	if err == nil || !strings.Contains(err.Error(), `pushed metric a is a GAUGE, but it's a COUNTER in group {instance="1", job="batch"}`) {
+		t.Fatalf("push err = %v", err)
+	}
+	if code := send(t, server, http.MethodPut, "/metrics/job/batch/instance/2", "# TYPE a gauge\na 1\n"); code != http.StatusBadRequest {
+		t.Fatalf("PUT = %d, want %d", code, http.StatusBadRequest)
+	}
+
+	// the group itself may change the type by replacing its metrics
+	mustSend(t, server, http.MethodPut, "/metrics/job/batch/instance/1", "# TYPE a gauge\na 1\n")
+	compare(t, h, `
+# TYPE a gauge
+a{instance="1",job="batch"} 1
+`, "a")
+}
+
+func decodeText(t *testing.T, body string) map[string]*dto.MetricFamily {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(body))
+	families, err := decode(req)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	return families
+}
+
+func TestPushTime(t *testing.T) {
+	h, server := newTestHandler(t)
+
+	mustSend(t, server, http.MethodPut, "/metrics/job/batch/instance/1", bodyA)
+	h.now = func() time.Time { return time.Unix(2000, 500000000) }
+	mustSend(t, server, http.MethodPost, "/metrics/job/batch/instance/2", bodyA)
+
+	want := `
+# HELP push_time_seconds Last Unix time when changing this group in the Pushgateway succeeded.
+# TYPE push_time_seconds gauge
+push_time_seconds{instance="1",job="batch"} 1000
+push_time_seconds{instance="2",job="batch"} 2000.5
+`
+	compare(t, h, want, "push_time_seconds")
+
+	// a rejected push doesn't change the time
+	h.now = func() time.Time { return time.Unix(3000, 0) }
+	send(t, server, http.MethodPost, "/metrics/job/batch/instance/1", `a{job="x"} 1`+"\n")
+	compare(t, h, want, "push_time_seconds")
+}
+
+func TestMethods(t *testing.T) {
+	_, server := newTestHandler(t)
+
+	for _, test := range []struct {
+		method, path string
+		code         int
+	}{
+		{method: http.MethodGet, path: "/metrics", code: http.StatusOK},
+		{method: http.MethodPost, path: "/metrics", code: http.StatusMethodNotAllowed},
+		{method: http.MethodGet, path: "/metrics/job/batch", code: http.StatusMethodNotAllowed},
+		{method: http.MethodPut, path: "/other", code: http.StatusNotFound},
+		{method: http.MethodPut, path: "/metrics/job/batch", code: http.StatusOK},
+	} {
+		if code := send(t, server, test.method, test.path, ""); code != test.code {
+			t.Errorf("%s %s = %d, want %d", test.method, test.path, code, test.code)
+		}
+	}
+
+	if code := send(t, server, http.MethodPut, "/metrics/job/batch", "a{"); code != http.StatusBadRequest {
+		t.Errorf("PUT of a bad body = %d, want %d", code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,123 @@
+// Package queuemetrics exposes the metrics of client-go workqueues through
+// Prometheus. Queues only report metrics when they are named, e.g. by
+// workqueue.NewNamedRateLimitingQueue, and the series are labeled by name.
+package queuemetrics
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const subsystem = "workqueue"
+
+// MetricsProvider implements workqueue.MetricsProvider with Prometheus
+// collectors, one vector per metric with a series per queue.
+type MetricsProvider struct {
+	depth                   *prometheus.GaugeVec
+	adds                    *prometheus.CounterVec
+	latency                 *prometheus.HistogramVec
+	workDuration            *prometheus.HistogramVec
+	unfinished              *prometheus.GaugeVec
+	longestRunningProcessor *prometheus.GaugeVec
+	retries                 *prometheus.CounterVec
+}
+
+var _ workqueue.MetricsProvider = &MetricsProvider{}
+
+// NewMetricsProvider creates a MetricsProvider and registers its collectors
+// with reg.
+func NewMetricsProvider(reg prometheus.Registerer) (*MetricsProvider, error) {
+	labels := []string{"name"}
+	p := &MetricsProvider{
+		depth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem: subsystem,
+			Name:      "depth",
+			Help:      "Current depth of the workqueue.",
+		}, labels),
+		adds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: subsystem,
+			Name:      "adds_total",
+			Help:      "Total number of adds handled by the workqueue.",
+		}, labels),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Subsystem: subsystem,
+			Name:      "queue_duration_seconds",
+			Help:      "How long in seconds an item stays in the workqueue before being requested.",
+			Buckets:   prometheus.ExponentialBuckets(10e-9, 10, 10),
+		}, labels),
+		workDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Subsystem: subsystem,
+			Name:      "work_duration_seconds",
+			Help:      "How long in seconds processing an item from the workqueue takes.",
+			Buckets:   prometheus.ExponentialBuckets(10e-9, 10, 10),
+		}, labels),
+		unfinished: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem: subsystem,
+			Name:      "unfinished_work_seconds",
+			Help: "How many seconds of work has been done that is in progress and hasn't been observed by work_duration. " +
+				"Large values indicate stuck threads.",
+		}, labels),
+		longestRunningProcessor: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem: subsystem,
+			Name:      "longest_running_processor_seconds",
+			Help:      "How many seconds the longest running processor of the workqueue has been running.",
+		}, labels),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: subsystem,
+			Name:      "retries_total",
+			Help:      "Total number of retries handled by the workqueue.",
+		}, labels),
+	}
+
+	for _, c := range []prometheus.Collector{
+		p.depth, p.adds, p.latency, p.workDuration, p.unfinished, p.longestRunningProcessor, p.retries,
+	} {
+		if err := reg.Register(c); err != nil {
+			return nil, fmt.Errorf("register workqueue metrics failed, err: %v", err)
+		}
+	}
+	return p, nil
+}
+
+// Register creates a MetricsProvider on reg and sets it as the provider of
+// client-go workqueues. Only the first provider set takes effect and only
+// queues created after it report metrics, so it must be called before any
+// named queue is created.
+func Register(reg prometheus.Registerer) (*MetricsProvider, error) {
+	p, err := NewMetricsProvider(reg)
+	if err != nil {
+		return nil, err
+	}
+	workqueue.SetProvider(p)
+	return p, nil
+}
+
+func (p *MetricsProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return p.depth.WithLabelValues(name)
+}
+
+func (p *MetricsProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return p.adds.WithLabelValues(name)
+}
+
+func (p *MetricsProvider) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return p.latency.WithLabelValues(name)
+}
+
+func (p *MetricsProvider) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return p.workDuration.WithLabelValues(name)
+}
+
+func (p *MetricsProvider) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return p.unfinished.WithLabelValues(name)
+}
+
+func (p *MetricsProvider) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return p.longestRunningProcessor.WithLabelValues(name)
+}
+
+func (p *MetricsProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return p.retries.WithLabelValues(name)
+}
@@ -0,0 +1,185 @@
+package remote
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages of the remote write protocol, encoded by hand as in
+// prometheus/prompb/remote.proto and types.proto, to avoid depending on the
+// whole Prometheus module. Metadata is not supported.
+
+// Label is a label of a series.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a value of a series at a timestamp in milliseconds.
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// TimeSeries is a series and some of its samples.
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+// String formats the labels of ts like a series selector.
+func (ts TimeSeries) String() string {
+	var name string
+	parts := make([]string, 0, len(ts.Labels))
+	for _, l := range ts.Labels {
+		if l.Name == "__name__" {
+			name = l.Value
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s=%q", l.Name, l.Value))
+	}
+	return name + "{" + strings.Join(parts, ", ") + "}"
+}
+
+// WriteRequest is the body of a remote write request.
+type WriteRequest struct {
+	Timeseries []TimeSeries
+}
+
+// Marshal encodes r in the protobuf wire format.
+func (r *WriteRequest) Marshal() []byte {
+	var b []byte
+	for _, ts := range r.Timeseries {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts.marshal())
+	}
+	return b
+}
+
+func (ts *TimeSeries) marshal() []byte {
+	var b []byte
+	for _, l := range ts.Labels {
+		var lb []byte
+		lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.Name)
+		lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.Value)
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, lb)
+	}
+	for _, s := range ts.Samples {
+		var sb []byte
+		sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(s.Value))
+		sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(s.Timestamp))
+
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, sb)
+	}
+	return b
+}
+
+// Unmarshal decodes a protobuf encoded write request into r, skipping
+// unknown fields.
+func (r *WriteRequest) Unmarshal(b []byte) error {
+	*r = WriteRequest{}
+	return fields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		var ts TimeSeries
+		if err := ts.unmarshal(v); err != nil {
+			return fmt.Errorf("timeseries %d: %v", len(r.Timeseries), err)
+		}
+		r.Timeseries = append(r.Timeseries, ts)
+		return nil
+	})
+}
+
+func (ts *TimeSeries) unmarshal(b []byte) error {
+	return fields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+
+		switch num {
+		case 1:
+			var l Label
+			err := fields(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				switch {
+				case num == 1 && typ == protowire.BytesType:
+					l.Name = string(v)
+				case num == 2 && typ == protowire.BytesType:
+					l.Value = string(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("label: %v", err)
+			}
+			ts.Labels = append(ts.Labels, l)
+
+		case 2:
+			var s Sample
+			err := fields(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				switch {
+				case num == 1 && typ == protowire.Fixed64Type:
+					bits, n := protowire.ConsumeFixed64(v)
+					if n < 0 {
+						return protowire.ParseError(n)
+					}
+					s.Value = math.Float64frombits(bits)
+				case num == 2 && typ == protowire.VarintType:
+					t, n := protowire.ConsumeVarint(v)
+					if n < 0 {
+						return protowire.ParseError(n)
+					}
+					s.Timestamp = int64(t)
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("sample: %v", err)
+			}
+			ts.Samples = append(ts.Samples, s)
+		}
+		return nil
+	})
+}
+
+// fields calls f with the number, type and raw value of each field of a
+// message. Length delimited values are passed without their length, other
+// values as they are encoded.
+func fields(b []byte, f func(num protowire.Number, typ protowire.Type, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var v []byte
+		if typ == protowire.BytesType {
+			v, n = protowire.ConsumeBytes(b)
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n >= 0 {
+				v = b[:n]
+			}
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := f(num, typ, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package remote
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// prompbWriteRequest returns the descriptor of WriteRequest of
+// prometheus/prompb, with the exemplars and metadata this package skips.
+// The enum of the metadata type is declared as the int32 it's encoded as.
+func prompbWriteRequest(t *testing.T) protoreflect.MessageDescriptor {
+	t.Helper()
+
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, message string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(number),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     typ.Enum(),
+		}
+		if message != "" {
+			f.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+			f.TypeName = proto.String(".prometheus." + message)
+		}
+		return f
+	}
+	message := func(name string, fields ...*descriptorpb.FieldDescriptorProto) *descriptorpb.DescriptorProto {
+		return &descriptorpb.DescriptorProto{Name: proto.String(name), Field: fields}
+	}
+	const (
+		typeMessage = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE
+		typeString  = descriptorpb.FieldDescriptorProto_TYPE_STRING
+		typeDouble  = descriptorpb.FieldDescriptorProto_TYPE_DOUBLE
+		typeInt64   = descriptorpb.FieldDescriptorProto_TYPE_INT64
+		typeInt32   = descriptorpb.FieldDescriptorProto_TYPE_INT32
+	)
+
+	fd, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("prompb.proto"),
+		Package: proto.String("prometheus"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			message("WriteRequest",
+				field("timeseries", 1, typeMessage, "TimeSeries"),
+				field("metadata", 3, typeMessage, "MetricMetadata"),
+			),
+			message("MetricMetadata",
+				field("type", 1, typeInt32, ""),
+				field("metric_family_name", 2, typeString, ""),
+				field("help", 4, typeString, ""),
+				field("unit", 5, typeString, ""),
+			),
+			message("TimeSeries",
+				field("labels", 1, typeMessage, "Label"),
+				field("samples", 2, typeMessage, "Sample"),
+				field("exemplars", 3, typeMessage, "Exemplar"),
+			),
+			message("Label",
+				field("name", 1, typeString, ""),
+				field("value", 2, typeString, ""),
+			),
+			message("Sample",
+				field("value", 1, typeDouble, ""),
+				field("timestamp", 2, typeInt64, ""),
+			),
+			message("Exemplar",
+				field("labels", 1, typeMessage, "Label"),
+				field("value", 2, typeDouble, ""),
+				field("timestamp", 3, typeInt64, ""),
+			),
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("build descriptor failed: %v", err)
+	}
+	return fd.Messages().ByName("WriteRequest")
+}
+
+// testRequest is encoded as prompbJSON without its exemplars and metadata.
+var testRequest = WriteRequest{Timeseries: []TimeSeries{
+	{
+		Labels: []Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}},
+		Samples: []Sample{
+			{Value: 1, Timestamp: 1600000000000},
+			{Value: math.Inf(1), Timestamp: -1},
+		},
+	},
+	{
+		Labels:  []Label{{Name: "__name__", Value: "empty"}, {Name: "label", Value: ""}},
+		Samples: []Sample{{Value: 0, Timestamp: 0}, {Value: -2.5, Timestamp: 1}},
+	},
+}}
+
+const prompbJSON = `{
+	"timeseries": [
+		{
+			"labels": [{"name": "__name__", "value": "up"}, {"name": "job", "value": "node"}],
+			"samples": [{"value": 1, "timestamp": 1600000000000}, {"value": "Infinity", "timestamp": -1}],
+			"exemplars": [{"labels": [{"name": "trace_id", "value": "abc"}], "value": 1, "timestamp": 1600000000000}]
+		},
+		{
+			"labels": [{"name": "__name__", "value": "empty"}, {"name": "label", "value": ""}],
+			"samples": [{}, {"value": -2.5, "timestamp": 1}]
+		}
+	],
+	"metadata": [{"type": 1, "metric_family_name": "up", "help": "Up."}]
+}`
+
+func TestMarshalMatchesPrompb(t *testing.T) {
+	desc := prompbWriteRequest(t)
+
+	got := dynamicpb.NewMessage(desc)
+	if err := proto.Unmarshal(testRequest.Marshal(), got); err != nil {
+		t.Fatalf("unmarshal as prompb failed: %v", err)
+	}
+
+	want := dynamicpb.NewMessage(desc)
+	if err := protojson.Unmarshal([]byte(prompbJSON), want); err != nil {
+		t.Fatalf("unmarshal JSON failed: %v", err)
+	}
+	// exemplars and metadata aren't supported
+	want.Clear(desc.Fields().ByName("metadata"))
+	timeseries := want.Get(desc.Fields().ByName("timeseries")).List()
+	for i := 0; i < timeseries.Len(); i++ {
+		ts := timeseries.Get(i).Message()
+		ts.Clear(ts.Descriptor().Fields().ByName("exemplars"))
+	}
+
+	if !proto.Equal(got, want) {
+		t.Fatalf("Marshal decodes as %v, want %v", protojson.Format(got), protojson.Format(want))
+	}
+}
+
+func TestUnmarshalPrompb(t *testing.T) {
+	m := dynamicpb.NewMessage(prompbWriteRequest(t))
+	if err := protojson.Unmarshal([]byte(prompbJSON), m); err != nil {
+		t.Fatalf("unmarshal JSON failed: %v", err)
+	}
+	b, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatalf("marshal as prompb failed: %v", err)
+	}
+
+	var r WriteRequest
+	if err := r.Unmarshal(b); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if !reflect.DeepEqual(r, testRequest) {
+		t.Fatalf("Unmarshal = %+v, want %+v", r, testRequest)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	var r WriteRequest
+	if err := r.Unmarshal(testRequest.Marshal()); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if !reflect.DeepEqual(r, testRequest) {
+		t.Fatalf("Unmarshal(Marshal(r)) = %+v, want %+v", r, testRequest)
+	}
+
+	// the NaN marking stale series survives bit for bit
+	stale := math.Float64frombits(0x7ff0000000000002)
+	in := WriteRequest{Timeseries: []TimeSeries{{Samples: []Sample{{Value: stale}}}}}
+	if err := r.Unmarshal(in.Marshal()); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if got := math.Float64bits(r.Timeseries[0].Samples[0].Value); got != 0x7ff0000000000002 {
+		t.Fatalf("stale NaN decoded as %x", got)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	b := testRequest.Marshal()
+	for name, b := range map[string][]byte{
+		"truncated":         b[:len(b)-1],
+		"truncated tag":     {0x80},
+		"length past end":   {0x0a, 0x10, 0x0a},
+		"truncated sample":  {0x0a, 0x04, 0x12, 0x02, 0x09, 0x00},
+		"truncated varint":  {0x0a, 0x04, 0x12, 0x02, 0x10, 0x80},
+		"truncated label":   {0x0a, 0x04, 0x0a, 0x02, 0x0a, 0x05},
+		"reserved field 0":  {0x00},
+		"end group unmatch": {0x0c},
+	} {
+		var r WriteRequest
+		if err := r.Unmarshal(b); err == nil {
+			t.Errorf("Unmarshal of %s request succeeded", name)
+		}
+	}
+}
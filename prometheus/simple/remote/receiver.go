@@ -0,0 +1,106 @@
+package remote
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// Receiver is a remote write endpoint that keeps the samples it receives in
+// memory, to test senders without a Prometheus server.
+type Receiver struct {
+	mu      sync.Mutex
+	series  map[string]*TimeSeries
+	samples int
+}
+
+// NewReceiver returns an empty receiver.
+func NewReceiver() *Receiver {
+	return &Receiver{series: make(map[string]*TimeSeries)}
+}
+
+// ServeHTTP decodes a snappy compressed protobuf write request and appends
+// its samples.
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	compressed, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	raw, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("decode snappy failed, err: %v", err), http.StatusBadRequest)
+		return
+	}
+	var wr WriteRequest
+	if err := wr.Unmarshal(raw); err != nil {
+		http.Error(w, fmt.Sprintf("unmarshal write request failed, err: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	r.mu.Lock()
+	for _, ts := range wr.Timeseries {
+		key := seriesKey(ts.Labels)
+		s, exist := r.series[key]
+		if !exist {
+			s = &TimeSeries{Labels: ts.Labels}
+			r.series[key] = s
+		}
+		s.Samples = append(s.Samples, ts.Samples...)
+		r.samples += len(ts.Samples)
+	}
+	r.mu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Series returns the received series sorted by labels, with their samples
+// in the order they were received.
+func (r *Receiver) Series() []TimeSeries {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys := make([]string, 0, len(r.series))
+	for key := range r.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	series := make([]TimeSeries, 0, len(keys))
+	for _, key := range keys {
+		s := r.series[key]
+		series = append(series, TimeSeries{
+			Labels:  s.Labels,
+			Samples: append([]Sample(nil), s.Samples...),
+		})
+	}
+	return series
+}
+
+// Samples returns the number of received samples.
+func (r *Receiver) Samples() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.samples
+}
+
+func seriesKey(labels []Label) string {
+	var b strings.Builder
+	for _, l := range labels {
+		b.WriteString(l.Name)
+		b.WriteByte(0xff)
+		b.WriteString(l.Value)
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
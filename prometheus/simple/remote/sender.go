@@ -0,0 +1,353 @@
+// Package remote sends metrics to and receives them from Prometheus remote
+// write endpoints, for nodes that can't be scraped.
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Config configures a Sender. Only URL and Gatherer are required.
+type Config struct {
+	// URL is the remote write endpoint, like http://localhost:9090/api/v1/write.
+	URL string
+	// Gatherer is gathered every Interval, 15s if zero. Counter, gauge and
+	// untyped metrics are sent, histograms and summaries aren't.
+	Gatherer prometheus.Gatherer
+	Interval time.Duration
+	// ExternalLabels are added to all series, overriding their labels.
+	ExternalLabels map[string]string
+
+	// Timeout limits each request, 10s if zero.
+	Timeout time.Duration
+	// MaxQueuedSamples bounds the memory of the queue of samples waiting to
+	// be sent, 10000 if zero. When the queue is full, the oldest samples are
+	// dropped.
+	MaxQueuedSamples int
+	// MaxSamplesPerSend is the maximum number of samples of a request, 500
+	// if zero.
+	MaxSamplesPerSend int
+	// MinBackoff is the wait before retrying a failed request, 100ms if
+	// zero. The wait doubles after each retry up to MaxBackoff, 5s if zero.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// OnError is called with the errors of gathering and of requests that
+	// were rejected, ignored if nil. Requests that are retried are counted
+	// by the remote_write_failed_requests_total metric instead.
+	OnError func(error)
+}
+
+// recoverableError is returned for requests that may succeed if sent again.
+type recoverableError struct {
+	error
+}
+
+// Sender gathers metrics on an interval and sends them to a remote write
+// endpoint. Samples that fail to send with a server or network error are
+// retried with backoff, in order, while new samples are queued.
+type Sender struct {
+	cfg    Config
+	client *http.Client
+
+	mu       sync.Mutex
+	queue    []TimeSeries
+	trimmed  int
+	notify   chan struct{}
+	sent     float64
+	dropped  map[string]float64
+	failures float64
+
+	queueDesc    *prometheus.Desc
+	sentDesc     *prometheus.Desc
+	droppedDesc  *prometheus.Desc
+	failuresDesc *prometheus.Desc
+}
+
+// NewSender returns a sender configured by cfg.
+func NewSender(cfg Config) (*Sender, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("no url")
+	}
+	if cfg.Gatherer == nil {
+		return nil, errors.New("no gatherer")
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = 15 * time.Second
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.MaxQueuedSamples == 0 {
+		cfg.MaxQueuedSamples = 10000
+	}
+	if cfg.MaxSamplesPerSend == 0 {
+		cfg.MaxSamplesPerSend = 500
+	}
+	if cfg.MinBackoff == 0 {
+		cfg.MinBackoff = 100 * time.Millisecond
+	}
+	if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = 5 * time.Second
+	}
+
+	return &Sender{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		notify:  make(chan struct{}, 1),
+		dropped: make(map[string]float64),
+		queueDesc: prometheus.NewDesc(
+			"remote_write_queued_samples",
+			"Number of samples waiting to be sent.",
+			nil, nil,
+		),
+		sentDesc: prometheus.NewDesc(
+			"remote_write_sent_samples_total",
+			"Number of samples sent.",
+			nil, nil,
+		),
+		droppedDesc: prometheus.NewDesc(
+			"remote_write_dropped_samples_total",
+			"Number of samples dropped because the queue was full or the endpoint rejected them.",
+			[]string{"reason"}, nil,
+		),
+		failuresDesc: prometheus.NewDesc(
+			"remote_write_failed_requests_total",
+			"Number of requests that failed and were retried.",
+			nil, nil,
+		),
+	}, nil
+}
+
+// Run gathers and sends samples until ctx is done.
+func (s *Sender) Run(ctx context.Context) {
+	go s.sendLoop(ctx)
+
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Gather(time.Now()); err != nil {
+			s.onError(fmt.Errorf("gather failed, err: %v", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Gather gathers the metrics and queues their samples with timestamp ts.
+// Samples that were gathered with a timestamp keep it.
+func (s *Sender) Gather(ts time.Time) error {
+	families, err := s.cfg.Gatherer.Gather()
+	if err != nil && len(families) == 0 {
+		return err
+	}
+
+	series := make([]TimeSeries, 0, len(families))
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			var value float64
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				value = m.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				value = m.GetGauge().GetValue()
+			case dto.MetricType_UNTYPED:
+				value = m.GetUntyped().GetValue()
+			default:
+				continue
+			}
+
+			timestamp := ts.UnixNano() / int64(time.Millisecond)
+			if m.TimestampMs != nil {
+				timestamp = m.GetTimestampMs()
+			}
+			series = append(series, TimeSeries{
+				Labels:  s.labels(mf.GetName(), m.GetLabel()),
+				Samples: []Sample{{Value: value, Timestamp: timestamp}},
+			})
+		}
+	}
+
+	s.enqueue(series)
+	return err
+}
+
+func (s *Sender) labels(name string, pairs []*dto.LabelPair) []Label {
+	labels := make(map[string]string, len(pairs)+len(s.cfg.ExternalLabels)+1)
+	for _, p := range pairs {
+		labels[p.GetName()] = p.GetValue()
+	}
+	for name, value := range s.cfg.ExternalLabels {
+		labels[name] = value
+	}
+	labels["__name__"] = name
+
+	result := make([]Label, 0, len(labels))
+	for name, value := range labels {
+		result = append(result, Label{Name: name, Value: value})
+	}
+	// remote write requires labels sorted by name
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+func (s *Sender) enqueue(series []TimeSeries) {
+	s.mu.Lock()
+	s.queue = append(s.queue, series...)
+	if over := len(s.queue) - s.cfg.MaxQueuedSamples; over > 0 {
+		s.queue = append(s.queue[:0], s.queue[over:]...)
+		s.trimmed += over
+		s.dropped["queue_full"] += float64(over)
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// sendLoop sends the queued samples in batches, retrying a batch until it's
+// sent or rejected.
+func (s *Sender) sendLoop(ctx context.Context) {
+	backoff := s.cfg.MinBackoff
+	for {
+		s.mu.Lock()
+		n := len(s.queue)
+		if n > s.cfg.MaxSamplesPerSend {
+			n = s.cfg.MaxSamplesPerSend
+		}
+		batch := append([]TimeSeries(nil), s.queue[:n]...)
+		trimmed := s.trimmed
+		s.mu.Unlock()
+
+		if len(batch) == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.notify:
+			}
+			continue
+		}
+
+		err := s.send(ctx, batch)
+		if _, ok := err.(recoverableError); ok {
+			s.mu.Lock()
+			s.failures++
+			s.mu.Unlock()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > s.cfg.MaxBackoff {
+				backoff = s.cfg.MaxBackoff
+			}
+			continue
+		}
+		backoff = s.cfg.MinBackoff
+
+		s.mu.Lock()
+		// the rest of the batch is at the head of the queue, unless the
+		// queue overflowed meanwhile and dropped some of it, which is
+		// counted as dropped already
+		rest := n - (s.trimmed - trimmed)
+		if rest > 0 {
+			s.queue = append(s.queue[:0], s.queue[rest:]...)
+		} else {
+			rest = 0
+		}
+		if err != nil {
+			s.dropped["rejected"] += float64(rest)
+		} else {
+			s.sent += float64(rest)
+		}
+		s.mu.Unlock()
+
+		if err != nil {
+			s.onError(fmt.Errorf("samples rejected, err: %v", err))
+		}
+	}
+}
+
+func (s *Sender) onError(err error) {
+	if s.cfg.OnError != nil {
+		s.cfg.OnError(err)
+	}
+}
+
+// send sends a batch, returning a recoverableError if it may be sent again.
+func (s *Sender) send(ctx context.Context, batch []TimeSeries) error {
+	req := &WriteRequest{Timeseries: batch}
+	body := snappy.Encode(nil, req.Marshal())
+
+	httpReq, err := http.NewRequest(http.MethodPost, s.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("User-Agent", "go-best-practise-remote-write")
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return recoverableError{err}
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	err = fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return recoverableError{err}
+	}
+	return err
+}
+
+// Describe implements prometheus.Collector.
+func (s *Sender) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.queueDesc
+	ch <- s.sentDesc
+	ch <- s.droppedDesc
+	ch <- s.failuresDesc
+}
+
+// Collect implements prometheus.Collector.
+func (s *Sender) Collect(ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(s.queueDesc, prometheus.GaugeValue, float64(len(s.queue)))
+	ch <- prometheus.MustNewConstMetric(s.sentDesc, prometheus.CounterValue, s.sent)
+	for _, reason := range []string{"queue_full", "rejected"} {
+		ch <- prometheus.MustNewConstMetric(s.droppedDesc, prometheus.CounterValue, s.dropped[reason], reason)
+	}
+	ch <- prometheus.MustNewConstMetric(s.failuresDesc, prometheus.CounterValue, s.failures)
+}
@@ -0,0 +1,393 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// testEndpoint is a remote write endpoint passing requests to a Receiver
+// after responding with statuses, one per request, first.
+type testEndpoint struct {
+	*httptest.Server
+	receiver *Receiver
+
+	mu       sync.Mutex
+	statuses []int
+	requests int
+	// block, if not nil, is received from before each request is handled
+	block chan struct{}
+}
+
+func newTestEndpoint(t *testing.T, statuses ...int) *testEndpoint {
+	e := &testEndpoint{receiver: NewReceiver(), statuses: statuses}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.mu.Lock()
+		e.requests++
+		block := e.block
+		var status int
+		if len(e.statuses) > 0 {
+			status, e.statuses = e.statuses[0], e.statuses[1:]
+		}
+		e.mu.Unlock()
+
+		if block != nil {
+			<-block
+		}
+		if status != 0 {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		e.receiver.ServeHTTP(w, r)
+	}))
+	t.Cleanup(e.Close)
+	return e
+}
+
+func (e *testEndpoint) Requests() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.requests
+}
+
+// newTestSender returns a sender to e, whose send loop is started by
+// runSendLoop. Samples are queued with enqueue or Gather.
+func newTestSender(t *testing.T, e *testEndpoint, cfg Config) *Sender {
+	cfg.URL = e.URL
+	if cfg.Gatherer == nil {
+		cfg.Gatherer = prometheus.NewRegistry()
+	}
+	if cfg.MinBackoff == 0 {
+		cfg.MinBackoff = time.Millisecond
+	}
+	s, err := NewSender(cfg)
+	if err != nil {
+		t.Fatalf("NewSender failed: %v", err)
+	}
+	return s
+}
+
+// runSendLoop runs the send loop of s until the test ends.
+func runSendLoop(t *testing.T, s *Sender) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		s.sendLoop(ctx)
+	}()
+}
+
+// testSeries returns n series of metric named name with one sample each.
+func testSeries(name string, n int) []TimeSeries {
+	series := make([]TimeSeries, n)
+	for i := range series {
+		series[i] = TimeSeries{
+			Labels:  []Label{{Name: "__name__", Value: name}, {Name: "i", Value: fmt.Sprint(i)}},
+			Samples: []Sample{{Value: float64(i), Timestamp: int64(i)}},
+		}
+	}
+	return series
+}
+
+// senderStats are the counters of a sender.
+type senderStats struct {
+	queued    int
+	sent      float64
+	queueFull float64
+	rejected  float64
+	failures  float64
+}
+
+func stats(s *Sender) senderStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return senderStats{
+		queued:    len(s.queue),
+		sent:      s.sent,
+		queueFull: s.dropped["queue_full"],
+		rejected:  s.dropped["rejected"],
+		failures:  s.failures,
+	}
+}
+
+// waitFor polls cond until it's true or fails the test after a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestSenderRetries(t *testing.T) {
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			e := newTestEndpoint(t, status, status)
+			s := newTestSender(t, e, Config{})
+			runSendLoop(t, s)
+
+			s.enqueue(testSeries("a", 3))
+			waitFor(t, "the samples to be sent", func() bool { return stats(s).sent == 3 })
+
+			if got, want := stats(s), (senderStats{sent: 3, failures: 2}); got != want {
+				t.Errorf("stats = %+v, want %+v", got, want)
+			}
+			if got := e.Requests(); got != 3 {
+				t.Errorf("requests = %d, want 3", got)
+			}
+			if got, want := e.receiver.Series(), testSeries("a", 3); !reflect.DeepEqual(got, want) {
+				t.Errorf("received %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestSenderDropsRejected(t *testing.T) {
+	e := newTestEndpoint(t, http.StatusBadRequest)
+
+	var (
+		mu       sync.Mutex
+		errs     []error
+		onErrors = func() int {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(errs)
+		}
+	)
+	s := newTestSender(t, e, Config{
+		MaxSamplesPerSend: 2,
+		OnError: func(err error) {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		},
+	})
+	runSendLoop(t, s)
+
+	s.enqueue(testSeries("a", 3))
+	waitFor(t, "the samples to be sent", func() bool { return stats(s).sent == 1 })
+
+	if got, want := stats(s), (senderStats{sent: 1, rejected: 2}); got != want {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+	if got := e.Requests(); got != 2 {
+		t.Errorf("requests = %d, want 2", got)
+	}
+	if got := onErrors(); got != 1 {
+		t.Errorf("OnError called %d times, want 1", got)
+	}
+	if got, want := e.receiver.Series(), testSeries("a", 3)[2:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("received %v, want %v", got, want)
+	}
+}
+
+func TestSenderBatches(t *testing.T) {
+	e := newTestEndpoint(t)
+	s := newTestSender(t, e, Config{MaxSamplesPerSend: 2})
+	runSendLoop(t, s)
+
+	s.enqueue(testSeries("a", 5))
+	waitFor(t, "the samples to be sent", func() bool { return stats(s).sent == 5 })
+
+	if got := e.Requests(); got != 3 {
+		t.Errorf("requests = %d, want 3", got)
+	}
+	if got, want := e.receiver.Series(), testSeries("a", 5); !reflect.DeepEqual(got, want) {
+		t.Errorf("received %v, want %v", got, want)
+	}
+}
+
+func TestSenderQueueFull(t *testing.T) {
+	e := newTestEndpoint(t)
+	s := newTestSender(t, e, Config{MaxQueuedSamples: 3})
+
+	// the send loop isn't running, so the queue only fills
+	s.enqueue(testSeries("a", 2))
+	s.enqueue(testSeries("b", 3))
+
+	if got, want := stats(s), (senderStats{queued: 3, queueFull: 2}); got != want {
+		t.Fatalf("stats = %+v, want %+v", got, want)
+	}
+	// the oldest samples are dropped
+	s.mu.Lock()
+	queue := append([]TimeSeries(nil), s.queue...)
+	s.mu.Unlock()
+	if want := testSeries("b", 3); !reflect.DeepEqual(queue, want) {
+		t.Fatalf("queue = %v, want %v", queue, want)
+	}
+}
+
+// TestSenderTrimmedWhileSending fills the queue while a batch is in flight,
+// so that some or all of the batch is dropped from the queue before it's
+// sent. Only the rest of the batch may be removed and counted as sent.
+func TestSenderTrimmedWhileSending(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// added are the samples queued while the batch is in flight
+		added int
+		// sent are the samples counted as sent, and received those
+		// received
+		sent     float64
+		received int
+	}{
+		{name: "part of the batch", added: 2, sent: 4, received: 6},
+		{name: "all of the batch", added: 4, sent: 4, received: 8},
+		{name: "more than the batch", added: 6, sent: 4, received: 8},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEndpoint(t)
+			release := make(chan struct{})
+			e.block = release
+			s := newTestSender(t, e, Config{MaxQueuedSamples: 4, MaxSamplesPerSend: 4})
+			runSendLoop(t, s)
+
+			s.enqueue(testSeries("a", 4))
+			waitFor(t, "the batch to be in flight", func() bool { return e.Requests() == 1 })
+			s.enqueue(testSeries("b", test.added))
+			close(release)
+
+			// the samples of b still queued are sent after the batch
+			kept := test.added
+			if kept > 4 {
+				kept = 4
+			}
+			waitFor(t, "the queue to drain", func() bool { return stats(s).queued == 0 && e.receiver.Samples() >= 4+kept })
+			time.Sleep(10 * time.Millisecond)
+
+			got := stats(s)
+			if got.sent != test.sent || got.queueFull != float64(test.added) {
+				t.Errorf("stats = %+v, want %v sent and %d dropped", got, test.sent, test.added)
+			}
+			if got := e.receiver.Samples(); got != test.received {
+				t.Errorf("received %d samples, want %d", got, test.received)
+			}
+			// nothing of b is lost or sent twice
+			want := append(testSeries("a", 4), testSeries("b", test.added)[test.added-kept:]...)
+			if received := e.receiver.Series(); !sameSeries(received, want) {
+				t.Errorf("received %v, want %v", received, want)
+			}
+		})
+	}
+}
+
+// sameSeries tells whether a and b have the same series regardless of their
+// order.
+func sameSeries(a, b []TimeSeries) bool {
+	count := make(map[string]int)
+	for _, ts := range a {
+		count[fmt.Sprint(ts)]++
+	}
+	for _, ts := range b {
+		count[fmt.Sprint(ts)]--
+	}
+	for _, n := range count {
+		if n != 0 {
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
+
+func TestSenderGather(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "g", Help: "Gauge."}, []string{"node", "sensor"})
+	gauge.WithLabelValues("a", "cpu").Set(1)
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "c_total", Help: "Counter."})
+	counter.Add(2)
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "h", Help: "Histogram."})
+	histogram.Observe(1)
+	registry.MustRegister(gauge, counter, histogram)
+
+	gatherers := prometheus.Gatherers{registry, prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return []*dto.MetricFamily{{
+			Name: proto.String("u"),
+			Type: dto.MetricType_UNTYPED.Enum(),
+			Metric: []*dto.Metric{{
+				Untyped:     &dto.Untyped{Value: proto.Float64(3)},
+				TimestampMs: proto.Int64(42),
+			}},
+		}}, nil
+	})}
+
+	e := newTestEndpoint(t)
+	s := newTestSender(t, e, Config{
+		Gatherer:       gatherers,
+		ExternalLabels: map[string]string{"node": "edge-1"},
+	})
+	if err := s.Gather(time.Unix(1, 0)); err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+
+	want := []TimeSeries{
+		{
+			Labels:  []Label{{Name: "__name__", Value: "c_total"}, {Name: "node", Value: "edge-1"}},
+			Samples: []Sample{{Value: 2, Timestamp: 1000}},
+		},
+		{
+			Labels:  []Label{{Name: "__name__", Value: "g"}, {Name: "node", Value: "edge-1"}, {Name: "sensor", Value: "cpu"}},
+			Samples: []Sample{{Value: 1, Timestamp: 1000}},
+		},
+		{
+			Labels:  []Label{{Name: "__name__", Value: "u"}, {Name: "node", Value: "edge-1"}},
+			Samples: []Sample{{Value: 3, Timestamp: 42}},
+		},
+	}
+	s.mu.Lock()
+	queue := s.queue
+	s.mu.Unlock()
+	if !reflect.DeepEqual(queue, want) {
+		t.Fatalf("queue = %v, want %v", queue, want)
+	}
+}
+
+func TestSenderGatherError(t *testing.T) {
+	e := newTestEndpoint(t)
+	s := newTestSender(t, e, Config{Gatherer: prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return nil, errors.New("gather failed")
+	})})
+	if err := s.Gather(time.Now()); err == nil {
+		t.Fatal("Gather succeeded")
+	}
+}
+
+func TestReceiverRejectsBadRequests(t *testing.T) {
+	server := httptest.NewServer(NewReceiver())
+	defer server.Close()
+
+	for _, test := range []struct {
+		method string
+		body   string
+		status int
+	}{
+		{method: http.MethodGet, status: http.StatusMethodNotAllowed},
+		{method: http.MethodPost, body: "not snappy", status: http.StatusBadRequest},
+		{method: http.MethodPost, body: string(snappy.Encode(nil, []byte{0x0a, 0x10})), status: http.StatusBadRequest},
+	} {
+		req, _ := http.NewRequest(test.method, server.URL, strings.NewReader(test.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s failed: %v", test.method, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s %q: status = %d, want %d", test.method, test.body, resp.StatusCode, test.status)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+// Package stale wraps metric vectors to delete the series of label values
+// that haven't been updated for a while, so that they don't linger in
+// /metrics after the thing they describe went away.
+package stale
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// vec is implemented by the metric vectors of client_golang.
+type vec interface {
+	prometheus.Collector
+	DeleteLabelValues(lvs ...string) bool
+}
+
+type series struct {
+	// touched is the Unix time in nanoseconds of the last update, accessed
+	// atomically.
+	touched int64
+	values  []string
+}
+
+// tracker records when the series of a vector were last updated and deletes
+// them from the vector once they expire. Series are updated with the read
+// lock held, so that updates of any series run concurrently but can't be
+// expired while running. Only adding a series takes the write lock.
+type tracker struct {
+	name       string
+	labelNames []string
+	ttl        time.Duration
+	vec        vec
+	now        func() time.Time
+
+	mu      sync.RWMutex
+	series  map[string]*series
+	expired float64
+
+	trackedDesc *prometheus.Desc
+	expiredDesc *prometheus.Desc
+}
+
+func newTracker(name string, labelNames []string, ttl time.Duration, v vec) *tracker {
+	return &tracker{
+		name:       name,
+		labelNames: labelNames,
+		ttl:        ttl,
+		vec:        v,
+		now:        time.Now,
+		series:     make(map[string]*series),
+		trackedDesc: prometheus.NewDesc(
+			"stale_tracked_series",
+			"Number of series of a metric tracked for expiry.",
+			nil, prometheus.Labels{"metric": name},
+		),
+		expiredDesc: prometheus.NewDesc(
+			"stale_expired_series_total",
+			"Number of series of a metric deleted because they weren't updated within their TTL.",
+			nil, prometheus.Labels{"metric": name},
+		),
+	}
+}
+
+// update runs f, which updates the series of lvs, and marks the series as
+// touched now.
+func (t *tracker) update(lvs []string, f func()) {
+	key := strings.Join(lvs, "\xff")
+
+	t.mu.RLock()
+	s, exist := t.series[key]
+	if exist {
+		f()
+		atomic.StoreInt64(&s.touched, t.now().UnixNano())
+		t.mu.RUnlock()
+		return
+	}
+	t.mu.RUnlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if s, exist = t.series[key]; !exist {
+		s = &series{values: append([]string(nil), lvs...)}
+		t.series[key] = s
+	}
+	f()
+	atomic.StoreInt64(&s.touched, t.now().UnixNano())
+}
+
+func (t *tracker) labelValues(labels prometheus.Labels) []string {
+	lvs := make([]string, len(t.labelNames))
+	for i, name := range t.labelNames {
+		lvs[i] = labels[name]
+	}
+	return lvs
+}
+
+// Expire deletes the series that weren't updated within the TTL and returns
+// how many were deleted.
+func (t *tracker) Expire() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	deadline := t.now().Add(-t.ttl).UnixNano()
+	n := 0
+	for key, s := range t.series {
+		if atomic.LoadInt64(&s.touched) > deadline {
+			continue
+		}
+		t.vec.DeleteLabelValues(s.values...)
+		delete(t.series, key)
+		n++
+	}
+	t.expired += float64(n)
+	return n
+}
+
+// Run expires series every interval until ctx is done.
+func (t *tracker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.Expire()
+		}
+	}
+}
+
+// Len returns the number of tracked series.
+func (t *tracker) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.series)
+}
+
+// DeleteLabelValues deletes the series of lvs right away.
+func (t *tracker) DeleteLabelValues(lvs ...string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.series, strings.Join(lvs, "\xff"))
+	return t.vec.DeleteLabelValues(lvs...)
+}
+
+// Describe implements prometheus.Collector.
+func (t *tracker) Describe(ch chan<- *prometheus.Desc) {
+	t.vec.Describe(ch)
+	ch <- t.trackedDesc
+	ch <- t.expiredDesc
+}
+
+// Collect implements prometheus.Collector, collecting the series of the
+// vector and the tracker's own metrics.
+func (t *tracker) Collect(ch chan<- prometheus.Metric) {
+	t.vec.Collect(ch)
+
+	t.mu.RLock()
+	tracked, expired := len(t.series), t.expired
+	t.mu.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(t.trackedDesc, prometheus.GaugeValue, float64(tracked))
+	ch <- prometheus.MustNewConstMetric(t.expiredDesc, prometheus.CounterValue, expired)
+}
+
+// GaugeVec is a prometheus.GaugeVec whose series expire if they aren't
+// updated within a TTL. Register the GaugeVec itself, not the vector it
+// wraps, and call Run or Expire to delete expired series.
+type GaugeVec struct {
+	*tracker
+	vec *prometheus.GaugeVec
+}
+
+// NewGaugeVec returns a GaugeVec whose series expire after ttl.
+func NewGaugeVec(opts prometheus.GaugeOpts, labelNames []string, ttl time.Duration) *GaugeVec {
+	v := prometheus.NewGaugeVec(opts, labelNames)
+	return &GaugeVec{
+		tracker: newTracker(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), labelNames, ttl, v),
+		vec:     v,
+	}
+}
+
+// WithLabelValues returns the gauge of lvs. Every update of the gauge
+// postpones its expiry, and recreates it if it already expired.
+func (v *GaugeVec) WithLabelValues(lvs ...string) prometheus.Gauge {
+	var m prometheus.Gauge
+	v.update(lvs, func() { m = v.vec.WithLabelValues(lvs...) })
+	return &gauge{Gauge: m, v: v, lvs: lvs}
+}
+
+// With is like WithLabelValues with the label values given by name.
+func (v *GaugeVec) With(labels prometheus.Labels) prometheus.Gauge {
+	return v.WithLabelValues(v.labelValues(labels)...)
+}
+
+type gauge struct {
+	prometheus.Gauge
+	v   *GaugeVec
+	lvs []string
+}
+
+func (g *gauge) update(f func(prometheus.Gauge)) {
+	g.v.update(g.lvs, func() { f(g.v.vec.WithLabelValues(g.lvs...)) })
+}
+
+func (g *gauge) Set(value float64) { g.update(func(m prometheus.Gauge) { m.Set(value) }) }
+func (g *gauge) Inc()              { g.update(func(m prometheus.Gauge) { m.Inc() }) }
+func (g *gauge) Dec()              { g.update(func(m prometheus.Gauge) { m.Dec() }) }
+func (g *gauge) Add(value float64) { g.update(func(m prometheus.Gauge) { m.Add(value) }) }
+func (g *gauge) Sub(value float64) { g.update(func(m prometheus.Gauge) { m.Sub(value) }) }
+func (g *gauge) SetToCurrentTime() { g.update(func(m prometheus.Gauge) { m.SetToCurrentTime() }) }
+
+// CounterVec is a prometheus.CounterVec whose series expire if they aren't
+// updated within a TTL, like GaugeVec. A counter that expired and is
+// incremented again starts from zero, which rate() treats as a reset.
+type CounterVec struct {
+	*tracker
+	vec *prometheus.CounterVec
+}
+
+// NewCounterVec returns a CounterVec whose series expire after ttl.
+func NewCounterVec(opts prometheus.CounterOpts, labelNames []string, ttl time.Duration) *CounterVec {
+	v := prometheus.NewCounterVec(opts, labelNames)
+	return &CounterVec{
+		tracker: newTracker(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), labelNames, ttl, v),
+		vec:     v,
+	}
+}
+
+// WithLabelValues returns the counter of lvs. Every update of the counter
+// postpones its expiry, and recreates it if it already expired.
+func (v *CounterVec) WithLabelValues(lvs ...string) prometheus.Counter {
+	var m prometheus.Counter
+	v.update(lvs, func() { m = v.vec.WithLabelValues(lvs...) })
+	return &counter{Counter: m, v: v, lvs: lvs}
+}
+
+// With is like WithLabelValues with the label values given by name.
+func (v *CounterVec) With(labels prometheus.Labels) prometheus.Counter {
+	return v.WithLabelValues(v.labelValues(labels)...)
+}
+
+type counter struct {
+	prometheus.Counter
+	v   *CounterVec
+	lvs []string
+}
+
+func (c *counter) Inc() {
+	c.v.update(c.lvs, func() { c.v.vec.WithLabelValues(c.lvs...).Inc() })
+}
+
+func (c *counter) Add(value float64) {
+	c.v.update(c.lvs, func() { c.v.vec.WithLabelValues(c.lvs...).Add(value) })
+}
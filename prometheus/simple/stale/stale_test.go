@@ -0,0 +1,206 @@
+package stale
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// clock is a clock advanced by the test.
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newClock(t *tracker) *clock {
+	c := &clock{now: time.Unix(1000, 0)}
+	t.now = c.Now
+	return c
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func compare(t *testing.T, c prometheus.Collector, want string) {
+	t.Helper()
+
+	if err := testutil.CollectAndCompare(c, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	v := NewGaugeVec(prometheus.GaugeOpts{Name: "temperature", Help: "Temperature."}, []string{"sensor"}, time.Minute)
+	clock := newClock(v.tracker)
+
+	v.WithLabelValues("cpu").Set(50)
+	disk := v.With(prometheus.Labels{"sensor": "disk"})
+	disk.Set(30)
+
+	clock.Advance(30 * time.Second)
+	disk.Add(1)
+	if n := v.Expire(); n != 0 {
+		t.Fatalf("Expire = %d before the TTL, want 0", n)
+	}
+
+	// cpu was updated exactly a TTL ago, disk 30s ago
+	clock.Advance(30 * time.Second)
+	if n := v.Expire(); n != 1 {
+		t.Fatalf("Expire = %d, want 1", n)
+	}
+	if n := v.Len(); n != 1 {
+		t.Fatalf("Len = %d, want 1", n)
+	}
+	compare(t, v, `
+# HELP stale_expired_series_total Number of series of a metric deleted because they weren't updated within their TTL.
+# TYPE stale_expired_series_total counter
+stale_expired_series_total{metric="temperature"} 1
+# HELP stale_tracked_series Number of series of a metric tracked for expiry.
+# TYPE stale_tracked_series gauge
+stale_tracked_series{metric="temperature"} 1
+# HELP temperature Temperature.
+# TYPE temperature gauge
+temperature{sensor="disk"} 31
+`)
+}
+
+func TestUpdatePostponesExpiry(t *testing.T) {
+	v := NewGaugeVec(prometheus.GaugeOpts{Name: "g", Help: "G."}, []string{"l"}, time.Minute)
+	clock := newClock(v.tracker)
+
+	g := v.WithLabelValues("a")
+	for _, update := range []func(){
+		func() { g.Set(1) },
+		func() { g.Inc() },
+		func() { g.Dec() },
+		func() { g.Add(2) },
+		func() { g.Sub(1) },
+		func() { g.SetToCurrentTime() },
+	} {
+		clock.Advance(50 * time.Second)
+		update()
+		if n := v.Expire(); n != 0 {
+			t.Fatalf("Expire = %d after an update, want 0", n)
+		}
+	}
+}
+
+func TestExpiredCounterRestarts(t *testing.T) {
+	v := NewCounterVec(prometheus.CounterOpts{Name: "requests_total", Help: "Requests."}, []string{"path"}, time.Minute)
+	clock := newClock(v.tracker)
+
+	// the counter is kept by the caller across expiry
+	c := v.WithLabelValues("/a")
+	c.Add(5)
+	clock.Advance(2 * time.Minute)
+	if n := v.Expire(); n != 1 {
+		t.Fatalf("Expire = %d, want 1", n)
+	}
+	if n := testutil.CollectAndCount(v, "requests_total"); n != 0 {
+		t.Fatalf("%d series collected after expiry, want 0", n)
+	}
+
+	c.Inc()
+	if n := v.Len(); n != 1 {
+		t.Fatalf("Len = %d after the update, want 1", n)
+	}
+	if got := testutil.ToFloat64(v.vec.WithLabelValues("/a")); got != 1 {
+		t.Fatalf("counter = %v after expiry, want 1", got)
+	}
+}
+
+func TestDeleteLabelValues(t *testing.T) {
+	v := NewCounterVec(prometheus.CounterOpts{Name: "c_total", Help: "C."}, []string{"l"}, time.Minute)
+	newClock(v.tracker)
+
+	v.WithLabelValues("a").Inc()
+	if !v.DeleteLabelValues("a") {
+		t.Fatalf("DeleteLabelValues = false, want true")
+	}
+	if v.DeleteLabelValues("a") {
+		t.Fatalf("DeleteLabelValues of a deleted series = true, want false")
+	}
+	if n := v.Len(); n != 0 {
+		t.Fatalf("Len = %d, want 0", n)
+	}
+	// deleted series don't count as expired
+	compare(t, v, `
+# HELP stale_expired_series_total Number of series of a metric deleted because they weren't updated within their TTL.
+# TYPE stale_expired_series_total counter
+stale_expired_series_total{metric="c_total"} 0
+# HELP stale_tracked_series Number of series of a metric tracked for expiry.
+# TYPE stale_tracked_series gauge
+stale_tracked_series{metric="c_total"} 0
+`)
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	v := NewCounterVec(prometheus.CounterOpts{Name: "c_total", Help: "C."}, []string{"l"}, time.Minute)
+	newClock(v.tracker)
+
+	const goroutines, updates = 8, 1000
+	labels := []string{"a", "b", "c", "d"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < updates; j++ {
+				v.WithLabelValues(labels[(i+j)%len(labels)]).Inc()
+				if j%100 == 0 {
+					// nothing expires, the clock doesn't move
+					v.Expire()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	total := 0.0
+	for _, l := range labels {
+		total += testutil.ToFloat64(v.vec.WithLabelValues(l))
+	}
+	if total != goroutines*updates {
+		t.Fatalf("total = %v, want %d", total, goroutines*updates)
+	}
+}
+
+func TestRun(t *testing.T) {
+	v := NewGaugeVec(prometheus.GaugeOpts{Name: "g", Help: "G."}, []string{"l"}, time.Minute)
+	clock := newClock(v.tracker)
+
+	v.WithLabelValues("a").Set(1)
+	clock.Advance(time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		v.Run(ctx, time.Millisecond)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for v.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("series not expired by Run")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+}
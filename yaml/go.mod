@@ -0,0 +1,8 @@
+module github.com/fatsheep9146/go-best-practise/yaml
+
+go 1.14
+
+require (
+	github.com/ghodss/yaml v1.0.0
+	gopkg.in/yaml.v2 v2.4.0 // indirect
+)
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -28,12 +27,14 @@ type metadata struct {
 	Namespace string            `yaml:"namespace"`
 }
 
+// alertRule is either an alerting rule or, when Record is set, a recording rule.
 type alertRule struct {
-	Alert       string            `yaml:"alert"`
-	Annotations map[string]string `yaml:"annotations"`
+	Alert       string            `yaml:"alert,omitempty"`
+	Record      string            `yaml:"record,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
 	Expr        string            `yaml:"expr"`
-	For         string            `yaml:"for"`
-	Labels      map[string]string `yaml:"labels"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
 }
 
 type group struct {
@@ -52,14 +53,30 @@ type prometheusRule struct {
 	Spec       spec     `yaml:"spec"`
 }
 
-func toPrometheusRule(rule *store.WorkloadAlertRule) (raw []byte, namespace string, err error) {
+// workloadAlertRule is an alert rule of a workload as it's stored. Manifest
+// holds the conditions as JSON and Labels the labels as name=value pairs
+// separated by #.
+type workloadAlertRule struct {
+	Name        string
+	Manifest    string
+	Labels      string
+	Dashboards  string
+	Detail      string
+	Owners      string
+	Playbooks   string
+	Description string
+	RuleGroupID string
+	UUID        string
+}
+
+func toPrometheusRule(rule *workloadAlertRule) (raw []byte, namespace string, err error) {
 	// parse all alert rule
-	alerts, err := toAlertRules(rule.Manifest)
+	records, alerts, err := toAlertRules(rule.Manifest)
 	if err != nil {
 		return
 	}
 
-	rulelabels, err := util.ParseLabelsStr(rule.Labels, "#")
+	rulelabels, err := parseLabels(rule.Labels, "#")
 	if err != nil {
 		return
 	}
@@ -76,6 +93,11 @@ func toPrometheusRule(rule *store.WorkloadAlertRule) (raw []byte, namespace stri
 			"alert_template_id": rule.RuleGroupID,
 			"alert_rule_id":     rule.UUID,
 		}
+
+		if err = validateAnnotations(alert, records); err != nil {
+			err = fmt.Errorf("validate alert %q failed, err: %v", alert.Alert, err)
+			return
+		}
 	}
 
 	if _, exist := rulelabels["prometheusrule_ignored"]; exist {
@@ -94,7 +116,7 @@ func toPrometheusRule(rule *store.WorkloadAlertRule) (raw []byte, namespace stri
 			Groups: []group{
 				{
 					Name:  prometheusRuleName(rule),
-					Rules: alerts,
+					Rules: append(records, alerts...),
 				},
 			},
 		},
@@ -108,37 +130,58 @@ func toPrometheusRule(rule *store.WorkloadAlertRule) (raw []byte, namespace stri
 	return
 }
 
-func prometheusRuleName(rule *store.WorkloadAlertRule) string {
+func prometheusRuleName(rule *workloadAlertRule) string {
 	return rule.Name
 }
 
-func toAlertRules(manifest string) (rules []*alertRule, err error) {
-	var (
-		conditions = make([]alertCondition, 0)
-		operator   = ""
-	)
+// toAlertRules returns an alert rule per condition of manifest. Sub-expressions
+// shared by several conditions are evaluated once by the returned recording
+// rules, which come before the alerts that select them.
+func toAlertRules(manifest string) (records []*alertRule, rules []*alertRule, err error) {
+	conditions := make([]alertCondition, 0)
 
 	if err = json.Unmarshal([]byte(manifest), &conditions); err != nil {
-		return nil, fmt.Errorf("unmarshal manifest failed: %v", err)
+		return nil, nil, fmt.Errorf("unmarshal manifest failed: %v", err)
 	}
 
-	switch conditions[0].Evaluator {
-	case "gt":
-		operator = ">"
-	case "lt":
-		operator = "<"
-	}
+	records = recordingRules(conditions)
 
 	rules = make([]*alertRule, 0)
-	rule := &alertRule{
-		Expr: fmt.Sprintf("(%s) %s %s", conditions[0].Expr, operator, conditions[0].Threshold),
-		For:  conditions[0].Duration,
+	for _, condition := range conditions {
+		operator := ""
+		switch condition.Evaluator {
+		case "gt":
+			operator = ">"
+		case "lt":
+			operator = "<"
+		}
+
+		rule := &alertRule{
+			Expr: fmt.Sprintf("(%s) %s %s", condition.Expr, operator, condition.Threshold),
+			For:  condition.Duration,
+		}
+		rules = append(rules, rule)
 	}
-	rules = append(rules, rule)
 
 	return
 }
 
+// parseLabels parses name=value pairs separated by sep.
+func parseLabels(s, sep string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, sep) {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid label %q", pair)
+		}
+		labels[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return labels, nil
+}
+
 func reduceNamespace(clusterType string) string {
 	switch clusterType {
 	case "primary":
@@ -173,5 +216,30 @@ func reducePrometheusRuleLabels(clusterType string) (prometheusRuleLabels map[st
 }
 
 func main() {
-	
-}
\ No newline at end of file
+	manifest := `[{"expr":"sum(rate(http_requests_total{code=~\"5..\"}[5m])) by (job, instance)","evaluator":"gt","threshold":"1","duration":"5m"}]`
+	records, alerts, err := toAlertRules(manifest)
+	if err != nil {
+		fmt.Println("err", err)
+		return
+	}
+
+	for _, alert := range alerts {
+		alert.Annotations = map[string]string{
+			"description": `{{ $labels.job }} on {{ $labels.instance }} serves {{ $value | humanize }} errors/s`,
+			"up":          `{{ query "up" | first | value }} targets up`,
+		}
+		if err := validateAnnotations(alert, records); err != nil {
+			fmt.Println("err", err)
+			continue
+		}
+
+		previews, err := previewAlert(alert, records, 1.5)
+		if err != nil {
+			fmt.Println("err", err)
+			continue
+		}
+		for name, preview := range previews {
+			fmt.Printf("%s: %s\n", name, preview)
+		}
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// aggregations are the PromQL aggregation operators, which may carry a
+// `by (...)` or `without (...)` grouping clause before or after their arguments.
+var aggregations = map[string]bool{
+	"sum":          true,
+	"avg":          true,
+	"min":          true,
+	"max":          true,
+	"count":        true,
+	"group":        true,
+	"stddev":       true,
+	"stdvar":       true,
+	"topk":         true,
+	"bottomk":      true,
+	"quantile":     true,
+	"count_values": true,
+}
+
+// keywords are identifiers that never name a metric.
+var keywords = map[string]bool{
+	"by":          true,
+	"without":     true,
+	"on":          true,
+	"ignoring":    true,
+	"group_left":  true,
+	"group_right": true,
+	"bool":        true,
+	"and":         true,
+	"or":          true,
+	"unless":      true,
+	"offset":      true,
+}
+
+// scalarFuncs are the functions returning a scalar, whose result can't be
+// recorded as a series without changing how it's compared.
+var scalarFuncs = map[string]bool{
+	"scalar": true,
+	"time":   true,
+	"pi":     true,
+}
+
+// subExpr is a function call or aggregation found in a condition expression.
+type subExpr struct {
+	text     string
+	grouping []string
+	without  bool
+	agg      string
+}
+
+// recordingRules finds sub-expressions shared by more than one condition,
+// returns a recording rule for each of them and rewrites the condition
+// expressions to select the recorded series instead.
+func recordingRules(conditions []alertCondition) (records []*alertRule) {
+	var (
+		counts = make(map[string]int)
+		found  = make(map[string]subExpr)
+	)
+
+	for i := range conditions {
+		conditions[i].Expr = normalizeExpr(conditions[i].Expr)
+
+		seen := make(map[string]bool)
+		for _, e := range subExprs(conditions[i].Expr) {
+			if seen[e.text] || !recordable(e) {
+				continue
+			}
+			seen[e.text] = true
+			counts[e.text]++
+			found[e.text] = e
+		}
+	}
+
+	shared := make([]string, 0)
+	for text, n := range counts {
+		if n > 1 {
+			shared = append(shared, text)
+		}
+	}
+
+	// replace the longest expressions first, so that only the outermost
+	// shared expression of a nested pair is recorded
+	sort.Slice(shared, func(i, j int) bool {
+		if len(shared[i]) != len(shared[j]) {
+			return len(shared[i]) > len(shared[j])
+		}
+		return shared[i] < shared[j]
+	})
+
+	names := make(map[string]string)
+	for _, text := range shared {
+		// the name is only taken once the expression is known to be
+		// emitted, so that discarded candidates don't shift the suffixes
+		name := recordName(found[text], names)
+		used := false
+		for i := range conditions {
+			expr, replaced := replaceExpr(conditions[i].Expr, text, name)
+			if !replaced {
+				continue
+			}
+			used = true
+			conditions[i].Expr = expr
+		}
+		if !used {
+			continue
+		}
+
+		names[text] = name
+		records = append(records, &alertRule{
+			Record: name,
+			Expr:   text,
+		})
+	}
+
+	return
+}
+
+// recordable tells whether e may be replaced by a recorded series: it must
+// return a vector computed from series. Calls like time() or vector(1)
+// compare as scalars or are cheaper than selecting a recorded series.
+func recordable(e subExpr) bool {
+	if scalarFuncs[readIdent(e.text, 0)] {
+		return false
+	}
+	_, selects := firstMetric(e.text)
+	return selects
+}
+
+// recordName names a recording rule after the `level:metric:operations`
+// convention, unique among the names already taken in names. It doesn't
+// take the name itself.
+func recordName(e subExpr, names map[string]string) string {
+	if name, exist := names[e.text]; exist {
+		return name
+	}
+
+	// the level is given by the outermost aggregation, if any
+	level := "instance"
+	for _, sub := range subExprs(e.text) {
+		if sub.agg == "" {
+			continue
+		}
+
+		grouping := make([]string, 0, len(sub.grouping))
+		for _, l := range sub.grouping {
+			// histogram_quantile aggregates the bucket label away
+			if l != "le" || !strings.HasPrefix(e.text, "histogram_quantile") {
+				grouping = append(grouping, l)
+			}
+		}
+
+		level = "cluster"
+		if len(grouping) > 0 && !sub.without {
+			level = strings.Join(grouping, "_")
+		}
+		break
+	}
+
+	name := fmt.Sprintf("%s:%s:%s", level, exprMetric(e.text), exprOperations(e.text))
+
+	taken := make(map[string]bool)
+	for _, n := range names {
+		taken[n] = true
+	}
+	for i, base := 2, name; taken[name]; i++ {
+		name = fmt.Sprintf("%s_%d", base, i)
+	}
+	return name
+}
+
+// replaceExpr replaces every occurrence of old in expr that is not part of a
+// longer identifier, so that rate(...) is never replaced inside irate(...).
+func replaceExpr(expr, old, new string) (string, bool) {
+	var (
+		b        strings.Builder
+		replaced bool
+	)
+
+	for {
+		i := strings.Index(expr, old)
+		if i < 0 {
+			break
+		}
+
+		b.WriteString(expr[:i])
+		if i > 0 && isIdentPart(expr[i-1]) {
+			b.WriteString(old)
+		} else {
+			b.WriteString(new)
+			replaced = true
+		}
+		expr = expr[i+len(old):]
+	}
+	b.WriteString(expr)
+
+	return b.String(), replaced
+}
+
+// normalizeExpr collapses runs of white space outside string literals, so
+// that equal expressions written with different spacing are detected as
+// shared.
+func normalizeExpr(expr string) string {
+	var (
+		b     strings.Builder
+		space bool
+	)
+
+	expr = strings.TrimSpace(expr)
+	for i := 0; i < len(expr); i++ {
+		switch c := expr[i]; {
+		case isQuote(c):
+			end := skipQuoted(expr, i)
+			b.WriteString(expr[i : end+1])
+			i = end
+		case unicode.IsSpace(rune(c)):
+			if !space {
+				b.WriteByte(' ')
+			}
+			space = true
+			continue
+		default:
+			b.WriteByte(c)
+		}
+		space = false
+	}
+
+	return b.String()
+}
+
+// subExprs returns every function call and aggregation in expr.
+func subExprs(expr string) (exprs []subExpr) {
+	for i := 0; i < len(expr); i++ {
+		if isQuote(expr[i]) {
+			i = skipQuoted(expr, i)
+			continue
+		}
+		if !isIdentStart(expr[i]) || (i > 0 && isIdentPart(expr[i-1])) {
+			continue
+		}
+
+		name := readIdent(expr, i)
+		if !keywords[name] {
+			if e, ok := callAt(expr, i, name); ok {
+				exprs = append(exprs, e)
+			}
+		}
+		i += len(name) - 1
+	}
+
+	return
+}
+
+// callAt parses the call of name starting at start. Function calls whose
+// argument is a range vector (e.g. the `x[5m]` in `rate(x[5m])`) are returned
+// whole, never their arguments.
+func callAt(expr string, start int, name string) (e subExpr, ok bool) {
+	pos := skipSpace(expr, start+len(name))
+
+	if aggregations[name] {
+		e.agg = name
+		if e.grouping, e.without, pos, ok = groupingAt(expr, pos); !ok {
+			return e, false
+		}
+	}
+
+	if pos >= len(expr) || expr[pos] != '(' {
+		return e, false
+	}
+
+	end := matchParen(expr, pos)
+	if end < 0 {
+		return e, false
+	}
+	end++
+
+	if e.agg != "" && e.grouping == nil {
+		var grouping []string
+		var without bool
+		if grouping, without, pos, ok = groupingAt(expr, skipSpace(expr, end)); ok && grouping != nil {
+			e.grouping, e.without, end = grouping, without, pos
+		}
+	}
+
+	e.text = strings.TrimSpace(expr[start:end])
+	return e, true
+}
+
+// groupingAt parses an optional `by (...)` or `without (...)` clause at pos and
+// returns the position following it.
+func groupingAt(expr string, pos int) (labels []string, without bool, next int, ok bool) {
+	if pos >= len(expr) || !isIdentStart(expr[pos]) {
+		return nil, false, pos, true
+	}
+
+	word := readIdent(expr, pos)
+	if word != "by" && word != "without" {
+		return nil, false, pos, true
+	}
+
+	open := skipSpace(expr, pos+len(word))
+	if open >= len(expr) || expr[open] != '(' {
+		return nil, false, pos, false
+	}
+	end := matchParen(expr, open)
+	if end < 0 {
+		return nil, false, pos, false
+	}
+
+	labels = make([]string, 0)
+	for _, l := range strings.Split(expr[open+1:end], ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			labels = append(labels, l)
+		}
+	}
+
+	return labels, word == "without", skipSpace(expr, end+1), true
+}
+
+// exprMetric returns the first metric name selected in expr, without the
+// `_total` suffix of counters.
+func exprMetric(expr string) string {
+	if name, _ := firstMetric(expr); name != "" {
+		return strings.TrimSuffix(name, "_total")
+	}
+	return "expr"
+}
+
+// firstMetric returns the first metric name selected in expr, and whether
+// expr selects series at all, which it may do by label matchers only.
+func firstMetric(expr string) (name string, selects bool) {
+	for i := 0; i < len(expr); i++ {
+		switch {
+		case expr[i] == '{':
+			// skip label matchers, whose values may look like identifiers
+			selects = true
+			for i < len(expr) && expr[i] != '}' {
+				if isQuote(expr[i]) {
+					i = skipQuoted(expr, i)
+				}
+				i++
+			}
+			continue
+		case isQuote(expr[i]):
+			i = skipQuoted(expr, i)
+			continue
+		case expr[i] == '[':
+			// skip range durations like [5m]
+			for i < len(expr) && expr[i] != ']' {
+				i++
+			}
+			continue
+		case !isIdentStart(expr[i]) || (i > 0 && isIdentPart(expr[i-1])):
+			continue
+		}
+
+		ident := readIdent(expr, i)
+		next := skipSpace(expr, i+len(ident))
+		if keywords[ident] && next < len(expr) && expr[next] == '(' {
+			// skip label lists of by, without, on and ignoring clauses
+			if end := matchParen(expr, next); end > 0 {
+				i = end
+				continue
+			}
+		}
+		if !keywords[ident] && !aggregations[ident] && (next >= len(expr) || expr[next] != '(') {
+			return ident, true
+		}
+		i += len(ident) - 1
+	}
+
+	return "", selects
+}
+
+// exprOperations lists the operations applied to the metric of expr, newest
+// first. A sum is only named when it is the sole operation.
+func exprOperations(expr string) string {
+	ops := make([]string, 0)
+	for _, e := range subExprs(expr) {
+		name := readIdent(e.text, 0)
+
+		// name range functions after their window, e.g. rate5m
+		args := e.text[strings.Index(e.text, "(")+1:]
+		if open := strings.IndexAny(args, "(["); open >= 0 && args[open] == '[' {
+			if close := strings.Index(args[open:], "]"); close > 0 && !strings.Contains(args[open+1:open+close], ":") {
+				name += args[open+1 : open+close]
+			}
+		}
+		ops = append(ops, name)
+	}
+
+	// subExprs returns the outermost call first, which is the newest operation
+	if len(ops) > 1 {
+		filtered := make([]string, 0, len(ops))
+		for _, op := range ops {
+			if op != "sum" {
+				filtered = append(filtered, op)
+			}
+		}
+		ops = filtered
+	}
+	if len(ops) == 0 {
+		return "expr"
+	}
+
+	return strings.Join(ops, "_")
+}
+
+func matchParen(expr string, open int) int {
+	depth := 0
+	for i := open; i < len(expr); i++ {
+		switch c := expr[i]; {
+		case isQuote(c):
+			i = skipQuoted(expr, i)
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func isQuote(c byte) bool {
+	return c == '"' || c == '\'' || c == '`'
+}
+
+// skipQuoted returns the position of the quote closing the string literal
+// starting at start. Raw strings quoted with backticks have no escapes.
+func skipQuoted(expr string, start int) int {
+	quote := expr[start]
+	for i := start + 1; i < len(expr); i++ {
+		switch {
+		case expr[i] == '\\' && quote != '`':
+			i++
+		case expr[i] == quote:
+			return i
+		}
+	}
+	return len(expr) - 1
+}
+
+func skipSpace(expr string, pos int) int {
+	for pos < len(expr) && unicode.IsSpace(rune(expr[pos])) {
+		pos++
+	}
+	return pos
+}
+
+func readIdent(expr string, start int) string {
+	end := start
+	for end < len(expr) && isIdentPart(expr[end]) {
+		end++
+	}
+	return expr[start:end]
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRecordingRules(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// exprs are the expressions of the conditions
+		exprs []string
+		// records are the recording rules as name and expression
+		records [][2]string
+		// want are the rewritten expressions of the conditions
+		want []string
+	}{
+		{
+			name: "shared aggregation",
+			exprs: []string{
+				`sum(rate(http_requests_total{code=~"5.."}[5m])) by (job)`,
+				`sum(rate(http_requests_total{code=~"5.."}[5m]))  by (job) / 2`,
+			},
+			records: [][2]string{
+				{"job:http_requests:rate5m", `sum(rate(http_requests_total{code=~"5.."}[5m])) by (job)`},
+			},
+			want: []string{"job:http_requests:rate5m", "job:http_requests:rate5m / 2"},
+		},
+		{
+			name:  "nothing shared",
+			exprs: []string{`rate(x[5m])`, `rate(y[5m])`},
+			want:  []string{`rate(x[5m])`, `rate(y[5m])`},
+		},
+		{
+			name:  "scalar function",
+			exprs: []string{`x > time()`, `y < time() - 300`},
+			want:  []string{`x > time()`, `y < time() - 300`},
+		},
+		{
+			name:  "call without series",
+			exprs: []string{`x > vector(1)`, `y < vector(1)`},
+			want:  []string{`x > vector(1)`, `y < vector(1)`},
+		},
+		{
+			name:    "argument of scalar",
+			exprs:   []string{`scalar(sum(x)) > 1`, `scalar(sum(x)) < 5`},
+			records: [][2]string{{"cluster:x:sum", `sum(x)`}},
+			want:    []string{`scalar(cluster:x:sum) > 1`, `scalar(cluster:x:sum) < 5`},
+		},
+		{
+			name:  "spaces in label values",
+			exprs: []string{`rate(x{path="a  b"}[5m])`, `rate(x{path="a b"}[5m])`},
+			want:  []string{`rate(x{path="a  b"}[5m])`, `rate(x{path="a b"}[5m])`},
+		},
+		{
+			name:    "longer identifier",
+			exprs:   []string{`irate(x[5m]) > 1`, `rate(x[5m]) > 1`, `rate(x[5m]) < 3`},
+			records: [][2]string{{"instance:x:rate5m", `rate(x[5m])`}},
+			want:    []string{`irate(x[5m]) > 1`, `instance:x:rate5m > 1`, `instance:x:rate5m < 3`},
+		},
+		{
+			name: "nested",
+			exprs: []string{
+				`histogram_quantile(0.9, sum(rate(d_bucket[5m])) by (le, job))`,
+				`histogram_quantile(0.9, sum(rate(d_bucket[5m])) by (le, job))`,
+				`sum(rate(d_bucket[5m])) by (le, job)`,
+			},
+			records: [][2]string{
+				{"job:d_bucket:histogram_quantile_rate5m", `histogram_quantile(0.9, sum(rate(d_bucket[5m])) by (le, job))`},
+				{"le_job:d_bucket:rate5m", `sum(rate(d_bucket[5m])) by (le, job)`},
+			},
+			want: []string{
+				"job:d_bucket:histogram_quantile_rate5m",
+				"job:d_bucket:histogram_quantile_rate5m",
+				"le_job:d_bucket:rate5m",
+			},
+		},
+		{
+			name:    "without",
+			exprs:   []string{`sum without (pod) (rate(x_total[1m]))`, `sum without (pod) (rate(x_total[1m]))`},
+			records: [][2]string{{"cluster:x:rate1m", `sum without (pod) (rate(x_total[1m]))`}},
+			want:    []string{"cluster:x:rate1m", "cluster:x:rate1m"},
+		},
+		{
+			name:  "name conflict",
+			exprs: []string{`avg(up{job="a"})`, `avg(up{job="a"})`, `avg(up{job="b"})`, `avg(up{job="b"})`},
+			records: [][2]string{
+				{"cluster:up:avg", `avg(up{job="a"})`},
+				{"cluster:up:avg_2", `avg(up{job="b"})`},
+			},
+			want: []string{"cluster:up:avg", "cluster:up:avg", "cluster:up:avg_2", "cluster:up:avg_2"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conditions := make([]alertCondition, len(test.exprs))
+			for i, expr := range test.exprs {
+				conditions[i].Expr = expr
+			}
+
+			var records [][2]string
+			for _, r := range recordingRules(conditions) {
+				records = append(records, [2]string{r.Record, r.Expr})
+			}
+			if !reflect.DeepEqual(records, test.records) {
+				t.Errorf("records = %q, want %q", records, test.records)
+			}
+
+			exprs := make([]string, len(conditions))
+			for i, c := range conditions {
+				exprs[i] = c.Expr
+			}
+			if !reflect.DeepEqual(exprs, test.want) {
+				t.Errorf("exprs = %q, want %q", exprs, test.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeExpr(t *testing.T) {
+	for _, test := range []struct {
+		expr string
+		want string
+	}{
+		{expr: "  sum(x)\n\tby (job) ", want: "sum(x) by (job)"},
+		{expr: `x{path="a  b"}  >  1`, want: `x{path="a  b"} > 1`},
+		{expr: `x{path='a  b'}`, want: `x{path='a  b'}`},
+		{expr: "x{path=`a \\`  >  1", want: "x{path=`a \\` > 1"},
+		{expr: `x{path="a \"  b"}`, want: `x{path="a \"  b"}`},
+	} {
+		if got := normalizeExpr(test.expr); got != test.want {
+			t.Errorf("normalizeExpr(%q) = %q, want %q", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestToAlertRules(t *testing.T) {
+	manifest := `[
+		{"expr": "sum(rate(x_total[5m])) by (job)", "evaluator": "gt", "threshold": "1", "duration": "5m"},
+		{"expr": "sum(rate(x_total[5m])) by (job)", "evaluator": "lt", "threshold": "0.1", "duration": "10m"}
+	]`
+	records, alerts, err := toAlertRules(manifest)
+	if err != nil {
+		t.Fatalf("toAlertRules failed: %v", err)
+	}
+
+	want := []*alertRule{{Record: "job:x:rate5m", Expr: "sum(rate(x_total[5m])) by (job)"}}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("records = %+v, want %+v", records, want)
+	}
+	want = []*alertRule{
+		{Expr: "(job:x:rate5m) > 1", For: "5m"},
+		{Expr: "(job:x:rate5m) < 0.1", For: "10m"},
+	}
+	if !reflect.DeepEqual(alerts, want) {
+		t.Errorf("alerts = %+v, want %+v", alerts, want)
+	}
+
+	if _, _, err := toAlertRules("{"); err == nil {
+		t.Error("toAlertRules of an invalid manifest succeeded")
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := parseLabels("cluster_type=primary# team = a=b#", "#")
+	if err != nil {
+		t.Fatalf("parseLabels failed: %v", err)
+	}
+	if want := map[string]string{"cluster_type": "primary", "team": "a=b"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("parseLabels = %q, want %q", labels, want)
+	}
+	if _, err := parseLabels("team", "#"); err == nil {
+		t.Error("parseLabels of a label without value succeeded")
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// templateDefs are the variables Prometheus defines before expanding the
+// annotations of an alert.
+const templateDefs = "{{$labels := .Labels}}{{$externalLabels := .ExternalLabels}}{{$externalURL := .ExternalURL}}{{$value := .Value}}"
+
+// templateData is the data Prometheus expands annotation templates with.
+type templateData struct {
+	Labels         map[string]string
+	ExternalLabels map[string]string
+	ExternalURL    string
+	Value          float64
+}
+
+// sample is an element of the result of the query template function.
+type sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+type queryResult []*sample
+
+// templateFuncs mirrors the functions Prometheus provides to alert templates.
+// Queries can't be run here, so query always returns an empty result unless
+// replaced, as previewAnnotation does.
+var templateFuncs = template.FuncMap{
+	"query": func(q string) (queryResult, error) {
+		return queryResult{}, nil
+	},
+	"first": func(v queryResult) (*sample, error) {
+		if len(v) > 0 {
+			return v[0], nil
+		}
+		return nil, errors.New("first() called on vector with no elements")
+	},
+	"label": func(label string, s *sample) string {
+		if s == nil {
+			return ""
+		}
+		return s.Labels[label]
+	},
+	"value": func(s *sample) float64 {
+		if s == nil {
+			return 0
+		}
+		return s.Value
+	},
+	"strvalue": func(s *sample) string {
+		if s == nil {
+			return ""
+		}
+		return s.Labels["__value__"]
+	},
+	"args": func(args ...interface{}) map[string]interface{} {
+		result := make(map[string]interface{})
+		for i, a := range args {
+			result[fmt.Sprintf("arg%d", i)] = a
+		}
+		return result
+	},
+	"reReplaceAll": func(pattern, repl, text string) string {
+		re := regexp.MustCompile(pattern)
+		return re.ReplaceAllString(text, repl)
+	},
+	"safeHtml": func(text string) string {
+		return text
+	},
+	"match":   regexp.MatchString,
+	"title":   strings.Title,
+	"toUpper": strings.ToUpper,
+	"toLower": strings.ToLower,
+	"graphLink": func(expr string) string {
+		return "/graph?g0.expr=" + url.QueryEscape(expr) + "&g0.tab=0"
+	},
+	"tableLink": func(expr string) string {
+		return "/graph?g0.expr=" + url.QueryEscape(expr) + "&g0.tab=1"
+	},
+	"sortByLabel": func(label string, v queryResult) queryResult {
+		sorted := append(queryResult{}, v...)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].Labels[label] < sorted[j].Labels[label]
+		})
+		return sorted
+	},
+	"humanize": func(i interface{}) (string, error) {
+		v, err := toFloat64(i)
+		if err != nil {
+			return "", err
+		}
+		return humanize(v, 1000, []string{"k", "M", "G", "T", "P", "E", "Z", "Y"}, []string{"m", "u", "n", "p", "f", "a", "z", "y"}), nil
+	},
+	"humanize1024": func(i interface{}) (string, error) {
+		v, err := toFloat64(i)
+		if err != nil {
+			return "", err
+		}
+		return humanize(v, 1024, []string{"ki", "Mi", "Gi", "Ti", "Pi", "Ei", "Zi", "Yi"}, nil), nil
+	},
+	"humanizeDuration": func(i interface{}) (string, error) {
+		v, err := toFloat64(i)
+		if err != nil {
+			return "", err
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Sprintf("%.4g", v), nil
+		}
+		if math.Abs(v) < 1 {
+			return humanize(v, 1000, nil, []string{"m", "u", "n", "p", "f", "a", "z", "y"}) + "s", nil
+		}
+		return time.Duration(v * float64(time.Second)).String(), nil
+	},
+	"humanizePercentage": func(i interface{}) (string, error) {
+		v, err := toFloat64(i)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%.4g%%", v*100), nil
+	},
+	"humanizeTimestamp": func(i interface{}) (string, error) {
+		v, err := toFloat64(i)
+		if err != nil {
+			return "", err
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Sprintf("%.4g", v), nil
+		}
+		sec, frac := math.Modf(v)
+		return time.Unix(int64(sec), int64(frac*1e9)).UTC().String(), nil
+	},
+	"toTime": func(i interface{}) (*time.Time, error) {
+		v, err := toFloat64(i)
+		if err != nil {
+			return nil, err
+		}
+		sec, frac := math.Modf(v)
+		t := time.Unix(int64(sec), int64(frac*1e9)).UTC()
+		return &t, nil
+	},
+	"parseDuration": func(d string) (float64, error) {
+		v, err := time.ParseDuration(d)
+		if err != nil {
+			return 0, err
+		}
+		return v.Seconds(), nil
+	},
+	"pathPrefix": func() string {
+		return ""
+	},
+	"externalURL": func() string {
+		return ""
+	},
+	"stripPort": func(hostPort string) string {
+		host, _, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			return hostPort
+		}
+		return host
+	},
+}
+
+func toFloat64(i interface{}) (float64, error) {
+	switch v := i.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, fmt.Errorf("can't convert %T to float", i)
+}
+
+func humanize(v float64, base float64, big, small []string) string {
+	if v == 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Sprintf("%.4g", v)
+	}
+
+	prefix := ""
+	if math.Abs(v) >= 1 {
+		for _, p := range big {
+			if math.Abs(v) < base {
+				break
+			}
+			prefix = p
+			v /= base
+		}
+	} else {
+		for _, p := range small {
+			if math.Abs(v) >= 1 {
+				break
+			}
+			prefix = p
+			v *= base
+		}
+	}
+
+	return fmt.Sprintf("%.4g%s", v, prefix)
+}
+
+// parseAnnotation parses an annotation the way Prometheus does when the alert fires.
+func parseAnnotation(name, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=zero").Funcs(templateFuncs).Parse(templateDefs + text)
+}
+
+// validateAnnotations checks that every annotation of alert is a valid template,
+// which calls defined functions only, and that the labels it references exist
+// in the output of the alert expression. records are the recording rules of
+// the group, so that labels of alerts which select recorded series can still
+// be inferred. Templates aren't executed, since what they query is unknown
+// until the alert fires.
+func validateAnnotations(alert *alertRule, records []*alertRule) error {
+	labels, inferred := outputLabels(alert.Expr, records)
+
+	names := make([]string, 0, len(alert.Annotations))
+	for name := range alert.Annotations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		text := alert.Annotations[name]
+
+		tmpl, err := parseAnnotation(name, text)
+		if err != nil {
+			return fmt.Errorf("parse annotation %q failed: %v", name, err)
+		}
+
+		if inferred {
+			for _, l := range referencedLabels(tmpl.Tree.Root) {
+				if _, exist := labels[l]; !exist {
+					return fmt.Errorf("annotation %q references label %q, which is not in the output of %q", name, l, alert.Expr)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// previewAlert renders the annotations of alert as they would look for an
+// alert on a sample series with value. The sample series has the labels the
+// expression is known to output, or else the labels the annotations
+// reference, each set to its name in angle brackets.
+func previewAlert(alert *alertRule, records []*alertRule, value float64) (map[string]string, error) {
+	labels, inferred := outputLabels(alert.Expr, records)
+	if !inferred {
+		labels = make(map[string]struct{})
+		for name, text := range alert.Annotations {
+			tmpl, err := parseAnnotation(name, text)
+			if err != nil {
+				return nil, fmt.Errorf("parse annotation %q failed: %v", name, err)
+			}
+			for _, l := range referencedLabels(tmpl.Tree.Root) {
+				labels[l] = struct{}{}
+			}
+		}
+	}
+
+	sampleLabels := make(map[string]string, len(labels))
+	for l := range labels {
+		sampleLabels[l] = "<" + l + ">"
+	}
+
+	previews := make(map[string]string, len(alert.Annotations))
+	for name, text := range alert.Annotations {
+		preview, err := previewAnnotation(text, sampleLabels, value)
+		if err != nil {
+			return nil, fmt.Errorf("preview annotation %q failed: %v", name, err)
+		}
+		previews[name] = preview
+	}
+
+	return previews, nil
+}
+
+// previewAnnotation renders an annotation as it would look for an alert on a
+// series with the given labels and value. query returns that series.
+func previewAnnotation(text string, labels map[string]string, value float64) (string, error) {
+	tmpl, err := parseAnnotation("preview", text)
+	if err != nil {
+		return "", err
+	}
+	tmpl.Funcs(template.FuncMap{
+		"query": func(q string) (queryResult, error) {
+			return queryResult{{Labels: labels, Value: value}}, nil
+		},
+	})
+
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, templateData{Labels: labels, Value: value}); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// outputLabels infers the labels of the series returned by expr. It can only
+// tell for expressions whose outermost operation is an aggregation, which keeps
+// the labels of its by clause, or for recorded series of such expressions.
+func outputLabels(expr string, records []*alertRule) (labels map[string]struct{}, ok bool) {
+	// alert expressions look like `(expr) > threshold`
+	expr = normalizeExpr(expr)
+	if strings.HasPrefix(expr, "(") {
+		if end := matchParen(expr, 0); end > 0 {
+			expr = strings.TrimSpace(expr[1:end])
+		}
+	}
+
+	for _, r := range records {
+		if r.Record == expr {
+			expr = r.Expr
+			break
+		}
+	}
+
+	exprs := subExprs(expr)
+	if len(exprs) == 0 || exprs[0].text != expr || exprs[0].agg == "" || exprs[0].without {
+		return nil, false
+	}
+
+	labels = make(map[string]struct{})
+	for _, l := range exprs[0].grouping {
+		labels[l] = struct{}{}
+	}
+
+	return labels, true
+}
+
+// referencedLabels returns the labels read through `$labels.name` or
+// `index $labels "name"` in the template tree rooted at node.
+func referencedLabels(node parse.Node) (labels []string) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			labels = append(labels, referencedLabels(c)...)
+		}
+	case *parse.ActionNode:
+		labels = append(labels, referencedLabels(n.Pipe)...)
+	case *parse.IfNode:
+		labels = append(labels, referencedLabels(&n.BranchNode)...)
+	case *parse.RangeNode:
+		labels = append(labels, referencedLabels(&n.BranchNode)...)
+	case *parse.WithNode:
+		labels = append(labels, referencedLabels(&n.BranchNode)...)
+	case *parse.BranchNode:
+		labels = append(labels, referencedLabels(n.Pipe)...)
+		labels = append(labels, referencedLabels(n.List)...)
+		labels = append(labels, referencedLabels(n.ElseList)...)
+	case *parse.TemplateNode:
+		labels = append(labels, referencedLabels(n.Pipe)...)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			labels = append(labels, referencedLabels(c)...)
+		}
+	case *parse.CommandNode:
+		if len(n.Args) == 3 {
+			fn, isIdent := n.Args[0].(*parse.IdentifierNode)
+			v, isVar := n.Args[1].(*parse.VariableNode)
+			s, isString := n.Args[2].(*parse.StringNode)
+			if isIdent && isVar && isString && fn.Ident == "index" && len(v.Ident) == 1 && v.Ident[0] == "$labels" {
+				labels = append(labels, s.Text)
+			}
+		}
+		for _, c := range n.Args {
+			labels = append(labels, referencedLabels(c)...)
+		}
+	case *parse.VariableNode:
+		if len(n.Ident) > 1 && n.Ident[0] == "$labels" {
+			labels = append(labels, n.Ident[1])
+		}
+	}
+
+	return
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestValidateAnnotations(t *testing.T) {
+	records := []*alertRule{{Record: "job:x:rate5m", Expr: "sum(rate(x_total[5m])) by (job)"}}
+
+	for _, test := range []struct {
+		name        string
+		expr        string
+		annotations map[string]string
+		// err is a substring of the expected error, empty if valid
+		err string
+	}{
+		{
+			name:        "labels of by clause",
+			expr:        "(sum(rate(x_total[5m])) by (job, instance)) > 1",
+			annotations: map[string]string{"description": `{{ $labels.job }} on {{ index $labels "instance" }} is at {{ $value | humanize }}`},
+		},
+		{
+			name:        "label aggregated away",
+			expr:        "(sum(rate(x_total[5m])) by (job)) > 1",
+			annotations: map[string]string{"description": `{{ $labels.instance }}`},
+			err:         `references label "instance"`,
+		},
+		{
+			name:        "label aggregated away in index",
+			expr:        "(sum(rate(x_total[5m])) by (job)) > 1",
+			annotations: map[string]string{"description": `{{ index $labels "pod" }}`},
+			err:         `references label "pod"`,
+		},
+		{
+			name:        "label aggregated away in branch",
+			expr:        "(sum(rate(x_total[5m])) by (job)) > 1",
+			annotations: map[string]string{"description": `{{ if gt $value 1.0 }}{{ $labels.pod }}{{ end }}`},
+			err:         `references label "pod"`,
+		},
+		{
+			name:        "recorded series",
+			expr:        "(job:x:rate5m) > 1",
+			annotations: map[string]string{"description": `{{ $labels.pod }}`},
+			err:         `references label "pod"`,
+		},
+		{
+			name:        "labels not inferred",
+			expr:        "(rate(x_total[5m])) > 1",
+			annotations: map[string]string{"description": `{{ $labels.pod }}`},
+		},
+		{
+			name:        "without",
+			expr:        "(sum without (pod) (rate(x_total[5m]))) > 1",
+			annotations: map[string]string{"description": `{{ $labels.instance }}`},
+		},
+		{
+			name:        "syntax error",
+			expr:        "(rate(x_total[5m])) > 1",
+			annotations: map[string]string{"description": `{{ $labels.job `},
+			err:         `parse annotation "description"`,
+		},
+		{
+			name:        "undefined function",
+			expr:        "(rate(x_total[5m])) > 1",
+			annotations: map[string]string{"description": `{{ $value | humanise }}`},
+			err:         `function "humanise" not defined`,
+		},
+		{
+			name:        "query isn't executed",
+			expr:        "(rate(x_total[5m])) > 1",
+			annotations: map[string]string{"up": `{{ query "up" | first | value }}`},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateAnnotations(&alertRule{Expr: test.expr, Annotations: test.annotations}, records)
+			switch {
+			case test.err == "" && err != nil:
+				t.Fatalf("validateAnnotations failed: %v", err)
+			case test.err != "" && err == nil:
+				t.Fatalf("validateAnnotations succeeded, want error %q", test.err)
+			case test.err != "" && !strings.Contains(err.Error(), test.err):
+				t.Fatalf("err = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestOutputLabels(t *testing.T) {
+	records := []*alertRule{{Record: "job:x:rate5m", Expr: "sum(rate(x_total[5m])) by (job)"}}
+
+	for _, test := range []struct {
+		expr   string
+		labels []string
+		ok     bool
+	}{
+		{expr: "(sum(x) by (job, instance)) > 1", labels: []string{"instance", "job"}, ok: true},
+		{expr: "(sum by (job) (x)) > 1", labels: []string{"job"}, ok: true},
+		{expr: "(sum(x)) > 1", labels: []string{}, ok: true},
+		{expr: "(job:x:rate5m) > 1", labels: []string{"job"}, ok: true},
+		{expr: "(sum(x) by (job) / sum(y) by (job)) > 1"},
+		{expr: "(sum without (pod) (x)) > 1"},
+		{expr: "(rate(x[5m])) > 1"},
+		{expr: "(x) > 1"},
+	} {
+		labels, ok := outputLabels(test.expr, records)
+		if ok != test.ok {
+			t.Errorf("outputLabels(%q) inferred = %v, want %v", test.expr, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		names := make([]string, 0, len(labels))
+		for l := range labels {
+			names = append(names, l)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, test.labels) {
+			t.Errorf("outputLabels(%q) = %v, want %v", test.expr, names, test.labels)
+		}
+	}
+}
+
+func TestPreviewAlert(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		expr        string
+		annotations map[string]string
+		want        map[string]string
+	}{
+		{
+			name: "inferred labels",
+			expr: "(sum(rate(x_total[5m])) by (job, instance)) > 1",
+			annotations: map[string]string{
+				"description": `{{ $labels.job }} on {{ $labels.instance }} serves {{ $value | humanize }} errors/s`,
+				"labels":      `{{ range $name, $_ := $labels }}{{ $name }} {{ end }}`,
+			},
+			want: map[string]string{
+				"description": "<job> on <instance> serves 1.5k errors/s",
+				"labels":      "instance job ",
+			},
+		},
+		{
+			name:        "referenced labels",
+			expr:        "(rate(x_total[5m])) > 1",
+			annotations: map[string]string{"description": `{{ $labels.pod }} at {{ $value | humanizePercentage }}`},
+			want:        map[string]string{"description": "<pod> at 1.5e+05%"},
+		},
+		{
+			name:        "query",
+			expr:        "(rate(x_total[5m])) > 1",
+			annotations: map[string]string{"up": `{{ with query "up" }}{{ . | first | value }} targets up{{ end }}`},
+			want:        map[string]string{"up": "1500 targets up"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			previews, err := previewAlert(&alertRule{Expr: test.expr, Annotations: test.annotations}, nil, 1500)
+			if err != nil {
+				t.Fatalf("previewAlert failed: %v", err)
+			}
+			if !reflect.DeepEqual(previews, test.want) {
+				t.Fatalf("previewAlert = %q, want %q", previews, test.want)
+			}
+		})
+	}
+}
+
+func TestPreviewAlertErrors(t *testing.T) {
+	for name, text := range map[string]string{
+		"parse":   `{{ $labels.job `,
+		"execute": `{{ humanize "one" }}`,
+	} {
+		alert := &alertRule{Expr: "(x) > 1", Annotations: map[string]string{"description": text}}
+		if _, err := previewAlert(alert, nil, 1); err == nil {
+			t.Errorf("previewAlert with %s error succeeded", name)
+		}
+	}
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	for _, test := range []struct {
+		text string
+		want string
+	}{
+		{text: `{{ humanize 1234567.0 }}`, want: "1.235M"},
+		{text: `{{ humanize 0.00123 }}`, want: "1.23m"},
+		{text: `{{ humanize 0 }}`, want: "0"},
+		{text: `{{ humanize1024 2048 }}`, want: "2ki"},
+		{text: `{{ humanizeDuration 90 }}`, want: "1m30s"},
+		{text: `{{ humanizeDuration 0.25 }}`, want: "250ms"},
+		{text: `{{ humanizePercentage 0.125 }}`, want: "12.5%"},
+		{text: `{{ humanizeTimestamp 0 }}`, want: "1970-01-01 00:00:00 +0000 UTC"},
+		{text: `{{ parseDuration "1m" }}`, want: "60"},
+		{text: `{{ stripPort "host:9090" }}`, want: "host"},
+		{text: `{{ reReplaceAll "(a+)" "<$1>" "baab" }}`, want: "b<aa>b"},
+		{text: `{{ graphLink "up == 0" }}`, want: "/graph?g0.expr=up+%3D%3D+0&g0.tab=0"},
+		{text: `{{ toUpper "a" }}{{ title "b" }}`, want: "AB"},
+	} {
+		got, err := previewAnnotation(test.text, nil, 0)
+		if err != nil {
+			t.Errorf("%s failed: %v", test.text, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s = %q, want %q", test.text, got, test.want)
+		}
+	}
+}